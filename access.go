@@ -0,0 +1,77 @@
+package mega
+
+// AccessLevel is what may be done to a node.  The nodes of the account
+// are its own, those in an incoming share have the level the share was
+// given with.
+type AccessLevel int
+
+// Access levels, the first three numbered as the server numbers them
+const (
+	ACCESS_READ      AccessLevel = iota // can be read only
+	ACCESS_READWRITE                    // files and folders can be added
+	ACCESS_FULL                         // can also be renamed, moved and deleted
+	ACCESS_OWNER                        // in the account's own tree
+)
+
+var accessLevelNames = [...]string{
+	ACCESS_READ:      "Read",
+	ACCESS_READWRITE: "ReadWrite",
+	ACCESS_FULL:      "Full",
+	ACCESS_OWNER:     "Owner",
+}
+
+func (a AccessLevel) String() string {
+	if a < 0 || int(a) >= len(accessLevelNames) {
+		return "Unknown"
+	}
+	return accessLevelNames[a]
+}
+
+// Access returns what may be done to n.  Changes which need more fail
+// with EACCESS before anything is sent to the server.
+func (n *Node) Access() AccessLevel {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.fs.access(n)
+}
+
+// access returns the access level of n, that of the incoming share it
+// is in if any
+//
+// Call with the FS mutex held
+func (fs *MegaFS) access(n *Node) AccessLevel {
+	for p := n; p != nil; p = p.parent {
+		if a, ok := fs.saccess[p.hash]; ok {
+			return a
+		}
+	}
+	return ACCESS_OWNER
+}
+
+// checkAccess returns EACCESS unless n may be changed in a way which
+// needs the access level need.  Nothing may be added to the inbox as
+// only other users send things there.
+//
+// Call with the FS mutex held
+func (fs *MegaFS) checkAccess(n *Node, need AccessLevel) error {
+	if n != nil && fs.access(n) < need {
+		return EACCESS
+	}
+	if need == ACCESS_READWRITE && fs.inInbox(n) {
+		return EACCESS
+	}
+	return nil
+}
+
+// setShareAccess records the access level r, as the server numbers
+// it, of the incoming share h.  A nil r, as sent before shares had
+// levels, leaves it to the server to say.
+//
+// Call with the FS mutex held
+func (fs *MegaFS) setShareAccess(h string, r *int) {
+	if r == nil || *r < int(ACCESS_READ) || *r > int(ACCESS_FULL) {
+		delete(fs.saccess, h)
+		return
+	}
+	fs.saccess[h] = AccessLevel(*r)
+}
@@ -0,0 +1,101 @@
+package mega
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAccessLevel(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	m.handle = "MEMEMEMEMEM"
+
+	root := m.FS.GetRoot()
+	in, err := m.CreateDir("in", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, in, "f.txt", "hello")
+	share := func(r int) {
+		t.Helper()
+		err := m.processShare([]byte(fmt.Sprintf(`{"a":"s2","n":%q,"o":"OTHERUSERXX","u":"MEMEMEMEMEM","r":%d}`, in.GetHash(), r)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := 0
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		sent++
+		return nil
+	}
+	b.mu.Unlock()
+
+	if root.Access() != ACCESS_OWNER || f.Access() != ACCESS_OWNER {
+		t.Errorf("own nodes: %v, %v", root.Access(), f.Access())
+	}
+
+	// Read only - nothing is sent
+	share(0)
+	if in.Access() != ACCESS_READ || f.Access() != ACCESS_READ || root.Access() != ACCESS_OWNER {
+		t.Errorf("read share: %v, %v, %v", in.Access(), f.Access(), root.Access())
+	}
+	if _, err = m.CreateDir("new", in); err != EACCESS {
+		t.Errorf("CreateDir: got %v", err)
+	}
+	if _, err = m.NewUpload(in, "new.txt", 5); err != EACCESS {
+		t.Errorf("NewUpload: got %v", err)
+	}
+	if err = m.Rename(f, "renamed"); err != EACCESS {
+		t.Errorf("Rename: got %v", err)
+	}
+	if err = m.Move(f, root); err != EACCESS {
+		t.Errorf("Move out: got %v", err)
+	}
+	if err = m.Delete(f, true); err != EACCESS {
+		t.Errorf("Delete: got %v", err)
+	}
+	if err = m.SetAttr(f, "app:x", 1); err != EACCESS {
+		t.Errorf("SetAttr: got %v", err)
+	}
+	b.mu.Lock()
+	if sent != 0 {
+		t.Errorf("%d commands sent", sent)
+	}
+	b.mu.Unlock()
+
+	// Read write - things can be added
+	share(1)
+	if _, err = m.CreateDir("new", in); err != nil {
+		t.Errorf("CreateDir: got %v", err)
+	}
+	if err = m.Rename(f, "renamed"); err != EACCESS {
+		t.Errorf("Rename: got %v", err)
+	}
+	other := uploadString(t, m, root, "other.txt", "other")
+	if err = m.Move(other, in); err != nil {
+		t.Errorf("Move in: got %v", err)
+	}
+
+	// Full - but links are for the owner
+	share(2)
+	if err = m.Rename(f, "renamed"); err != nil {
+		t.Errorf("Rename: got %v", err)
+	}
+	if _, err = m.Link(f, true); err != EACCESS {
+		t.Errorf("Link: got %v", err)
+	}
+
+	// The share can be left whatever its level
+	share(0)
+	if err = m.Delete(in, true); err != nil {
+		t.Errorf("leaving share: got %v", err)
+	}
+}
+
+func TestAccessLevelString(t *testing.T) {
+	if ACCESS_READWRITE.String() != "ReadWrite" || AccessLevel(9).String() != "Unknown" {
+		t.Errorf("got %v, %v", ACCESS_READWRITE, AccessLevel(9))
+	}
+}
@@ -0,0 +1,309 @@
+package mega
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ProLevel is the plan level of an account as reported by the "uq"
+// command
+type ProLevel int
+
+// Account plan levels
+const (
+	PRO_LEVEL_FREE      ProLevel = 0
+	PRO_LEVEL_PRO_I     ProLevel = 1
+	PRO_LEVEL_PRO_II    ProLevel = 2
+	PRO_LEVEL_PRO_III   ProLevel = 3
+	PRO_LEVEL_LITE      ProLevel = 4
+	PRO_LEVEL_STARTER   ProLevel = 11
+	PRO_LEVEL_BASIC     ProLevel = 12
+	PRO_LEVEL_ESSENTIAL ProLevel = 13
+	PRO_LEVEL_BUSINESS  ProLevel = 100
+	PRO_LEVEL_PRO_FLEXI ProLevel = 101
+)
+
+func (l ProLevel) String() string {
+	switch l {
+	case PRO_LEVEL_FREE:
+		return "Free"
+	case PRO_LEVEL_PRO_I:
+		return "Pro I"
+	case PRO_LEVEL_PRO_II:
+		return "Pro II"
+	case PRO_LEVEL_PRO_III:
+		return "Pro III"
+	case PRO_LEVEL_LITE:
+		return "Pro Lite"
+	case PRO_LEVEL_STARTER:
+		return "Starter"
+	case PRO_LEVEL_BASIC:
+		return "Basic"
+	case PRO_LEVEL_ESSENTIAL:
+		return "Essential"
+	case PRO_LEVEL_BUSINESS:
+		return "Business"
+	case PRO_LEVEL_PRO_FLEXI:
+		return "Pro Flexi"
+	}
+	return fmt.Sprintf("Unknown(%d)", int(l))
+}
+
+// SubscriptionStatus describes the state of a recurring payment
+type SubscriptionStatus int
+
+// Subscription states
+const (
+	SUBSCRIPTION_NONE    SubscriptionStatus = 0
+	SUBSCRIPTION_VALID   SubscriptionStatus = 1
+	SUBSCRIPTION_INVALID SubscriptionStatus = 2
+)
+
+func (s SubscriptionStatus) String() string {
+	switch s {
+	case SUBSCRIPTION_NONE:
+		return "None"
+	case SUBSCRIPTION_VALID:
+		return "Valid"
+	case SUBSCRIPTION_INVALID:
+		return "Invalid"
+	}
+	return fmt.Sprintf("Unknown(%d)", int(s))
+}
+
+// AccountDetails describes the plan and usage of the logged in account
+type AccountDetails struct {
+	// Plan level of the account
+	ProLevel ProLevel
+	// State of the recurring subscription, if any
+	SubscriptionStatus SubscriptionStatus
+	// Billing cycle of the subscription, eg "1 M" or "1 Y"
+	SubscriptionCycle string
+	// Time the subscription next renews - zero if unknown
+	SubscriptionRenew time.Time
+	// Time the pro plan expires - zero for free accounts
+	ProExpiry time.Time
+	// Total storage capacity in bytes
+	StorageMax uint64
+	// Used storage in bytes
+	StorageUsed uint64
+	// Transfer quota of the account
+	Transfer TransferQuota
+
+	// clock of the client the details came from, for Expired
+	clock Clock
+}
+
+// IsPro returns true if the account is on any paid plan
+func (a *AccountDetails) IsPro() bool {
+	return a.ProLevel != PRO_LEVEL_FREE
+}
+
+// Expired returns true if the account had a pro plan which has
+// passed its expiry time by the clock of the client
+func (a *AccountDetails) Expired() bool {
+	clock := a.clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return !a.ProExpiry.IsZero() && clock.Now().After(a.ProExpiry)
+}
+
+// parseAccountDetails converts the raw quota response into
+// AccountDetails
+func parseAccountDetails(res QuotaResp) AccountDetails {
+	a := AccountDetails{
+		ProLevel:          ProLevel(res.Utype),
+		SubscriptionCycle: res.Scycle,
+		StorageMax:        res.Mstrg,
+		StorageUsed:       res.Cstrg,
+		Transfer:          parseTransferQuota(res),
+	}
+
+	switch res.Stype {
+	case "S":
+		a.SubscriptionStatus = SUBSCRIPTION_VALID
+	case "R":
+		a.SubscriptionStatus = SUBSCRIPTION_INVALID
+	default:
+		a.SubscriptionStatus = SUBSCRIPTION_NONE
+	}
+
+	if res.Suntil > 0 {
+		a.ProExpiry = time.Unix(res.Suntil, 0)
+	}
+	if len(res.Srenew) > 0 && res.Srenew[0] > 0 {
+		a.SubscriptionRenew = time.Unix(res.Srenew[0], 0)
+	}
+
+	return a
+}
+
+// GetAccountDetails returns the plan level, subscription status and
+// expiry along with the storage usage of the account
+func (m *Mega) GetAccountDetails() (AccountDetails, error) {
+	var msg [1]QuotaMsg
+	var res [1]QuotaResp
+
+	msg[0].Cmd = "uq"
+	msg[0].Xfer = 1
+	msg[0].Strg = 1
+	msg[0].Pro = 1
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return AccountDetails{}, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return AccountDetails{}, err
+	}
+
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return AccountDetails{}, err
+	}
+
+	a := parseAccountDetails(res[0])
+	cfg := m.getConfig()
+	a.clock = cfg.timeSource()
+	m.noteStorage(a.StorageUsed, a.StorageMax, nil)
+	return a, nil
+}
+
+// TransferQuota describes how much can be downloaded by the account
+type TransferQuota struct {
+	// Known is false if the server didn't report a limit, for
+	// example for anonymous sessions
+	Known bool
+	// Max is the transfer quota in bytes
+	Max uint64
+	// Used is the transfer quota used in bytes
+	Used uint64
+}
+
+// Available returns the number of bytes which can still be
+// transferred
+func (q *TransferQuota) Available() uint64 {
+	if q.Used >= q.Max {
+		return 0
+	}
+	return q.Max - q.Used
+}
+
+// TransferQuotaError is returned by CheckTransferQuota when the
+// planned transfer doesn't fit in the remaining quota.  It wraps
+// EGOINGOVERQUOTA.
+type TransferQuotaError struct {
+	// Bytes the transfer needs
+	Needed uint64
+	// Bytes of quota remaining
+	Available uint64
+}
+
+func (e *TransferQuotaError) Error() string {
+	return fmt.Sprintf("%v: need %d bytes of transfer quota, %d available", EGOINGOVERQUOTA, e.Needed, e.Available)
+}
+
+// Unwrap returns EGOINGOVERQUOTA
+func (e *TransferQuotaError) Unwrap() error {
+	return EGOINGOVERQUOTA
+}
+
+// parseTransferQuota reads the transfer quota from the raw quota
+// response.  Accounts have either a fixed quota or a rolling window
+// with usage reported per hour.
+func parseTransferQuota(res QuotaResp) TransferQuota {
+	switch {
+	case res.Mxfer > 0:
+		return TransferQuota{
+			Known: true,
+			Max:   res.Mxfer,
+			Used:  res.Caxfer + res.Csxfer,
+		}
+	case res.Tal > 0:
+		q := TransferQuota{Known: true, Max: res.Tal}
+		for _, used := range res.Tah {
+			q.Used += used
+		}
+		return q
+	}
+	return TransferQuota{}
+}
+
+// GetTransferQuota returns the transfer quota of the account
+func (m *Mega) GetTransferQuota() (TransferQuota, error) {
+	var msg [1]QuotaMsg
+	var res [1]QuotaResp
+
+	msg[0].Cmd = "uq"
+	msg[0].Xfer = 1
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return TransferQuota{}, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return TransferQuota{}, err
+	}
+
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return TransferQuota{}, err
+	}
+
+	return parseTransferQuota(res[0]), nil
+}
+
+// CheckTransferQuota checks that size bytes can be downloaded with the
+// remaining transfer quota, returning a *TransferQuotaError if not.
+//
+// If the server doesn't report a limit the returned quota has Known
+// set to false and the error is nil so callers can decide whether to
+// go ahead.
+func (m *Mega) CheckTransferQuota(size int64) (TransferQuota, error) {
+	q, err := m.GetTransferQuota()
+	if err != nil {
+		return q, err
+	}
+	if q.Known && uint64(size) > q.Available() {
+		return q, &TransferQuotaError{Needed: uint64(size), Available: q.Available()}
+	}
+	return q, nil
+}
+
+// CheckDownloadQuota checks there is enough transfer quota to
+// download the nodes given, including everything below any folders,
+// as CheckTransferQuota does.
+func (m *Mega) CheckDownloadQuota(nodes ...*Node) (TransferQuota, error) {
+	for _, n := range nodes {
+		if n != nil {
+			err := m.LoadTree(n)
+			if err != nil {
+				return TransferQuota{}, err
+			}
+		}
+	}
+
+	var size int64
+	m.FS.mutex.Lock()
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n.ntype == FILE {
+			size += n.size
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	for _, n := range nodes {
+		if n != nil {
+			walk(n)
+		}
+	}
+	m.FS.mutex.Unlock()
+
+	return m.CheckTransferQuota(size)
+}
@@ -0,0 +1,92 @@
+package mega
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseAccountDetails(t *testing.T) {
+	var res [1]QuotaResp
+	err := json.Unmarshal([]byte(`[{"mstrg":2199023255552,"cstrg":1024,"utype":2,"stype":"S","scycle":"1 M","suntil":1700000000,"srenew":[1690000000]}]`), &res)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	a := parseAccountDetails(res[0])
+	if a.ProLevel != PRO_LEVEL_PRO_II {
+		t.Errorf("wrong pro level: %v", a.ProLevel)
+	}
+	if !a.IsPro() {
+		t.Error("expecting pro account")
+	}
+	if a.SubscriptionStatus != SUBSCRIPTION_VALID {
+		t.Errorf("wrong subscription status: %v", a.SubscriptionStatus)
+	}
+	if !a.ProExpiry.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("wrong expiry: %v", a.ProExpiry)
+	}
+	if !a.SubscriptionRenew.Equal(time.Unix(1690000000, 0)) {
+		t.Errorf("wrong renew time: %v", a.SubscriptionRenew)
+	}
+	if a.StorageMax != 2199023255552 || a.StorageUsed != 1024 {
+		t.Errorf("wrong storage: %d/%d", a.StorageUsed, a.StorageMax)
+	}
+
+	// Expiry is by the client's clock
+	a.clock = &stepClock{now: time.Unix(1690000000, 0)}
+	if a.Expired() {
+		t.Error("expired before the expiry time")
+	}
+	a.clock = &stepClock{now: time.Unix(1710000000, 0)}
+	if !a.Expired() {
+		t.Error("not expired after the expiry time")
+	}
+
+	a = parseAccountDetails(QuotaResp{})
+	if a.IsPro() || a.SubscriptionStatus != SUBSCRIPTION_NONE || !a.ProExpiry.IsZero() {
+		t.Errorf("unexpected details for free account: %+v", a)
+	}
+}
+
+func TestParseTransferQuota(t *testing.T) {
+	q := parseTransferQuota(QuotaResp{Mxfer: 1000, Caxfer: 300, Csxfer: 200})
+	if !q.Known || q.Available() != 500 {
+		t.Errorf("bad fixed quota %+v", q)
+	}
+	q = parseTransferQuota(QuotaResp{Tal: 1000, Tah: []uint64{600, 600}})
+	if !q.Known || q.Used != 1200 || q.Available() != 0 {
+		t.Errorf("bad rolling quota %+v", q)
+	}
+	q = parseTransferQuota(QuotaResp{})
+	if q.Known {
+		t.Errorf("expecting unknown quota %+v", q)
+	}
+}
+
+func TestCheckDownloadQuota(t *testing.T) {
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		return map[string]interface{}{"mxfer": 1000, "caxfer": 100}
+	})
+	defer srv.Close()
+	m := newMockSession(t, srv)
+
+	dir := &Node{fs: m.FS, ntype: FOLDER}
+	a := &Node{fs: m.FS, ntype: FILE, size: 600, parent: dir}
+	b := &Node{fs: m.FS, ntype: FILE, size: 600, parent: dir}
+	dir.children = []*Node{a, b}
+
+	_, err := m.CheckDownloadQuota(a)
+	if err != nil {
+		t.Errorf("expecting file to fit: %v", err)
+	}
+	_, err = m.CheckDownloadQuota(dir)
+	qerr, ok := err.(*TransferQuotaError)
+	if !ok {
+		t.Fatalf("expecting TransferQuotaError, got %v", err)
+	}
+	if qerr.Needed != 1200 || qerr.Available != 900 || !errors.Is(err, EGOINGOVERQUOTA) {
+		t.Errorf("bad error %+v", qerr)
+	}
+}
@@ -0,0 +1,169 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// User alert types
+const (
+	USER_ALERT_CONTACT_REQUEST  = "ipc"    // incoming pending contact request
+	USER_ALERT_CONTACT_CHANGE   = "c"      // contact added or removed
+	USER_ALERT_CONTACT_UPDATE   = "upci"   // incoming contact request updated
+	USER_ALERT_CONTACT_REPLY    = "upco"   // outgoing contact request answered
+	USER_ALERT_NEW_SHARE        = "share"  // new folder shared with us
+	USER_ALERT_DELETED_SHARE    = "dshare" // share removed
+	USER_ALERT_NEW_SHARED_NODES = "put"    // nodes added to a share
+	USER_ALERT_REMOVED_NODES    = "d"      // nodes removed from a share
+	USER_ALERT_UPDATED_NODES    = "u"      // nodes updated in a share
+	USER_ALERT_PAYMENT          = "psts"   // payment succeeded or failed
+	USER_ALERT_PAYMENT_REMINDER = "pses"   // plan is about to expire
+	USER_ALERT_TAKEDOWN         = "ph"     // public link taken down or reinstated
+)
+
+// UserAlert is a notification shown to the user by the MEGA clients
+type UserAlert struct {
+	// Type of the alert, one of the USER_ALERT_* constants
+	Type string
+	// Approximate time the alert was raised
+	Time time.Time
+	// Handle of the user which caused the alert, if any
+	UserHandle string
+	// Email of the user which caused the alert, if known
+	Email string
+	// Handle of the node the alert is about, if any
+	NodeHandle string
+	// Handles of the nodes the alert is about for multi node alerts
+	NodeHandles []string
+	// Raw alert as received from the server
+	Raw json.RawMessage
+}
+
+// sc_request makes a request to the server client channel with the
+// query given returning the body
+func (m *Mega) sc_request(query string) (buf []byte, err error) {
+	var resp *http.Response
+	m.ensureRegion()
+
+	cfg := m.getConfig()
+	url := fmt.Sprintf("%s/sc?%s%s", cfg.baseurl, query, m.authQuery())
+
+	sleepTime := minSleepTime // inital backoff time
+	for i := 0; i < cfg.retries+1; i++ {
+		if i != 0 {
+			m.debugf("Retry sc request %d/%d: %v", i, cfg.retries, err)
+			m.backOffSleep(&sleepTime)
+		}
+		resp, err = m.client.Post(url, "application/json", nil)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != 200 {
+			err = errors.New("Http Status: " + resp.Status)
+			_ = resp.Body.Close()
+			continue
+		}
+		buf, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			_ = resp.Body.Close()
+			continue
+		}
+		err = resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		// A lone number is an error
+		if !bytes.HasPrefix(buf, []byte("{")) {
+			var emsg ErrorMsg
+			err = json.Unmarshal(buf, &emsg)
+			if err != nil {
+				return nil, EBADRESP
+			}
+			err = parseError(emsg)
+			if err == EAGAIN {
+				continue
+			}
+			if err == nil {
+				err = EBADRESP
+			}
+			return nil, err
+		}
+
+		return buf, nil
+	}
+
+	return nil, err
+}
+
+// GetUserAlerts fetches the most recent user alerts for the account
+// such as new shares, contact requests and payment reminders.
+func (m *Mega) GetUserAlerts() ([]UserAlert, error) {
+	result, err := m.sc_request("c=50")
+	if err != nil {
+		return nil, err
+	}
+
+	var res UserAlertsResp
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make(map[string]string, len(res.U))
+	for _, u := range res.U {
+		emails[u.User] = u.Email
+	}
+
+	now := m.now()
+	alerts := make([]UserAlert, 0, len(res.C))
+	for _, raw := range res.C {
+		var msg UserAlertMsg
+		err = json.Unmarshal(raw, &msg)
+		if err != nil {
+			m.debugf("GetUserAlerts: couldn't parse alert %s: %v", raw, err)
+			continue
+		}
+		alert := UserAlert{
+			Type:       msg.Type,
+			Time:       now.Add(-time.Duration(msg.Td) * time.Second),
+			UserHandle: msg.User,
+			Email:      msg.Email,
+			NodeHandle: msg.N,
+			Raw:        raw,
+		}
+		if alert.Email == "" {
+			alert.Email = emails[msg.User]
+		}
+		for _, f := range msg.F {
+			alert.NodeHandles = append(alert.NodeHandles, f.H)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, nil
+}
+
+// AcknowledgeUserAlerts marks all the user alerts as seen
+func (m *Mega) AcknowledgeUserAlerts() error {
+	var msg [1]UserAlertsAckMsg
+	var err error
+
+	msg[0].Cmd = "sla"
+	msg[0].I, err = m.newRequestID()
+	if err != nil {
+		return err
+	}
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = m.api_request(req)
+	return err
+}
@@ -0,0 +1,37 @@
+package mega
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetUserAlerts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sc" || r.URL.Query().Get("c") != "50" {
+			t.Errorf("unexpected request %q", r.URL)
+		}
+		fmt.Fprint(w, `{"c":[{"a":"share","td":60,"u":"AAAAAAAAAAA","n":"NNNNNNNN"},{"a":"put","td":5,"u":"BBBBBBBBBBB","m":"b@example.com","f":[{"h":"11111111","t":0},{"h":"22222222","t":1}]}],"u":[{"u":"AAAAAAAAAAA","m":"a@example.com"}],"lsn":"xyz"}`)
+	}))
+	defer srv.Close()
+
+	m := New()
+	m.SetAPIUrl(srv.URL)
+	alerts, err := m.GetUserAlerts()
+	if err != nil {
+		t.Fatalf("GetUserAlerts failed: %v", err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expecting 2 alerts, got %d", len(alerts))
+	}
+	if alerts[0].Type != USER_ALERT_NEW_SHARE || alerts[0].NodeHandle != "NNNNNNNN" || alerts[0].Email != "a@example.com" {
+		t.Errorf("bad share alert: %+v", alerts[0])
+	}
+	if alerts[1].Type != USER_ALERT_NEW_SHARED_NODES || len(alerts[1].NodeHandles) != 2 || alerts[1].Email != "b@example.com" {
+		t.Errorf("bad put alert: %+v", alerts[1])
+	}
+	if !alerts[0].Time.Before(alerts[1].Time) {
+		t.Errorf("alert times out of order: %v, %v", alerts[0].Time, alerts[1].Time)
+	}
+}
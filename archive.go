@@ -0,0 +1,370 @@
+package mega
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat is the kind of archive StreamArchive writes
+type ArchiveFormat int
+
+// Archive formats
+const (
+	ARCHIVE_ZIP ArchiveFormat = iota
+	ARCHIVE_TAR
+)
+
+// archiveEntry is a file or folder to put in an archive
+type archiveEntry struct {
+	// slash separated path, ending in / for folders
+	path  string
+	node  *Node
+	size  int64
+	mtime time.Time
+}
+
+// StreamArchive writes the folder n and everything below it to w as a
+// zip or tar archive, so a web app can offer a folder as one download.
+// The files are downloaded one after another straight into the
+// archive, so nothing is kept on disk and only a chunk at a time in
+// memory.  The paths in the archive start with the name of the
+// folder.  n may also be a single file.
+//
+// Files whose keys couldn't be decrypted fail it with their
+// DecryptionError before anything is written.  If a file fails part
+// way the archive written so far is incomplete and the error is
+// returned.
+func (m *Mega) StreamArchive(n *Node, w io.Writer, format ArchiveFormat) error {
+	if n == nil || w == nil || (format != ARCHIVE_ZIP && format != ARCHIVE_TAR) {
+		return EARGS
+	}
+	err := m.LoadTree(n)
+	if err != nil {
+		return err
+	}
+
+	m.FS.mutex.Lock()
+	var entries []archiveEntry
+	err = m.FS.archiveTree(&entries, n, "")
+	m.FS.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case ARCHIVE_TAR:
+		tw := tar.NewWriter(w)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.path, ModTime: e.mtime, Mode: 0644, Size: e.size, Typeflag: tar.TypeReg}
+			if e.node == nil {
+				hdr.Mode, hdr.Size, hdr.Typeflag = 0755, 0, tar.TypeDir
+			}
+			err = tw.WriteHeader(hdr)
+			if err == nil && e.node != nil {
+				err = m.streamNode(tw, e.node)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	default:
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			hdr := &zip.FileHeader{Name: e.path, Method: zip.Deflate, Modified: e.mtime}
+			hdr.SetMode(0644)
+			if e.node == nil {
+				hdr.Method = zip.Store
+				hdr.SetMode(os.ModeDir | 0755)
+			}
+			fw, err := zw.CreateHeader(hdr)
+			if err == nil && e.node != nil {
+				err = m.streamNode(fw, e.node)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+}
+
+// archiveTree adds n and everything below it to entries, in name
+// order, rel being the path of the folder n is in
+//
+// Call with the FS mutex held
+func (fs *MegaFS) archiveTree(entries *[]archiveEntry, n *Node, rel string) error {
+	p := path.Join(rel, archiveName(n.name))
+	if n.ntype == FILE {
+		if n.meta.compkey == nil {
+			if n.decryptErr != nil {
+				return n.decryptErr
+			}
+			return EKEY
+		}
+		*entries = append(*entries, archiveEntry{path: p, node: n, size: n.size, mtime: n.ts})
+		return nil
+	}
+	*entries = append(*entries, archiveEntry{path: p + "/", mtime: n.ts})
+	children := append([]*Node(nil), n.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	for _, c := range children {
+		err := fs.archiveTree(entries, c, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveName returns name made safe to use as one element of a path
+// in an archive, so it can't add folders or climb out of the archive
+// when extracted
+func archiveName(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// streamNode downloads the file n to w a chunk at a time in order,
+// checking its MAC once it is all written
+func (m *Mega) streamNode(w io.Writer, n *Node) error {
+	d, err := m.NewDownload(n)
+	if err != nil {
+		return err
+	}
+	for id := 0; id < d.Chunks(); id++ {
+		_, size, err := d.ChunkLocation(id)
+		if err != nil {
+			return err
+		}
+		err = m.mem.acquire(d.context(), int64(size))
+		if err != nil {
+			return err
+		}
+		chunk, err := d.DownloadChunk(id)
+		if err == nil {
+			_, err = w.Write(chunk)
+		}
+		m.mem.release(int64(size))
+		if err != nil {
+			return err
+		}
+	}
+	return d.Finish()
+}
+
+// errNotRegular is reported for archive entries which are neither
+// files nor folders, such as links
+var errNotRegular = errors.New("not a file or folder")
+
+// UploadArchive unpacks the zip or tar archive read from r into the
+// folder parent, making a folder for each in the archive and uploading
+// each file on its own, so that backups made as archives are kept as
+// trees which can be browsed.  A tar archive is read as a stream.  A
+// zip archive has to be read at random so it is copied to a temporary
+// file first, see SetTempDir, unless r is an *os.File or an io.ReaderAt
+// with a Size method, such as a *bytes.Reader.
+//
+// As with UploadArtifacts folders already there are used and a file
+// already there with the same name is skipped if it is the same size
+// and fails with EEXIST if not.  Entries which are neither files nor
+// folders are skipped.
+//
+// The report lists each entry by its path in the archive.  Errors on
+// individual files are logged and the upload carries on, the first one
+// is returned.  An error reading the archive stops it.
+func (m *Mega) UploadArchive(r io.Reader, format ArchiveFormat, parent *Node) (*Report, error) {
+	if r == nil || parent == nil || (format != ARCHIVE_ZIP && format != ARCHIVE_TAR) {
+		return nil, EARGS
+	}
+
+	report := newReport(m.getConfig().failureThreshold)
+	var firstErr error
+	// add uploads or creates the entry, returning true if the upload
+	// should stop
+	add := func(name string, mode os.FileMode, size int64, open func() (io.ReadCloser, error)) bool {
+		rel := archiveRel(name)
+		if rel == "" {
+			return false
+		}
+		var err error
+		switch {
+		case mode.IsDir():
+			_, err = m.artifactPath(parent, rel)
+		case mode.IsRegular():
+			err = m.uploadArchiveFile(report, parent, rel, size, open)
+		default:
+			return report.add(rel, ITEM_SKIPPED, errNotRegular)
+		}
+		if err == nil {
+			return false
+		}
+		m.logf("archive: %q: %v", rel, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		return report.add(rel, ITEM_FAILED, err)
+	}
+
+	if format == ARCHIVE_TAR {
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return report, err
+			}
+			open := func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(tr), nil
+			}
+			if add(hdr.Name, hdr.FileInfo().Mode(), hdr.Size, open) {
+				return report, ETOOMANYFAILURES
+			}
+		}
+		return report, firstErr
+	}
+
+	zr, cleanup, err := zipReader(r, m.getConfig())
+	if err != nil {
+		return report, err
+	}
+	defer cleanup()
+	for _, f := range zr.File {
+		if add(f.Name, f.Mode(), int64(f.UncompressedSize64), f.Open) {
+			return report, ETOOMANYFAILURES
+		}
+	}
+	return report, firstErr
+}
+
+// archiveRel returns the path of the archive entry name made relative,
+// so entries can't be put outside the folder the archive is unpacked
+// into, or "" for the top.  Backslashes, which some Windows tools
+// write, are taken as separators.
+func archiveRel(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.Replace(name, "\\", "/", -1)), "/")
+}
+
+// zipReader returns a reader for the zip archive in r, copying it to a
+// temporary file as cfg allows if it can't be read at random.  Call
+// cleanup when done with it.
+func zipReader(r io.Reader, cfg config) (zr *zip.Reader, cleanup func(), err error) {
+	cleanup = func() {}
+	var ra io.ReaderAt
+	var size int64
+	switch f := r.(type) {
+	case *os.File:
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, cleanup, err
+		}
+		ra, size = f, fi.Size()
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		ra, size = f, f.Size()
+	default:
+		tmp, n, spilled, err := cfg.spill(r, "mega-archive")
+		if err != nil {
+			return nil, cleanup, err
+		}
+		ra, size, cleanup = tmp, n, spilled
+	}
+	zr, err = zip.NewReader(ra, size)
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	return zr, cleanup, nil
+}
+
+// uploadArchiveFile uploads the file of size read from open to rel
+// below parent unless a file of the same size is already there
+func (m *Mega) uploadArchiveFile(report *Report, parent *Node, rel string, size int64, open func() (io.ReadCloser, error)) error {
+	dir, err := m.artifactPath(parent, path.Dir(rel))
+	if err != nil {
+		return err
+	}
+	name := path.Base(rel)
+	children, err := m.FS.GetChildren(dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if c.GetName() != name {
+			continue
+		}
+		if !c.IsFile() || c.GetSize() != size {
+			return EEXIST
+		}
+		report.add(rel, ITEM_SKIPPED, errAlreadyUploaded)
+		return nil
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+	m.debugf("archive: uploading %q", rel)
+	_, err = m.uploadStream(rc, size, dir, name)
+	if err != nil {
+		return err
+	}
+	report.add(rel, ITEM_DONE, nil)
+	return nil
+}
+
+// uploadStream uploads size bytes read from r in order, a chunk at a
+// time, as name in parent, passing them to the content filter as they
+// go.  The chunks can't be read again so if the upload URL expires
+// part way the upload fails.
+func (m *Mega) uploadStream(r io.Reader, size int64, parent *Node, name string) (*Node, error) {
+	u, err := m.NewUpload(parent, name, size)
+	if err != nil {
+		return nil, err
+	}
+	filter := m.newUploadFilter(name)
+	for id := 0; id < u.Chunks() && err == nil; id++ {
+		var chk_size int
+		_, chk_size, err = u.ChunkLocation(id)
+		if err != nil {
+			break
+		}
+		err = m.mem.acquire(u.context(), int64(chk_size))
+		if err != nil {
+			break
+		}
+		chunk := make([]byte, chk_size)
+		_, err = io.ReadFull(r, chunk)
+		if err == nil {
+			// before it is encrypted in place
+			filter.write(chunk)
+			err = u.UploadChunk(id, chunk)
+		}
+		m.mem.release(int64(chk_size))
+	}
+	err = filter.close(err)
+	if err != nil {
+		return nil, err
+	}
+	return u.finishRetry()
+}
@@ -0,0 +1,214 @@
+package mega
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestStreamArchive(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	data, err := m.CreateDir("data", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := m.CreateDir("sub", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.CreateDir("empty dir", data); err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, data, "a.txt", "first file")
+	uploadString(t, m, sub, "b.txt", "second file")
+	uploadString(t, m, sub, "../evil", "")
+
+	want := map[string]string{
+		"data/":            "",
+		"data/a.txt":       "first file",
+		"data/empty dir/":  "",
+		"data/sub/":        "",
+		"data/sub/.._evil": "",
+		"data/sub/b.txt":   "second file",
+	}
+	check := func(format string, got map[string]string, order []string) {
+		for name, contents := range want {
+			if c, ok := got[name]; !ok || c != contents {
+				t.Errorf("%s: %q has %q, want %q", format, name, c, contents)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: archive has %q", format, order)
+		}
+		if len(order) > 0 && order[0] != "data/" {
+			t.Errorf("%s: archive starts with %q", format, order[0])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = m.StreamArchive(data, &buf, ARCHIVE_ZIP); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	var order []string
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[f.Name] = string(contents)
+		order = append(order, f.Name)
+	}
+	check("zip", got, order)
+
+	buf.Reset()
+	if err = m.StreamArchive(data, &buf, ARCHIVE_TAR); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	got = make(map[string]string)
+	order = nil
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(contents)
+		order = append(order, hdr.Name)
+	}
+	check("tar", got, order)
+
+	if err = m.StreamArchive(data, &buf, ArchiveFormat(7)); err != EARGS {
+		t.Errorf("unknown format: got %v, want EARGS", err)
+	}
+	if err = m.StreamArchive(nil, &buf, ARCHIVE_ZIP); err != EARGS {
+		t.Errorf("nil node: got %v, want EARGS", err)
+	}
+}
+
+func TestUploadArchive(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dest, err := m.CreateDir("backup", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, dest, "same.txt", "12345")
+	uploadString(t, m, dest, "differs.txt", "12345")
+
+	big := make([]byte, 300000)
+	_, _ = rand.Read(big)
+	files := []struct {
+		name, data string
+	}{
+		{"top.txt", "top"},
+		{"dir/nested/deep.bin", string(big)},
+		{"dir/empty", ""},
+		{"../../escape.txt", "kept inside"},
+		{"same.txt", "abcde"},
+		{"differs.txt", "longer contents"},
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	_ = tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	_ = tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "top.txt"})
+	for _, f := range files {
+		_ = tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))})
+		_, _ = tw.Write([]byte(f.data))
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := m.UploadArchive(&tarBuf, ARCHIVE_TAR, dest)
+	if err != EEXIST {
+		t.Errorf("tar: got %v, want EEXIST", err)
+	}
+	if report.Count(ITEM_DONE) != 4 || report.Count(ITEM_SKIPPED) != 2 || report.Count(ITEM_FAILED) != 1 {
+		t.Errorf("tar report: %+v", report.Items)
+	}
+	for _, f := range files[:4] {
+		rel := archiveRel(f.name)
+		n, err := m.FS.PathLookup(dest, strings.Split(rel, "/"))
+		if err != nil {
+			t.Errorf("%q: %v", rel, err)
+			continue
+		}
+		var got bytes.Buffer
+		if err = m.streamNode(&got, n[len(n)-1]); err != nil || got.String() != f.data {
+			t.Errorf("%q: contents differ: %v", rel, err)
+		}
+	}
+
+	// A zip which can only be read as a stream into a fresh folder
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, f := range files[:2] {
+		w, _ := zw.Create(f.name)
+		_, _ = w.Write([]byte(f.data))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zdest, err := m.CreateDir("zipped", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = m.UploadArchive(struct{ io.Reader }{&zipBuf}, ARCHIVE_ZIP, zdest)
+	if err != nil || report.Count(ITEM_DONE) != 2 {
+		t.Errorf("zip: %v %+v", err, report.Items)
+	}
+	if _, err = m.FS.PathLookup(zdest, []string{"dir", "nested", "deep.bin"}); err != nil {
+		t.Errorf("zip: %v", err)
+	}
+
+	if _, err = m.UploadArchive(bytes.NewReader([]byte("not a zip")), ARCHIVE_ZIP, zdest); err == nil {
+		t.Errorf("bad zip accepted")
+	}
+	if _, err = m.UploadArchive(&zipBuf, ARCHIVE_ZIP, nil); err != EARGS {
+		t.Errorf("nil parent: got %v, want EARGS", err)
+	}
+}
+
+func TestArchiveRel(t *testing.T) {
+	for name, want := range map[string]string{
+		"a/b.txt":       "a/b.txt",
+		"./a/":          "a",
+		"/etc/passwd":   "etc/passwd",
+		"../../x":       "x",
+		"a/../../b":     "b",
+		`win\dir\f.txt`: "win/dir/f.txt",
+		".":             "",
+	} {
+		if got := archiveRel(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package mega
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errAlreadyUploaded is reported for artifacts which are already there
+var errAlreadyUploaded = errors.New("already uploaded")
+
+// UploadArtifacts uploads build artifacts into a writable folder link
+// without any account credentials, for CI systems which distribute
+// their builds through MEGA.  link and auth are the URL and AuthKey of
+// a WritableLink made by the owner of the folder with LinkWritable.
+// opts configure the session as for New.
+//
+// The local files and directories in paths are uploaded into dest, a
+// slash separated path below the folder of the link which is created
+// if needed, or "" for the folder itself.  Directories are uploaded
+// with everything below them.  Uploaders can't remove files so a file
+// already there with the same name is skipped if it is the same size,
+// which lets a failed job be run again, and fails with EEXIST if not.
+//
+// The report lists each file by its path relative to dest.  Errors on
+// individual files are logged and the upload carries on, the first one
+// is returned.
+func UploadArtifacts(link, auth, dest string, paths []string, opts ...Option) (*Report, error) {
+	if auth == "" {
+		return nil, EARGS
+	}
+	m, err := NewWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = m.OpenWritableFolderLink(link, auth)
+	if err != nil {
+		return nil, err
+	}
+	return m.uploadArtifacts(dest, paths)
+}
+
+// uploadArtifacts uploads the local files and directories in paths
+// into the folder dest below the root
+func (m *Mega) uploadArtifacts(dest string, paths []string) (*Report, error) {
+	root := m.FS.GetRoot()
+	if root == nil {
+		return nil, ENOENT
+	}
+	parent, err := m.artifactPath(root, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	report := newReport(m.getConfig().failureThreshold)
+	var firstErr error
+	fail := func(rel string, err error) bool {
+		m.logf("artifacts: %q: %v", rel, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		return report.add(rel, ITEM_FAILED, err)
+	}
+	for _, p := range paths {
+		p = longPath(p)
+		base := filepath.Dir(p)
+		err = filepath.Walk(p, func(local string, fi os.FileInfo, err error) error {
+			rel, relErr := filepath.Rel(base, local)
+			if relErr != nil {
+				return relErr
+			}
+			rel = remoteRel(rel)
+			if err != nil {
+				if fail(rel, err) {
+					return ETOOMANYFAILURES
+				}
+				return nil
+			}
+			switch {
+			case fi.IsDir():
+				_, err = m.artifactPath(parent, rel)
+			case fi.Mode().IsRegular():
+				err = m.uploadArtifact(report, parent, rel, local, fi.Size())
+			}
+			if err != nil && fail(rel, err) {
+				return ETOOMANYFAILURES
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, firstErr
+}
+
+// artifactDir returns the folder name in parent, creating it if needed
+func (m *Mega) artifactDir(parent *Node, name string) (*Node, error) {
+	children, err := m.FS.GetChildren(parent)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range children {
+		if c.GetName() != name {
+			continue
+		}
+		if !c.IsFolder() {
+			return nil, EEXIST
+		}
+		return c, nil
+	}
+	return m.CreateDir(name, parent)
+}
+
+// artifactPath returns the folder for the slash separated path rel
+// below parent, creating any missing folders
+func (m *Mega) artifactPath(parent *Node, rel string) (*Node, error) {
+	var err error
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		parent, err = m.artifactDir(parent, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parent, nil
+}
+
+// uploadArtifact uploads the local file to rel below parent unless a
+// file of the same size is already there
+func (m *Mega) uploadArtifact(report *Report, parent *Node, rel, local string, size int64) error {
+	dir, err := m.artifactPath(parent, path.Dir(rel))
+	if err != nil {
+		return err
+	}
+	name := path.Base(rel)
+	children, err := m.FS.GetChildren(dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if c.GetName() != name {
+			continue
+		}
+		if !c.IsFile() || c.GetSize() != size {
+			return EEXIST
+		}
+		report.add(rel, ITEM_SKIPPED, errAlreadyUploaded)
+		return nil
+	}
+	m.debugf("artifacts: uploading %q", rel)
+	_, err = m.UploadFile(local, dir, name, nil)
+	if err != nil {
+		return err
+	}
+	report.add(rel, ITEM_DONE, nil)
+	return nil
+}
@@ -0,0 +1,75 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadArtifacts(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(filepath.Join(dir, "dist", "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	bin := randomFile(t, dir, "app.tar.gz", 100000)
+	doc := randomFile(t, filepath.Join(dir, "dist", "docs"), "index.html", 1000)
+	randomFile(t, filepath.Join(dir, "dist"), "app.zip", 2000)
+
+	link := "https://mega.nz/folder/PubHandl#" + base64urlencode(m.k)
+	paths := []string{filepath.Join(dir, "app.tar.gz"), filepath.Join(dir, "dist")}
+	report, err := UploadArtifacts(link, "secret", "builds/42", paths, WithLogger(nil), WithAPIURL(b.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count(ITEM_DONE) != 3 {
+		t.Errorf("uploaded %d files, want 3: %+v", report.Count(ITEM_DONE), report.Items)
+	}
+
+	// Running the job again skips what is there already
+	report, err = UploadArtifacts(link, "secret", "builds/42", paths, WithLogger(nil), WithAPIURL(b.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count(ITEM_SKIPPED) != 3 || report.Count(ITEM_DONE) != 0 {
+		t.Errorf("second run: %+v", report.Items)
+	}
+
+	// but won't clobber a different file
+	randomFile(t, dir, "app.tar.gz", 10)
+	report, err = UploadArtifacts(link, "secret", "builds/42", paths[:1], WithLogger(nil), WithAPIURL(b.URL))
+	if err != EEXIST || report.Count(ITEM_FAILED) != 1 {
+		t.Errorf("changed artifact: got %v, want EEXIST", err)
+	}
+
+	if _, err = UploadArtifacts(link, "", "builds", paths, WithLogger(nil), WithAPIURL(b.URL)); err != EARGS {
+		t.Errorf("no auth key: got %v, want EARGS", err)
+	}
+
+	// Read them back through the link
+	check := New(WithLogger(nil), WithAPIURL(b.URL))
+	if err = check.OpenFolderLink(link); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path []string
+		data []byte
+	}{
+		{[]string{"builds", "42", "app.tar.gz"}, bin},
+		{[]string{"builds", "42", "dist", "docs", "index.html"}, doc},
+	} {
+		nodes, err := check.FS.PathLookup(check.FS.GetRoot(), test.path)
+		if err != nil {
+			t.Errorf("%q: %v", test.path, err)
+			continue
+		}
+		checkDownload(t, check, nodes[len(nodes)-1], filepath.Join(dir, "check"), test.data)
+	}
+}
@@ -0,0 +1,184 @@
+package mega
+
+import (
+	"crypto/aes"
+	"encoding/json"
+	"strings"
+)
+
+// MarshalJSON packs the name and fingerprint along with the other
+// attributes in Extra
+func (a FileAttr) MarshalJSON() ([]byte, error) {
+	m := make(map[string]json.RawMessage, len(a.Extra)+2)
+	for k, v := range a.Extra {
+		m[k] = v
+	}
+	name, err := json.Marshal(a.Name)
+	if err != nil {
+		return nil, err
+	}
+	m["n"] = name
+	delete(m, "c")
+	if a.Fingerprint != "" {
+		m["c"], err = json.Marshal(a.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON unpacks the name and fingerprint, keeping any other
+// attributes in Extra so they aren't lost when written back
+func (a *FileAttr) UnmarshalJSON(data []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*a = FileAttr{}
+	if v, ok := m["n"]; ok {
+		if err := json.Unmarshal(v, &a.Name); err != nil {
+			return err
+		}
+		delete(m, "n")
+	}
+	if v, ok := m["c"]; ok {
+		if err := json.Unmarshal(v, &a.Fingerprint); err != nil {
+			return err
+		}
+		delete(m, "c")
+	}
+	if len(m) > 0 {
+		a.Extra = m
+	}
+	return nil
+}
+
+// checkAttrKey checks key names a custom attribute, which must be
+// namespaced as "namespace:name" so it can't clash with the
+// attributes MEGA's clients use
+func checkAttrKey(key string) error {
+	i := strings.Index(key, ":")
+	if i <= 0 || i == len(key)-1 {
+		return EARGS
+	}
+	return nil
+}
+
+// GetAttr returns the raw JSON of the attribute key of the node and
+// whether it is set.  This covers the custom attributes set with
+// SetAttr and those set by other clients which this package doesn't
+// interpret, like labels.  Use GetName and GetFingerprint for the name
+// and fingerprint.
+func (n *Node) GetAttr(key string) (json.RawMessage, bool) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	v, ok := n.attrs[key]
+	if !ok {
+		return nil, false
+	}
+	return append(json.RawMessage(nil), v...), true
+}
+
+// GetAttrs returns the keys of the attributes of the node other than
+// the name and fingerprint
+func (n *Node) GetAttrs() []string {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	keys := make([]string, 0, len(n.attrs))
+	for k := range n.attrs {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// SetAttr sets the custom attribute key of the node to value encoded
+// as JSON, or removes it if value is nil.  The key must be namespaced
+// as "namespace:name", say "myapp:tag", and the other attributes of
+// the node are kept.  Custom attributes are encrypted like the name
+// so only those with the node key can read them.
+func (m *Mega) SetAttr(n *Node, key string, value interface{}) error {
+	defer m.auditNodes("SetAttr", n)()
+	if n == nil {
+		return EARGS
+	}
+	if err := checkAttrKey(key); err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	if value != nil {
+		var err error
+		raw, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	attrs := make(map[string]json.RawMessage, len(n.attrs)+1)
+	for k, v := range n.attrs {
+		attrs[k] = v
+	}
+	if raw == nil {
+		delete(attrs, key)
+	} else {
+		attrs[key] = raw
+	}
+	err := m.setNodeAttr(n, FileAttr{Name: n.name, Fingerprint: n.fingerprint, Extra: attrs})
+	if err != nil {
+		return err
+	}
+	n.attrs = attrs
+	return nil
+}
+
+// setNodeAttr replaces the attributes of n on the server with attr
+//
+// Call with the FS mutex held
+func (m *Mega) setNodeAttr(n *Node, attr FileAttr) error {
+	var msg [1]FileAttrMsg
+	var err error
+
+	msg[0], err = m.attrMsg(n, attr)
+	if err != nil {
+		return err
+	}
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = m.api_request(req)
+	return err
+}
+
+// attrMsg returns the command which sets the attributes of n to attr
+//
+// Call with the FS mutex held
+func (m *Mega) attrMsg(n *Node, attr FileAttr) (msg FileAttrMsg, err error) {
+	if err = m.FS.checkAccess(n, ACCESS_FULL); err != nil {
+		return msg, err
+	}
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return msg, err
+	}
+	attr_data, err := encryptAttr(n.meta.key, attr)
+	if err != nil {
+		return msg, err
+	}
+	key := make([]byte, len(n.meta.compkey))
+	err = blockEncrypt(master_aes, key, n.meta.compkey)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Cmd = "a"
+	msg.Attr = attr_data
+	msg.Key = base64urlencode(key)
+	msg.N = n.hash
+	msg.I, err = m.newRequestID()
+	return msg, err
+}
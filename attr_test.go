@@ -0,0 +1,84 @@
+package mega
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFileAttrJSON(t *testing.T) {
+	key := make([]byte, 16)
+	data, err := encryptAttr(key, FileAttr{Name: "a", Extra: map[string]json.RawMessage{
+		"lbl":      json.RawMessage(`3`),
+		"zz:obj":   json.RawMessage(`{"x":"y"}`),
+		"myapp:id": json.RawMessage(`"42"`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr, err := decryptAttr(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Name != "a" || attr.Fingerprint != "" || len(attr.Extra) != 3 ||
+		string(attr.Extra["lbl"]) != "3" || string(attr.Extra["zz:obj"]) != `{"x":"y"}` {
+		t.Errorf("decrypted %+v", attr)
+	}
+
+	// The name and fingerprint win over Extra
+	b, err := json.Marshal(FileAttr{Name: "n", Extra: map[string]json.RawMessage{"n": json.RawMessage(`"x"`), "c": json.RawMessage(`"y"`)}})
+	if err != nil || string(b) != `{"n":"n"}` {
+		t.Errorf("marshalled %s: %v", b, err)
+	}
+}
+
+func TestSetAttr(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	n := uploadString(t, m, m.FS.GetRoot(), "f.txt", "hello")
+	for _, key := range []string{"", "lbl", "n", ":x", "x:"} {
+		if err := m.SetAttr(n, key, 1); err != EARGS {
+			t.Errorf("SetAttr(%q): got %v, want EARGS", key, err)
+		}
+	}
+	if err := m.SetAttr(n, "myapp:tags", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAttr(n, "myapp:gone", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAttr(n, "myapp:gone", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming keeps the custom attributes
+	if err := m.Rename(n, "g.txt"); err != nil {
+		t.Fatal(err)
+	}
+	v, ok := n.GetAttr("myapp:tags")
+	if !ok || string(v) != `["a","b"]` {
+		t.Errorf("GetAttr gave %s %v", v, ok)
+	}
+
+	// and they reach the server
+	m2 := newMockSession(t, b.mockServer)
+	m2.k = m.k
+	m2.sid = m.sid
+	if err := m2.getFileSystem(); err != nil {
+		t.Fatal(err)
+	}
+	n2 := m2.FS.HashLookup(n.GetHash())
+	if n2 == nil || n2.GetName() != "g.txt" {
+		t.Fatalf("renamed node not found")
+	}
+	v, ok = n2.GetAttr("myapp:tags")
+	if !ok || string(v) != `["a","b"]` {
+		t.Errorf("GetAttr after login gave %s %v", v, ok)
+	}
+	if _, ok = n2.GetAttr("myapp:gone"); ok {
+		t.Errorf("removed attribute still set")
+	}
+	if keys := n2.GetAttrs(); len(keys) != 1 {
+		t.Errorf("GetAttrs gave %q", keys)
+	}
+}
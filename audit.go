@@ -0,0 +1,139 @@
+package mega
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Misuse is a use of the package found in audit mode which is likely a
+// mistake, such as two goroutines changing the same node at once or a
+// transfer being used again once it has finished
+type Misuse struct {
+	// The call which found it, for example "Move" or
+	// "Upload.UploadChunk"
+	Op string
+	// What is wrong and what to do about it
+	Message string
+}
+
+func (e Misuse) String() string {
+	return e.Op + ": " + e.Message
+}
+
+// SetAudit turns on audit mode, calling fn with each misuse found, or
+// turns it off if fn is nil.
+//
+// The calls of this package are safe to make from several goroutines
+// but that doesn't make every use of them sensible: changes to the same
+// node made at once are applied by the server in whatever order they
+// arrive, and the chunks and Finish of a transfer are only meant to be
+// called once each.  Audit mode tracks the changes and transfers in
+// flight to report these, at some cost, so is meant for debugging code
+// written against the older API.  fn may be called from any goroutine.
+func (m *Mega) SetAudit(fn func(Misuse)) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.audit = fn
+}
+
+// WithAudit turns on audit mode, see SetAudit
+func WithAudit(fn func(Misuse)) Option {
+	return func(m *Mega) error {
+		m.config.audit = fn
+		return nil
+	}
+}
+
+// auditf reports a misuse found by op if audit mode is on
+func (m *Mega) auditf(op string, format string, v ...interface{}) {
+	fn := m.getConfig().audit
+	if fn == nil {
+		return
+	}
+	fn(Misuse{Op: op, Message: fmt.Sprintf(format, v...)})
+}
+
+// auditNodes notes that op is changing nodes, reporting any another
+// goroutine is still changing, and returns a func to call once it is
+// done.  Only the call reported as the first is released by its func.
+func (m *Mega) auditNodes(op string, nodes ...*Node) func() {
+	if m.getConfig().audit == nil {
+		return func() {}
+	}
+	var mine []string
+	m.auditMu.Lock()
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		// the handle of a node never changes so needs no lock
+		h := n.hash
+		if other, ok := m.busy[h]; ok {
+			m.auditMu.Unlock()
+			m.auditf(op, "node %s is being changed by %s in another goroutine; changes to the same node race on the server so wait for one to return before making the next", h, other)
+			m.auditMu.Lock()
+			continue
+		}
+		if m.busy == nil {
+			m.busy = make(map[string]string)
+		}
+		m.busy[h] = op
+		mine = append(mine, h)
+	}
+	m.auditMu.Unlock()
+	return func() {
+		m.auditMu.Lock()
+		defer m.auditMu.Unlock()
+		for _, h := range mine {
+			delete(m.busy, h)
+		}
+	}
+}
+
+// auditFinish is the id begin is given for Finish
+const auditFinish = -1
+
+// transferAudit tracks the calls on a transfer in audit mode
+type transferAudit struct {
+	mu     sync.Mutex
+	done   bool
+	active map[int]bool
+}
+
+// begin notes that op on the transfer what has started, for the chunk
+// id or auditFinish, reporting it if the transfer has finished or the
+// same is already running in another goroutine.  It returns a func to
+// call when op is done with whether it worked.
+func (t *transferAudit) begin(m *Mega, op, what string, id int) func(ok bool) {
+	if m.getConfig().audit == nil {
+		return func(bool) {}
+	}
+	t.mu.Lock()
+	done, running := t.done, t.active[id]
+	if !running {
+		if t.active == nil {
+			t.active = make(map[int]bool)
+		}
+		t.active[id] = true
+	}
+	t.mu.Unlock()
+
+	switch {
+	case done:
+		m.auditf(op, "the %s has already finished; make a new one for each transfer rather than using it again", what)
+	case running && id == auditFinish:
+		m.auditf(op, "the %s is already being finished in another goroutine; call Finish once, after all the chunks are done", what)
+	case running:
+		m.auditf(op, "chunk %d of the %s is already being transferred in another goroutine; give each chunk to one goroutine only", id, what)
+	}
+	return func(ok bool) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !running {
+			delete(t.active, id)
+		}
+		if ok && id == auditFinish {
+			t.done = true
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package mega
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	var mu sync.Mutex
+	var misuses []Misuse
+	reported := make(chan struct{}, 10)
+	m.SetAudit(func(e Misuse) {
+		mu.Lock()
+		misuses = append(misuses, e)
+		mu.Unlock()
+		reported <- struct{}{}
+	})
+	found := func() []Misuse {
+		mu.Lock()
+		defer mu.Unlock()
+		got := misuses
+		misuses = nil
+		return got
+	}
+
+	// Proper use reports nothing
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, root, "f", "hello")
+	if err = m.Rename(f, "g"); err != nil {
+		t.Fatal(err)
+	}
+	if got := found(); len(got) != 0 {
+		t.Fatalf("misuse reported: %v", got)
+	}
+
+	// A rename while a move of the same node is in flight
+	started := make(chan struct{})
+	release := make(chan struct{})
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "m" {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+	b.mu.Unlock()
+	done := make(chan error, 2)
+	go func() {
+		done <- m.Move(f, dir)
+	}()
+	<-started
+	go func() {
+		done <- m.Rename(f, "h")
+	}()
+	<-reported
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := found()
+	if len(got) != 1 || got[0].Op != "Rename" || !strings.Contains(got[0].Message, "Move") {
+		t.Errorf("misuses %v", got)
+	}
+
+	// A download used again once finished
+	d, err := m.NewDownload(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.DownloadChunk(0); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if got := found(); len(got) != 0 {
+		t.Fatalf("misuse reported: %v", got)
+	}
+	if _, err = d.DownloadChunk(0); err != nil {
+		t.Fatal(err)
+	}
+	got = found()
+	if len(got) != 1 || got[0].Op != "Download.DownloadChunk" || !strings.Contains(got[0].Message, "already finished") {
+		t.Errorf("misuses %v", got)
+	}
+
+	// Off again nothing is reported
+	m.SetAudit(nil)
+	if _, err = d.DownloadChunk(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := found(); len(got) != 0 {
+		t.Errorf("misuse reported with audit off: %v", got)
+	}
+}
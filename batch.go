@@ -0,0 +1,312 @@
+package mega
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Default pacing of a Batch
+const (
+	BATCH_SIZE         = 50                     // commands per request
+	BATCH_INTERVAL     = 500 * time.Millisecond // between requests
+	BATCH_MAX_INTERVAL = time.Minute            // when slowed down
+	BATCH_RETRIES      = 8                      // sends of a refused command
+)
+
+// batchOp is an operation queued in a Batch
+type batchOp struct {
+	// path of the node for the report
+	path string
+	// build returns the command
+	//
+	// Call with the FS mutex held
+	build func() (interface{}, error)
+	// apply updates the tree once the server has done the command
+	//
+	// Call with the FS mutex held
+	apply func() *JournalEntry
+	// command built, kept so retries send the same request ID
+	msg   interface{}
+	tries int
+}
+
+// Batch performs many moves, renames and deletes, say when
+// reorganising or clearing out tens of thousands of files, without
+// running into MEGA's rate limits.  The operations are queued then
+// Run sends them several commands to a request with the requests
+// paced out.  Whenever the server says to slow down the pace is halved
+// and the commands it refused are sent again, and once requests go
+// through it eases back up.
+//
+// The tree is updated and the changes journaled as each command
+// succeeds, as the single operations do.
+type Batch struct {
+	m *Mega
+
+	// Size is the most commands sent in one request, BATCH_SIZE if 0
+	Size int
+	// Interval is the least time between requests, BATCH_INTERVAL if
+	// 0.  It grows up to BATCH_MAX_INTERVAL while being rate limited.
+	Interval time.Duration
+	// Progress, if set, is called after each request with the
+	// number of operations finished, whether they worked or not, and
+	// the total
+	Progress func(done, total int)
+	// FailureThreshold is the number of failed operations after which
+	// Run stops with ETOOMANYFAILURES, 0 for no limit.  It defaults
+	// to the threshold set with WithFailureThreshold.
+	FailureThreshold int
+
+	ops []*batchOp
+}
+
+// NewBatch returns an empty Batch
+func (m *Mega) NewBatch() *Batch {
+	return &Batch{
+		m:                m,
+		FailureThreshold: m.getConfig().failureThreshold,
+	}
+}
+
+// Len returns the number of operations queued
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Move queues moving src into parent as Mega.Move does, though without
+// the name collision handling set with SetCollision as the names can't
+// be checked until the batch is sent
+func (b *Batch) Move(src *Node, parent *Node) error {
+	if src == nil || parent == nil {
+		return EARGS
+	}
+	m := b.m
+	// every node moved into a share needs its key sent
+	m.FS.mutex.Lock()
+	shared := m.FS.shareOf(parent) != "" && src.ntype != FILE
+	m.FS.mutex.Unlock()
+	if shared {
+		err := m.LoadTree(src)
+		if err != nil {
+			return err
+		}
+	}
+	b.ops = append(b.ops, &batchOp{
+		path: m.FS.nodePath(src),
+		build: func() (interface{}, error) {
+			return m.moveMsg(src, parent)
+		},
+		apply: func() *JournalEntry {
+			return m.applyMove(src, parent)
+		},
+	})
+	return nil
+}
+
+// Rename queues renaming src to name as Mega.Rename does
+func (b *Batch) Rename(src *Node, name string) error {
+	if src == nil {
+		return EARGS
+	}
+	m := b.m
+	b.ops = append(b.ops, &batchOp{
+		path: m.FS.nodePath(src),
+		build: func() (interface{}, error) {
+			return m.attrMsg(src, FileAttr{Name: name, Fingerprint: src.fingerprint, Extra: src.attrs})
+		},
+		apply: func() *JournalEntry {
+			return m.applyRename(src, name)
+		},
+	})
+	return nil
+}
+
+// Delete queues deleting node as Mega.Delete does, moving it to the
+// trash unless destroy is set
+func (b *Batch) Delete(node *Node, destroy bool) error {
+	if node == nil {
+		return EARGS
+	}
+	if !destroy {
+		return b.Move(node, b.m.FS.GetTrash())
+	}
+	m := b.m
+	b.ops = append(b.ops, &batchOp{
+		path: m.FS.nodePath(node),
+		build: func() (interface{}, error) {
+			return m.deleteMsg(node)
+		},
+		apply: func() *JournalEntry {
+			return m.applyDelete(node)
+		},
+	})
+	return nil
+}
+
+// slowDown returns true for errors which mean the server wants fewer
+// requests
+func slowDown(err error) bool {
+	return err == ERATELIMIT || err == EAGAIN || err == ETEMPUNAVAIL
+}
+
+// Run sends the queued operations, returning a report of what happened
+// to each, by path, and the first error.  Operations which fail are
+// logged and the rest carried on with unless the FailureThreshold is
+// reached.  Cancelling ctx stops Run between requests with the
+// operations not sent yet left queued.
+func (b *Batch) Run(ctx context.Context) (*Report, error) {
+	m := b.m
+	size := b.Size
+	if size <= 0 {
+		size = BATCH_SIZE
+	}
+	interval := b.Interval
+	if interval <= 0 {
+		interval = BATCH_INTERVAL
+	}
+	report := newReport(b.FailureThreshold)
+	var firstErr error
+	fail := func(op *batchOp, err error) bool {
+		m.logf("batch: %q: %v", op.path, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		return report.add(op.path, ITEM_FAILED, err)
+	}
+
+	total := len(b.ops)
+	finished := 0
+	wait := interval
+	var last time.Time
+	for len(b.ops) > 0 {
+		if !last.IsZero() {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-m.after(last.Add(wait).Sub(m.now())):
+			}
+		}
+
+		n := size
+		if n > len(b.ops) {
+			n = len(b.ops)
+		}
+		ops := append([]*batchOp(nil), b.ops[:n]...)
+		b.ops = b.ops[n:]
+
+		// Build the commands, failing any which can't be
+		m.FS.mutex.Lock()
+		sent := ops[:0]
+		var failed []*batchOp
+		var failedErrs []error
+		for _, op := range ops {
+			if op.msg == nil {
+				msg, err := op.build()
+				if err != nil {
+					failed = append(failed, op)
+					failedErrs = append(failedErrs, err)
+					continue
+				}
+				op.msg = msg
+			}
+			sent = append(sent, op)
+		}
+		m.FS.mutex.Unlock()
+
+		var errs []error
+		if len(sent) > 0 {
+			msgs := make([]interface{}, len(sent))
+			for i, op := range sent {
+				msgs[i] = op.msg
+			}
+			req, err := json.Marshal(msgs)
+			if err != nil {
+				return report, err
+			}
+			buf, err := m.api_request(req)
+			last = m.now()
+			errs = batchResults(buf, err, len(sent))
+		}
+
+		var entries []*JournalEntry
+		var retry []*batchOp
+		limited := false
+		m.FS.mutex.Lock()
+		for i, op := range sent {
+			switch err := errs[i]; {
+			case err == nil:
+				entries = append(entries, op.apply())
+				report.add(op.path, ITEM_DONE, nil)
+				finished++
+			case slowDown(err) && op.tries < BATCH_RETRIES:
+				op.tries++
+				limited = true
+				retry = append(retry, op)
+			default:
+				failed = append(failed, op)
+				failedErrs = append(failedErrs, err)
+			}
+		}
+		m.FS.mutex.Unlock()
+		m.journal(entries...)
+
+		for i, op := range failed {
+			finished++
+			if fail(op, failedErrs[i]) {
+				return report, ETOOMANYFAILURES
+			}
+		}
+		b.ops = append(retry, b.ops...)
+		if limited {
+			wait = slower(wait)
+			m.debugf("batch: slowing down to a request every %v", wait)
+		} else if wait > interval {
+			// ease back up
+			wait -= wait / 4
+			if wait < interval {
+				wait = interval
+			}
+		}
+		if b.Progress != nil {
+			b.Progress(finished, total)
+		}
+	}
+	return report, firstErr
+}
+
+// slower returns the doubled interval between requests
+func slower(wait time.Duration) time.Duration {
+	wait *= 2
+	if wait > BATCH_MAX_INTERVAL {
+		wait = BATCH_MAX_INTERVAL
+	}
+	return wait
+}
+
+// batchResults splits the reply to a request of n commands into the
+// result of each.  An error for the whole request is the result of all
+// of them.
+func batchResults(buf []byte, err error, n int) []error {
+	errs := make([]error, n)
+	if err == nil {
+		var res []json.RawMessage
+		err = json.Unmarshal(buf, &res)
+		if err == nil && len(res) != n {
+			err = EBADRESP
+		}
+		if err == nil {
+			for i, r := range res {
+				var errno ErrorMsg
+				if json.Unmarshal(r, &errno) == nil {
+					errs[i] = parseError(errno)
+				}
+			}
+			return errs
+		}
+	}
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
@@ -0,0 +1,127 @@
+package mega
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dst, err := m.CreateDir("dst", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*Node
+	for i := 0; i < 7; i++ {
+		files = append(files, uploadString(t, m, root, fmt.Sprintf("f%d", i), "data"))
+	}
+
+	// The server turns away the first move
+	refused := 0
+	var requests []*http.Request
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if len(requests) == 0 || requests[len(requests)-1] != r {
+			requests = append(requests, r)
+		}
+		if refused == 0 && cmd["a"] == "m" {
+			refused++
+			return ErrorMsg(-4)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	batch := m.NewBatch()
+	batch.Size = 3
+	batch.Interval = time.Millisecond
+	var progress []int
+	batch.Progress = func(done, total int) {
+		if total != 8 {
+			t.Errorf("total %d, want 8", total)
+		}
+		progress = append(progress, done)
+	}
+	for _, f := range files[:4] {
+		if err = batch.Move(f, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = batch.Rename(files[4], "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = batch.Delete(files[5], true); err != nil {
+		t.Fatal(err)
+	}
+	if err = batch.Delete(files[6], false); err != nil {
+		t.Fatal(err)
+	}
+	if err = batch.Delete(nil, false); err != EARGS {
+		t.Errorf("nil node: got %v, want EARGS", err)
+	}
+	gone := uploadString(t, m, root, "gone", "data")
+	if err = batch.Rename(gone, "still gone"); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.remove(gone.GetHash())
+	b.mu.Unlock()
+	if batch.Len() != 8 {
+		t.Fatalf("%d operations queued, want 8", batch.Len())
+	}
+	b.mu.Lock()
+	requests = nil
+	b.mu.Unlock()
+
+	report, err := batch.Run(context.Background())
+	if err != ENOENT {
+		t.Errorf("Run: got %v, want ENOENT", err)
+	}
+	if report.Count(ITEM_DONE) != 7 || report.Count(ITEM_FAILED) != 1 {
+		t.Errorf("report: %+v", report.Items)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 8 {
+		t.Errorf("progress %v", progress)
+	}
+	b.mu.Lock()
+	if len(requests) != 3 {
+		t.Errorf("sent %d requests, want 3", len(requests))
+	}
+	b.mu.Unlock()
+
+	for _, f := range files[:4] {
+		if f.parent != dst {
+			t.Errorf("%q not moved", f.GetName())
+		}
+	}
+	if files[4].GetName() != "renamed" {
+		t.Errorf("not renamed")
+	}
+	if m.FS.HashLookup(files[5].GetHash()) != nil {
+		t.Errorf("not deleted")
+	}
+	if files[6].parent != m.FS.GetTrash() {
+		t.Errorf("not trashed")
+	}
+}
+
+func TestBatchResults(t *testing.T) {
+	errs := batchResults([]byte(`[0,-9,{"u":"x"}]`), nil, 3)
+	if errs[0] != nil || errs[1] != ENOENT || errs[2] != nil {
+		t.Errorf("got %v", errs)
+	}
+	errs = batchResults([]byte(`[0]`), nil, 2)
+	if errs[0] != EBADRESP || errs[1] != EBADRESP {
+		t.Errorf("short reply: got %v", errs)
+	}
+	errs = batchResults(nil, ERATELIMIT, 2)
+	if errs[0] != ERATELIMIT || errs[1] != ERATELIMIT {
+		t.Errorf("whole request: got %v", errs)
+	}
+}
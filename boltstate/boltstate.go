@@ -0,0 +1,94 @@
+//go:build !js
+// +build !js
+
+// Package boltstate provides a mega.StateStore kept in a bolt database
+// which suits trees too large to hold in memory.
+package boltstate
+
+import (
+	"encoding/json"
+	"time"
+
+	mega "github.com/SeyitDurmus/go-mega"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name of the bucket holding the file states keyed by path
+var filesBucket = []byte("files")
+
+// Store is a mega.StateStore backed by a bolt database.  Every change is
+// committed as it is made.
+type Store struct {
+	db *bolt.DB
+}
+
+// check interface
+var _ mega.StateStore = (*Store)(nil)
+
+// Open opens or creates the bolt database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(filesBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Get returns the state for path
+func (s *Store) Get(path string) (state mega.FileState, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(filesBucket).Get([]byte(path))
+		if buf == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(buf, &state)
+	})
+	return state, ok, err
+}
+
+// Put stores the state
+func (s *Store) Put(state mega.FileState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Put([]byte(state.Path), buf)
+	})
+}
+
+// Delete removes the state for path
+func (s *Store) Delete(path string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Delete([]byte(path))
+	})
+}
+
+// Walk calls fn for each state in Path order.  fn runs inside a read
+// transaction so it must not modify the store.
+func (s *Store) Walk(fn func(state mega.FileState) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var state mega.FileState
+			err := json.Unmarshal(v, &state)
+			if err != nil {
+				return err
+			}
+			return fn(state)
+		})
+	})
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
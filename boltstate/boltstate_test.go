@@ -0,0 +1,66 @@
+//go:build !js
+// +build !js
+
+package boltstate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mega "github.com/SeyitDurmus/go-mega"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mega-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.db")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"b", "a", "c"} {
+		err = s.Put(mega.FileState{Path: p, Size: 1, Hash: "h" + p})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Delete("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	state, ok, err := s.Get("a")
+	if err != nil || !ok || state.Hash != "ha" {
+		t.Errorf("Get: %+v %v %v", state, ok, err)
+	}
+	if _, ok, _ := s.Get("c"); ok {
+		t.Errorf("deleted state still present")
+	}
+	var paths []string
+	err = s.Walk(func(state mega.FileState) error {
+		paths = append(paths, state.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != "a" || paths[1] != "b" {
+		t.Errorf("bad walk %v", paths)
+	}
+}
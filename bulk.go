@@ -0,0 +1,238 @@
+package mega
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// treeSize returns the total size of the files in n and below,
+// fetching any of them lazy loading has left out first
+func (fs *MegaFS) treeSize(n *Node) (size int64, err error) {
+	err = fs.loadTree(n)
+	if err != nil {
+		return 0, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n.ntype == FILE {
+			size += n.size
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(n)
+	return size, nil
+}
+
+// nodePath returns the slash separated path of n from the top of its
+// tree, eg "Cloud Drive/dir/file"
+func (fs *MegaFS) nodePath(n *Node) string {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.pathOf(n)
+}
+
+// pathOf returns the path of n like nodePath
+//
+// Call with the mutex held
+func (fs *MegaFS) pathOf(n *Node) string {
+	var names []string
+	for ; n != nil; n = n.parent {
+		names = append(names, n.name)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/")
+}
+
+// dirSyncer returns a Syncer which uploads the local directory srcpath
+// into a folder of the same name in parent.  The folder is created
+// unless planning, when the Syncer's remote may be nil.
+func (m *Mega) dirSyncer(srcpath string, parent *Node, plan *Plan) (*Syncer, error) {
+	if parent == nil {
+		return nil, EARGS
+	}
+	srcpath = longPath(srcpath)
+	fi, err := os.Stat(srcpath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, EARGS
+	}
+
+	s := &Syncer{
+		m:     m,
+		local: srcpath,
+		state: &JSONStateStore{states: make(map[string]FileState)},
+		plan:  plan,
+
+		FailureThreshold: m.getConfig().failureThreshold,
+	}
+	if plan != nil {
+		s.planned = make(map[string]bool)
+	}
+
+	name := remoteName(filepath.Base(srcpath))
+	s.remote = s.child(parent, name)
+	if s.remote != nil && !s.remote.IsFolder() {
+		return nil, EEXIST
+	}
+	if s.remote == nil {
+		if plan != nil {
+			plan.add(Action{Type: ACTION_MKDIR, Path: "."})
+		} else {
+			s.remote, err = m.CreateDir(name, parent)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// UploadDir uploads the local directory srcpath and everything below
+// it into a folder of the same name in parent, creating it if needed.
+// Files already there with the same name are replaced.
+//
+// Errors on individual files are logged and the upload carries on,
+// the first one is returned.  With WithFailureThreshold it stops with
+// ETOOMANYFAILURES once enough files have failed.
+func (m *Mega) UploadDir(srcpath string, parent *Node) error {
+	_, err := m.UploadDirReport(srcpath, parent)
+	return err
+}
+
+// UploadDirReport is UploadDir returning a report of what happened to
+// each file.  The report is nil if the upload couldn't start.
+func (m *Mega) UploadDirReport(srcpath string, parent *Node) (*Report, error) {
+	s, err := m.dirSyncer(srcpath, parent, nil)
+	if err != nil {
+		return nil, err
+	}
+	report := newReport(s.FailureThreshold)
+	s.report = report
+	return report, s.syncTree(".")
+}
+
+// PlanUploadDir returns what UploadDir would do without doing it.
+// Paths are relative to the folder being uploaded.
+func (m *Mega) PlanUploadDir(srcpath string, parent *Node) (*Plan, error) {
+	plan := &Plan{}
+	s, err := m.dirSyncer(srcpath, parent, plan)
+	if err != nil {
+		return nil, err
+	}
+	err = s.syncTree(".")
+	return plan, err
+}
+
+// dirMirror returns a Mirror which downloads the remote folder src
+// into a directory of the same name in dstpath
+func (m *Mega) dirMirror(src *Node, dstpath string, plan *Plan) (*Mirror, error) {
+	if src == nil || !src.IsFolder() {
+		return nil, EARGS
+	}
+	name := src.GetName()
+	if !safeName(name) {
+		return nil, EARGS
+	}
+	return &Mirror{
+		m:      m,
+		remote: src,
+		local:  longPath(filepath.Join(dstpath, localName(name))),
+		state:  &JSONStateStore{states: make(map[string]FileState)},
+		plan:   plan,
+		Dedupe: m.getConfig().dedupe,
+
+		FailureThreshold: m.getConfig().failureThreshold,
+	}, nil
+}
+
+// DownloadDir downloads the remote folder src and everything below it
+// into a directory of the same name in dstpath.  Local files with the
+// same names are replaced.
+//
+// Errors on individual files are logged and the download carries on,
+// the first one is returned.  With WithFailureThreshold it stops with
+// ETOOMANYFAILURES once enough files have failed.
+func (m *Mega) DownloadDir(src *Node, dstpath string) error {
+	_, err := m.DownloadDirReport(src, dstpath)
+	return err
+}
+
+// DownloadDirReport is DownloadDir returning a report of what happened
+// to each file.  The report is nil if the download couldn't start.
+func (m *Mega) DownloadDirReport(src *Node, dstpath string) (*Report, error) {
+	mr, err := m.dirMirror(src, dstpath, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(mr.local, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return mr.SyncReport()
+}
+
+// PlanDownloadDir returns what DownloadDir would do without doing it.
+// Paths are relative to the folder being downloaded.
+func (m *Mega) PlanDownloadDir(src *Node, dstpath string) (*Plan, error) {
+	plan := &Plan{}
+	mr, err := m.dirMirror(src, dstpath, plan)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(mr.local); os.IsNotExist(err) {
+		plan.add(Action{Type: ACTION_LOCAL_MKDIR, Path: "."})
+	}
+	err = mr.Sync()
+	return plan, err
+}
+
+// PlanDelete returns what DeleteNodes would do without doing it.
+// Paths are from the top of each node's tree.
+func (m *Mega) PlanDelete(nodes []*Node, destroy bool) (*Plan, error) {
+	t := ACTION_TRASH
+	if destroy {
+		t = ACTION_DELETE
+	}
+	plan := &Plan{}
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		size, err := m.FS.treeSize(n)
+		if err != nil {
+			return plan, err
+		}
+		plan.add(Action{Type: t, Path: m.FS.nodePath(n), Size: size})
+	}
+	return plan, nil
+}
+
+// DeleteNodes deletes each of the nodes as Delete does, carrying on
+// past failures.  The first error is returned.
+func (m *Mega) DeleteNodes(nodes []*Node, destroy bool) error {
+	var firstErr error
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		err := m.Delete(n, destroy)
+		if err != nil {
+			m.logf("delete %q: %v", n.GetName(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
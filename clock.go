@@ -0,0 +1,72 @@
+package mega
+
+import "time"
+
+// Clock tells the time and waits for the retries, backoff, batches,
+// transfers, syncs and keep alives.  The default is the system clock.
+// Setting another one is meant for testing these deterministically,
+// stepping the time on rather than waiting for it.  SetIDSource does
+// the same for the random IDs; keys are always random, see there.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After returns a channel which is sent the time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock using the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SetClock sets the clock used to tell the time and wait, nil for the
+// system clock
+func (m *Mega) SetClock(c Clock) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.clock = c
+	m.usage.setClock(m.config.timeSource())
+}
+
+// WithClock sets the clock used to tell the time and wait
+func WithClock(c Clock) Option {
+	return func(m *Mega) error {
+		m.config.clock = c
+		m.usage.setClock(m.config.timeSource())
+		return nil
+	}
+}
+
+// timeSource returns the clock, the system clock if none is set
+func (c *config) timeSource() Clock {
+	if c.clock != nil {
+		return c.clock
+	}
+	return systemClock{}
+}
+
+// now returns the time by the clock
+func (m *Mega) now() time.Time {
+	cfg := m.getConfig()
+	return cfg.timeSource().Now()
+}
+
+// after returns a channel which is sent the time once d has passed by
+// the clock
+func (m *Mega) after(d time.Duration) <-chan time.Time {
+	cfg := m.getConfig()
+	return cfg.timeSource().After(d)
+}
+
+// sleep waits for d by the clock
+func (m *Mega) sleep(d time.Duration) {
+	if d > 0 {
+		<-m.after(d)
+	}
+}
@@ -0,0 +1,104 @@
+package mega
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stepClock is a Clock which never waits, moving its time on by
+// whatever is waited for instead
+type stepClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stepClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *stepClock) waited() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+func TestClock(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	start := time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC)
+	clock := &stepClock{now: start}
+	m.SetClock(clock)
+	m.SetIDSource(&countingKeys{})
+	j := &memJournal{}
+	m.SetJournal(j)
+
+	// The server is busy twice so the request backs off
+	busy := 0
+	var ids []interface{}
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] != "p" {
+			return nil
+		}
+		if busy < 2 {
+			busy++
+			return ErrorMsg(-3)
+		}
+		ids = append(ids, cmd["i"])
+		return nil
+	}
+	b.mu.Unlock()
+
+	_, err := m.CreateDir("dir", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waits := clock.waited()
+	if len(waits) != 2 || waits[0] != minSleepTime || waits[1] != 2*minSleepTime {
+		t.Errorf("waited %v", waits)
+	}
+	now := start.Add(3 * minSleepTime)
+	if len(j.entries) != 1 || !j.entries[0].Time.Equal(now) {
+		t.Errorf("journal %+v, want time %v", j.entries, now)
+	}
+	if got := m.UsageToday().Date; got != "2020-02-29" {
+		t.Errorf("usage date %q", got)
+	}
+
+	// The IDs come from the ID source
+	want, _ := randString(&countingKeys{}, 10)
+	b.mu.Lock()
+	if len(ids) != 1 || ids[0] != want {
+		t.Errorf("request IDs %v, want %q", ids, want)
+	}
+	b.mu.Unlock()
+}
+
+func TestRateLimiterClock(t *testing.T) {
+	clock := &stepClock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(1000)
+	l.SetClock(clock)
+	l.SetSchedule([]RateWindow{{Start: 12 * time.Hour, End: 13 * time.Hour, Rate: 100}})
+
+	// the burst is 10 bytes so 110 bytes take a second
+	l.Wait(110)
+	waits := clock.waited()
+	if len(waits) != 1 || waits[0] != time.Second {
+		t.Errorf("waited %v, want [1s]", waits)
+	}
+}
@@ -0,0 +1,187 @@
+package mega
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Collision says what CreateDir and Move do when the folder they put a
+// node in already has one of the same name.  MEGA allows names to be
+// repeated, but most applications don't want them to be.
+type Collision int
+
+// Name collision modes
+const (
+	// Allow the name to be repeated, as MEGA does
+	COLLISION_ALLOW Collision = iota
+	// Fail with EEXIST
+	COLLISION_ERROR
+	// Add a number to the name, as in "report (1).txt"
+	COLLISION_RENAME
+	// Use the folder already there.  CreateDir returns it and Move
+	// moves what is in the folder moved into it, merging the folders
+	// below in turn, then moves the emptied folder to the trash.
+	// Files, which can't be merged, are renamed as with
+	// COLLISION_RENAME.
+	COLLISION_MERGE
+)
+
+// SetCollision sets what CreateDir and Move do when a name is already
+// taken in the destination folder.  Moves to the trash, which may hold
+// any number of nodes with the same name, are left alone, as are the
+// moves made by Batch and by the package itself, such as a Syncer
+// following a local rename or Staging.Abort putting a node back.
+//
+// Checking the name and creating or moving are separate requests, so
+// a node given the same name meanwhile by another client may still end
+// up next to the one made.
+func (m *Mega) SetCollision(mode Collision) error {
+	if !mode.valid() {
+		return EARGS
+	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.collision = mode
+	return nil
+}
+
+// WithCollision sets what CreateDir and Move do when a name is already
+// taken, see SetCollision
+func WithCollision(mode Collision) Option {
+	return func(m *Mega) error {
+		if !mode.valid() {
+			return EARGS
+		}
+		m.config.collision = mode
+		return nil
+	}
+}
+
+// valid returns true if mode is one of the modes
+func (mode Collision) valid() bool {
+	return mode >= COLLISION_ALLOW && mode <= COLLISION_MERGE
+}
+
+// childNamed returns the node called name in parent other than except,
+// nil if there is none
+func (m *Mega) childNamed(parent *Node, name string, except *Node) (*Node, error) {
+	children, err := m.FS.GetChildren(parent)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range children {
+		if c != except && c.GetName() == name {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// freeName returns name with a number added which isn't taken in
+// parent, before the extension if isFile
+func (m *Mega) freeName(parent *Node, name string, isFile bool) (string, error) {
+	children, err := m.FS.GetChildren(parent)
+	if err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool, len(children))
+	for _, c := range children {
+		taken[c.GetName()] = true
+	}
+	ext := ""
+	if isFile {
+		ext = path.Ext(name)
+		if ext == name {
+			// dot files like ".profile" have no extension
+			ext = ""
+		}
+	}
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !taken[candidate] {
+			return candidate, nil
+		}
+	}
+}
+
+// dirName returns the name for CreateDir to give a new folder called
+// name in parent, or the folder to return in its place
+func (m *Mega) dirName(name string, parent *Node) (string, *Node, error) {
+	mode := m.getConfig().collision
+	if mode == COLLISION_ALLOW || parent == nil {
+		return name, nil, nil
+	}
+	other, err := m.childNamed(parent, name, nil)
+	if err != nil || other == nil {
+		return name, nil, err
+	}
+	switch {
+	case mode == COLLISION_ERROR:
+		return "", nil, EEXIST
+	case mode == COLLISION_MERGE && other.GetType() == FOLDER:
+		return "", other, nil
+	}
+	name, err = m.freeName(parent, name, false)
+	return name, nil, err
+}
+
+// moveColliding moves src into parent dealing with a node of the same
+// name already there as mode says
+func (m *Mega) moveColliding(src *Node, parent *Node, mode Collision) error {
+	if mode == COLLISION_ALLOW || src == nil || parent == nil || parent == m.FS.GetTrash() {
+		return m.move(src, parent)
+	}
+	other, err := m.childNamed(parent, src.GetName(), src)
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return m.move(src, parent)
+	}
+	switch {
+	case mode == COLLISION_ERROR:
+		return EEXIST
+	case mode == COLLISION_MERGE && src.GetType() == FOLDER && other.GetType() == FOLDER:
+		return m.merge(src, other)
+	}
+	name, err := m.freeName(parent, src.GetName(), src.GetType() == FILE)
+	if err != nil {
+		return err
+	}
+	err = m.rename(src, name)
+	if err != nil {
+		return err
+	}
+	return m.move(src, parent)
+}
+
+// merge moves what is in the folder src into the folder dst, merging
+// the folders of the same name below, then moves src to the trash
+// rather than deleting it in case something was put in it meanwhile.
+// If it fails part way what has been moved stays moved.
+func (m *Mega) merge(src, dst *Node) error {
+	m.FS.mutex.Lock()
+	inside := false
+	for n := dst; n != nil; n = n.parent {
+		inside = inside || n == src
+	}
+	m.FS.mutex.Unlock()
+	if inside {
+		return EARGS
+	}
+
+	children, err := m.FS.GetChildren(src)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		err = m.moveColliding(c, dst, COLLISION_MERGE)
+		if err != nil {
+			return err
+		}
+	}
+	m.debugf("merged %d nodes from %s into %s", len(children), src.GetHash(), dst.GetHash())
+	return m.Delete(src, false)
+}
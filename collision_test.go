@@ -0,0 +1,103 @@
+package mega
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// childNames returns the sorted names of the children of n
+func childNames(t *testing.T, m *Mega, n *Node) []string {
+	children, err := m.FS.GetChildren(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range children {
+		names = append(names, c.GetName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCollision(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	root := m.FS.GetRoot()
+	mkdir := func(name string, parent *Node) *Node {
+		n, err := m.CreateDir(name, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Allowed by default
+	a := mkdir("a", root)
+	if a2 := mkdir("a", root); a2 == a {
+		t.Error("no second folder")
+	}
+	if err := m.SetCollision(Collision(9)); err != EARGS {
+		t.Errorf("bad mode: got %v", err)
+	}
+
+	if err := m.SetCollision(COLLISION_ERROR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateDir("a", root); err != EEXIST {
+		t.Errorf("CreateDir: got %v", err)
+	}
+	f := uploadString(t, m, a, "f.txt", "one")
+	uploadString(t, m, root, "f.txt", "two")
+	if err := m.Move(f, root); err != EEXIST {
+		t.Errorf("Move: got %v", err)
+	}
+	if err := m.Delete(f, false); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+
+	_ = m.SetCollision(COLLISION_RENAME)
+	mkdir("b", root)
+	if n := mkdir("b", root); n.GetName() != "b (1)" {
+		t.Errorf("CreateDir made %q", n.GetName())
+	}
+	g := uploadString(t, m, a, "f.txt", "three")
+	if err := m.Move(g, root); err != nil {
+		t.Fatal(err)
+	}
+	if g.GetName() != "f (1).txt" {
+		t.Errorf("Move renamed to %q", g.GetName())
+	}
+
+	// src/c/{p.txt,sub/q.txt} merged into dst/c/{p.txt,sub/r.txt}
+	_ = m.SetCollision(COLLISION_MERGE)
+	src, dst := mkdir("src", root), mkdir("dst", root)
+	c := mkdir("c", src)
+	uploadString(t, m, c, "p.txt", "p1")
+	uploadString(t, m, mkdir("sub", c), "q.txt", "q")
+	dc := mkdir("c", dst)
+	uploadString(t, m, dc, "p.txt", "p2")
+	dsub := mkdir("sub", dc)
+	uploadString(t, m, dsub, "r.txt", "r")
+	if n := mkdir("c", dst); n != dc {
+		t.Error("CreateDir didn't return the folder there")
+	}
+	if err := m.Move(c, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := childNames(t, m, dc); !reflect.DeepEqual(got, []string{"p (1).txt", "p.txt", "sub"}) {
+		t.Errorf("merged %v", got)
+	}
+	if got := childNames(t, m, dsub); !reflect.DeepEqual(got, []string{"q.txt", "r.txt"}) {
+		t.Errorf("merged sub %v", got)
+	}
+	if got := childNames(t, m, src); len(got) != 0 {
+		t.Errorf("left %v", got)
+	}
+	b.mu.Lock()
+	trashed := b.nodes[c.GetHash()] != nil && b.nodes[c.GetHash()].Parent == fakeTrash
+	b.mu.Unlock()
+	if !trashed {
+		t.Error("merged folder not moved to the trash")
+	}
+}
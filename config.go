@@ -0,0 +1,364 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// Config is the configuration of a client which can be kept in a file,
+// so deployments can manage worker counts, limits, endpoints and
+// filters declaratively.  It holds nothing secret: the session, keys
+// and credentials aren't part of it, and neither are the hooks, clocks
+// and HTTP clients which can only be set in code.
+//
+// As JSON the durations are strings such as "90s" and the field names
+// are those of the tags, for example
+//
+//	{
+//	  "api_url": "https://g.api.mega.co.nz",
+//	  "download_workers": 6,
+//	  "upload_workers": 4,
+//	  "timeout": "30s",
+//	  "rate_limit": 1048576,
+//	  "rate_schedule": [{"start": "22h", "end": "6h", "rate": 0}],
+//	  "filter": {"deny": ["*.tmp"], "max_size": 1073741824}
+//	}
+//
+// Fields left out keep the value they had, so a file only needs what
+// differs from DefaultConfig.
+type Config struct {
+	// Base URL of the API, see SetAPIUrl
+	APIURL string `json:"api_url"`
+	// Retries of API calls and chunk transfers
+	Retries int `json:"retries"`
+	// Workers per download and upload, and goroutines decrypting
+	// each download, 0 for one per CPU
+	DownloadWorkers int `json:"download_workers"`
+	UploadWorkers   int `json:"upload_workers"`
+	DecryptWorkers  int `json:"decrypt_workers"`
+	// Connection timeout of the default HTTP clients, only used by New
+	Timeout time.Duration `json:"timeout"`
+	// Whether https is used for transfers
+	HTTPS bool `json:"https"`
+	// Application key sent with each API request
+	AppID string `json:"app_id,omitempty"`
+	// See SetReadOnly, WithLazyLoading and SetStrictDecoding.
+	// LazyLoading only has an effect when logging in.
+	ReadOnly       bool `json:"read_only,omitempty"`
+	LazyLoading    bool `json:"lazy_loading,omitempty"`
+	StrictDecoding bool `json:"strict_decoding,omitempty"`
+	// What to do with files downloaded twice, see WithDownloadDedupe
+	DownloadDedupe DedupeMode `json:"download_dedupe,omitempty"`
+	// What CreateDir and Move do with names already taken, see
+	// SetCollision
+	Collision Collision `json:"collision,omitempty"`
+	// Failures before bulk operations stop, see WithFailureThreshold
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// Temporary directory and the most spooled to a file in it, see
+	// SetTempDir
+	TempDir  string `json:"temp_dir,omitempty"`
+	MaxSpill int64  `json:"max_spill,omitempty"`
+	// Directory and size of the thumbnail cache, see
+	// SetThumbnailCache
+	ThumbnailCache     string `json:"thumbnail_cache,omitempty"`
+	ThumbnailCacheSize int64  `json:"thumbnail_cache_size,omitempty"`
+	// Storage connections open at once, see SetMaxConnections
+	MaxConnections int `json:"max_connections,omitempty"`
+	// Memory for chunk buffers and caches, see SetMemoryLimit
+	MemoryLimit int64 `json:"memory_limit,omitempty"`
+	// Bandwidth limit in bytes per second and the windows of the day
+	// with their own, see RateLimiter.  They are set on the client's
+	// RateLimiter, which is made if it has none and there is a limit.
+	RateLimit    int64        `json:"rate_limit,omitempty"`
+	RateSchedule []RateWindow `json:"rate_schedule,omitempty"`
+	// Files turned down by name and size, nil for none.  Other
+	// ContentFilters can only be set in code and aren't exported.
+	Filter *PatternFilter `json:"filter,omitempty"`
+}
+
+// rateWindowJSON is a RateWindow as it is kept in a Config file
+type rateWindowJSON struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Rate  int64  `json:"rate"`
+}
+
+// DefaultConfig returns the configuration of a client made by New
+// with no options
+func DefaultConfig() Config {
+	return Config{
+		APIURL:          API_URL,
+		Retries:         RETRIES,
+		DownloadWorkers: DOWNLOAD_WORKERS,
+		UploadWorkers:   UPLOAD_WORKERS,
+		Timeout:         TIMEOUT,
+		HTTPS:           HTTPSONLY,
+	}
+}
+
+// MarshalJSON writes c with its durations as strings
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	schedule := make([]rateWindowJSON, len(c.RateSchedule))
+	for i, w := range c.RateSchedule {
+		schedule[i] = rateWindowJSON{Start: w.Start.String(), End: w.End.String(), Rate: w.Rate}
+	}
+	return json.Marshal(struct {
+		plain
+		Timeout      string           `json:"timeout"`
+		RateSchedule []rateWindowJSON `json:"rate_schedule,omitempty"`
+	}{plain(c), c.Timeout.String(), schedule})
+}
+
+// UnmarshalJSON reads c as written by MarshalJSON.  Fields which
+// aren't in buf are left as they are and unknown ones are an error, as
+// they are likely misspelt.
+func (c *Config) UnmarshalJSON(buf []byte) error {
+	type plain Config
+	aux := struct {
+		*plain
+		Timeout      *string          `json:"timeout"`
+		RateSchedule []rateWindowJSON `json:"rate_schedule"`
+	}{plain: (*plain)(c)}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&aux)
+	if err != nil {
+		return err
+	}
+	if aux.Timeout != nil {
+		c.Timeout, err = time.ParseDuration(*aux.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	if aux.RateSchedule != nil {
+		c.RateSchedule = make([]RateWindow, len(aux.RateSchedule))
+		for i, w := range aux.RateSchedule {
+			start, err := time.ParseDuration(w.Start)
+			if err != nil {
+				return err
+			}
+			end, err := time.ParseDuration(w.End)
+			if err != nil {
+				return err
+			}
+			c.RateSchedule[i] = RateWindow{Start: start, End: end, Rate: w.Rate}
+		}
+	}
+	return nil
+}
+
+// LoadConfig reads the JSON configuration file at path, as written by
+// json.Marshal of a Config, over DefaultConfig.  Pass it to WithConfig
+// when making the client or to SetConfig to change a running one, say
+// when a daemon is told to reload.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(buf, &c)
+	return c, err
+}
+
+// Config returns the configuration of the client, for saving with
+// json.Marshal
+func (m *Mega) Config() Config {
+	cfg := m.getConfig()
+	c := Config{
+		APIURL:           cfg.baseurl,
+		Retries:          cfg.retries,
+		DownloadWorkers:  cfg.dl_workers,
+		UploadWorkers:    cfg.ul_workers,
+		DecryptWorkers:   cfg.cpu_workers,
+		Timeout:          cfg.timeout,
+		HTTPS:            cfg.https,
+		AppID:            cfg.appid,
+		ReadOnly:         cfg.readonly,
+		LazyLoading:      cfg.lazy,
+		StrictDecoding:   cfg.strict,
+		DownloadDedupe:   cfg.dedupe,
+		Collision:        cfg.collision,
+		FailureThreshold: cfg.failureThreshold,
+		TempDir:          cfg.tempDir,
+		MaxSpill:         cfg.maxSpill,
+	}
+	if cfg.thumbs != nil {
+		c.ThumbnailCache = cfg.thumbs.dir
+		c.ThumbnailCacheSize = cfg.thumbs.max
+	}
+	if l := cfg.limiter; l != nil {
+		l.mu.Lock()
+		c.RateLimit = l.rate
+		c.RateSchedule = append([]RateWindow(nil), l.schedule...)
+		l.mu.Unlock()
+	}
+	if f, ok := cfg.filter.(*PatternFilter); ok {
+		c.Filter = f.clone()
+	}
+	m.conns.mu.Lock()
+	c.MaxConnections = m.conns.max
+	m.conns.mu.Unlock()
+	m.mem.mu.Lock()
+	c.MemoryLimit = m.mem.max
+	m.mem.mu.Unlock()
+	return c
+}
+
+// SetConfig changes the configuration of the client to c, as a whole
+// or not at all if any of it is invalid.  Transfers and requests
+// already started carry on as they were.
+func (m *Mega) SetConfig(c Config) error {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.applyConfig(c)
+}
+
+// WithConfig configures the client with c, see SetConfig.  Options
+// after it change what it sets.
+func WithConfig(c Config) Option {
+	return func(m *Mega) error {
+		return m.applyConfig(c)
+	}
+}
+
+// applyConfig checks c and sets it
+//
+// Call with configMu held or from an Option
+func (m *Mega) applyConfig(c Config) error {
+	switch {
+	case c.APIURL == "":
+		return EARGS
+	case c.Retries < 0, c.DecryptWorkers < 0, c.Timeout < 0, c.FailureThreshold < 0:
+		return EARGS
+	case c.MaxSpill < 0, c.MaxConnections < 0, c.MemoryLimit < 0, c.RateLimit < 0:
+		return EARGS
+	case c.DownloadDedupe < DEDUPE_OFF || c.DownloadDedupe > DEDUPE_COPY:
+		return EARGS
+	case !c.Collision.valid():
+		return EARGS
+	case c.DownloadWorkers < 1 || c.UploadWorkers < 1:
+		return EARGS
+	}
+	if c.Filter != nil {
+		if err := c.Filter.check(); err != nil {
+			return err
+		}
+	}
+	cfg := m.config
+	err := cfg.setDownloadWorkers(c.DownloadWorkers)
+	if err != nil {
+		return err
+	}
+	err = cfg.setUploadWorkers(c.UploadWorkers)
+	if err != nil {
+		return err
+	}
+	thumbs := cfg.thumbs
+	if thumbs == nil || thumbs.dir != c.ThumbnailCache || thumbs.max != c.ThumbnailCacheSize {
+		thumbs, err = newThumbCache(c.ThumbnailCache, c.ThumbnailCacheSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.setAPIUrl(c.APIURL)
+	cfg.retries = c.Retries
+	cfg.cpu_workers = c.DecryptWorkers
+	cfg.timeout = c.Timeout
+	cfg.https = c.HTTPS
+	cfg.appid = c.AppID
+	cfg.readonly = c.ReadOnly
+	cfg.lazy = c.LazyLoading
+	cfg.strict = c.StrictDecoding
+	cfg.dedupe = c.DownloadDedupe
+	cfg.collision = c.Collision
+	cfg.failureThreshold = c.FailureThreshold
+	cfg.tempDir = c.TempDir
+	cfg.maxSpill = c.MaxSpill
+	cfg.thumbs = thumbs
+	if c.Filter != nil {
+		cfg.filter = c.Filter.clone()
+	} else if _, ok := cfg.filter.(*PatternFilter); ok {
+		cfg.filter = nil
+	}
+	if cfg.limiter == nil && (c.RateLimit > 0 || len(c.RateSchedule) > 0) {
+		cfg.limiter = NewRateLimiter(0)
+	}
+	if cfg.limiter != nil {
+		cfg.limiter.SetRate(c.RateLimit)
+		cfg.limiter.SetSchedule(c.RateSchedule)
+	}
+	m.config = cfg
+	m.conns.setMax(c.MaxConnections)
+	m.mem.setMax(c.MemoryLimit)
+	return nil
+}
+
+// PatternFilter is a ContentFilter which turns down files by their
+// name and size, for setting in a Config.  Files turned down fail with
+// a *FilterError wrapping EFILTERED.
+type PatternFilter struct {
+	// Files whose name matches any of these patterns, as in
+	// path.Match, are turned down
+	Deny []string `json:"deny,omitempty"`
+	// Files bigger than this are turned down, 0 for no limit
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// check returns an error if a pattern of f is malformed
+func (f *PatternFilter) check() error {
+	if f.MaxSize < 0 {
+		return EARGS
+	}
+	for _, p := range f.Deny {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of f so the one in the configuration can't be
+// changed from outside
+func (f *PatternFilter) clone() *PatternFilter {
+	return &PatternFilter{Deny: append([]string(nil), f.Deny...), MaxSize: f.MaxSize}
+}
+
+// allowed returns EFILTERED if the file name of size bytes is turned
+// down
+func (f *PatternFilter) allowed(name string, size int64) error {
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return EFILTERED
+	}
+	for _, p := range f.Deny {
+		if ok, _ := path.Match(p, name); ok {
+			return EFILTERED
+		}
+	}
+	return nil
+}
+
+// CheckUpload turns down the file name if it is denied or too big
+func (f *PatternFilter) CheckUpload(name string, r io.Reader) error {
+	var size int64
+	if f.MaxSize > 0 {
+		var err error
+		size, err = io.Copy(ioutil.Discard, io.LimitReader(r, f.MaxSize+1))
+		if err != nil {
+			return err
+		}
+	}
+	return f.allowed(name, size)
+}
+
+// CheckDownload turns down the file n if it is denied or too big
+func (f *PatternFilter) CheckDownload(n *Node, r io.Reader) error {
+	return f.allowed(n.GetName(), n.GetSize())
+}
@@ -0,0 +1,136 @@
+package mega
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mega-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if got := New(WithLogger(nil)).Config(); !reflect.DeepEqual(got, DefaultConfig()) {
+		t.Errorf("new client: got %+v", got)
+	}
+
+	// Only what differs from the defaults in the file
+	path := filepath.Join(dir, "mega.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"download_workers": 2,
+		"timeout": "90s",
+		"max_connections": 3,
+		"rate_limit": 1000,
+		"rate_schedule": [{"start": "22h", "end": "6h", "rate": 0}],
+		"filter": {"deny": ["*.tmp"]}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.DownloadWorkers = 2
+	want.Timeout = 90 * time.Second
+	want.MaxConnections = 3
+	want.RateLimit = 1000
+	want.RateSchedule = []RateWindow{{Start: 22 * time.Hour, End: 6 * time.Hour}}
+	want.Filter = &PatternFilter{Deny: []string{"*.tmp"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("loaded %+v", c)
+	}
+
+	m := New(WithLogger(nil), WithConfig(c))
+	got := m.Config()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %+v", got)
+	}
+	buf, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Config
+	if err = json.Unmarshal(buf, &back); err != nil || !reflect.DeepEqual(back, want) {
+		t.Errorf("round trip of %s: %+v, %v", buf, back, err)
+	}
+
+	// Invalid settings change nothing
+	for _, bad := range []string{
+		`{"upload_workers": 0}`,
+		`{"download_workers": 1000}`,
+		`{"filter": {"deny": ["["]}}`,
+	} {
+		c := m.Config()
+		if err = json.Unmarshal([]byte(bad), &c); err != nil {
+			t.Fatal(err)
+		}
+		if err = m.SetConfig(c); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+		if !reflect.DeepEqual(m.Config(), want) {
+			t.Errorf("%s: changed to %+v", bad, m.Config())
+		}
+	}
+	for _, bad := range []string{`{"download_worker": 2}`, `{"timeout": "soon"}`} {
+		c := m.Config()
+		if err = json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+
+	// The limiter is kept and changed, the filter removed
+	limiter := m.getConfig().limiter
+	c = m.Config()
+	c.RateLimit = 2000
+	c.Filter = nil
+	if err = m.SetConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	cfg := m.getConfig()
+	if cfg.limiter != limiter || limiter.Rate() == 1000 || cfg.filter != nil {
+		t.Errorf("limiter %p rate %d filter %v", cfg.limiter, cfg.limiter.Rate(), cfg.filter)
+	}
+}
+
+func TestPatternFilter(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	c := m.Config()
+	c.Filter = &PatternFilter{Deny: []string{"*.tmp"}, MaxSize: 10}
+	if err := m.SetConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mega-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	randomFile(t, dir, "a.tmp", 5)
+	randomFile(t, dir, "big.bin", 11)
+	data := randomFile(t, dir, "ok.bin", 10)
+
+	root := m.FS.GetRoot()
+	for _, name := range []string{"a.tmp", "big.bin"} {
+		_, err = m.UploadFile(filepath.Join(dir, name), root, "", nil)
+		var fe *FilterError
+		if !errors.As(err, &fe) || !errors.Is(err, EFILTERED) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	n, err := m.UploadFile(filepath.Join(dir, "ok.bin"), root, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "out.bin"), data)
+}
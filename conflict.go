@@ -0,0 +1,90 @@
+package mega
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conflict records a file which changed both locally and remotely
+// since it was last synced.  Both versions are kept: the original path
+// has one and ConflictPath the other.
+type Conflict struct {
+	// Path of the file relative to the root of the sync
+	Path string
+	// Path the other version was saved under
+	ConflictPath string
+	// Time the conflict was found
+	Time time.Time
+}
+
+// conflictReport collects the conflicts found by a Syncer or Mirror
+type conflictReport struct {
+	mu        sync.Mutex
+	conflicts []Conflict
+
+	// OnConflict is called for each conflict found if set
+	OnConflict func(Conflict)
+	// ConflictUser is put in the name of conflict copies, the local
+	// user name if empty
+	ConflictUser string
+}
+
+// Conflicts returns the conflicts found since the last call
+func (r *conflictReport) Conflicts() []Conflict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conflicts := r.conflicts
+	r.conflicts = nil
+	return conflicts
+}
+
+// add records a conflict
+func (r *conflictReport) add(c Conflict) {
+	r.mu.Lock()
+	r.conflicts = append(r.conflicts, c)
+	fn := r.OnConflict
+	r.mu.Unlock()
+	if fn != nil {
+		fn(c)
+	}
+}
+
+// user returns the name to put in conflict copies
+func (r *conflictReport) user() string {
+	if r.ConflictUser != "" {
+		return r.ConflictUser
+	}
+	for _, env := range []string{"USER", "USERNAME"} {
+		if u := os.Getenv(env); u != "" {
+			return u
+		}
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "unknown"
+}
+
+// conflictName returns the name for the conflict copy of the slash
+// separated path rel, eg "dir/report (conflict 2006-01-02 user).txt".
+// If the name is taken according to exists a number is added.
+func conflictName(rel string, t time.Time, user string, exists func(string) bool) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	if ext == name {
+		// dot files like ".profile" have no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	tag := fmt.Sprintf("conflict %s %s", t.Format("2006-01-02"), user)
+
+	candidate := fmt.Sprintf("%s%s (%s)%s", dir, base, tag, ext)
+	for i := 2; exists(candidate); i++ {
+		candidate = fmt.Sprintf("%s%s (%s %d)%s", dir, base, tag, i, ext)
+	}
+	return candidate
+}
@@ -0,0 +1,199 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestConflictName(t *testing.T) {
+	when := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	none := func(string) bool { return false }
+	for _, test := range []struct {
+		in   string
+		want string
+	}{
+		{"report.txt", "report (conflict 2021-03-04 bob).txt"},
+		{"dir/archive.tar.gz", "dir/archive.tar (conflict 2021-03-04 bob).gz"},
+		{"noext", "noext (conflict 2021-03-04 bob)"},
+		{"dir/.profile", "dir/.profile (conflict 2021-03-04 bob)"},
+	} {
+		got := conflictName(test.in, when, "bob", none)
+		if got != test.want {
+			t.Errorf("%q: want %q got %q", test.in, test.want, got)
+		}
+	}
+
+	taken := map[string]bool{"a (conflict 2021-03-04 bob).txt": true}
+	got := conflictName("a.txt", when, "bob", func(p string) bool { return taken[p] })
+	if want := "a (conflict 2021-03-04 bob 2).txt"; got != want {
+		t.Errorf("want %q got %q", want, got)
+	}
+}
+
+// replaceRemote replaces the remote file at rel below root with a new
+// upload as another client would
+func replaceRemote(t *testing.T, m *Mega, root *Node, rel, data string) {
+	nodes, err := m.FS.PathLookup(root, []string{rel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, root, path.Base(rel), data)
+	err = m.Delete(nodes[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncerConflict(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.txt", "original")
+
+	root := m.FS.GetRoot()
+	s, err := m.NewSyncer(dir, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ConflictUser = "tester"
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaceRemote(t, m, root, "a.txt", "remote edit")
+	writeFile(t, dir, "a.txt", "local edit!")
+	remote := b.lookupPath(m, "a.txt")
+
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts := s.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Path != "a.txt" {
+		t.Fatalf("bad conflicts %+v", conflicts)
+	}
+	cname := conflicts[0].ConflictPath
+	if b.lookupPath(m, "a.txt") != remote {
+		t.Errorf("remote version was replaced")
+	}
+	h := b.lookupPath(m, cname)
+	if h == "" {
+		t.Fatalf("conflict copy %q not uploaded", cname)
+	}
+	if data, _ := b.content(h); len(data) != len("local edit!") {
+		t.Errorf("conflict copy has wrong contents")
+	}
+	if readString(dir, cname) != "local edit!" {
+		t.Errorf("local file not renamed")
+	}
+
+	// Nothing more happens on the next pass
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.lookupPath(m, "a.txt") != remote || b.lookupPath(m, cname) != h {
+		t.Errorf("conflict resolution not stable")
+	}
+}
+
+func TestSyncerRemoteOnlyChange(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.txt", "original")
+
+	root := m.FS.GetRoot()
+	s, err := m.NewSyncer(dir, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := m.FS.HashLookup(b.lookupPath(m, "a.txt"))
+
+	// The remote copy is replaced and the synced version is gone for
+	// good while the local file is left untouched
+	replaceRemote(t, m, root, "a.txt", "remote edit")
+	err = m.Delete(old, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflicts := s.Conflicts(); len(conflicts) != 0 {
+		t.Errorf("untouched file made a conflict %+v", conflicts)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || readString(dir, "a.txt") != "original" {
+		t.Errorf("local files changed")
+	}
+	if data, _ := b.content(b.lookupPath(m, "a.txt")); len(data) != len("original") {
+		t.Errorf("remote copy not synced from the local file")
+	}
+}
+
+func TestMirrorConflict(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	uploadString(t, m, root, "a.txt", "original")
+
+	dir, err := ioutil.TempDir("", "mega-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mr, err := m.NewMirror(root, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.ConflictUser = "tester"
+	var reported []Conflict
+	mr.OnConflict = func(c Conflict) { reported = append(reported, c) }
+	err = mr.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaceRemote(t, m, root, "a.txt", "remote edit")
+	writeFile(t, dir, "a.txt", "local edit!")
+
+	err = mr.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 {
+		t.Fatalf("bad conflicts %+v", reported)
+	}
+	if got := readString(dir, "a.txt"); got != "remote edit" {
+		t.Errorf("remote version not downloaded: %q", got)
+	}
+	if got := readString(dir, reported[0].ConflictPath); got != "local edit!" {
+		t.Errorf("local version not kept: %q", got)
+	}
+}
@@ -0,0 +1,89 @@
+package mega
+
+import "sync"
+
+// connLimiter limits the number of connections open at once
+type connLimiter struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	max     int // 0 for unlimited
+	active  int
+}
+
+// newConnLimiter returns a limiter allowing max connections, 0 for
+// unlimited
+func newConnLimiter(max int) *connLimiter {
+	l := &connLimiter{max: max}
+	l.changed = sync.NewCond(&l.mu)
+	return l
+}
+
+// setMax changes the limit.  Connections already open over a lowered
+// limit carry on and new ones wait for them to finish.
+func (l *connLimiter) setMax(max int) {
+	l.mu.Lock()
+	l.max = max
+	l.changed.Broadcast()
+	l.mu.Unlock()
+}
+
+// acquire waits until a connection may be opened.  A nil limiter
+// doesn't limit.
+func (l *connLimiter) acquire() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for l.max > 0 && l.active >= l.max {
+		l.changed.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+// release marks a connection from acquire as finished
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.active--
+	l.changed.Signal()
+	l.mu.Unlock()
+}
+
+// SetMaxConnections limits the number of connections to MEGA storage
+// open at once across all the transfers, 0 for unlimited.  Transfers
+// still use up to their number of workers but wait for a connection
+// before fetching or sending each chunk.
+//
+// API requests aren't counted.
+func (m *Mega) SetMaxConnections(n int) {
+	m.conns.setMax(n)
+}
+
+// WithMaxConnections limits the number of storage connections open at
+// once across all transfers
+func WithMaxConnections(n int) Option {
+	return func(m *Mega) error {
+		if n < 0 {
+			return EARGS
+		}
+		m.conns.setMax(n)
+		return nil
+	}
+}
+
+// SetMaxConnections limits the number of connections this download
+// opens at once, 0 for no limit other than the one set on the Mega.
+// It is useful when calling DownloadChunk from many goroutines.
+func (d *Download) SetMaxConnections(n int) {
+	d.conns.setMax(n)
+}
+
+// SetMaxConnections limits the number of connections this upload
+// opens at once, 0 for no limit other than the one set on the Mega.
+// It is useful when calling UploadChunk from many goroutines.
+func (u *Upload) SetMaxConnections(n int) {
+	u.conns.setMax(n)
+}
@@ -0,0 +1,173 @@
+package mega
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countConns makes the fake's downloads slow and records the most
+// running at once
+func countConns(b *fakeBackend) (peak func() int) {
+	var mu sync.Mutex
+	active, max := 0, 0
+	b.mu.Lock()
+	b.beforeDownload = func(h string, start int) {
+		mu.Lock()
+		active++
+		if active > max {
+			max = active
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}
+	b.mu.Unlock()
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return max
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	_ = m.SetDownloadWorkers(8)
+
+	dir, err := ioutil.TempDir("", "mega-conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	randomFile(t, dir, "a.bin", 3000000)
+	randomFile(t, dir, "b.bin", 3000000)
+	var nodes []*Node
+	for _, name := range []string{"a.bin", "b.bin"} {
+		n, err := m.UploadFile(filepath.Join(dir, name), m.FS.GetRoot(), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	peak := countConns(b)
+	m.SetMaxConnections(3)
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *Node) {
+			defer wg.Done()
+			err := m.DownloadFile(n, filepath.Join(dir, n.GetName()+".out"), nil)
+			if err != nil {
+				t.Errorf("download %d: %v", i, err)
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	if got := peak(); got != 3 {
+		t.Errorf("%d connections at once, want 3", got)
+	}
+}
+
+func TestDownloadMaxConnections(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	randomFile(t, dir, "a.bin", 3000000)
+	n, err := m.UploadFile(filepath.Join(dir, "a.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peak := countConns(b)
+	d, err := m.NewDownload(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetMaxConnections(2)
+	var wg sync.WaitGroup
+	for id := 0; id < d.Chunks(); id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_, err := d.DownloadChunk(id)
+			if err != nil {
+				t.Errorf("chunk %d: %v", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	if got := peak(); got != 2 {
+		t.Errorf("%d connections at once, want 2", got)
+	}
+}
+
+// stallTransport holds up every request until released
+type stallTransport struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestStorageClient(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if m.storage == m.client {
+		t.Fatal("API and storage traffic share a client")
+	}
+
+	dir, err := ioutil.TempDir("", "mega-conns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "a.bin", 100000)
+	n, err := m.UploadFile(filepath.Join(dir, "a.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// API calls go through while the download is stuck
+	stall := &stallTransport{started: make(chan struct{}, 16), release: make(chan struct{})}
+	m.SetStorageClient(&http.Client{Transport: stall})
+	done := make(chan error, 1)
+	go func() {
+		done <- m.DownloadFile(n, filepath.Join(dir, "a.out"), nil)
+	}()
+	<-stall.started
+	if _, err = m.CreateDir("while stalled", m.FS.GetRoot()); err != nil {
+		t.Errorf("CreateDir: %v", err)
+	}
+	close(stall.release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "a.out"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs: %v", err)
+	}
+
+	client := &http.Client{}
+	m.SetClient(client)
+	if m.client != client || m.storage != client {
+		t.Errorf("SetClient didn't set both clients")
+	}
+}
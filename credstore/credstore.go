@@ -0,0 +1,349 @@
+// Package credstore keeps the credentials of programs built on go-mega,
+// such as a saved session or the master key, encrypted at rest so each
+// CLI and daemon needn't invent its own storage.
+//
+// A Store holds named secrets.  FileStore keeps them in a single file
+// encrypted with a key derived from a passphrase, KeyringStore in the
+// OS keyring through the Keyring interface, which wraps whichever
+// keyring package the program already uses.  For example with
+// github.com/zalando/go-keyring
+//
+//	type osKeyring struct{}
+//
+//	func (osKeyring) Get(service, user string) (string, error) {
+//		s, err := keyring.Get(service, user)
+//		if err == keyring.ErrNotFound {
+//			return "", credstore.ErrNotFound
+//		}
+//		return s, err
+//	}
+//
+//	func (osKeyring) Set(service, user, secret string) error {
+//		return keyring.Set(service, user, secret)
+//	}
+//
+//	func (osKeyring) Delete(service, user string) error {
+//		err := keyring.Delete(service, user)
+//		if err == keyring.ErrNotFound {
+//			return nil
+//		}
+//		return err
+//	}
+package credstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// ErrNotFound is returned for a secret which isn't stored
+	ErrNotFound = errors.New("credstore: secret not found")
+	// ErrPassphrase is returned when a FileStore can't be decrypted,
+	// because the passphrase is wrong or the file was changed
+	ErrPassphrase = errors.New("credstore: wrong passphrase or corrupt store")
+)
+
+// Store keeps named secrets
+type Store interface {
+	// Get returns the secret called name or ErrNotFound
+	Get(name string) ([]byte, error)
+	// Put stores secret as name replacing any already there
+	Put(name string, secret []byte) error
+	// Delete removes the secret called name if there is one
+	Delete(name string) error
+}
+
+// Parameters of scrypt for new FileStores.  Those a file was written
+// with are kept in it so these can be raised later.
+const (
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+)
+
+// Version of the FileStore file format
+const fileVersion = 1
+
+// fileFormat is a FileStore as kept on disk.  Data is the secrets as
+// JSON sealed with AES-256-GCM under a key derived from the passphrase
+// and Salt with scrypt.
+type fileFormat struct {
+	Version int    `json:"version"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// FileStore is a Store kept in a file encrypted with a passphrase.
+// Each change rewrites the whole file, readable by the owner only,
+// replacing it atomically.
+type FileStore struct {
+	path       string
+	passphrase []byte
+
+	mu sync.Mutex
+	// parameters of the file and the key derived from them, nil
+	// until the file is read or first written
+	f   fileFormat
+	key []byte
+}
+
+// check interface
+var _ Store = (*FileStore)(nil)
+
+// NewFileStore returns a FileStore kept at path, which is created by
+// the first Put, encrypted with passphrase
+func NewFileStore(path string, passphrase []byte) *FileStore {
+	return &FileStore{
+		path:       path,
+		passphrase: append([]byte(nil), passphrase...),
+	}
+}
+
+// deriveKey sets the key for the parameters in f
+//
+// Call with the mutex held
+func (s *FileStore) deriveKey(f fileFormat) error {
+	if s.key != nil && s.f.N == f.N && s.f.R == f.R && s.f.P == f.P && string(s.f.Salt) == string(f.Salt) {
+		return nil
+	}
+	key, err := scrypt.Key(s.passphrase, f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return err
+	}
+	s.f, s.key = f, key
+	return nil
+}
+
+// aead returns the cipher sealing the secrets
+//
+// Call with the mutex held
+func (s *FileStore) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load returns the secrets in the file, none if there isn't one yet
+//
+// Call with the mutex held
+func (s *FileStore) load() (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f fileFormat
+	err = json.Unmarshal(buf, &f)
+	if err != nil || f.Version != fileVersion {
+		return nil, ErrPassphrase
+	}
+	err = s.deriveKey(f)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, ErrPassphrase
+	}
+	data, err := aead.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	err = json.Unmarshal(data, &secrets)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return secrets, nil
+}
+
+// save writes secrets to the file, with a new salt if it has none
+//
+// Call with the mutex held
+func (s *FileStore) save(secrets map[string][]byte) error {
+	if s.key == nil {
+		salt := make([]byte, 16)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return err
+		}
+		err = s.deriveKey(fileFormat{Version: fileVersion, N: SCRYPT_N, R: SCRYPT_R, P: SCRYPT_P, Salt: salt})
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	aead, err := s.aead()
+	if err != nil {
+		return err
+	}
+	f := s.f
+	f.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(f.Nonce)
+	if err != nil {
+		return err
+	}
+	f.Data = aead.Seal(nil, f.Nonce, data, nil)
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// Write alongside then rename so the store is never half written
+	dir := filepath.Dir(s.path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Get returns the secret called name or ErrNotFound
+func (s *FileStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := secrets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return secret, nil
+}
+
+// Put stores secret as name replacing any already there
+func (s *FileStore) Put(name string, secret []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	secrets[name] = secret
+	return s.save(secrets)
+}
+
+// Delete removes the secret called name if there is one
+func (s *FileStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return nil
+	}
+	delete(secrets, name)
+	return s.save(secrets)
+}
+
+// ChangePassphrase encrypts the store with passphrase from now on,
+// rewriting the file if there is one
+func (s *FileStore) ChangePassphrase(passphrase []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	// the key is only set once there is a file
+	exists := s.key != nil
+	s.passphrase = append([]byte(nil), passphrase...)
+	s.f, s.key = fileFormat{}, nil
+	if !exists {
+		return nil
+	}
+	return s.save(secrets)
+}
+
+// Keyring is an OS keyring, such as the macOS Keychain, the Windows
+// Credential Manager or the Secret Service on Linux, keeping string
+// secrets by service and user
+type Keyring interface {
+	// Get returns the secret or ErrNotFound
+	Get(service, user string) (string, error)
+	// Set stores the secret replacing any already there
+	Set(service, user, secret string) error
+	// Delete removes the secret, returning nil if there is none
+	Delete(service, user string) error
+}
+
+// KeyringStore is a Store kept in an OS keyring.  The secrets are the
+// users of its service, base64 encoded as keyrings hold strings.
+type KeyringStore struct {
+	keyring Keyring
+	service string
+}
+
+// check interface
+var _ Store = (*KeyringStore)(nil)
+
+// NewKeyringStore returns a Store keeping its secrets in keyring under
+// service, such as the name of the program
+func NewKeyringStore(keyring Keyring, service string) *KeyringStore {
+	return &KeyringStore{keyring: keyring, service: service}
+}
+
+// Get returns the secret called name or ErrNotFound
+func (s *KeyringStore) Get(name string) ([]byte, error) {
+	secret, err := s.keyring.Get(s.service, name)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(secret)
+}
+
+// Put stores secret as name replacing any already there
+func (s *KeyringStore) Put(name string, secret []byte) error {
+	return s.keyring.Set(s.service, name, base64.StdEncoding.EncodeToString(secret))
+}
+
+// Delete removes the secret called name if there is one
+func (s *KeyringStore) Delete(name string) error {
+	return s.keyring.Delete(s.service, name)
+}
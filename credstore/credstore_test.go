@@ -0,0 +1,110 @@
+package credstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "creds", "store.json")
+
+	s := NewFileStore(path, []byte("correct horse"))
+	if _, err = s.Get("session"); err != ErrNotFound {
+		t.Errorf("empty store: got %v", err)
+	}
+	secret := []byte("session blob")
+	if err = s.Put("session", secret); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("key", []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, secret) {
+		t.Error("secret stored in the clear")
+	}
+	if fi, err := os.Stat(path); err != nil || (fi.Mode().Perm()&0077 != 0 && os.PathSeparator == '/') {
+		t.Errorf("file mode %v: %v", fi.Mode(), err)
+	}
+
+	// A second store reads it with the passphrase only
+	got, err := NewFileStore(path, []byte("correct horse")).Get("session")
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("reopened: got %q, %v", got, err)
+	}
+	if _, err = NewFileStore(path, []byte("wrong")).Get("session"); err != ErrPassphrase {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+
+	if err = s.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("key"); err != ErrNotFound {
+		t.Errorf("deleted: got %v", err)
+	}
+
+	if err = s.ChangePassphrase([]byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewFileStore(path, []byte("correct horse")).Get("session"); err != ErrPassphrase {
+		t.Errorf("old passphrase: got %v", err)
+	}
+	got, err = NewFileStore(path, []byte("battery staple")).Get("session")
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("new passphrase: got %q, %v", got, err)
+	}
+}
+
+// memKeyring is a Keyring held in memory
+type memKeyring map[string]string
+
+func (k memKeyring) Get(service, user string) (string, error) {
+	s, ok := k[service+"/"+user]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return s, nil
+}
+
+func (k memKeyring) Set(service, user, secret string) error {
+	k[service+"/"+user] = secret
+	return nil
+}
+
+func (k memKeyring) Delete(service, user string) error {
+	delete(k, service+"/"+user)
+	return nil
+}
+
+func TestKeyringStore(t *testing.T) {
+	k := memKeyring{}
+	s := NewKeyringStore(k, "megacli")
+	secret := []byte{0, 0xff, 'x'}
+	if err := s.Put("key", secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k["megacli/key"]; !ok {
+		t.Errorf("not under the service: %v", k)
+	}
+	got, err := s.Get("key")
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if err = s.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("key"); err != ErrNotFound {
+		t.Errorf("deleted: got %v", err)
+	}
+}
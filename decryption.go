@@ -0,0 +1,117 @@
+package mega
+
+import (
+	"sort"
+)
+
+// DecryptionError returns why the key or attributes of the node
+// couldn't be decrypted, or nil if they were.  Such nodes are named
+// "BAD ATTRIBUTE" and, if the key is missing, can't be downloaded.
+//
+// They are repaired automatically when the keys of new shares arrive
+// from the server.
+func (n *Node) DecryptionError() error {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	if n.decryptErr == nil {
+		return nil
+	}
+	return n.decryptErr
+}
+
+// setDecryptionError records err, which may be nil, as the result of
+// decrypting n from itm, keeping itm to retry with if it failed
+//
+// Call with the FS mutex held
+func (fs *MegaFS) setDecryptionError(n *Node, itm FSNode, err error) {
+	if err == nil {
+		n.decryptErr = nil
+		delete(fs.broken, itm.Hash)
+		return
+	}
+	n.decryptErr = &DecryptionError{Hash: itm.Hash, Err: err}
+	fs.broken[itm.Hash] = itm
+}
+
+// Undecryptable returns the nodes whose key or attributes couldn't be
+// decrypted, ordered by handle
+func (fs *MegaFS) Undecryptable() []*Node {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var nodes []*Node
+	for _, n := range fs.lookup {
+		if n.decryptErr != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].hash < nodes[j].hash
+	})
+	return nodes
+}
+
+// UndecryptableCount returns the number of nodes whose key or
+// attributes couldn't be decrypted
+func (fs *MegaFS) UndecryptableCount() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	count := 0
+	for _, n := range fs.lookup {
+		if n.decryptErr != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// RepairNodes tries to decrypt the undecryptable nodes again with the
+// keys known now, returning how many were repaired.  An
+// EVENT_NODE_UPDATED is sent for each.
+func (m *Mega) RepairNodes() int {
+	m.FS.mutex.Lock()
+	events, entries := m.repairNodes()
+	m.FS.mutex.Unlock()
+
+	m.journal(entries...)
+	m.emitEvents(events)
+	return len(events)
+}
+
+// brokenItems returns the nodes which couldn't be decrypted, in
+// handle order
+//
+// Call with the FS mutex held
+func (fs *MegaFS) brokenItems() []FSNode {
+	if len(fs.broken) == 0 {
+		return nil
+	}
+	items := make([]FSNode, 0, len(fs.broken))
+	for _, itm := range fs.broken {
+		items = append(items, itm)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Hash < items[j].Hash
+	})
+	return items
+}
+
+// repairNodes is RepairNodes returning the events and journal entries
+// for the repaired nodes
+//
+// Call with the FS mutex held
+func (m *Mega) repairNodes() (events []Event, entries []*JournalEntry) {
+	for _, itm := range m.FS.brokenItems() {
+		var oldPath string
+		if n, ok := m.FS.lookup[itm.Hash]; ok {
+			oldPath = m.FS.pathOf(n)
+		}
+		node, err := m.addFSNode(itm)
+		if err != nil || node == nil || node.decryptErr != nil {
+			continue
+		}
+		m.debugf("repaired node %s", itm.Hash)
+		entries = append(entries, m.journalEntry(JOURNAL_REPAIR, JOURNAL_SERVER, itm.User, node, oldPath))
+		events = append(events, Event{Type: EVENT_NODE_UPDATED, Node: node, Hash: itm.Hash})
+	}
+	return events, entries
+}
@@ -0,0 +1,121 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDecryptAttrWrongKey(t *testing.T) {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	attr, _ := encryptAttr(key, FileAttr{Name: "name"})
+	other := make([]byte, 16)
+	_, _ = rand.Read(other)
+	if _, err := decryptAttr(other, attr); err != EBADATTR {
+		t.Errorf("want EBADATTR, got %v", err)
+	}
+	if _, err := decryptAttr(key, "AAAA"); err != EBADATTR {
+		t.Errorf("want EBADATTR for short attribute, got %v", err)
+	}
+}
+
+func TestRepairNodesOnShareKey(t *testing.T) {
+	m := New()
+	m.SetLogger(t.Logf)
+	m.k = make([]byte, 16)
+	_, _ = rand.Read(m.k)
+	m.handle = "MEMEMEMEMEM"
+	master_aes, _ := aes.NewCipher(m.k)
+
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk)
+	sk_aes, _ := aes.NewCipher(sk)
+	esk := make([]byte, 16)
+	_ = blockEncrypt(master_aes, esk, sk)
+
+	var events []Event
+	m.Subscribe(func(ev Event) {
+		events = append(events, ev)
+	})
+
+	// folder encrypted with the share key, with attributes which are
+	// broken whatever the key if bad
+	item := func(h, parent string, t NodeType, name string, bad bool) FSNode {
+		key := make([]byte, 16)
+		_, _ = rand.Read(key)
+		attr, _ := encryptAttr(key, FileAttr{Name: name})
+		if bad {
+			attr = base64urlencode(make([]byte, 16))
+		}
+		ekey := make([]byte, 16)
+		_ = blockEncrypt(sk_aes, ekey, key)
+		return FSNode{Hash: h, Parent: parent, User: "OTHERUSERXX", T: t, Attr: attr, Key: "SHAREHND:" + base64urlencode(ekey)}
+	}
+
+	// the nodes arrive before the share key
+	ev := FSEvent{Cmd: "t"}
+	ev.T.Files = []FSNode{
+		item("SHAREHND", "", FOLDER, "shared", false),
+		item("BADATTR1", "SHAREHND", FOLDER, "", true),
+	}
+	evRaw, _ := json.Marshal(ev)
+	if err := m.processAddNode(evRaw); err != nil {
+		t.Fatalf("processAddNode failed: %v", err)
+	}
+	if n := m.FS.UndecryptableCount(); n != 2 {
+		t.Fatalf("want 2 undecryptable nodes, got %d", n)
+	}
+	root := m.FS.HashLookup("SHAREHND")
+	if root == nil || root.GetName() != "BAD ATTRIBUTE" {
+		t.Fatalf("undecryptable node not added: %v", root)
+	}
+	var derr *DecryptionError
+	if err := root.DecryptionError(); !errors.As(err, &derr) || derr.Hash != "SHAREHND" {
+		t.Fatalf("want DecryptionError, got %v", err)
+	}
+	if _, err := m.NewDownload(root); err != root.DecryptionError() {
+		t.Errorf("download of node without key: %v", err)
+	}
+
+	events = nil
+	j := &memJournal{}
+	m.SetJournal(j)
+	err := m.processShare([]byte(fmt.Sprintf(`{"a":"s2","n":"SHAREHND","o":"OTHERUSERXX","u":"MEMEMEMEMEM","r":0,"k":%q}`, base64urlencode(esk))))
+	if err != nil {
+		t.Fatalf("processShare failed: %v", err)
+	}
+	if root.GetName() != "shared" || root.DecryptionError() != nil {
+		t.Errorf("share root not repaired: %q %v", root.GetName(), root.DecryptionError())
+	}
+	got := m.FS.Undecryptable()
+	if len(got) != 1 || got[0].GetHash() != "BADATTR1" {
+		t.Errorf("want only BADATTR1 undecryptable, got %v", got)
+	}
+	if errors.Unwrap(got[0].DecryptionError()) != EBADATTR {
+		t.Errorf("want EBADATTR, got %v", got[0].DecryptionError())
+	}
+	if len(events) != 2 || events[0].Type != EVENT_NODE_UPDATED || events[0].Hash != "SHAREHND" || events[1].Type != EVENT_SHARE_ADDED {
+		t.Errorf("wrong events: %v", events)
+	}
+	j.mu.Lock()
+	if len(j.entries) != 1 || j.entries[0].Op != JOURNAL_REPAIR || j.entries[0].Hash != "SHAREHND" || j.entries[0].Path != "shared" {
+		t.Errorf("wrong journal entries: %+v", j.entries)
+	}
+	j.mu.Unlock()
+	if n := m.RepairNodes(); n != 0 {
+		t.Errorf("repaired %d more nodes", n)
+	}
+
+	// deleting forgets about it
+	dev, _ := json.Marshal(FSEvent{Cmd: "d", N: "BADATTR1"})
+	if err = m.processDeleteNode(dev); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.FS.UndecryptableCount(); n != 0 || len(m.FS.broken) != 0 {
+		t.Errorf("want no undecryptable nodes, got %d", n)
+	}
+}
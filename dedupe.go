@@ -0,0 +1,127 @@
+package mega
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// DedupeMode says what a Mirror does with remote files whose contents
+// are already downloaded elsewhere in the tree
+type DedupeMode int
+
+// Dedupe modes
+const (
+	// Download every file
+	DEDUPE_OFF DedupeMode = iota
+	// Hard link the local copy, copying if linking fails.  Editing
+	// one linked file changes all of them.
+	DEDUPE_LINK
+	// Copy the local copy
+	DEDUPE_COPY
+)
+
+// WithDownloadDedupe sets what DownloadDir and new Mirrors do with
+// files having the same fingerprint and size as one already
+// downloaded, see Mirror.Dedupe
+func WithDownloadDedupe(mode DedupeMode) Option {
+	return func(m *Mega) error {
+		if mode < DEDUPE_OFF || mode > DEDUPE_COPY {
+			return EARGS
+		}
+		m.config.dedupe = mode
+		return nil
+	}
+}
+
+// duplicate is a remote file indexed by its contents
+type duplicate struct {
+	rel  string
+	node *Node
+}
+
+// dedupeKey returns the key under which n is indexed by its contents,
+// "" if they aren't known
+func dedupeKey(n *Node) string {
+	fp := n.GetFingerprint()
+	if fp == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", fp, n.GetSize())
+}
+
+// indexDuplicates indexes the remote files by their contents for
+// localCopy
+func (mr *Mirror) indexDuplicates(files map[string]*Node) {
+	mr.dupes = nil
+	if mr.Dedupe == DEDUPE_OFF {
+		return
+	}
+	mr.dupes = make(map[string][]duplicate)
+	for rel, n := range files {
+		if key := dedupeKey(n); key != "" {
+			mr.dupes[key] = append(mr.dupes[key], duplicate{rel: rel, node: n})
+		}
+	}
+}
+
+// localCopy returns the local path of an up to date download of
+// another file with the same contents as n, "" if there is none
+func (mr *Mirror) localCopy(rel string, n *Node) string {
+	key := dedupeKey(n)
+	if key == "" {
+		return ""
+	}
+	for _, d := range mr.dupes[key] {
+		if d.rel == rel {
+			continue
+		}
+		st, ok, err := mr.state.Get(d.rel)
+		if err != nil || !ok || st.Hash != d.node.GetHash() {
+			continue
+		}
+		p := mr.localPath(d.rel)
+		fi, err := os.Stat(p)
+		if err == nil && st.Unchanged(fi) {
+			return p
+		}
+	}
+	return ""
+}
+
+// dedupe links or copies src to dst according to the Dedupe mode,
+// returning true if it was linked
+func (mr *Mirror) dedupe(src, dst string) (linked bool, err error) {
+	if mr.Dedupe == DEDUPE_LINK {
+		err = os.Link(src, dst)
+		if err == nil {
+			return true, nil
+		}
+		mr.m.debugf("mirror: can't link %q: %v, copying", dst, err)
+	}
+	return false, copyFile(src, dst)
+}
+
+// copyFile copies the local file src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorDedupe(t *testing.T) {
+	for _, mode := range []DedupeMode{DEDUPE_LINK, DEDUPE_COPY} {
+		m, b := newFakeMegaWith(t, func(m *Mega) {
+			if err := WithDownloadDedupe(mode)(m); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		root, err := m.CreateDir("top", m.FS.GetRoot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := uploadString(t, m, root, "a.txt", "same")
+		sub, err := m.CreateDir("sub", root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dup := uploadString(t, m, sub, "b.txt", "same")
+		other := uploadString(t, m, root, "c.txt", "different")
+		m.FS.mutex.Lock()
+		a.fingerprint = "fp"
+		dup.fingerprint = "fp"
+		other.fingerprint = "fp" // different size
+		m.FS.mutex.Unlock()
+
+		dir, err := ioutil.TempDir("", "mega-dedupe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = m.DownloadDir(root, dir); err != nil {
+			t.Fatal(err)
+		}
+		local := filepath.Join(dir, "top")
+		for _, rel := range []string{"a.txt", "sub/b.txt"} {
+			if got := readString(local, rel); got != "same" {
+				t.Errorf("%v: %s: got %q", mode, rel, got)
+			}
+		}
+		if got := readString(local, "c.txt"); got != "different" {
+			t.Errorf("%v: c.txt: got %q", mode, got)
+		}
+		downloads := b.requestCount(a.GetHash()+"/0") + b.requestCount(dup.GetHash()+"/0")
+		if downloads != 1 {
+			t.Errorf("%v: duplicate contents downloaded %d times", mode, downloads)
+		}
+		if b.requestCount(other.GetHash()+"/0") != 1 {
+			t.Errorf("%v: file of a different size not downloaded", mode)
+		}
+
+		fa, err1 := os.Stat(filepath.Join(local, "a.txt"))
+		fb, err2 := os.Stat(filepath.Join(local, "sub", "b.txt"))
+		if err1 != nil || err2 != nil {
+			t.Fatalf("stat: %v, %v", err1, err2)
+		}
+		if linked := os.SameFile(fa, fb); linked != (mode == DEDUPE_LINK) {
+			t.Errorf("%v: linked is %v", mode, linked)
+		}
+
+		os.RemoveAll(dir)
+		b.Close()
+	}
+}
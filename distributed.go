@@ -0,0 +1,140 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// ChunkJob describes downloading one chunk of a file so the work can
+// be spread over several machines.  Running a job needs nothing but
+// HTTP access to MEGA storage, no session.
+//
+// A job contains the key of the file so only send it to machines which
+// may see the file.  The URL expires after a while like any download
+// URL, so run the jobs soon after making them.
+type ChunkJob struct {
+	// Number of the chunk in the ChunkPlan
+	ID int `json:"id"`
+	// URL of the byte range of the chunk
+	URL string `json:"url"`
+	// Position and size of the chunk in the file
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+	// AES key of the file
+	Key []byte `json:"key"`
+	// AES-CTR counter block for the start of the chunk
+	IV []byte `json:"iv"`
+	// IV for the chunk MAC
+	MACIV []byte `json:"mac_iv"`
+}
+
+// ChunkResult is sent back to the coordinator for a ChunkJob which has
+// been run
+type ChunkResult struct {
+	// Number of the chunk
+	ID int `json:"id"`
+	// MAC of the decrypted chunk
+	MAC []byte `json:"mac"`
+}
+
+// ChunkJobs returns a job for each chunk of the download.
+//
+// Hand them out to the workers, write the data they produce at the
+// Offset of each job and pass their results to AddChunkResult.  Once
+// all the results are in FinishChunkJobs checks the MAC of the whole
+// file.
+func (d *Download) ChunkJobs() ([]ChunkJob, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	jobs := make([]ChunkJob, 0, len(d.chunks))
+	for id, c := range d.chunks {
+		iv, err := ctrIV(d.src.meta.iv, c.position)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, ChunkJob{
+			ID:     id,
+			URL:    fmt.Sprintf("%s/%d-%d", d.mirrors[d.mirror], c.position, c.position+int64(c.size)-1),
+			Offset: c.position,
+			Length: c.size,
+			Key:    append([]byte(nil), d.key...),
+			IV:     iv,
+			MACIV:  append([]byte(nil), d.iv...),
+		})
+	}
+	return jobs, nil
+}
+
+// AddChunkResult records the MAC of a chunk downloaded by a worker
+func (d *Download) AddChunkResult(res ChunkResult) error {
+	if res.ID < 0 || res.ID >= len(d.chunks) || len(res.MAC) != 16 {
+		return EARGS
+	}
+	d.setChunkMac(res.ID, res.MAC)
+	return nil
+}
+
+// FinishChunkJobs checks the MAC of the whole file from the results
+// passed to AddChunkResult.  Unlike Finish, which lets a download with
+// chunks missing through unchecked, it returns a *MissingChunksError
+// naming the chunks which have no result.
+func (d *Download) FinishChunkJobs() error {
+	var missing []int
+	d.mutex.Lock()
+	for id, mac := range d.chunk_macs {
+		if mac == nil {
+			missing = append(missing, id)
+		}
+	}
+	d.mutex.Unlock()
+	if len(missing) > 0 {
+		return &MissingChunksError{Name: d.src.GetName(), Chunks: missing, Err: EINCOMPLETE}
+	}
+	return d.Finish()
+}
+
+// Run fetches and decrypts the chunk using client, or
+// http.DefaultClient if nil, returning the data and the result for the
+// coordinator.
+func (job *ChunkJob) Run(client *http.Client) ([]byte, ChunkResult, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if job.Length <= 0 || len(job.IV) != 16 || len(job.MACIV) != 16 {
+		return nil, ChunkResult{}, EARGS
+	}
+	aes_block, err := aes.NewCipher(job.Key)
+	if err != nil {
+		return nil, ChunkResult{}, err
+	}
+
+	resp, err := client.Get(job.URL)
+	if err != nil {
+		return nil, ChunkResult{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != 200 {
+		return nil, ChunkResult{}, errors.New("Http Status: " + resp.Status)
+	}
+	// Read one byte extra to spot a chunk which is too long
+	chunk, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(job.Length)+1))
+	if err == io.ErrUnexpectedEOF {
+		err = ESIZE
+	}
+	if err != nil {
+		return nil, ChunkResult{}, err
+	}
+	if len(chunk) != job.Length {
+		return nil, ChunkResult{}, ESIZE
+	}
+
+	cipher.NewCTR(aes_block, job.IV).XORKeyStream(chunk, chunk)
+	return chunk, ChunkResult{ID: job.ID, MAC: chunkMAC(aes_block, job.MACIV, chunk)}, nil
+}
@@ -0,0 +1,100 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkJobs(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-distributed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "big.bin", 3000000)
+	n, err := m.UploadFile(filepath.Join(dir, "big.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The coordinator makes the jobs and sends them out
+	d, err := m.NewDownload(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := d.ChunkJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != d.Chunks() {
+		t.Fatalf("%d jobs for %d chunks", len(jobs), d.Chunks())
+	}
+	buf, err := json.Marshal(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Workers run them, last first to show order doesn't matter
+	var sent []ChunkJob
+	err = json.Unmarshal(buf, &sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	var results []ChunkResult
+	for i := len(sent) - 1; i >= 0; i-- {
+		chunk, res, err := sent[i].Run(nil)
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		copy(got[sent[i].Offset:], chunk)
+		results = append(results, res)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("assembled data differs")
+	}
+
+	// The coordinator collects the results and checks the file, which
+	// can't be done until they are all in
+	for _, res := range results[1:] {
+		err = d.AddChunkResult(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var missing *MissingChunksError
+	if err = d.FinishChunkJobs(); !errors.As(err, &missing) || !errors.Is(err, EINCOMPLETE) {
+		t.Errorf("want MissingChunksError, got %v", err)
+	} else if len(missing.Chunks) != 1 || missing.Chunks[0] != results[0].ID {
+		t.Errorf("missing chunks %v, want [%d]", missing.Chunks, results[0].ID)
+	}
+	err = d.AddChunkResult(results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.FinishChunkJobs()
+	if err != nil {
+		t.Errorf("FinishChunkJobs: %v", err)
+	}
+
+	// A bad result is caught
+	results[0].MAC[0] ^= 1
+	_ = d.AddChunkResult(results[0])
+	var merr *MACError
+	if err = d.FinishChunkJobs(); !errors.As(err, &merr) || merr.Err != EMACMISMATCH {
+		t.Errorf("want EMACMISMATCH, got %v", err)
+	} else if merr.Chunks != len(jobs) || merr.Size != int64(len(data)) || merr.Expected == merr.Computed {
+		t.Errorf("MACError %+v", merr)
+	}
+	if err = d.AddChunkResult(ChunkResult{ID: len(jobs), MAC: make([]byte, 16)}); err != EARGS {
+		t.Errorf("want EARGS for unknown chunk, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchChunkSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			_, _ = w.Write(make([]byte, 16))
+		case "/short":
+			_, _ = w.Write(make([]byte, 8))
+		case "/closed":
+			// promise more than is sent
+			w.Header().Set("Content-Length", strconv.Itoa(16))
+			_, _ = w.Write(make([]byte, 8))
+		case "/error":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	m := New(WithLogger(nil))
+	d := &Download{m: m, cfg: m.getConfig(), src: &Node{name: "test"}}
+	for _, test := range []struct {
+		path string
+		ok   bool
+		err  error
+	}{
+		{"/ok", true, nil},
+		{"/short", false, ESIZE},
+		{"/closed", false, ESIZE},
+		{"/error", false, nil},
+	} {
+		chunk, err := d.fetchChunk(fmt.Sprintf("%s%s", srv.URL, test.path), 16)
+		if test.ok {
+			if err != nil || len(chunk) != 16 {
+				t.Errorf("%s: unexpected result %d, %v", test.path, len(chunk), err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error", test.path)
+		} else if test.err != nil && err != test.err {
+			t.Errorf("%s: expecting %v, got %v", test.path, test.err, err)
+		}
+	}
+}
+
+func TestChunkError(t *testing.T) {
+	var err error = &ChunkError{Op: "write", Chunk: 3, Offset: 786432, Err: ESIZE}
+	if !errors.Is(err, ESIZE) {
+		t.Error("ChunkError should unwrap to ESIZE")
+	}
+	want := "write chunk 3 at offset 786432: " + ESIZE.Error()
+	if err.Error() != want {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestDrainErrors(t *testing.T) {
+	m := New(WithLogger(nil))
+	errch := make(chan error, 2)
+	errch <- EWRITE
+	errch <- EREAD
+	if err := drainErrors(m, "x", nil, errch); err != EWRITE {
+		t.Errorf("expecting first error, got %v", err)
+	}
+	errch <- EREAD
+	if err := drainErrors(m, "x", ESIZE, errch); err != ESIZE {
+		t.Errorf("expecting original error, got %v", err)
+	}
+	if len(errch) != 0 {
+		t.Error("errors not drained")
+	}
+}
+
+func TestStorageMirrors(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		ips  []string
+		want []string
+	}{
+		{"http://gfs1.example/dl/x", nil, []string{"http://gfs1.example/dl/x"}},
+		{"http://gfs1.example/dl/x", []string{"1.2.3.4", "2a01::1", "1.2.3.4", "bogus"}, []string{
+			"http://gfs1.example/dl/x",
+			"http://1.2.3.4/dl/x",
+			"http://[2a01::1]/dl/x",
+		}},
+		{"http://gfs1.example:8080/dl/x", []string{"2a01::1"}, []string{
+			"http://gfs1.example:8080/dl/x",
+			"http://[2a01::1]:8080/dl/x",
+		}},
+		{"https://gfs1.example/dl/x", []string{"1.2.3.4"}, []string{"https://gfs1.example/dl/x"}},
+	} {
+		got := storageMirrors(test.url, test.ips)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s %q: want %q got %q", test.url, test.ips, test.want, got)
+		}
+	}
+}
+
+// deadHostTransport fails every request to host
+type deadHostTransport struct {
+	host  string
+	mu    sync.Mutex
+	tries int
+}
+
+func (d *deadHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Hostname() == d.host {
+		d.mu.Lock()
+		d.tries++
+		d.mu.Unlock()
+		return nil, errors.New("i/o timeout")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadMirrorFailover(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "a.bin", 3000000)
+	n, err := m.UploadFile(filepath.Join(dir, "a.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The storage server named in the URL is down but its address works
+	srv, err := url.Parse(b.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] != "g" {
+			return nil
+		}
+		fn := b.nodes[cmd["n"].(string)]
+		return map[string]interface{}{
+			"g":  "http://storage.invalid:" + srv.Port() + "/dl/" + fn.Hash,
+			"ip": []string{srv.Hostname()},
+			"s":  fn.Sz,
+			"at": fn.Attr,
+		}
+	}
+	b.mu.Unlock()
+	dead := &deadHostTransport{host: "storage.invalid"}
+	m.SetStorageClient(&http.Client{Transport: dead})
+
+	checkDownload(t, m, n, filepath.Join(dir, "a.out"), data)
+	if dead.tries == 0 || dead.tries > m.getConfig().dl_workers {
+		t.Errorf("%d requests to the dead server", dead.tries)
+	}
+}
+
+// stallWriterAt is a memWriterAt whose writes wait until released
+type stallWriterAt struct {
+	memWriterAt
+	release chan struct{}
+}
+
+func (w *stallWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	<-w.release
+	return w.memWriterAt.WriteAt(p, off)
+}
+
+func TestDecryptWorkers(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if err := m.SetDecryptWorkers(-1); err != EARGS {
+		t.Errorf("negative workers: got %v, want EARGS", err)
+	}
+
+	data := make([]byte, 3*1024*1024)
+	_, _ = rand.Read(data)
+	n, err := m.UploadFrom(bytes.NewReader(data), int64(len(data)), m.FS.GetRoot(), "a.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.SetDownloadWorkers(2)
+	_ = m.SetDecryptWorkers(1)
+
+	// With the decrypt worker stuck writing the download workers
+	// still read a chunk each
+	w := &stallWriterAt{release: make(chan struct{})}
+	var once sync.Once
+	release := func() { once.Do(func() { close(w.release) }) }
+	var mu sync.Mutex
+	fetched := 0
+	b.mu.Lock()
+	b.beforeDownload = func(h string, start int) {
+		mu.Lock()
+		fetched++
+		if fetched == 3 {
+			release()
+		}
+		mu.Unlock()
+	}
+	b.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.DownloadTo(n, w, nil)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("network reads stalled behind the writes")
+		release()
+		err = <-done
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf, data) {
+		t.Errorf("downloaded data differs")
+	}
+}
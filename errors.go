@@ -40,10 +40,245 @@ var (
 	EGOINGOVERQUOTA     = errors.New("Not enough quota")
 	EMFAREQUIRED        = errors.New("Multi-factor authentication required")
 
+	// Transfer errors
+	ESIZE            = errors.New("Transferred data doesn't match the expected size")
+	ETOOMANYFAILURES = errors.New("Stopped after too many items failed")
+	ESPILL           = errors.New("Data is larger than the temporary file limit")
+	EFILTERED        = errors.New("File denied by the filter")
+
 	// Config errors
 	EWORKER_LIMIT_EXCEEDED = errors.New("Maximum worker limit exceeded")
+
+	// Client errors
+	EREADONLY    = errors.New("Client is read only")
+	EUNSUPPORTED = errors.New("Not supported on this platform")
+	ENOTMEDIA    = errors.New("Not a recognised image or video")
+
+	// Transaction errors
+	EIRREVERSIBLE = errors.New("Step can't be rolled back")
 )
 
+// ChunkError is returned by transfers when a chunk fails.  It records
+// which chunk failed and where, and wraps the underlying error so
+// errors.Is can be used to check for, say, ESIZE or a full disk.
+type ChunkError struct {
+	// What was being done - "download", "decrypt", "write", "read" or
+	// "upload"
+	Op string
+	// Number of the chunk
+	Chunk int
+	// Position of the chunk in the file
+	Offset int64
+	// The underlying error
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("%s chunk %d at offset %d: %v", e.Op, e.Chunk, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// MACError is returned when the MAC of a downloaded or local file
+// doesn't match the one it should have, with what is known about the
+// transfer for reporting the corruption.  Err is EMACMISMATCH so
+// errors.Is can be used to check for it.
+type MACError struct {
+	// Name of the file
+	Name string
+	// The MAC the file should have and the one it has, in hex
+	Expected string
+	Computed string
+	// Size of the file
+	Size int64
+	// Number of chunks downloaded, 0 for a local file
+	Chunks int
+	// Times chunk requests were retried during the download
+	Retries int
+	// The underlying error
+	Err error
+}
+
+func (e *MACError) Error() string {
+	return fmt.Sprintf("%v for %q: expected %s, computed %s (%d bytes, %d chunks, %d retries)", e.Err, e.Name, e.Expected, e.Computed, e.Size, e.Chunks, e.Retries)
+}
+
+// Unwrap returns the underlying error
+func (e *MACError) Unwrap() error {
+	return e.Err
+}
+
+// MissingChunksError is returned by Download.FinishChunkJobs when
+// some of the chunks have no result yet, so the MAC of the file can't
+// be checked.  Err is EINCOMPLETE.
+type MissingChunksError struct {
+	// Name of the file
+	Name string
+	// Numbers of the chunks without a result
+	Chunks []int
+	// The underlying error
+	Err error
+}
+
+func (e *MissingChunksError) Error() string {
+	return fmt.Sprintf("%v for %q: no result for chunks %v", e.Err, e.Name, e.Chunks)
+}
+
+// Unwrap returns the underlying error
+func (e *MissingChunksError) Unwrap() error {
+	return e.Err
+}
+
+// CompletionError is returned when all the chunks of an upload were
+// sent but creating the node failed.  The data is still held by the
+// server under the completion handle for a while, so the upload can be
+// finished later by passing State to ResumeUpload and calling Finish
+// rather than uploading it again.
+type CompletionError struct {
+	// Name of the file being uploaded
+	Name string
+	// Completion handle returned by the last chunk
+	Handle string
+	// State of the upload for ResumeUpload
+	State UploadState
+	// The underlying error
+	Err error
+}
+
+func (e *CompletionError) Error() string {
+	return fmt.Sprintf("completing upload of %q: %v", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CompletionError) Unwrap() error {
+	return e.Err
+}
+
+// FilterError is returned when the ContentFilter turns down a file.
+// An upload turned down is sent but never completed so no node is
+// made, and a download turned down is deleted.
+type FilterError struct {
+	// Name of the file
+	Name string
+	// Whether it was being uploaded or downloaded
+	Upload bool
+	// The error returned by the filter
+	Err error
+}
+
+func (e *FilterError) Error() string {
+	op := "download"
+	if e.Upload {
+		op = "upload"
+	}
+	return fmt.Sprintf("content filter rejected %s of %q: %v", op, e.Name, e.Err)
+}
+
+// Unwrap returns the error returned by the filter
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// TransactionError is returned when a step of a Transaction fails to
+// run or to roll back.  Token records the steps which are done so the
+// transaction can be carried on with ResumeTransaction, or the caller
+// can see what is left to tidy up by hand.
+type TransactionError struct {
+	// Name of the step which failed
+	Step string
+	// Progress of the transaction when it failed
+	Token TransactionToken
+	// The underlying error
+	Err error
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("step %q failed after %d steps done: %v", e.Step, len(e.Token.Done), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// DecryptionError marks a node whose key or attributes couldn't be
+// decrypted, usually because the key of the share it is in hasn't
+// arrived.  See Node.DecryptionError.
+type DecryptionError struct {
+	// Handle of the node
+	Hash string
+	// The underlying error
+	Err error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("couldn't decrypt node %s: %v", e.Hash, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+// SchemaError is returned in strict decoding mode, see
+// SetStrictDecoding, when a reply from the API isn't what is expected.
+type SchemaError struct {
+	// Type of the reply being decoded
+	Type string
+	// The field which isn't known, "" if the shape was wrong
+	Field string
+	// What is wrong
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("API reply %s: %s %q", e.Type, e.Reason, e.Field)
+	}
+	return fmt.Sprintf("API reply %s: %s", e.Type, e.Reason)
+}
+
+// LoginError is returned by Login and MultiFactorLogin when the server
+// refuses to log in for a reason which trying again straight away
+// won't fix, so callers can tell it from a wrong password and stop
+// retrying.  Err is EBLOCKED if the account is locked, ETOOMANY after
+// too many attempts or ERATELIMIT if the server is throttling requests.
+type LoginError struct {
+	// The underlying error
+	Err error
+	// What the user can do about it
+	Guidance string
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("login refused: %v: %s", e.Err, e.Guidance)
+}
+
+// Unwrap returns the underlying error
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+// loginError wraps the errors from logging in which mean the account is
+// locked or throttled in a LoginError, returning others as they are
+func loginError(err error) error {
+	var guidance string
+	switch err {
+	case EBLOCKED:
+		guidance = "the account is locked or suspended, log in on the MEGA website to find out why"
+	case ETOOMANY:
+		guidance = "too many login attempts from this address, wait an hour before trying again"
+	case ERATELIMIT:
+		guidance = "the server is throttling requests, wait a while before trying again"
+	default:
+		return err
+	}
+	return &LoginError{Err: err, Guidance: guidance}
+}
+
 type ErrorMsg int
 
 func parseError(errno ErrorMsg) error {
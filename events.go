@@ -0,0 +1,304 @@
+package mega
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventType describes the kind of change an Event reports
+type EventType int
+
+// Filesystem event types
+const (
+	EVENT_NODE_ADDED EventType = iota
+	EVENT_NODE_UPDATED
+	EVENT_NODE_DELETED
+	EVENT_SHARE_ADDED
+	EVENT_SHARE_REMOVED
+	// The server lost track of the changes since the event cursor so
+	// the tree was fetched again.  The differences found have been
+	// sent as events before it.  Node is nil.
+	EVENT_TREE_RELOADED
+)
+
+// EVENT_MAX_BACKOFF is the longest wait before polling for events again
+// after errors
+const EVENT_MAX_BACKOFF = time.Minute
+
+func (t EventType) String() string {
+	switch t {
+	case EVENT_NODE_ADDED:
+		return "NodeAdded"
+	case EVENT_NODE_UPDATED:
+		return "NodeUpdated"
+	case EVENT_NODE_DELETED:
+		return "NodeDeleted"
+	case EVENT_SHARE_ADDED:
+		return "ShareAdded"
+	case EVENT_SHARE_REMOVED:
+		return "ShareRemoved"
+	case EVENT_TREE_RELOADED:
+		return "TreeReloaded"
+	}
+	return "Unknown"
+}
+
+// Event describes a change to the filesystem received from the
+// server
+type Event struct {
+	// What happened
+	Type EventType
+	// The node affected - for deletions this is no longer in the FS
+	Node *Node
+	// Hash of the node affected
+	Hash string
+}
+
+// EventFilter picks the events a subscriber is told of, so a UI
+// showing one folder isn't woken for every change in the account.  The
+// zero EventFilter passes every event.
+type EventFilter struct {
+	// The types of event to pass, all if empty
+	Types []EventType
+	// Pass only events for these nodes or those below them, all if
+	// empty.  Deleted nodes are matched by where they were.
+	// EVENT_TREE_RELOADED, which has no node, is passed whatever
+	// Under is so the subscriber knows to look again.
+	Under []*Node
+}
+
+// subscriber is a callback registered with Subscribe and the filter
+// for it
+type subscriber struct {
+	fn    func(Event)
+	types map[EventType]bool
+	under map[string]bool
+}
+
+// match returns true if the subscriber wants ev
+//
+// Call with the FS mutex held
+func (s *subscriber) match(ev Event) bool {
+	if s.types != nil && !s.types[ev.Type] {
+		return false
+	}
+	if s.under == nil || ev.Node == nil {
+		return true
+	}
+	// parents are kept on deleted nodes
+	for n := ev.Node; n != nil; n = n.parent {
+		if s.under[n.hash] {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe registers fn to be called for each filesystem event
+// received from the server.  It returns a function which removes the
+// subscription.
+//
+// fn is called from the event polling goroutine so it should not
+// block for long.
+func (m *Mega) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return m.SubscribeFiltered(EventFilter{}, fn)
+}
+
+// SubscribeFiltered is like Subscribe but fn is only called for the
+// events filter passes.
+func (m *Mega) SubscribeFiltered(filter EventFilter, fn func(Event)) (unsubscribe func()) {
+	s := &subscriber{fn: fn}
+	if len(filter.Types) > 0 {
+		s.types = make(map[EventType]bool, len(filter.Types))
+		for _, t := range filter.Types {
+			s.types[t] = true
+		}
+	}
+	if len(filter.Under) > 0 {
+		s.under = make(map[string]bool, len(filter.Under))
+		m.FS.mutex.Lock()
+		for _, n := range filter.Under {
+			if n != nil {
+				s.under[n.hash] = true
+			}
+		}
+		m.FS.mutex.Unlock()
+	}
+
+	m.subscribersMu.Lock()
+	defer m.subscribersMu.Unlock()
+
+	if m.subscribers == nil {
+		m.subscribers = make(map[int]*subscriber)
+	}
+	id := m.nextSubscriber
+	m.nextSubscriber++
+	m.subscribers[id] = s
+
+	return func() {
+		m.subscribersMu.Lock()
+		delete(m.subscribers, id)
+		m.subscribersMu.Unlock()
+	}
+}
+
+// emitEvents calls the subscribers for each of the events they want
+//
+// This must be called without the FS mutex held
+func (m *Mega) emitEvents(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	m.subscribersMu.Lock()
+	subs := make([]*subscriber, 0, len(m.subscribers))
+	filtered := false
+	for _, s := range m.subscribers {
+		subs = append(subs, s)
+		filtered = filtered || s.types != nil || s.under != nil
+	}
+	m.subscribersMu.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	// work out who wants what with the lock held once, then call them
+	// without it
+	calls := make([][]func(Event), len(events))
+	if filtered {
+		m.FS.mutex.Lock()
+	}
+	for i, ev := range events {
+		for _, s := range subs {
+			if s.match(ev) {
+				calls[i] = append(calls[i], s.fn)
+			}
+		}
+	}
+	if filtered {
+		m.FS.mutex.Unlock()
+	}
+
+	for i, ev := range events {
+		for _, fn := range calls[i] {
+			fn(ev)
+		}
+	}
+}
+
+// EventCursor returns the position in the event stream which the tree
+// is up to date with
+func (m *Mega) EventCursor() string {
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	return m.ssn
+}
+
+// setCursor moves the event cursor on to sn, telling the cursor func
+func (m *Mega) setCursor(sn string) {
+	m.FS.mutex.Lock()
+	m.ssn = sn
+	m.FS.mutex.Unlock()
+	if fn := m.getConfig().cursorFunc; fn != nil {
+		fn(sn)
+	}
+}
+
+// SetCursorFunc sets fn to be called with the event cursor each time
+// the events received have been applied to the tree, or the tree has
+// been reloaded, so it can be saved and given to WithEventCursor next
+// time.  fn is called from the event polling goroutine.  nil stops the
+// calls.
+func (m *Mega) SetCursorFunc(fn func(cursor string)) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.cursorFunc = fn
+}
+
+// WithEventCursor starts the event stream at cursor, saved from an
+// earlier run by SetCursorFunc or EventCursor, rather than where the
+// tree fetched at login is up to.  The changes made since then are
+// sent as events and journaled so an app can catch up with them.  As
+// the tree fetched already has them subscribers must cope with being
+// told of changes they can already see.  If the server no longer has
+// them the tree is reloaded as usual.
+func WithEventCursor(cursor string) Option {
+	return func(m *Mega) error {
+		m.config.cursor = cursor
+		return nil
+	}
+}
+
+// reloadTree fetches the whole tree again, when the server has lost
+// the events since the cursor, and brings the tree up to date with it
+// sending events for the differences and then EVENT_TREE_RELOADED.
+// When lazy loading every folder is loaded afterwards.
+func (m *Mega) reloadTree() error {
+	var msg [1]FilesMsg
+	var res [1]FilesResp
+
+	msg[0].Cmd = "f"
+	msg[0].C = 1
+	if m.flink != nil {
+		msg[0].R = 1
+	}
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return err
+	}
+
+	m.FS.mutex.Lock()
+	for _, sk := range res[0].Ok {
+		m.FS.skmap[sk.Hash] = sk.Key
+	}
+	m.FS.addContacts(res[0].User)
+	var events []Event
+	var entries []*JournalEntry
+	seen := make(map[string]bool, len(res[0].F))
+	for _, itm := range res[0].F {
+		var ok bool
+		events, entries, ok = m.reconcileNode(itm, false, events, entries)
+		if ok {
+			seen[itm.Hash] = true
+		}
+	}
+
+	// Remove the tops of the trees which have gone.  Placeholders for
+	// parents which aren't in the tree, such as those of incoming
+	// shares, have no hash and stay.
+	isGone := func(n *Node) bool {
+		return n.hash != "" && !seen[n.hash]
+	}
+	var gone []*Node
+	for _, n := range m.FS.lookup {
+		if isGone(n) && (n.parent == nil || !isGone(n.parent)) {
+			gone = append(gone, n)
+		}
+	}
+	for _, n := range gone {
+		entries = append(entries, m.journalEntry(JOURNAL_DELETE, JOURNAL_SERVER, "", n, m.FS.pathOf(n)))
+		m.FS.removeSharedRoot(n)
+		m.FS.removeTree(n)
+		events = append(events, Event{Type: EVENT_NODE_DELETED, Node: n, Hash: n.hash})
+	}
+	for _, n := range m.FS.lookup {
+		n.unloaded = false
+	}
+	repaired, repairedEntries := m.repairNodes()
+	events = append(events, repaired...)
+	entries = append(entries, repairedEntries...)
+	m.FS.mutex.Unlock()
+
+	m.journal(entries...)
+	m.emitEvents(append(events, Event{Type: EVENT_TREE_RELOADED}))
+	m.setCursor(res[0].Sn)
+	return nil
+}
@@ -0,0 +1,165 @@
+package mega
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEventStreamReload(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	a := uploadString(t, m, root, "a.txt", "a")
+	gone := uploadString(t, m, root, "gone.txt", "gone")
+
+	events := make(chan Event, 10)
+	m.Subscribe(func(ev Event) {
+		events <- ev
+	})
+	cursors := make(chan string, 10)
+	m.SetCursorFunc(func(cursor string) {
+		cursors <- cursor
+	})
+
+	// Changes the client never heard of
+	b.mu.Lock()
+	b.remove(gone.GetHash())
+	copied := *b.nodes[a.GetHash()]
+	copied.Hash = "COPIEDNO"
+	b.nodes[copied.Hash] = &copied
+	b.mu.Unlock()
+
+	// The stream fails a couple of times then says the events are lost
+	calls := 0
+	b.eventsMu.Lock()
+	b.events = func(sn string) (string, int) {
+		calls++
+		switch {
+		case calls <= 2:
+			return "", http.StatusServiceUnavailable
+		case calls == 3:
+			if sn != "fakesn" {
+				t.Errorf("polled from %q", sn)
+			}
+			return "-6", 0
+		}
+		return "", 0
+	}
+	b.eventsMu.Unlock()
+
+	var got []Event
+	timeout := time.After(5 * time.Second)
+	for len(got) == 0 || got[len(got)-1].Type != EVENT_TREE_RELOADED {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-timeout:
+			t.Fatalf("no reload, got %v", got)
+		}
+	}
+	added, deleted := false, false
+	for _, ev := range got {
+		added = added || (ev.Type == EVENT_NODE_ADDED && ev.Hash == "COPIEDNO")
+		deleted = deleted || (ev.Type == EVENT_NODE_DELETED && ev.Hash == gone.GetHash())
+	}
+	if !added || !deleted || len(got) != 3 {
+		t.Errorf("events %v", got)
+	}
+	if n := m.FS.HashLookup("COPIEDNO"); n == nil || n.GetName() != "a.txt" || n.parent != root {
+		t.Errorf("missed node not added")
+	}
+	if m.FS.HashLookup(gone.GetHash()) != nil || m.FS.HashLookup(a.GetHash()) == nil {
+		t.Errorf("tree not reconciled")
+	}
+	if c := <-cursors; c != "fakesn" || m.EventCursor() != "fakesn" {
+		t.Errorf("cursor %q", c)
+	}
+}
+
+func TestEventCursor(t *testing.T) {
+	polled := make(chan string, 1)
+	m, b := newFakeMegaWith(t, func(m *Mega) {
+		if err := WithEventCursor("oldsn")(m); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer b.Close()
+	b.eventsMu.Lock()
+	b.events = func(sn string) (string, int) {
+		select {
+		case polled <- sn:
+		default:
+		}
+		return "", 0
+	}
+	b.eventsMu.Unlock()
+
+	select {
+	case sn := <-polled:
+		if sn != "oldsn" {
+			t.Errorf("polled from %q, want oldsn", sn)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not polled")
+	}
+	if m.getConfig().cursor != "" {
+		t.Errorf("cursor kept for the next login")
+	}
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	a, err := m.CreateDir("a", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := m.CreateDir("sub", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inA := uploadString(t, m, sub, "in-a", "data")
+	outside := uploadString(t, m, root, "outside", "data")
+
+	var all, under, deletes, both []Event
+	m.Subscribe(func(ev Event) { all = append(all, ev) })
+	m.SubscribeFiltered(EventFilter{Under: []*Node{a}}, func(ev Event) { under = append(under, ev) })
+	m.SubscribeFiltered(EventFilter{Types: []EventType{EVENT_NODE_DELETED}}, func(ev Event) { deletes = append(deletes, ev) })
+	unsubscribe := m.SubscribeFiltered(EventFilter{Types: []EventType{EVENT_NODE_DELETED}, Under: []*Node{a}}, func(ev Event) { both = append(both, ev) })
+
+	// a deleted node is still matched by where it was
+	m.FS.mutex.Lock()
+	m.FS.removeTree(inA)
+	m.FS.mutex.Unlock()
+
+	m.emitEvents([]Event{
+		{Type: EVENT_NODE_UPDATED, Node: inA, Hash: inA.GetHash()},
+		{Type: EVENT_NODE_UPDATED, Node: outside, Hash: outside.GetHash()},
+		{Type: EVENT_NODE_DELETED, Node: inA, Hash: inA.GetHash()},
+		{Type: EVENT_NODE_DELETED, Node: outside, Hash: outside.GetHash()},
+		{Type: EVENT_NODE_UPDATED, Node: a, Hash: a.GetHash()},
+		{Type: EVENT_TREE_RELOADED},
+	})
+	if len(all) != 6 {
+		t.Errorf("unfiltered got %d events, want 6", len(all))
+	}
+	if len(under) != 4 || under[0].Node != inA || under[1].Node != inA || under[2].Node != a || under[3].Type != EVENT_TREE_RELOADED {
+		t.Errorf("under a got %v", under)
+	}
+	if len(deletes) != 2 || deletes[0].Node != inA || deletes[1].Node != outside {
+		t.Errorf("deletes got %v", deletes)
+	}
+	if len(both) != 1 || both[0].Node != inA {
+		t.Errorf("deletes under a got %v", both)
+	}
+
+	unsubscribe()
+	m.emitEvents([]Event{{Type: EVENT_NODE_DELETED, Node: sub, Hash: sub.GetHash()}})
+	if len(both) != 1 {
+		t.Errorf("called after unsubscribe")
+	}
+}
@@ -0,0 +1,428 @@
+package mega
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is an in memory MEGA account for tests which exercise
+// whole operations such as uploads and syncs against the real client
+// code.  It stores whatever the client sends so it never needs the
+// keys.
+type fakeBackend struct {
+	*mockServer
+	mu    sync.Mutex
+	nodes map[string]*FSNode
+	// uploaded data by upload id
+	uploads map[string][]byte
+	// size of each upload and the bytes received by chunk offset
+	uploadSizes  map[string]int
+	uploadChunks map[string]map[int]int
+	// file contents by node handle
+	data map[string][]byte
+	next int
+	// extra can handle commands the fake doesn't know about
+	extra func(cmd map[string]interface{}, r *http.Request) interface{}
+	// upload ids whose URL has expired
+	expired map[string]bool
+	// upload and download chunk requests fail if these return true
+	failUpload   func(id string, offset int) bool
+	failDownload func(h string, start int) bool
+	// called before serving each download chunk, outside the lock
+	beforeDownload func(h string, start int)
+	// chunk requests seen by "id/offset" or "handle/start"
+	requests map[string]int
+	// uploaded file attributes by handle
+	fileAttrs map[string][]byte
+}
+
+// Error codes returned by the fake
+const (
+	fakeEARGS  ErrorMsg = -2
+	fakeENOENT ErrorMsg = -9
+)
+
+const (
+	fakeUser  = "FakeUser"
+	fakeRoot  = "FakeRoot"
+	fakeTrash = "FakeTrsh"
+	// only there if a test adds it
+	fakeInbox = "FakeInbx"
+)
+
+// newFakeMega returns a Mega logged into a fresh fake account
+func newFakeMega(t *testing.T) (*Mega, *fakeBackend) {
+	return newFakeMegaWith(t, nil)
+}
+
+// newFakeMegaWith is newFakeMega calling setup, if not nil, on the Mega
+// before it logs in and starts polling for events
+func newFakeMegaWith(t *testing.T, setup func(m *Mega)) (*Mega, *fakeBackend) {
+	b := &fakeBackend{
+		nodes: map[string]*FSNode{
+			fakeRoot:  {Hash: fakeRoot, T: ROOT, User: fakeUser},
+			fakeTrash: {Hash: fakeTrash, T: TRASH, User: fakeUser},
+		},
+		uploads:      make(map[string][]byte),
+		uploadSizes:  make(map[string]int),
+		uploadChunks: make(map[string]map[int]int),
+		expired:      make(map[string]bool),
+		data:         make(map[string][]byte),
+		requests:     make(map[string]int),
+		fileAttrs:    make(map[string][]byte),
+	}
+	b.mockServer = newMockServer(t, b.handle)
+	b.Config.Handler.(*http.ServeMux).HandleFunc("/ul/", b.upload)
+	b.Config.Handler.(*http.ServeMux).HandleFunc("/dl/", b.download)
+	b.Config.Handler.(*http.ServeMux).HandleFunc("/fa/", b.fileAttr)
+
+	m := newMockSession(t, b.mockServer)
+	m.k = make([]byte, 16)
+	_, _ = rand.Read(m.k)
+	m.sid = "fakesid"
+	if setup != nil {
+		setup(m)
+	}
+	err := m.getFileSystem()
+	if err != nil {
+		t.Fatalf("getFileSystem: %v", err)
+	}
+	return m, b
+}
+
+// newHandle returns a new unique node handle
+//
+// Call with the mutex held
+func (b *fakeBackend) newHandle() string {
+	b.next++
+	return fmt.Sprintf("N%07d", b.next)
+}
+
+// children returns the handles of the nodes below h
+//
+// Call with the mutex held
+func (b *fakeBackend) children(h string) (hs []string) {
+	for _, n := range b.nodes {
+		if n.Parent == h {
+			hs = append(hs, n.Hash)
+		}
+	}
+	return hs
+}
+
+// remove deletes h and everything below it
+//
+// Call with the mutex held
+func (b *fakeBackend) remove(h string) {
+	for _, c := range b.children(h) {
+		b.remove(c)
+	}
+	delete(b.nodes, h)
+	delete(b.data, h)
+}
+
+func (b *fakeBackend) handle(cmd map[string]interface{}, r *http.Request) interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.extra != nil {
+		if res := b.extra(cmd, r); res != nil {
+			return res
+		}
+	}
+
+	str := func(k string) string {
+		s, _ := cmd[k].(string)
+		return s
+	}
+	switch cmd["a"] {
+	case "f":
+		nodes := make([]FSNode, 0, len(b.nodes))
+		// parents must come before their children
+		var add func(h string)
+		add = func(h string) {
+			nodes = append(nodes, *b.nodes[h])
+			for _, c := range b.children(h) {
+				add(c)
+			}
+		}
+		if h := str("n"); h != "" {
+			// one folder and its children
+			if b.nodes[h] == nil {
+				return fakeENOENT
+			}
+			nodes = append(nodes, *b.nodes[h])
+			for _, c := range b.children(h) {
+				nodes = append(nodes, *b.nodes[c])
+			}
+			return map[string]interface{}{"f": nodes, "sn": "fakesn"}
+		}
+		add(fakeRoot)
+		add(fakeTrash)
+		if b.nodes[fakeInbox] != nil {
+			add(fakeInbox)
+		}
+		return map[string]interface{}{"f": nodes, "sn": "fakesn"}
+	case "uq":
+		// the top level folders by the storage they use
+		cstrgn := map[string][]int64{fakeRoot: {0, 0, 0, 0, 0}, fakeTrash: {0, 0, 0, 0, 0}}
+		if b.nodes[fakeInbox] != nil {
+			cstrgn[fakeInbox] = []int64{0, 0, 0, 0, 0}
+		}
+		return map[string]interface{}{"cstrgn": cstrgn}
+	case "u":
+		b.next++
+		id := strconv.Itoa(b.next)
+		size, _ := cmd["s"].(float64)
+		b.uploadSizes[id] = int(size)
+		b.uploadChunks[id] = make(map[int]int)
+		return map[string]interface{}{"p": fmt.Sprintf("%s/ul/%s", b.URL, id)}
+	case "p":
+		parent := str("t")
+		if b.nodes[parent] == nil {
+			return fakeENOENT
+		}
+		var res []FSNode
+		for _, raw := range cmd["n"].([]interface{}) {
+			in := raw.(map[string]interface{})
+			n := &FSNode{
+				Hash:   b.newHandle(),
+				Parent: parent,
+				User:   fakeUser,
+				T:      NodeType(in["t"].(float64)),
+				Attr:   in["a"].(string),
+				Key:    fakeUser + ":" + in["k"].(string),
+				Ts:     time.Now().Unix(),
+			}
+			if n.T == FILE {
+				h := in["h"].(string)
+				data, ok := b.uploads[strings.TrimPrefix(h, "ch")]
+				if src := b.nodes[h]; src != nil && src.T == FILE {
+					// a copy of an existing file
+					data, ok = b.data[h], true
+					n.Fa = src.Fa
+				}
+				if !ok {
+					return fakeEARGS
+				}
+				b.data[n.Hash] = data
+				n.Sz = int64(len(data))
+			}
+			b.nodes[n.Hash] = n
+			res = append(res, *n)
+		}
+		return map[string]interface{}{"f": res}
+	case "m":
+		n, t := b.nodes[str("n")], b.nodes[str("t")]
+		if n == nil || t == nil {
+			return fakeENOENT
+		}
+		n.Parent = t.Hash
+		return 0
+	case "a":
+		n := b.nodes[str("n")]
+		if n == nil {
+			return fakeENOENT
+		}
+		n.Attr = str("attr")
+		return 0
+	case "k":
+		nk, _ := cmd["nk"].([]interface{})
+		for i := 0; i+1 < len(nk); i += 2 {
+			n := b.nodes[nk[i].(string)]
+			if n == nil {
+				return fakeENOENT
+			}
+			n.Key = fakeUser + ":" + nk[i+1].(string)
+		}
+		return 0
+	case "d":
+		if b.nodes[str("n")] == nil {
+			return fakeENOENT
+		}
+		b.remove(str("n"))
+		return 0
+	case "pfa":
+		n := b.nodes[str("n")]
+		if n == nil {
+			return fakeENOENT
+		}
+		fa := str("fa")
+		typ := fa[:strings.IndexByte(fa, '*')+1]
+		attrs := []string{"1:" + fa}
+		for _, a := range strings.Split(n.Fa, "/") {
+			if a != "" && !strings.HasPrefix(a[strings.IndexByte(a, ':')+1:], typ) {
+				attrs = append(attrs, a)
+			}
+		}
+		n.Fa = strings.Join(attrs, "/")
+		return n.Fa
+	case "ufa":
+		if cmd["fah"] != nil {
+			return map[string]string{"p": b.URL + "/fa/get"}
+		}
+		return map[string]string{"p": b.URL + "/fa/"}
+	case "g":
+		n := b.nodes[str("n")]
+		if n == nil || n.T != FILE {
+			return fakeENOENT
+		}
+		return map[string]interface{}{"g": b.URL + "/dl/" + n.Hash, "s": n.Sz, "at": n.Attr}
+	}
+	b.t.Errorf("fake: unexpected command %v", cmd)
+	return fakeEARGS
+}
+
+// upload handles POST /ul/<id>/<offset>
+// fileAttr stores an uploaded file attribute, answering with its handle
+func (b *fakeBackend) fileAttr(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad upload", http.StatusBadRequest)
+		return
+	}
+	b.mu.Lock()
+	if r.URL.Path == "/fa/get" {
+		// answer with each attribute asked for
+		var reply []byte
+		for i := 0; i+8 <= len(body); i += 8 {
+			data := b.fileAttrs[base64urlencode(body[i:i+8])]
+			b.requests["fa/"+string(body[i:i+8])]++
+			reply = append(reply, body[i:i+8]...)
+			reply = append(reply, byte(len(data)), byte(len(data)>>8), byte(len(data)>>16), byte(len(data)>>24))
+			reply = append(reply, data...)
+		}
+		b.mu.Unlock()
+		_, _ = w.Write(reply)
+		return
+	}
+	b.next++
+	h := fmt.Sprintf("fa%06d", b.next)
+	b.fileAttrs[base64urlencode([]byte(h))] = body
+	b.mu.Unlock()
+	_, _ = w.Write([]byte(h))
+}
+
+func (b *fakeBackend) upload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ul/"), "/")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(parts) != 2 {
+		http.Error(w, "bad upload", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	b.requests[parts[0]+"/"+parts[1]]++
+	if b.failUpload != nil && b.failUpload(parts[0], offset) {
+		b.mu.Unlock()
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	if b.expired[parts[0]] {
+		b.mu.Unlock()
+		_, _ = w.Write([]byte("-8"))
+		return
+	}
+	data := b.uploads[parts[0]]
+	if len(data) < offset+len(body) {
+		data = append(data, make([]byte, offset+len(body)-len(data))...)
+	}
+	copy(data[offset:], body)
+	b.uploads[parts[0]] = data
+
+	// Like MEGA only the chunk completing the upload gets the handle
+	received := b.uploadChunks[parts[0]]
+	if received == nil {
+		b.mu.Unlock()
+		http.Error(w, "bad upload", http.StatusBadRequest)
+		return
+	}
+	received[offset] = len(body)
+	total := 0
+	for _, n := range received {
+		total += n
+	}
+	done := total >= b.uploadSizes[parts[0]]
+	b.mu.Unlock()
+
+	if done {
+		_, _ = w.Write([]byte("ch" + parts[0]))
+	}
+}
+
+// download handles GET /dl/<handle>/<start>-<end>
+func (b *fakeBackend) download(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/dl/"), "/")
+	if len(parts) != 2 {
+		http.Error(w, "bad download", http.StatusBadRequest)
+		return
+	}
+	var start, end int
+	_, err := fmt.Sscanf(parts[1], "%d-%d", &start, &end)
+	b.mu.Lock()
+	before := b.beforeDownload
+	b.mu.Unlock()
+	if before != nil {
+		before(parts[0], start)
+	}
+
+	b.mu.Lock()
+	b.requests[fmt.Sprintf("%s/%d", parts[0], start)]++
+	fail := b.failDownload != nil && b.failDownload(parts[0], start)
+	data, ok := b.data[parts[0]]
+	b.mu.Unlock()
+	if fail {
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || !ok || start > end || end >= len(data) {
+		http.Error(w, "bad range", http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write(data[start : end+1])
+}
+
+// lookupPath returns the handle of the node at the slash separated
+// path below the root as seen by the client, checking the fake has
+// it too.  It returns "" if not found.
+func (b *fakeBackend) lookupPath(m *Mega, path string) string {
+	nodes, err := m.FS.PathLookup(m.FS.GetRoot(), strings.Split(path, "/"))
+	if err != nil {
+		return ""
+	}
+	h := nodes[len(nodes)-1].GetHash()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.nodes[h] == nil {
+		return ""
+	}
+	return h
+}
+
+// requestCount returns how many times the chunk request key was seen
+func (b *fakeBackend) requestCount(key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests[key]
+}
+
+// content returns the stored contents of the file with handle h
+func (b *fakeBackend) content(h string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.data[h]
+	return data, ok
+}
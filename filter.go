@@ -0,0 +1,138 @@
+package mega
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ContentFilter checks the contents of the files transferred, say to
+// scan them for malware or for data which mustn't leave the
+// organisation.  Its methods may be called from several goroutines at
+// once.  They needn't read all of r.
+type ContentFilter interface {
+	// CheckUpload reads the contents of the file name being
+	// uploaded.  An error stops the upload before the node is made.
+	CheckUpload(name string, r io.Reader) error
+	// CheckDownload reads the contents of the file n once it has been
+	// downloaded and its MAC checked.  An error fails the download.
+	CheckDownload(n *Node, r io.Reader) error
+}
+
+// SetContentFilter checks the contents of the files uploaded and
+// downloaded with f.  nil turns the checks off.
+//
+// Uploads from local files, with UploadFrom and from archives are
+// checked, as are downloads to local files and with DownloadTo to a
+// destination which is also an io.ReaderAt.  StreamArchive and the
+// transfers driven chunk by chunk with NewUpload and NewDownload
+// aren't, as the data has gone before it can be checked.
+func (m *Mega) SetContentFilter(f ContentFilter) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.filter = f
+}
+
+// WithContentFilter checks the contents of files transferred with f,
+// see SetContentFilter
+func WithContentFilter(f ContentFilter) Option {
+	return func(m *Mega) error {
+		m.config.filter = f
+		return nil
+	}
+}
+
+// checkUpload runs the content filter, if any, over the size bytes of
+// the file name read from r
+func (m *Mega) checkUpload(name string, r io.ReaderAt, size int64) error {
+	f := m.getConfig().filter
+	if f == nil {
+		return nil
+	}
+	err := f.CheckUpload(name, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return &FilterError{Name: name, Upload: true, Err: err}
+	}
+	return nil
+}
+
+// checkDownload runs the content filter, if any, over the size bytes
+// of the file n read from r
+func (m *Mega) checkDownload(n *Node, r io.ReaderAt, size int64) error {
+	f := m.getConfig().filter
+	if f == nil {
+		return nil
+	}
+	err := f.CheckDownload(n, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return &FilterError{Name: n.GetName(), Err: err}
+	}
+	return nil
+}
+
+// checkDownloadFile runs the content filter, if any, over the file n
+// downloaded to path, deleting the file if it is turned down
+func (m *Mega) checkDownloadFile(n *Node, path string) error {
+	if m.getConfig().filter == nil {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = m.checkDownload(n, file, n.GetSize())
+	_ = file.Close()
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// uploadFilter feeds the contents of a file uploaded as a stream to
+// the content filter as they are read
+type uploadFilter struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+// newUploadFilter starts the content filter, if any, reading the file
+// name.  It returns nil if there is no filter.
+func (m *Mega) newUploadFilter(name string) *uploadFilter {
+	f := m.getConfig().filter
+	if f == nil {
+		return nil
+	}
+	r, w := io.Pipe()
+	uf := &uploadFilter{w: w, done: make(chan error, 1)}
+	go func() {
+		err := f.CheckUpload(name, r)
+		// let the upload carry on whatever the filter left unread
+		_, _ = io.Copy(ioutil.Discard, r)
+		if err != nil {
+			err = &FilterError{Name: name, Upload: true, Err: err}
+		}
+		uf.done <- err
+	}()
+	return uf
+}
+
+// write passes the next bytes of the file to the filter
+func (uf *uploadFilter) write(b []byte) {
+	if uf != nil {
+		_, _ = uf.w.Write(b)
+	}
+}
+
+// close ends the file, returning the verdict of the filter if the
+// upload worked, which is err
+func (uf *uploadFilter) close(err error) error {
+	if uf == nil {
+		return err
+	}
+	_ = uf.w.CloseWithError(err)
+	filterErr := <-uf.done
+	if err != nil {
+		return err
+	}
+	return filterErr
+}
@@ -0,0 +1,140 @@
+package mega
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// errInfected is returned by wordFilter for files containing its word
+var errInfected = errors.New("infected")
+
+// wordFilter turns down files containing bad, keeping what it read
+type wordFilter struct {
+	bad string
+	mu  sync.Mutex
+	// contents read by file name
+	seen map[string]string
+}
+
+func (f *wordFilter) check(name string, r io.Reader) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.seen[name] = string(buf)
+	f.mu.Unlock()
+	if strings.Contains(string(buf), f.bad) {
+		return errInfected
+	}
+	return nil
+}
+
+func (f *wordFilter) CheckUpload(name string, r io.Reader) error {
+	return f.check(name, r)
+}
+
+func (f *wordFilter) CheckDownload(n *Node, r io.Reader) error {
+	return f.check(n.GetName(), r)
+}
+
+// memFile is a memWriterAt which can be read back
+type memFile struct {
+	memWriterAt
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.buf).ReadAt(p, off)
+}
+
+func TestContentFilter(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	root := m.FS.GetRoot()
+	clean := uploadString(t, m, root, "before.txt", "contains EVIL but uploaded before the filter")
+	filter := &wordFilter{bad: "EVIL", seen: make(map[string]string)}
+	m.SetContentFilter(filter)
+
+	dir, err := ioutil.TempDir("", "mega-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Uploads
+	good := uploadString(t, m, root, "good.txt", "harmless")
+	if filter.seen["good.txt"] != "harmless" {
+		t.Errorf("filter saw %q", filter.seen["good.txt"])
+	}
+	bad := filepath.Join(dir, "bad.txt")
+	if err = ioutil.WriteFile(bad, []byte("some EVIL data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.UploadFile(bad, root, "", nil)
+	var filterErr *FilterError
+	if !errors.As(err, &filterErr) || !filterErr.Upload || !errors.Is(err, errInfected) {
+		t.Errorf("UploadFile: got %v, want upload FilterError", err)
+	}
+	data := []byte("more EVIL")
+	_, err = m.UploadFrom(bytes.NewReader(data), int64(len(data)), root, "from.txt", nil)
+	if !errors.As(err, &filterErr) {
+		t.Errorf("UploadFrom: got %v, want FilterError", err)
+	}
+
+	// Archives are checked as they stream
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, f := range []struct{ name, data string }{{"ok.txt", "fine"}, {"worm.txt", strings.Repeat("x", 200000) + "EVIL"}} {
+		_ = tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))})
+		_, _ = tw.Write([]byte(f.data))
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := m.UploadArchive(&tarBuf, ARCHIVE_TAR, root)
+	if !errors.As(err, &filterErr) || report.Count(ITEM_DONE) != 1 || report.Count(ITEM_FAILED) != 1 {
+		t.Errorf("UploadArchive: got %v, %+v", err, report.Items)
+	}
+	if len(filter.seen["worm.txt"]) != 200004 {
+		t.Errorf("filter saw %d bytes of the archived file", len(filter.seen["worm.txt"]))
+	}
+
+	children, err := m.FS.GetChildren(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range children {
+		names = append(names, c.GetName())
+	}
+	if len(names) != 3 {
+		t.Errorf("files uploaded: %q, want before.txt, good.txt and ok.txt", names)
+	}
+
+	// Downloads
+	dst := filepath.Join(dir, "good.txt")
+	if err = m.DownloadFile(good, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	dst = filepath.Join(dir, "before.txt")
+	err = m.DownloadFile(clean, dst, nil)
+	if !errors.As(err, &filterErr) || filterErr.Upload {
+		t.Errorf("DownloadFile: got %v, want download FilterError", err)
+	}
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("rejected download kept: %v", err)
+	}
+	w := &memFile{}
+	err = m.DownloadTo(clean, w, nil)
+	if !errors.As(err, &filterErr) {
+		t.Errorf("DownloadTo: got %v, want FilterError", err)
+	}
+}
@@ -0,0 +1,303 @@
+package mega
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/SeyitDurmus/go-mega/urlparse"
+)
+
+// folderLink holds the state of a folder link session
+type folderLink struct {
+	// public handle of the link
+	handle string
+	// key of the shared folder
+	key []byte
+	// write auth key for writable links
+	auth string
+}
+
+// authQuery returns the query parameters which authenticate API and
+// event requests for the session
+func (m *Mega) authQuery() string {
+	if m.flink != nil {
+		q := "&n=" + m.flink.handle
+		if m.flink.auth != "" {
+			q += "&wa=" + url.QueryEscape(m.flink.auth)
+		}
+		return q
+	}
+	if m.sid != "" {
+		return "&sid=" + m.sid
+	}
+	return ""
+}
+
+// parseFolderLink returns the public handle and key from a folder
+// link
+func parseFolderLink(link string) (handle string, key []byte, err error) {
+	l, err := urlparse.ParseLink(link)
+	if err != nil {
+		return "", nil, err
+	}
+	if l.Type != urlparse.LINK_FOLDER || l.Password || l.Key == "" {
+		return "", nil, EARGS
+	}
+	key, err = base64urldecode(l.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	return l.Handle, key, nil
+}
+
+// OpenFolderLink starts an anonymous session on the folder link given
+// and loads the filesystem below it.  FS.GetRoot() returns the folder
+// of the link.
+func (m *Mega) OpenFolderLink(link string) error {
+	return m.OpenWritableFolderLink(link, "")
+}
+
+// OpenFolderLinkContext opens the folder link given as OpenFolderLink
+// does, giving up loading the filesystem if ctx is done and reporting
+// its progress to the function set with SetLoadProgress
+func (m *Mega) OpenFolderLinkContext(ctx context.Context, link string) error {
+	return m.openFolderLink(ctx, link, "")
+}
+
+// OpenWritableFolderLink starts an anonymous session on the folder
+// link given as OpenFolderLink does.  If auth is the AuthKey of a
+// WritableLink then files may be uploaded and folders created in the
+// link with UploadFile and CreateDir.
+func (m *Mega) OpenWritableFolderLink(link string, auth string) error {
+	return m.openFolderLink(context.Background(), link, auth)
+}
+
+// openFolderLink is OpenWritableFolderLink loading the filesystem with
+// ctx
+func (m *Mega) openFolderLink(ctx context.Context, link string, auth string) error {
+	handle, key, err := parseFolderLink(link)
+	if err != nil {
+		return err
+	}
+
+	m.flink = &folderLink{
+		handle: handle,
+		key:    key,
+		auth:   auth,
+	}
+	// Node keys are all encrypted with the folder key so use it as
+	// the master key for decrypting and encrypting them
+	m.k = key
+	m.sid = ""
+	m.FS = newMegaFS()
+
+	waitEvent := m.WaitEventsStart()
+
+	err = m.getFileSystemContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.WaitEvents(waitEvent, 5*time.Second)
+
+	return nil
+}
+
+// WritableLink is a folder link which anonymous users can upload to
+type WritableLink struct {
+	// URL of the folder link including the decryption key
+	URL string
+	// AuthKey must be passed to OpenWritableFolderLink to upload
+	AuthKey string
+}
+
+// handleAuth returns the handle authentication for a share of h
+func handleAuth(master_aes cipher.Block, h string) string {
+	buf := make([]byte, aes.BlockSize)
+	copy(buf, h+h)
+	master_aes.Encrypt(buf, buf)
+	return base64urlencode(buf)
+}
+
+// makeCr returns the cr element of a request which supplies the keys
+// of nodes encrypted with the share key sk of the share with handle
+// sh
+//
+// Call with the FS mutex held
+func makeCr(sh string, sk []byte, nodes []*Node) ([]interface{}, error) {
+	sk_aes, err := aes.NewCipher(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	handles := make([]string, 0, len(nodes))
+	keys := make([]interface{}, 0, 3*len(nodes))
+	for _, n := range nodes {
+		if len(n.meta.compkey) == 0 {
+			continue
+		}
+		buf := make([]byte, len(n.meta.compkey))
+		err = blockEncrypt(sk_aes, buf, n.meta.compkey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, 0, len(handles), base64urlencode(buf))
+		handles = append(handles, n.hash)
+	}
+
+	return []interface{}{[]string{sh}, handles, keys}, nil
+}
+
+// shareKey returns the share key for the folder n creating a new one
+// if it isn't shared yet
+//
+// Call with the FS mutex held
+func (m *Mega) shareKey(n *Node) (sk []byte, err error) {
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := m.FS.skmap[n.hash]; ok {
+		sk, err = base64urldecode(k)
+		if err != nil {
+			return nil, err
+		}
+		err = blockDecrypt(master_aes, sk, sk)
+		if err != nil {
+			return nil, err
+		}
+		return sk, nil
+	}
+
+	cfg := m.getConfig()
+	return cfg.randomKey(aes.BlockSize)
+}
+
+// exportFolder shares the folder n with the special EXP user which
+// is needed before a folder link can be created, returning the
+// share key.
+func (m *Mega) exportFolder(n *Node) ([]byte, error) {
+	// every node in the folder needs its key sent
+	err := m.LoadTree(n)
+	if err != nil {
+		return nil, err
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if n.ntype != FOLDER {
+		return nil, EARGS
+	}
+	if err = m.FS.checkAccess(n, ACCESS_OWNER); err != nil {
+		return nil, err
+	}
+
+	sk, err := m.shareKey(n)
+	if err != nil {
+		return nil, err
+	}
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return nil, err
+	}
+	ok := make([]byte, len(sk))
+	err = blockEncrypt(master_aes, ok, sk)
+	if err != nil {
+		return nil, err
+	}
+
+	// Supply the keys of the existing contents with the share key
+	var nodes []*Node
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(n)
+	cr, err := makeCr(n.hash, sk, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg [1]ShareMsg
+	msg[0].Cmd = "s2"
+	msg[0].N = n.hash
+	msg[0].S = []ShareUser{{U: "EXP", R: 0}}
+	msg[0].Ok = base64urlencode(ok)
+	msg[0].Ha = handleAuth(master_aes, n.hash)
+	msg[0].Cr = cr
+	msg[0].I, err = m.newRequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	m.FS.skmap[n.hash] = base64urlencode(ok)
+	return sk, nil
+}
+
+// LinkWritable exports a folder link for the folder n which anonymous
+// users can upload files into, for example to collect files from
+// people without a MEGA account.
+//
+// Give both the URL and the AuthKey to the uploader who should open it
+// with OpenWritableFolderLink.  Anyone with just the URL can only
+// read the folder.
+func (m *Mega) LinkWritable(n *Node) (WritableLink, error) {
+	if n == nil {
+		return WritableLink{}, EARGS
+	}
+
+	sk, err := m.exportFolder(n)
+	if err != nil {
+		return WritableLink{}, err
+	}
+
+	var msg [1]GetLinkMsg
+	var res [1]WritableLinkResp
+
+	msg[0].Cmd = "l"
+	msg[0].N = n.GetHash()
+	msg[0].W = "1"
+	msg[0].I, err = m.newRequestID()
+	if err != nil {
+		return WritableLink{}, err
+	}
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return WritableLink{}, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return WritableLink{}, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return WritableLink{}, err
+	}
+	if res[0].Ph == "" || res[0].W == "" {
+		return WritableLink{}, EBADRESP
+	}
+
+	return WritableLink{
+		URL:     fmt.Sprintf("%v/#F!%v!%v", BASE_DOWNLOAD_URL, res[0].Ph, base64urlencode(sk)),
+		AuthKey: res[0].W,
+	}, nil
+}
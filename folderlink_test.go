@@ -0,0 +1,83 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"net/http"
+	"testing"
+)
+
+func TestParseFolderLink(t *testing.T) {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	k := base64urlencode(key)
+	for _, link := range []string{
+		"https://mega.nz/folder/AbCdEfGh#" + k,
+		"https://mega.nz/folder/AbCdEfGh#" + k + "/folder/XXXXXXXX",
+		"https://mega.co.nz/#F!AbCdEfGh!" + k,
+		"https://mega.nz/#F!AbCdEfGh!" + k + "!XXXXXXXX",
+	} {
+		h, gotKey, err := parseFolderLink(link)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", link, err)
+			continue
+		}
+		if h != "AbCdEfGh" || string(gotKey) != string(key) {
+			t.Errorf("%q: wrong result %q %x", link, h, gotKey)
+		}
+	}
+	for _, link := range []string{
+		"",
+		"https://mega.nz/file/AbCdEfGh#" + k,
+		"https://mega.nz/folder/AbCdEfGh",
+		"https://mega.nz/#F!AbCdEfGh!short",
+	} {
+		_, _, err := parseFolderLink(link)
+		if err == nil {
+			t.Errorf("%q: expecting error", link)
+		}
+	}
+}
+
+func TestOpenFolderLink(t *testing.T) {
+	folderKey := make([]byte, 16)
+	_, _ = rand.Read(folderKey)
+	fk_aes, _ := aes.NewCipher(folderKey)
+
+	// node key of the root, encrypted with the folder key
+	nodeKey := make([]byte, 16)
+	_, _ = rand.Read(nodeKey)
+	enc := make([]byte, 16)
+	_ = blockEncrypt(fk_aes, enc, nodeKey)
+	attr, _ := encryptAttr(nodeKey, FileAttr{Name: "linked"})
+
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if r.URL.Query().Get("n") != "PubHandl" || r.URL.Query().Get("wa") != "secret" {
+			t.Errorf("bad auth in %q", r.URL)
+		}
+		if cmd["a"] != "f" || cmd["r"] != 1.0 {
+			t.Errorf("unexpected command %v", cmd)
+		}
+		return map[string]interface{}{
+			"f": []FSNode{{
+				Hash: "RootHndl",
+				User: "OwnerUserXX",
+				T:    FOLDER,
+				Attr: attr,
+				Key:  "RootHndl:" + base64urlencode(enc),
+			}},
+			"sn": "abc",
+		}
+	})
+	defer srv.Close()
+
+	m := newMockSession(t, srv)
+	err := m.OpenWritableFolderLink("https://mega.nz/folder/PubHandl#"+base64urlencode(folderKey), "secret")
+	if err != nil {
+		t.Fatalf("OpenWritableFolderLink failed: %v", err)
+	}
+	root := m.FS.GetRoot()
+	if root == nil || root.GetName() != "linked" || root.GetHash() != "RootHndl" {
+		t.Fatalf("wrong root: %+v", root)
+	}
+}
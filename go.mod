@@ -1,5 +1,9 @@
 module github.com/SeyitDurmus/go-mega
 
-require golang.org/x/crypto v0.31.0
+require (
+	github.com/fsnotify/fsnotify v1.5.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.31.0
+)
 
 go 1.13
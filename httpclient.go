@@ -0,0 +1,63 @@
+//go:build !js
+// +build !js
+
+package mega
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHttpClient returns a client whose connections time out after
+// timeout, looking up hosts with resolver if it isn't nil
+func newHttpClient(timeout time.Duration, resolver Resolver) *http.Client {
+	// TODO: Need to test this out
+	// Doesn't seem to work as expected
+	c := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(netw, addr string) (net.Conn, error) {
+				if resolver != nil {
+					return resolveDial(resolver, timeout, netw, addr)
+				}
+				c, err := net.DialTimeout(netw, addr, timeout)
+				if err != nil {
+					return nil, err
+				}
+				return c, nil
+			},
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+	return c
+}
+
+// resolveDial connects to addr, trying each of the addresses resolver
+// gives for its host in turn
+func resolveDial(resolver Resolver, timeout time.Duration, netw, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return net.DialTimeout(netw, addr, timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ips, err := resolver.LookupHost(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	for _, ip := range ips {
+		var c net.Conn
+		c, err = net.DialTimeout(netw, net.JoinHostPort(ip, port), timeout)
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
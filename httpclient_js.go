@@ -0,0 +1,14 @@
+package mega
+
+import (
+	"net/http"
+	"time"
+)
+
+// newHttpClient returns a client using the default transport which in
+// the browser makes requests with fetch.  A transport with its own
+// dialer would try to open sockets, which the browser doesn't allow,
+// so neither the connection timeout nor the resolver can be applied.
+func newHttpClient(timeout time.Duration, resolver Resolver) *http.Client {
+	return &http.Client{}
+}
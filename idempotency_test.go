@@ -0,0 +1,157 @@
+package mega
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// loseFirstReply is a transport which lets the first API request
+// containing match reach the server then pretends the reply was lost
+type loseFirstReply struct {
+	next  http.RoundTripper
+	match string
+
+	mu   sync.Mutex
+	lost bool
+}
+
+func (l *loseFirstReply) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil && req.GetBody != nil {
+		rc, _ := req.GetBody()
+		buf := new(strings.Builder)
+		_, _ = io.Copy(buf, rc)
+		body = buf.String()
+	}
+	resp, err := l.next.RoundTrip(req)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil && !l.lost && strings.Contains(body, l.match) {
+		l.lost = true
+		_ = resp.Body.Close()
+		return nil, errors.New("connection reset")
+	}
+	return resp, err
+}
+
+// recordIDs records the "i" of each command a sent to the fake
+func recordIDs(b *fakeBackend, a string) func() []string {
+	var ids []string
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == a {
+			id, _ := cmd["i"].(string)
+			ids = append(ids, id)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+	return func() []string {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return append([]string(nil), ids...)
+	}
+}
+
+func TestCreateDirRetrySameID(t *testing.T) {
+	m, b := newFakeMegaWith(t, func(m *Mega) {
+		m.SetClient(&http.Client{Transport: &loseFirstReply{next: http.DefaultTransport, match: `"a":"p"`}})
+	})
+	defer b.Close()
+	ids := recordIDs(b, "p")
+
+	_, err := m.CreateDir("dir", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ids()
+	if len(got) != 2 || got[0] == "" || got[0] != got[1] {
+		t.Errorf("retried request IDs %q, want two the same", got)
+	}
+
+	// The caller can retry with its own ID too
+	_, _ = m.CreateDirWithID("again", m.FS.GetRoot(), "myid123456")
+	_, _ = m.CreateDirWithID("again", m.FS.GetRoot(), "myid123456")
+	got = ids()[2:]
+	if len(got) != 2 || got[0] != "myid123456" || got[1] != "myid123456" {
+		t.Errorf("request IDs %q, want the caller's", got)
+	}
+	if _, err := m.CreateDirWithID("x", m.FS.GetRoot(), ""); err != EARGS {
+		t.Errorf("empty ID: %v", err)
+	}
+}
+
+func TestUploadCompletionSameID(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	u, err := m.NewUpload(m.FS.GetRoot(), "f.txt", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.UploadChunk(0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ids := recordIDs(b, "p")
+	fail := true
+	b.mu.Lock()
+	extra := b.extra
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		extra(cmd, r)
+		if cmd["a"] == "p" && fail {
+			fail = false
+			return ErrorMsg(-18)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	// Resuming from the saved state keeps the ID too
+	st := u.State()
+	if _, err = u.Finish(); err != ETEMPUNAVAIL {
+		t.Fatalf("want ETEMPUNAVAIL, got %v", err)
+	}
+	u, err = m.ResumeUpload(m.FS.GetRoot(), "f.txt", 5, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	got := ids()
+	if len(got) != 2 || got[0] == "" || got[0] != got[1] || got[0] != st.CompletionID {
+		t.Errorf("completion request IDs %q, want two of %q", got, st.CompletionID)
+	}
+}
+
+func TestCreateDirTempHandle(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	// bytes which are "+" and "/" in standard base64
+	m.SetIDSource(bytes.NewReader(bytes.Repeat([]byte{0xfb, 0xef, 0xbf}, 100)))
+	var handle string
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "p" {
+			handle = cmd["n"].([]interface{})[0].(map[string]interface{})["h"].(string)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	_, err := m.CreateDirWithID("dir", m.FS.GetRoot(), "id12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if h, err := base64urldecode(handle); err != nil || len(h) != 6 || strings.ContainsAny(handle, "+/=") {
+		t.Errorf("temporary handle %q isn't a node handle", handle)
+	}
+}
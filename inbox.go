@@ -0,0 +1,144 @@
+package mega
+
+import (
+	"crypto/aes"
+	"encoding/json"
+)
+
+// The inbox holds the files and folders other users have sent to the
+// account.  Their keys arrive encrypted to the account's public key and
+// are rewritten under the master key when they are moved out.  Nothing
+// may be added to the inbox by the account itself.
+
+// InInbox returns true if n is the inbox or below it
+func (fs *MegaFS) InInbox(n *Node) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.inInbox(n)
+}
+
+// inInbox returns true if n is the inbox or below it
+//
+// Call with the FS mutex held
+func (fs *MegaFS) inInbox(n *Node) bool {
+	for ; n != nil; n = n.parent {
+		if n == fs.inbox {
+			return true
+		}
+	}
+	return false
+}
+
+// ListInbox returns the files and folders in the inbox, or ENOENT if
+// the account has none
+func (m *Mega) ListInbox() ([]*Node, error) {
+	inbox := m.FS.GetInbox()
+	if inbox == nil {
+		return nil, ENOENT
+	}
+	return m.FS.GetChildren(inbox)
+}
+
+// inboxItem returns EARGS unless n is in the inbox, not the inbox
+// itself
+func (m *Mega) inboxItem(n *Node) error {
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	if n == nil || n == m.FS.inbox || !m.FS.inInbox(n) {
+		return EARGS
+	}
+	return nil
+}
+
+// MoveFromInbox moves n, a file or folder in the inbox, to parent, or
+// to the root if parent is nil.  The keys of what is moved are
+// rewritten under the master key first.  It returns EARGS if n isn't in
+// the inbox and EACCESS if parent is.
+func (m *Mega) MoveFromInbox(n, parent *Node) error {
+	err := m.inboxItem(n)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		parent = m.FS.GetRoot()
+	}
+	err = m.rewriteInboxKeys(n)
+	if err != nil {
+		return err
+	}
+	return m.Move(n, parent)
+}
+
+// DeleteFromInbox deletes n, a file or folder in the inbox, as Delete
+// does.  It returns EARGS if n isn't in the inbox.
+func (m *Mega) DeleteFromInbox(n *Node, destroy bool) error {
+	err := m.inboxItem(n)
+	if err != nil {
+		return err
+	}
+	if !destroy {
+		// it will no longer be in the inbox
+		err = m.rewriteInboxKeys(n)
+		if err != nil {
+			return err
+		}
+	}
+	return m.Delete(n, destroy)
+}
+
+// rewriteInboxKeys replaces the RSA encrypted keys of n and the nodes
+// below it with ones encrypted with the master key
+func (m *Mega) rewriteInboxKeys(n *Node) error {
+	err := m.LoadTree(n)
+	if err != nil {
+		return err
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return err
+	}
+	var msg [1]NodeKeysMsg
+	msg[0].Cmd = "k"
+	var handles []string
+	var walk func(n *Node) error
+	walk = func(n *Node) error {
+		if m.FS.rsaKeyed[n.hash] && len(n.meta.compkey) > 0 {
+			key := make([]byte, len(n.meta.compkey))
+			err := blockEncrypt(master_aes, key, n.meta.compkey)
+			if err != nil {
+				return err
+			}
+			msg[0].Nk = append(msg[0].Nk, n.hash, base64urlencode(key))
+			handles = append(handles, n.hash)
+		}
+		for _, c := range n.getChildren() {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = walk(n); err != nil {
+		return err
+	}
+	if len(handles) == 0 {
+		return nil
+	}
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = m.api_request(req)
+	if err != nil {
+		return err
+	}
+	for _, h := range handles {
+		delete(m.FS.rsaKeyed, h)
+	}
+	m.debugf("rewrote the keys of %d nodes from the inbox", len(handles))
+	return nil
+}
@@ -0,0 +1,135 @@
+package mega
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInbox(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if _, err := m.ListInbox(); err != ENOENT {
+		t.Errorf("no inbox: got %v", err)
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubk := base64urlencode(append(encodeMPI(priv.N), encodeMPI(big.NewInt(int64(priv.E)))...))
+	m.privk = &rsaPrivateKey{p: priv.Primes[0], q: priv.Primes[1], d: priv.D}
+
+	// Make a file and a folder then send them to the inbox with their
+	// keys encrypted to the public key, as another user would
+	root := m.FS.GetRoot()
+	keep, err := m.CreateDir("keep", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, root, "sent.txt", "hello")
+	dir, err := m.CreateDir("sentdir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := uploadString(t, m, dir, "inner.txt", "inner")
+	sent := []*Node{f, dir, g}
+	b.mu.Lock()
+	b.nodes[fakeInbox] = &FSNode{Hash: fakeInbox, T: INBOX, User: fakeUser}
+	for _, n := range sent {
+		fn := b.nodes[n.GetHash()]
+		if fn.Parent == fakeRoot {
+			fn.Parent = fakeInbox
+		}
+		k, err := encryptShareKey(n.meta.compkey, pubk, rand.Reader)
+		if err != nil {
+			b.mu.Unlock()
+			t.Fatal(err)
+		}
+		fn.Key = fakeUser + ":" + k
+	}
+	b.mu.Unlock()
+
+	session := func(privk *rsaPrivateKey) *Mega {
+		s := newMockSession(t, b.mockServer)
+		s.k, s.sid, s.privk = m.k, m.sid, privk
+		if err := s.getFileSystem(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	m = session(m.privk)
+	items, err := m.ListInbox()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("got %d items: %v", len(items), err)
+	}
+	f, dir, g = m.FS.HashLookup(f.GetHash()), m.FS.HashLookup(dir.GetHash()), m.FS.HashLookup(g.GetHash())
+	keep = m.FS.HashLookup(keep.GetHash())
+	for _, n := range []*Node{f, dir, g} {
+		if n == nil || n.DecryptionError() != nil || !m.FS.InInbox(n) {
+			t.Fatalf("%v not decrypted in the inbox", n)
+		}
+	}
+
+	// Nothing may be added, and only what is in it moved out
+	inbox := m.FS.GetInbox()
+	if _, err = m.CreateDir("x", inbox); err != EACCESS {
+		t.Errorf("CreateDir: got %v", err)
+	}
+	if err = m.Move(keep, dir); err != EACCESS {
+		t.Errorf("Move in: got %v", err)
+	}
+	if err = m.MoveFromInbox(keep, nil); err != EARGS {
+		t.Errorf("MoveFromInbox of a node outside: got %v", err)
+	}
+	if err = m.MoveFromInbox(inbox, nil); err != EARGS {
+		t.Errorf("MoveFromInbox of the inbox: got %v", err)
+	}
+	if err = m.MoveFromInbox(g, dir); err != EACCESS {
+		t.Errorf("MoveFromInbox within: got %v", err)
+	}
+
+	if err = m.MoveFromInbox(dir, keep); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.DeleteFromInbox(f, false); err != nil {
+		t.Fatal(err)
+	}
+	if items, err = m.ListInbox(); err != nil || len(items) != 0 {
+		t.Errorf("left %d items: %v", len(items), err)
+	}
+	m.FS.mutex.Lock()
+	if g.parent != dir || dir.parent != keep || f.parent != m.FS.trash {
+		t.Error("not moved")
+	}
+	m.FS.mutex.Unlock()
+	b.mu.Lock()
+	for _, n := range sent {
+		if k := b.nodes[n.GetHash()].Key; len(k) > len(fakeUser)+1+43 {
+			t.Errorf("%s: key not rewritten", n.GetName())
+		}
+	}
+	b.mu.Unlock()
+
+	// The keys are now under the master key
+	m = session(nil)
+	tmp, err := ioutil.TempDir("", "mega-inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, c := range []struct {
+		n    *Node
+		data string
+	}{{g, "inner"}, {f, "hello"}} {
+		n := m.FS.HashLookup(c.n.GetHash())
+		if n == nil || n.DecryptionError() != nil {
+			t.Fatalf("%s not decrypted", c.n.GetName())
+		}
+		checkDownload(t, m, n, filepath.Join(tmp, n.GetName()), []byte(c.data))
+	}
+}
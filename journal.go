@@ -0,0 +1,175 @@
+package mega
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalOp is the kind of change a JournalEntry records
+type JournalOp int
+
+// Journal operations
+const (
+	JOURNAL_CREATE JournalOp = iota // a node was added
+	JOURNAL_RENAME                  // a node changed name
+	JOURNAL_MOVE                    // a node moved to another folder
+	JOURNAL_UPDATE                  // the attributes of a node changed
+	JOURNAL_DELETE                  // a node was deleted permanently
+	JOURNAL_REPAIR                  // the key of a node arrived so it could be decrypted
+)
+
+var journalOps = []string{"create", "rename", "move", "update", "delete", "repair"}
+
+func (op JournalOp) String() string {
+	if op < 0 || int(op) >= len(journalOps) {
+		return "unknown"
+	}
+	return journalOps[op]
+}
+
+// MarshalText writes the operation by name
+func (op JournalOp) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+// UnmarshalText reads an operation written by MarshalText
+func (op *JournalOp) UnmarshalText(text []byte) error {
+	for i, name := range journalOps {
+		if name == string(text) {
+			*op = JournalOp(i)
+			return nil
+		}
+	}
+	return EARGS
+}
+
+// Sources of journal entries
+const (
+	JOURNAL_LOCAL  = "local"  // made by this client
+	JOURNAL_SERVER = "server" // received from the server event stream
+)
+
+// JournalEntry records one change to the filesystem.
+//
+// Changes made by this client are usually recorded twice, once as they
+// are made and again when the server sends them back as events.
+type JournalEntry struct {
+	// When the change was seen
+	Time time.Time `json:"time"`
+	// What happened
+	Op JournalOp `json:"op"`
+	// JOURNAL_LOCAL or JOURNAL_SERVER
+	Source string `json:"source"`
+	// Handle of the user who made the change if known
+	User string `json:"user,omitempty"`
+	// Hash of the node changed
+	Hash string `json:"hash"`
+	// Path before the change, for renames, moves, deletes and repairs
+	OldPath string `json:"old_path,omitempty"`
+	// Path after the change, for everything but deletes
+	Path string `json:"path,omitempty"`
+}
+
+// JournalSink receives the journal entries.  Write is called for each
+// change, from whichever goroutine made it, so must be safe for
+// concurrent use.  Errors are logged.
+type JournalSink interface {
+	Write(JournalEntry) error
+}
+
+// SetJournal records every change to the filesystem, made locally or
+// received from the server, to sink.  nil turns journaling off.
+func (m *Mega) SetJournal(sink JournalSink) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.journal = sink
+}
+
+// WithJournal records every change to the filesystem to sink
+func WithJournal(sink JournalSink) Option {
+	return func(m *Mega) error {
+		m.config.journal = sink
+		return nil
+	}
+}
+
+// journalEntry returns an entry for op on n with the current path of
+// n, or nil if journaling is off
+//
+// Call with the FS mutex held
+func (m *Mega) journalEntry(op JournalOp, source string, user string, n *Node, oldPath string) *JournalEntry {
+	if m.getConfig().journal == nil || n == nil {
+		return nil
+	}
+	e := &JournalEntry{
+		Op:      op,
+		Source:  source,
+		User:    user,
+		Hash:    n.hash,
+		OldPath: oldPath,
+	}
+	if op != JOURNAL_DELETE {
+		e.Path = m.FS.pathOf(n)
+	}
+	return e
+}
+
+// journal writes the entries to the journal.  nil entries are skipped.
+//
+// Call without the FS mutex held
+func (m *Mega) journal(entries ...*JournalEntry) {
+	sink := m.getConfig().journal
+	if sink == nil {
+		return
+	}
+	now := m.now()
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		e.Time = now
+		err := sink.Write(*e)
+		if err != nil {
+			m.logf("journal: %v", err)
+		}
+	}
+}
+
+// FileJournal is a JournalSink appending entries to a file as lines of
+// JSON
+type FileJournal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenFileJournal opens the journal file at path for appending,
+// creating it if necessary
+func OpenFileJournal(path string) (*FileJournal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{f: f}, nil
+}
+
+// Write appends e to the journal
+func (j *FileJournal) Write(e JournalEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.f.Write(buf)
+	return err
+}
+
+// Close closes the journal file
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
@@ -0,0 +1,123 @@
+package mega
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memJournal collects journal entries in memory
+type memJournal struct {
+	mu      sync.Mutex
+	entries []JournalEntry
+}
+
+func (j *memJournal) Write(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+func TestJournal(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	j := &memJournal{}
+	m.SetJournal(j)
+	m.handle = "MEMEMEMEMEM"
+
+	root := m.FS.GetRoot()
+	a, err := m.CreateDir("a", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdir, err := m.CreateDir("b", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, a, "f.txt", "hello")
+	if err = m.Rename(f, "g.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Move(f, bdir); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Delete(f, true); err != nil {
+		t.Fatal(err)
+	}
+	// A deletion received from the server
+	if err = m.processDeleteNode([]byte(`{"a":"d","n":"` + bdir.GetHash() + `","u":"OTHEROTHERO"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []JournalEntry{
+		{Op: JOURNAL_CREATE, Source: JOURNAL_LOCAL, Path: "Cloud Drive/a"},
+		{Op: JOURNAL_CREATE, Source: JOURNAL_LOCAL, Path: "Cloud Drive/b"},
+		{Op: JOURNAL_CREATE, Source: JOURNAL_LOCAL, Path: "Cloud Drive/a/f.txt"},
+		{Op: JOURNAL_RENAME, Source: JOURNAL_LOCAL, OldPath: "Cloud Drive/a/f.txt", Path: "Cloud Drive/a/g.txt"},
+		{Op: JOURNAL_MOVE, Source: JOURNAL_LOCAL, OldPath: "Cloud Drive/a/g.txt", Path: "Cloud Drive/b/g.txt"},
+		{Op: JOURNAL_DELETE, Source: JOURNAL_LOCAL, OldPath: "Cloud Drive/b/g.txt"},
+		{Op: JOURNAL_DELETE, Source: JOURNAL_SERVER, OldPath: "Cloud Drive/b", User: "OTHEROTHERO"},
+	}
+	j.mu.Lock()
+	got := j.entries
+	j.mu.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		w := want[i]
+		if w.User == "" {
+			w.User = "MEMEMEMEMEM"
+		}
+		if e.Op != w.Op || e.Source != w.Source || e.User != w.User || e.OldPath != w.OldPath || e.Path != w.Path || e.Hash == "" || e.Time.IsZero() {
+			t.Errorf("entry %d: got %+v, want %+v", i, e, w)
+		}
+	}
+}
+
+func TestFileJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mega-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+
+	for i := 0; i < 2; i++ {
+		j, err := OpenFileJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = j.Write(JournalEntry{Op: JOURNAL_MOVE, Source: JOURNAL_LOCAL, Hash: "h", OldPath: "x", Path: "y"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = j.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for sc := bufio.NewScanner(f); sc.Scan(); n++ {
+		var e JournalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %d: %v", n, err)
+		}
+		if e.Op != JOURNAL_MOVE || e.Path != "y" {
+			t.Errorf("line %d: %+v", n, e)
+		}
+	}
+	if n != 2 {
+		t.Errorf("journal has %d lines, want 2 appended", n)
+	}
+}
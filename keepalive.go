@@ -0,0 +1,61 @@
+package mega
+
+import (
+	"context"
+	"time"
+)
+
+// Default interval between the pings of KeepAlive
+const KEEPALIVE_INTERVAL = 5 * time.Minute
+
+// KeepAlive keeps the session from going stale in long running
+// processes which may sit idle for hours.  Every interval (or
+// KEEPALIVE_INTERVAL if 0) it pings the API with Ping unless another
+// request has succeeded since the last tick, so busy sessions aren't
+// charged any extra requests.
+//
+// When the server says the session is no longer valid reauth is
+// called, which should log in again, say with Login, and keeping alive
+// carries on if it returns nil.  KeepAlive returns ESID if reauth is
+// nil, or the error from reauth.  Other errors, for example network
+// ones, are logged and the session pinged again next time.
+//
+// KeepAlive blocks until ctx is done, then returns nil, so run it in
+// its own goroutine.
+func (m *Mega) KeepAlive(ctx context.Context, interval time.Duration, reauth func() error) error {
+	if interval <= 0 {
+		interval = KEEPALIVE_INTERVAL
+	}
+	last := m.now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-m.after(interval):
+			if m.metrics.lastActive().After(last) {
+				last = now
+				continue
+			}
+			last = now
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := m.Ping(pingCtx)
+		cancel()
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return nil
+		case err == ESID:
+			if reauth == nil {
+				return ESID
+			}
+			m.logf("keepalive: session expired, logging in again")
+			if err = reauth(); err != nil {
+				return err
+			}
+		default:
+			m.logf("keepalive: ping failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mega
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		pings++
+		if r.URL.Query().Get("sid") != "good" {
+			return ErrorMsg(-15)
+		}
+		return map[string]interface{}{"u": "me"}
+	})
+	defer srv.Close()
+	m := newMockSession(t, srv)
+	m.sid = "expired"
+
+	// Without reauth an expired session ends it
+	if err := m.KeepAlive(context.Background(), 10*time.Millisecond, nil); err != ESID {
+		t.Fatalf("got %v, want ESID", err)
+	}
+
+	reauths := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.KeepAlive(ctx, 10*time.Millisecond, func() error {
+			reauths++
+			m.sid = "good"
+			return nil
+		})
+	}()
+	waitFor(t, "pings", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pings >= 4
+	})
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("KeepAlive: %v", err)
+	}
+	if reauths != 1 {
+		t.Errorf("logged in again %d times, want 1", reauths)
+	}
+}
+
+func TestKeepAliveIdle(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		pings++
+		return map[string]interface{}{"u": "me"}
+	})
+	defer srv.Close()
+	m := newMockSession(t, srv)
+	m.sid = "good"
+
+	// Requests made by the session stand in for pings
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.KeepAlive(ctx, 50*time.Millisecond, nil)
+	}()
+	for i := 0; i < 10; i++ {
+		m.metrics.touch(time.Now())
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if pings != 0 {
+		t.Errorf("pinged a busy session %d times", pings)
+	}
+	mu.Unlock()
+	waitFor(t, "idle ping", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pings > 0
+	})
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("KeepAlive: %v", err)
+	}
+}
@@ -0,0 +1,377 @@
+package mega
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Nodes in an incoming share can only be decrypted if the owner has
+// given us the share key and put the key of each node under it.  When
+// either is missing RequestKeys asks for it with a "k" command, the
+// server passes the request on to the owner as a "k" event and, if the
+// owner has a client running, it answers with the keys.  Share keys
+// come back in a share event and node keys in a "k" event, and the
+// nodes are repaired as they arrive.
+
+// keyHandle returns the handle of the user or share a node key in itm
+// is encrypted for
+func keyHandle(itm FSNode) string {
+	i := strings.IndexByte(itm.Key, ':')
+	if i < 0 {
+		return ""
+	}
+	return itm.Key[:i]
+}
+
+// owned returns true if n is in our own tree rather than an incoming
+// share
+//
+// Call with the mutex held
+func (fs *MegaFS) owned(n *Node) bool {
+	for ; n != nil; n = n.parent {
+		if n == fs.root || n == fs.trash || n == fs.inbox {
+			return true
+		}
+	}
+	return false
+}
+
+// shareOf returns the handle of the incoming share n is in, or "" if
+// none
+//
+// Call with the mutex held
+func (fs *MegaFS) shareOf(n *Node) string {
+	for ; n != nil; n = n.parent {
+		if _, ok := fs.skmap[n.hash]; ok && n.hash != "" {
+			return n.hash
+		}
+	}
+	return ""
+}
+
+// RequestKeys asks the owners of the shares containing undecryptable
+// nodes for the missing keys, returning the number of nodes asked
+// about.
+//
+// The owners' clients answer while they are running.  The nodes are
+// repaired when the keys arrive, see Node.DecryptionError.
+func (m *Mega) RequestKeys() (int, error) {
+	m.FS.mutex.Lock()
+	if m.flink != nil {
+		m.FS.mutex.Unlock()
+		return 0, nil
+	}
+	hashes := make([]string, 0, len(m.FS.broken))
+	for h := range m.FS.broken {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	var sr, crShares, crNodes []string
+	seen := make(map[string]bool)
+	count := 0
+	for _, h := range hashes {
+		itm := m.FS.broken[h]
+		kh := keyHandle(itm)
+		switch {
+		case kh == "" || kh == m.handle:
+			// under our own master key so nobody can help
+			continue
+		case kh != itm.User && m.FS.skmap[kh] == "":
+			// under a share key we don't have
+			if !seen[kh] {
+				seen[kh] = true
+				sr = append(sr, kh)
+			}
+		default:
+			// not under a share key we have
+			sh := m.FS.shareOf(m.FS.lookup[h])
+			if sh == "" {
+				continue
+			}
+			if !seen[sh] {
+				seen[sh] = true
+				crShares = append(crShares, sh)
+			}
+			crNodes = append(crNodes, h)
+		}
+		count++
+	}
+	m.FS.mutex.Unlock()
+
+	if count == 0 {
+		return 0, nil
+	}
+	msg := KeyMsg{Sr: sr}
+	if len(crNodes) > 0 {
+		msg.Cr = []interface{}{crShares, crNodes}
+	}
+	err := m.sendKeys(msg)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// sendKeys sends a "k" command
+func (m *Mega) sendKeys(msg KeyMsg) error {
+	var err error
+	msg.Cmd = "k"
+	msg.I, err = m.newRequestID()
+	if err != nil {
+		return err
+	}
+	req, err := json.Marshal([1]KeyMsg{msg})
+	if err != nil {
+		return err
+	}
+	_, err = m.api_request(req)
+	return err
+}
+
+// userPublicKey fetches the RSA public key of the user with handle u
+func (m *Mega) userPublicKey(u string) (string, error) {
+	var msg [1]PubKeyMsg
+	var res [1]PubKeyResp
+
+	msg[0].Cmd = "uk"
+	msg[0].U = u
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return "", err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return "", err
+	}
+	if res[0].Pubk == "" {
+		return "", EKEY
+	}
+	return res[0].Pubk, nil
+}
+
+// shareRecipients fetches the handles of the users our share with
+// handle h is shared with
+func (m *Mega) shareRecipients(h string) (map[string]bool, error) {
+	var msg [1]FilesMsg
+	var res [1]FilesResp
+
+	msg[0].Cmd = "f"
+	msg[0].C = 1
+	msg[0].N = h
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool)
+	for _, s := range res[0].S {
+		if s.Hash == h {
+			users[s.User] = true
+		}
+	}
+	return users, nil
+}
+
+// ownShareKey returns the share key of our own share with handle h, or
+// nil if we don't have such a share
+//
+// Call with the FS mutex held
+func (m *Mega) ownShareKey(h string) (*Node, []byte) {
+	n := m.FS.hashLookup(h)
+	if n == nil || !m.FS.owned(n) {
+		return nil, nil
+	}
+	if _, ok := m.FS.skmap[h]; !ok {
+		return nil, nil
+	}
+	sk, err := m.shareKey(n)
+	if err != nil {
+		return nil, nil
+	}
+	return n, sk
+}
+
+// process a crypto key request or reply
+func (m *Mega) processKeys(evRaw []byte) error {
+	var ev KeyEvent
+	err := json.Unmarshal(evRaw, &ev)
+	if err != nil {
+		return err
+	}
+
+	var shares, nodes []string
+	if len(ev.Cr) >= 2 {
+		err = json.Unmarshal(ev.Cr[0], &shares)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(ev.Cr[1], &nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(ev.Sr) > 0 {
+		err = m.answerShareKeys(ev.Sr)
+	}
+	switch {
+	case len(ev.Cr) >= 3:
+		m.applyNodeKeys(shares, nodes, ev.Cr[2])
+	case len(ev.Cr) == 2:
+		if err2 := m.answerNodeKeys(shares, nodes); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// answerShareKeys sends the keys of our shares to the users asking
+// for them in sr, a list of share handle, user handle pairs.  Requests
+// from users the share isn't shared with are dropped.
+func (m *Mega) answerShareKeys(sr []string) error {
+	type request struct {
+		share, user string
+		sk          []byte
+	}
+	var requests []request
+	m.FS.mutex.Lock()
+	for i := 0; i+1 < len(sr); i += 2 {
+		_, sk := m.ownShareKey(sr[i])
+		if sk != nil {
+			requests = append(requests, request{sr[i], sr[i+1], sk})
+		}
+	}
+	m.FS.mutex.Unlock()
+
+	cfg := m.getConfig()
+	random := cfg.keySource()
+	var answer []string
+	var firstErr error
+	recipients := make(map[string]map[string]bool)
+	for _, r := range requests {
+		users, ok := recipients[r.share]
+		if !ok {
+			var err error
+			users, err = m.shareRecipients(r.share)
+			if err != nil {
+				m.logf("couldn't fetch the users of share %s: %v", r.share, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			recipients[r.share] = users
+		}
+		if !users[r.user] {
+			m.logf("dropping request from %s for the key of share %s which isn't shared with them", r.user, r.share)
+			continue
+		}
+		pubk, err := m.userPublicKey(r.user)
+		if err == nil {
+			var k string
+			k, err = encryptShareKey(r.sk, pubk, random)
+			if err == nil {
+				answer = append(answer, r.share, r.user, k)
+				continue
+			}
+		}
+		m.logf("couldn't send key of share %s to %s: %v", r.share, r.user, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(answer) == 0 {
+		return firstErr
+	}
+	err := m.sendKeys(KeyMsg{Sr: answer})
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// answerNodeKeys sends the keys of the nodes in our shares asked for
+func (m *Mega) answerNodeKeys(shares, nodes []string) error {
+	var msgs []KeyMsg
+	m.FS.mutex.Lock()
+	for _, sh := range shares {
+		root, sk := m.ownShareKey(sh)
+		if sk == nil {
+			continue
+		}
+		var in []*Node
+		for _, h := range nodes {
+			n := m.FS.hashLookup(h)
+			for p := n; p != nil; p = p.parent {
+				if p == root {
+					in = append(in, n)
+					break
+				}
+			}
+		}
+		if len(in) == 0 {
+			continue
+		}
+		cr, err := makeCr(sh, sk, in)
+		if err != nil {
+			m.FS.mutex.Unlock()
+			return err
+		}
+		msgs = append(msgs, KeyMsg{Cr: cr})
+	}
+	m.FS.mutex.Unlock()
+
+	for _, msg := range msgs {
+		err := m.sendKeys(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyNodeKeys uses node keys sent by the owners of shares, as
+// [share index, node index, key, ...], to repair undecryptable nodes
+func (m *Mega) applyNodeKeys(shares, nodes []string, raw json.RawMessage) {
+	var keys []interface{}
+	err := json.Unmarshal(raw, &keys)
+	if err != nil {
+		m.logf("bad node keys %s: %v", raw, err)
+		return
+	}
+
+	m.FS.mutex.Lock()
+	for i := 0; i+2 < len(keys); i += 3 {
+		si, ok1 := keys[i].(float64)
+		ni, ok2 := keys[i+1].(float64)
+		k, ok3 := keys[i+2].(string)
+		if !ok1 || !ok2 || !ok3 || si < 0 || int(si) >= len(shares) || ni < 0 || int(ni) >= len(nodes) {
+			continue
+		}
+		itm, ok := m.FS.broken[nodes[int(ni)]]
+		if !ok {
+			continue
+		}
+		itm.Key = shares[int(si)] + ":" + k
+		m.FS.broken[itm.Hash] = itm
+	}
+	events, entries := m.repairNodes()
+	m.FS.mutex.Unlock()
+
+	m.journal(entries...)
+	m.emitEvents(events)
+}
@@ -0,0 +1,212 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// nodeItem returns a file or folder node whose key is encrypted with
+// block for the key handle kh
+func nodeItem(t *testing.T, ntype NodeType, h, parent, user, kh string, block []byte, name string) FSNode {
+	compkey := make([]byte, 16)
+	if ntype == FILE {
+		compkey = make([]byte, 32)
+	}
+	_, _ = rand.Read(compkey)
+	key := compkey
+	if ntype == FILE {
+		key = make([]byte, 16)
+		for i := range key {
+			key[i] = compkey[i] ^ compkey[i+16]
+		}
+	}
+	attr, err := encryptAttr(key, FileAttr{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, _ := aes.NewCipher(block)
+	ekey := make([]byte, len(compkey))
+	_ = blockEncrypt(blk, ekey, compkey)
+	return FSNode{Hash: h, Parent: parent, User: user, T: ntype, Attr: attr, Key: kh + ":" + base64urlencode(ekey)}
+}
+
+func TestRequestKeys(t *testing.T) {
+	var mu sync.Mutex
+	var sent []map[string]interface{}
+	s := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd["a"] == "k" {
+			sent = append(sent, cmd)
+		}
+		return 0
+	})
+	defer s.Close()
+	m := newMockSession(t, s)
+	m.k = make([]byte, 16)
+	_, _ = rand.Read(m.k)
+	m.handle = "MEMEMEMEMEM"
+	master_aes, _ := aes.NewCipher(m.k)
+
+	// OTHERSHR is a share we have the key of
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk)
+	esk := make([]byte, 16)
+	_ = blockEncrypt(master_aes, esk, sk)
+	m.FS.skmap["OTHERSHR"] = base64urlencode(esk)
+
+	ev := FSEvent{Cmd: "t"}
+	ev.T.Files = []FSNode{
+		// share key missing
+		nodeItem(t, FILE, "FILEHND1", "SHAREHND", "OTHERUSERXX", "SHAREHND", make([]byte, 16), "one"),
+		// share key present
+		nodeItem(t, FOLDER, "OTHERSHR", "", "OTHERUSERXX", "OTHERSHR", sk, "share"),
+		// added by someone else without a key for the share
+		nodeItem(t, FILE, "FILEHND2", "OTHERSHR", "THIRDPARTYX", "THIRDPARTYX", make([]byte, 16), "two"),
+		// our own
+		nodeItem(t, FILE, "FILEHND3", "", m.handle, m.handle, make([]byte, 16), "three"),
+	}
+	evRaw, _ := json.Marshal(ev)
+	if err := m.processAddNode(evRaw); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.FS.UndecryptableCount(); n != 3 {
+		t.Fatalf("want 3 undecryptable nodes, got %d", n)
+	}
+
+	n, err := m.RequestKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("asked about %d nodes, want 2", n)
+	}
+	mu.Lock()
+	if len(sent) != 1 {
+		t.Fatalf("want one key request, got %v", sent)
+	}
+	want := map[string]interface{}{
+		"sr": []interface{}{"SHAREHND"},
+		"cr": []interface{}{[]interface{}{"OTHERSHR"}, []interface{}{"FILEHND2"}},
+	}
+	if !reflect.DeepEqual(sent[0]["sr"], want["sr"]) || !reflect.DeepEqual(sent[0]["cr"], want["cr"]) {
+		t.Errorf("wrong request %v", sent[0])
+	}
+	mu.Unlock()
+
+	// the owner supplies the key of FILEHND2
+	fixed := nodeItem(t, FILE, "FILEHND2", "OTHERSHR", "THIRDPARTYX", "OTHERSHR", sk, "two")
+	reply := fmt.Sprintf(`{"a":"k","cr":[["OTHERSHR"],["FILEHND2"],[0,0,%q]]}`, fixed.Key[len("OTHERSHR:"):])
+	m.FS.mutex.Lock()
+	itm := m.FS.broken["FILEHND2"]
+	itm.Attr = fixed.Attr
+	m.FS.broken["FILEHND2"] = itm
+	m.FS.mutex.Unlock()
+	if err = m.processKeys([]byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+	node := m.FS.HashLookup("FILEHND2")
+	if node.GetName() != "two" || node.DecryptionError() != nil {
+		t.Errorf("node not repaired: %q %v", node.GetName(), node.DecryptionError())
+	}
+}
+
+func TestAnswerKeyRequests(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := m.CreateDir("shared", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, dir, "f.txt", "hello")
+
+	// make dir a share
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk)
+	master_aes, _ := aes.NewCipher(m.k)
+	esk := make([]byte, 16)
+	_ = blockEncrypt(master_aes, esk, sk)
+	dh := dir.GetHash()
+	m.FS.mutex.Lock()
+	m.FS.skmap[dh] = base64urlencode(esk)
+	m.FS.mutex.Unlock()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubk := base64urlencode(append(encodeMPI(priv.N), encodeMPI(big.NewInt(int64(priv.E)))...))
+	var sent []map[string]interface{}
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		switch cmd["a"] {
+		case "f":
+			if cmd["n"] == dh {
+				return map[string]interface{}{"f": []FSNode{}, "s": []map[string]string{{"h": dh, "u": "OTHERUSERXX"}}}
+			}
+		case "uk":
+			if cmd["u"] != "OTHERUSERXX" {
+				t.Errorf("public key of %v fetched", cmd["u"])
+			}
+			return map[string]interface{}{"u": cmd["u"], "pubk": pubk}
+		case "k":
+			sent = append(sent, cmd)
+			return 0
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	// share key for OTHERUSERXX, ignoring shares which aren't ours and
+	// users the share isn't shared with
+	ev := fmt.Sprintf(`{"a":"k","sr":[%q,"OTHERUSERXX","NOTOURS1","OTHERUSERXX",%q,"STRANGERXXX"]}`, dh, dh)
+	if err = m.processKeys([]byte(ev)); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	if len(sent) != 1 {
+		b.mu.Unlock()
+		t.Fatalf("want one answer, got %v", sent)
+	}
+	sr, _ := sent[0]["sr"].([]interface{})
+	b.mu.Unlock()
+	if len(sr) != 3 || sr[0] != dir.GetHash() || sr[1] != "OTHERUSERXX" {
+		t.Fatalf("wrong answer %v", sr)
+	}
+	key := &rsaPrivateKey{p: priv.Primes[0], q: priv.Primes[1], d: priv.D}
+	got, err := decryptShareKey(sr[2].(string), key)
+	if err != nil || string(got) != string(sk) {
+		t.Errorf("wrong share key %x: %v", got, err)
+	}
+
+	// node keys
+	ev = fmt.Sprintf(`{"a":"k","cr":[[%q],[%q]]}`, dir.GetHash(), f.GetHash())
+	if err = m.processKeys([]byte(ev)); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(sent) != 2 {
+		t.Fatalf("want node keys, got %v", sent)
+	}
+	cr, _ := sent[1]["cr"].([]interface{})
+	if len(cr) != 3 || !reflect.DeepEqual(cr[1], []interface{}{f.GetHash()}) {
+		t.Fatalf("wrong node keys %v", cr)
+	}
+	keys := cr[2].([]interface{})
+	ekey, _ := base64urldecode(keys[2].(string))
+	sk_aes, _ := aes.NewCipher(sk)
+	_ = blockDecrypt(sk_aes, ekey, ekey)
+	if string(ekey) != string(f.meta.compkey) {
+		t.Errorf("wrong node key")
+	}
+}
@@ -0,0 +1,64 @@
+package mega
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// SetIDSource sets where the random bytes which the IDs of requests
+// and transfers are made from come from, nil for crypto/rand.  Setting
+// another one, along with SetClock, is meant for deterministic tests.
+//
+// The keys of files, folders, shares and sessions always come from
+// crypto/rand.  They are deliberately left out as keys from any other
+// source could be guessed, so tests of code using this package can
+// reproduce IDs and times but not ciphertexts.
+func (m *Mega) SetIDSource(r io.Reader) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.ids = r
+}
+
+// WithIDSource sets where the random bytes for IDs come from
+func WithIDSource(r io.Reader) Option {
+	return func(m *Mega) error {
+		m.config.ids = r
+		return nil
+	}
+}
+
+// idSource returns the ID source, crypto/rand if none is set
+func (c *config) idSource() io.Reader {
+	if c.ids != nil {
+		return c.ids
+	}
+	return rand.Reader
+}
+
+// keySource returns where new file, folder and share keys come from,
+// crypto/rand unless a test has set another source
+func (c *config) keySource() io.Reader {
+	if c.keys != nil {
+		return c.keys
+	}
+	return rand.Reader
+}
+
+// randomKey returns n random bytes from the key source
+func (c *config) randomKey(n int) ([]byte, error) {
+	key := make([]byte, n)
+	_, err := io.ReadFull(c.keySource(), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// randomA32 returns n random words from the key source
+func (c *config) randomA32(n int) ([]uint32, error) {
+	key, err := c.randomKey(4 * n)
+	if err != nil {
+		return nil, err
+	}
+	return bytes_to_a32(key)
+}
@@ -0,0 +1,84 @@
+package mega
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// setKeySource sets where new keys come from, nil for crypto/rand
+func (m *Mega) setKeySource(r io.Reader) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.keys = r
+}
+
+// countingKeys is a deterministic key source for tests
+type countingKeys struct {
+	reads int
+	next  byte
+}
+
+func (k *countingKeys) Read(p []byte) (int, error) {
+	k.reads++
+	for i := range p {
+		p[i] = k.next
+		k.next++
+	}
+	return len(p), nil
+}
+
+func TestKeySource(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	keys := &countingKeys{}
+	m.setKeySource(keys)
+
+	u, err := m.NewUpload(m.FS.GetRoot(), "f.txt", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := bytes_to_a32([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23})
+	if got := u.State().Key; !reflect.DeepEqual(got, want) {
+		t.Errorf("upload key %v, want %v", got, want)
+	}
+
+	dir, err := m.CreateDir("dir", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKey := []byte{24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39}
+	if !bytes.Equal(dir.meta.key, wantKey) {
+		t.Errorf("folder key %x, want %x", dir.meta.key, wantKey)
+	}
+	if keys.reads != 2 {
+		t.Errorf("key source read %d times, want 2", keys.reads)
+	}
+
+	// The default is crypto/rand so two uploads differ
+	m.setKeySource(nil)
+	tmp, err := ioutil.TempDir("", "mega-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	randomFile(t, tmp, "a", 10)
+	n1, err := m.UploadFile(filepath.Join(tmp, "a"), m.FS.GetRoot(), "a1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := m.UploadFile(filepath.Join(tmp, "a"), m.FS.GetRoot(), "a2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(n1.meta.key, n2.meta.key) {
+		t.Error("two uploads got the same key")
+	}
+	if keys.reads != 2 {
+		t.Error("key source used after being unset")
+	}
+}
@@ -0,0 +1,197 @@
+package mega
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// Lazy loading fetches only the top level folders, such as the Cloud
+// Drive and the Rubbish Bin, and their children at login.  The top
+// level folders are found from the storage "uq" reports for each, then
+// fetched with a per-folder "f" like the folders below, which are
+// marked unloaded and fetched the first time GetChildren or PathLookup
+// looks in them.  For accounts with huge trees used as cold storage
+// this saves a lot of time and memory at startup.
+
+// WithLazyLoading fetches the tree a folder at a time as it is looked
+// at rather than all of it at login.  Folder link sessions always
+// fetch everything.  Incoming shares, which the API only lists along
+// with the whole tree, aren't loaded.
+//
+// Operations on whole trees, such as DownloadDir, load what they need
+// first.  LoadTree does the same for other walks of the tree.
+func WithLazyLoading() Option {
+	return func(m *Mega) error {
+		m.config.lazy = true
+		return nil
+	}
+}
+
+// fetchRoots fetches the top level folders and their children as a
+// single reply to "f", with the size of the replies read, and returns
+// the folders below them to mark unloaded.  The top level folders are
+// those "uq" reports the storage used by.
+func (m *Mega) fetchRoots(ctx context.Context) (res FilesResp, size int64, unloaded []string, err error) {
+	var qmsg [1]QuotaMsg
+	var qres [1]QuotaResp
+	qmsg[0].Cmd = "uq"
+	qmsg[0].Strg = 1
+	req, err := json.Marshal(qmsg)
+	if err != nil {
+		return res, 0, nil, err
+	}
+	result, err := m.apiRequestContext(ctx, req, nil)
+	if err != nil {
+		return res, 0, nil, err
+	}
+	err = m.decodeResponse(result, &qres)
+	if err != nil {
+		return res, 0, nil, err
+	}
+	roots := make([]string, 0, len(qres[0].Cstrgn))
+	for h := range qres[0].Cstrgn {
+		roots = append(roots, h)
+	}
+	sort.Strings(roots)
+
+	for _, h := range roots {
+		var msg [1]FilesMsg
+		var fres [1]FilesResp
+		msg[0].Cmd = "f"
+		msg[0].C = 1
+		msg[0].N = h
+		req, err = json.Marshal(msg)
+		if err != nil {
+			return res, 0, nil, err
+		}
+		result, err = m.apiRequestContext(ctx, req, nil)
+		if err != nil {
+			return res, 0, nil, err
+		}
+		size += int64(len(result))
+		err = m.decodeResponse(result, &fres)
+		if err != nil {
+			return res, 0, nil, err
+		}
+		for _, itm := range fres[0].F {
+			if itm.Hash != h && itm.Parent != h {
+				continue
+			}
+			res.F = append(res.F, itm)
+			if itm.Parent == h && itm.T == FOLDER {
+				unloaded = append(unloaded, itm.Hash)
+			}
+		}
+		res.Ok = append(res.Ok, fres[0].Ok...)
+		res.User = append(res.User, fres[0].User...)
+		if res.Sn == "" {
+			res.Sn = fres[0].Sn
+		}
+	}
+	return res, size, unloaded, nil
+}
+
+// loadChildren fetches the children of n if they haven't been yet
+func (fs *MegaFS) loadChildren(n *Node) error {
+	fs.mutex.Lock()
+	load, unloaded := fs.load, n.unloaded
+	fs.mutex.Unlock()
+	if load == nil || !unloaded {
+		return nil
+	}
+	return load(n)
+}
+
+// loadPath fetches the children of the folders along the path ns
+// from root which haven't been yet
+func (fs *MegaFS) loadPath(root *Node, ns []string) error {
+	fs.mutex.Lock()
+	lazy := fs.load != nil
+	fs.mutex.Unlock()
+	if !lazy {
+		return nil
+	}
+
+	n := root
+	for _, name := range ns {
+		err := fs.loadChildren(n)
+		if err != nil {
+			return err
+		}
+		fs.mutex.Lock()
+		var next *Node
+		for _, c := range n.children {
+			if c.name == name {
+				next = c
+				break
+			}
+		}
+		fs.mutex.Unlock()
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return nil
+}
+
+// loadChildren fetches the children of the unloaded folder n into the
+// tree.  This is loading what was left out at login rather than a
+// change so no events are sent.
+func (m *Mega) loadChildren(n *Node) error {
+	m.FS.mutex.Lock()
+	h := n.hash
+	m.FS.mutex.Unlock()
+
+	items, err := m.fetchFolder(h)
+	if err != nil {
+		return err
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	if n.unloaded {
+		_, _ = m.reconcileChildren(n, items, nil)
+		n.unloaded = false
+	}
+	return nil
+}
+
+// LoadTree fetches everything below n which lazy loading has left
+// out.  Without lazy loading it does nothing.
+func (m *Mega) LoadTree(n *Node) error {
+	if n == nil {
+		return EARGS
+	}
+	return m.FS.loadTree(n)
+}
+
+// loadTree fetches everything below n which hasn't been yet
+func (fs *MegaFS) loadTree(n *Node) error {
+	err := fs.loadChildren(n)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	if fs.load == nil {
+		fs.mutex.Unlock()
+		return nil
+	}
+	var folders []*Node
+	for _, c := range n.children {
+		if c.ntype != FILE {
+			folders = append(folders, c)
+		}
+	}
+	fs.mutex.Unlock()
+
+	for _, c := range folders {
+		err = fs.loadTree(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
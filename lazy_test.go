@@ -0,0 +1,118 @@
+package mega
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLazyLoading(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	a, err := m.CreateDir("a", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab, err := m.CreateDir("b", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abc, err := m.CreateDir("c", ab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, abc, "f.txt", "deep")
+	uploadString(t, m, ab, "g.txt", "shallow")
+	empty, err := m.CreateDir("empty", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Log in again lazily
+	var fetched []string
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "f" {
+			h, _ := cmd["n"].(string)
+			fetched = append(fetched, h)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+	lazy := newMockSession(t, b.mockServer)
+	lazy.k = m.k
+	lazy.sid = m.sid
+	lazy.config.lazy = true
+	if err = lazy.getFileSystem(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the top level folders are fetched, never the whole tree
+	b.mu.Lock()
+	if len(fetched) != 2 || fetched[0] != fakeRoot || fetched[1] != fakeTrash {
+		t.Errorf("login fetched %q", fetched)
+	}
+	fetched = nil
+	b.mu.Unlock()
+	if lazy.FS.HashLookup(a.GetHash()) == nil {
+		t.Fatalf("top level folder not loaded")
+	}
+	if lazy.FS.HashLookup(ab.GetHash()) != nil {
+		t.Errorf("folder below the top level loaded at login")
+	}
+	if children, err := lazy.FS.GetChildren(lazy.FS.HashLookup(empty.GetHash())); err != nil || len(children) != 0 {
+		t.Errorf("GetChildren of an empty folder: %d children, %v", len(children), err)
+	}
+
+	nodes, err := lazy.FS.PathLookup(lazy.FS.GetRoot(), []string{"a", "b", "c", "f.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nodes[len(nodes)-1]; got.GetHash() != f.GetHash() || got.GetName() != "f.txt" {
+		t.Errorf("PathLookup found %q", got.GetName())
+	}
+	children, err := lazy.FS.GetChildren(lazy.FS.HashLookup(ab.GetHash()))
+	if err != nil || len(children) != 2 {
+		t.Errorf("GetChildren: %d children, %v", len(children), err)
+	}
+
+	b.mu.Lock()
+	want := []string{empty.GetHash(), a.GetHash(), ab.GetHash(), abc.GetHash()}
+	if len(fetched) != len(want) {
+		t.Errorf("fetched %q, want %q", fetched, want)
+	} else {
+		for i := range want {
+			if fetched[i] != want[i] {
+				t.Errorf("fetched %q, want %q", fetched, want)
+				break
+			}
+		}
+	}
+	fetched = nil
+	b.mu.Unlock()
+
+	// Already loaded
+	if err = lazy.LoadTree(lazy.FS.GetRoot()); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	if len(fetched) != 0 {
+		t.Errorf("LoadTree fetched loaded folders %q", fetched)
+	}
+	b.mu.Unlock()
+
+	// Sizes count what hasn't been loaded yet
+	fresh := newMockSession(t, b.mockServer)
+	fresh.k = m.k
+	fresh.sid = m.sid
+	fresh.config.lazy = true
+	if err = fresh.getFileSystem(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := fresh.PlanDelete([]*Node{fresh.FS.HashLookup(a.GetHash())}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(t, plan, "trash Cloud Drive/a (11 bytes)")
+}
@@ -0,0 +1,195 @@
+package mega
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateWindow sets the bandwidth limit for part of the day.
+//
+// Start and End are offsets from local midnight.  If End is before
+// Start the window wraps around midnight, so {22h, 6h, 0} is
+// unlimited overnight.
+type RateWindow struct {
+	Start time.Duration
+	End   time.Duration
+	// Rate in bytes per second, 0 for unlimited
+	Rate int64
+}
+
+// contains returns true if the time of day t falls in the window
+func (w RateWindow) contains(t time.Duration) bool {
+	if w.Start <= w.End {
+		return t >= w.Start && t < w.End
+	}
+	return t >= w.Start || t < w.End
+}
+
+// RateLimiter limits the combined bandwidth of all the transfers
+// which use it.  It may be shared between several Mega clients.  Only
+// the chunk data sent to and from the storage servers is paced - API
+// calls and the event stream are never held up by it.
+//
+// The limit can vary by time of day using SetSchedule which makes it
+// suitable for long running daemons.
+type RateLimiter struct {
+	mu sync.Mutex
+	// rate when no window of the schedule applies
+	rate     int64
+	schedule []RateWindow
+	// token bucket state
+	tokens  float64
+	last    time.Time
+	current int64
+	// clock - replaced in tests
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second, 0
+// for unlimited
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate:  rate,
+		now:   time.Now,
+		after: time.After,
+	}
+}
+
+// SetClock sets the clock the limiter tells the time of day and waits
+// by, nil for the system clock
+func (l *RateLimiter) SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = c.Now
+	l.after = c.After
+}
+
+// SetRate sets the limit used outside the scheduled windows in bytes
+// per second, 0 for unlimited
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+}
+
+// SetSchedule sets time of day windows with their own limits.  The
+// first window containing the current time wins and outside all of
+// them the rate from SetRate applies.
+func (l *RateLimiter) SetSchedule(windows []RateWindow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schedule = append([]RateWindow(nil), windows...)
+}
+
+// Rate returns the limit in force now in bytes per second, 0 for
+// unlimited
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rateAt(l.now())
+}
+
+// rateAt returns the limit in force at t
+//
+// Call with the mutex held
+func (l *RateLimiter) rateAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Sub(midnight)
+	for _, w := range l.schedule {
+		if w.contains(tod) {
+			return w.Rate
+		}
+	}
+	return l.rate
+}
+
+// Wait blocks until n more bytes may be transferred
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	rate := l.rateAt(now)
+	if rate <= 0 {
+		l.current = 0
+		l.mu.Unlock()
+		return
+	}
+
+	// Allow bursts of up to 100ms worth of data
+	burst := float64(rate) / 10
+	if rate != l.current || l.last.IsZero() {
+		// the limit has changed so start again with a full bucket
+		l.current = rate
+		l.tokens = burst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+
+	// Take the tokens even if that leaves a debt which makes other
+	// transfers wait their turn
+	l.tokens -= float64(n)
+	var sleep time.Duration
+	if l.tokens < 0 {
+		sleep = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	after := l.after
+	l.mu.Unlock()
+
+	if sleep > 0 {
+		<-after(sleep)
+	}
+}
+
+// limitedReader paces reads from an io.Reader with a RateLimiter
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+// Read reads at most 32k at a time so pacing is smooth
+func (lr *limitedReader) Read(p []byte) (n int, err error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err = lr.r.Read(p)
+	lr.l.Wait(n)
+	return n, err
+}
+
+// reader returns r paced by the limiter, or r itself for a nil
+// limiter
+func (l *RateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+// SetRateLimiter sets the limiter shared by all transfers of this
+// client.  Use nil for no limit.  Transfers already running are not
+// affected.
+func (m *Mega) SetRateLimiter(l *RateLimiter) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.limiter = l
+}
+
+// WithRateLimiter sets the limiter shared by all transfers
+func WithRateLimiter(l *RateLimiter) Option {
+	return func(m *Mega) error {
+		m.config.limiter = l
+		return nil
+	}
+}
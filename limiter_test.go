@@ -0,0 +1,65 @@
+package mega
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSchedule(t *testing.T) {
+	l := NewRateLimiter(1000)
+	l.SetSchedule([]RateWindow{
+		{Start: 22 * time.Hour, End: 6 * time.Hour, Rate: 0},
+		{Start: 9 * time.Hour, End: 17 * time.Hour, Rate: 1 << 20},
+	})
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		at   time.Duration
+		want int64
+	}{
+		{0, 0},
+		{5*time.Hour + 59*time.Minute, 0},
+		{6 * time.Hour, 1000},
+		{9 * time.Hour, 1 << 20},
+		{16*time.Hour + 59*time.Minute, 1 << 20},
+		{17 * time.Hour, 1000},
+		{23 * time.Hour, 0},
+	} {
+		at := day.Add(test.at)
+		l.now = func() time.Time { return at }
+		if got := l.Rate(); got != test.want {
+			t.Errorf("at %v: want rate %d got %d", test.at, test.want, got)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := NewRateLimiter(100000)
+
+	// 10k of burst then 20k more at 100k/s is 200ms
+	start := time.Now()
+	l.Wait(30000)
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expecting wait of about 200ms got %v", elapsed)
+	}
+
+	// Unlimited doesn't wait
+	l.SetRate(0)
+	start = time.Now()
+	l.Wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited wait took %v", elapsed)
+	}
+
+	// nil limiter is unlimited
+	var nl *RateLimiter
+	nl.Wait(1 << 30)
+	r := nl.reader(bytes.NewReader([]byte("hello")))
+	buf, err := ioutil.ReadAll(r)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("nil limiter reader: %q %v", buf, err)
+	}
+}
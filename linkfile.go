@@ -0,0 +1,83 @@
+package mega
+
+import (
+	"io"
+	"strings"
+)
+
+// LinkFile returns the file at the slash separated path p below the
+// folder of the link opened with OpenFolderLink, for picking single
+// files out of a big shared folder without walking it.  It returns
+// EARGS if no folder link is open or p is a folder, and ENOENT if
+// there is nothing at p.
+func (m *Mega) LinkFile(p string) (*Node, error) {
+	if m.flink == nil {
+		return nil, EARGS
+	}
+	rel := cleanRel(p)
+	if rel == "" {
+		return nil, EARGS
+	}
+	nodes, err := m.FS.PathLookup(m.FS.GetRoot(), strings.Split(rel, "/"))
+	if err != nil {
+		return nil, err
+	}
+	n := nodes[len(nodes)-1]
+	if n.GetType() != FILE {
+		return nil, EARGS
+	}
+	return n, nil
+}
+
+// DownloadLinkFile downloads the file at the slash separated path p
+// below the folder link opened to dstpath, see LinkFile
+func (m *Mega) DownloadLinkFile(p string, dstpath string, progress *chan int) error {
+	n, err := m.LinkFile(p)
+	if err != nil {
+		return err
+	}
+	return m.DownloadFile(n, dstpath, progress)
+}
+
+// DownloadRange writes length bytes of the file src from offset on to
+// w, or up to the end if length is negative.  Only the chunks holding
+// the range are fetched so a little of a huge file can be read
+// cheaply, but as the whole file isn't the MAC can't be checked.  It
+// returns EARGS if the range isn't in the file.
+func (m *Mega) DownloadRange(src *Node, w io.Writer, offset, length int64) error {
+	d, err := m.NewDownload(src)
+	if err != nil {
+		return err
+	}
+	end := offset + length
+	if length < 0 {
+		end = d.Size()
+	}
+	if offset < 0 || end > d.Size() || offset > end {
+		return EARGS
+	}
+
+	for id := 0; id < d.Chunks() && offset < end; id++ {
+		pos, size, err := d.ChunkLocation(id)
+		if err != nil {
+			return err
+		}
+		if pos+int64(size) <= offset {
+			continue
+		}
+		chunk, err := d.DownloadChunk(id)
+		if err != nil {
+			return err
+		}
+		stop := int64(size)
+		if pos+stop > end {
+			stop = end - pos
+		}
+		_, err = w.Write(chunk[offset-pos : stop])
+		if err != nil {
+			return err
+		}
+		offset = pos + stop
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package mega
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkFile(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-linkfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "big.bin", 600000)
+
+	root := m.FS.GetRoot()
+	a, err := m.CreateDir("a", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := m.CreateDir("b", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.UploadFile(filepath.Join(dir, "big.bin"), sub, "big.bin", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.LinkFile("a/b/big.bin"); err != EARGS {
+		t.Errorf("without a folder link: got %v", err)
+	}
+
+	link := New(WithLogger(nil), WithAPIURL(b.URL))
+	if err = link.OpenFolderLink("https://mega.nz/folder/PubHandl#" + base64urlencode(m.k)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := link.LinkFile("/a/b/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = link.LinkFile("a/b"); err != EARGS {
+		t.Errorf("folder: got %v", err)
+	}
+	if _, err = link.LinkFile("a/c/big.bin"); err != ENOENT {
+		t.Errorf("missing: got %v", err)
+	}
+
+	// Ranges within a chunk, across several and to the end
+	for _, r := range []struct{ offset, length int64 }{
+		{10, 100},
+		{100000, 300000},
+		{599990, -1},
+		{0, 0},
+	} {
+		var buf bytes.Buffer
+		if err = link.DownloadRange(n, &buf, r.offset, r.length); err != nil {
+			t.Fatalf("%+v: %v", r, err)
+		}
+		end := r.offset + r.length
+		if r.length < 0 {
+			end = int64(len(data))
+		}
+		if !bytes.Equal(buf.Bytes(), data[r.offset:end]) {
+			t.Errorf("%+v: got %d bytes, not what was uploaded", r, buf.Len())
+		}
+	}
+	if err = link.DownloadRange(n, ioutil.Discard, 599990, 20); err != EARGS {
+		t.Errorf("past the end: got %v", err)
+	}
+
+	dst := filepath.Join(dir, "got.bin")
+	if err = link.DownloadLinkFile("a/b/big.bin", dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Errorf("downloaded file differs")
+	}
+}
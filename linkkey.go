@@ -0,0 +1,59 @@
+package mega
+
+import (
+	"github.com/SeyitDurmus/go-mega/urlparse"
+)
+
+// ExportNodeKey exports a public link to the file or folder n and
+// returns it without its decryption key, along with the key on its
+// own.  This is MEGA's "send the key separately" way of sharing: the
+// link can go by one channel and the key by another, so anyone who
+// intercepts only one of them can't read the node.  ImportNodeKey puts
+// the two back together.
+func (m *Mega) ExportNodeKey(n *Node) (link, key string, err error) {
+	if n == nil {
+		return "", "", EARGS
+	}
+	t := urlparse.LINK_FILE
+	switch n.GetType() {
+	case FILE:
+		m.FS.mutex.Lock()
+		key = base64urlencode(n.meta.compkey)
+		m.FS.mutex.Unlock()
+	case FOLDER:
+		t = urlparse.LINK_FOLDER
+		sk, err := m.exportFolder(n)
+		if err != nil {
+			return "", "", err
+		}
+		key = base64urlencode(sk)
+	default:
+		return "", "", EARGS
+	}
+
+	handle, err := m.getLink(n)
+	if err != nil {
+		return "", "", err
+	}
+	return urlparse.BuildLink(t, handle, ""), key, nil
+}
+
+// ImportNodeKey returns the full link to open or download from a link
+// without a key and the key sent separately, as from ExportNodeKey.
+// It returns EARGS if the link already has a key or the key is the
+// wrong kind for the link.
+func ImportNodeKey(link, key string) (string, error) {
+	l, err := urlparse.ParseLink(link)
+	if err != nil {
+		return "", err
+	}
+	if l.Password || l.Key != "" || key == "" {
+		return "", EARGS
+	}
+	l.Key = key
+	full := l.String()
+	if _, err = urlparse.ParseLink(full); err != nil {
+		return "", EARGS
+	}
+	return full, nil
+}
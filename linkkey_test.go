@@ -0,0 +1,71 @@
+package mega
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SeyitDurmus/go-mega/urlparse"
+)
+
+func TestExportImportNodeKey(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		switch cmd["a"] {
+		case "l":
+			return "PubHandl"
+		case "s2":
+			return 0
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	root := m.FS.GetRoot()
+	f := uploadString(t, m, root, "f.txt", "secret")
+	link, key, err := m.ExportNodeKey(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://mega.nz/file/PubHandl" || strings.Contains(link, key) {
+		t.Errorf("link %q includes the key or is wrong", link)
+	}
+	full, err := ImportNodeKey(link, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := urlparse.ParseLink(full)
+	if err != nil || l.Type != urlparse.LINK_FILE || l.Handle != "PubHandl" || l.Key != key {
+		t.Errorf("ImportNodeKey gave %q: %v", full, err)
+	}
+
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, key, err = m.ExportNodeKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://mega.nz/folder/PubHandl" {
+		t.Errorf("folder link %q", link)
+	}
+	if _, err = ImportNodeKey(link, key); err != nil {
+		t.Error(err)
+	}
+
+	// The key must fit the link
+	for _, tc := range [][2]string{
+		{"https://mega.nz/file/PubHandl", key},
+		{"https://mega.nz/file/PubHandl", ""},
+		{full, key},
+		{"rubbish", key},
+	} {
+		if _, err = ImportNodeKey(tc[0], tc[1]); err == nil {
+			t.Errorf("ImportNodeKey(%q, %q): expecting error", tc[0], tc[1])
+		}
+	}
+}
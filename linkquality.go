@@ -0,0 +1,250 @@
+package mega
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Chunk requests a storage host needs before LinkQuality judges it
+const LINK_MIN_CHUNKS = 4
+
+// Bottleneck is what LinkQuality reckons is limiting the transfers
+type Bottleneck int
+
+// Bottlenecks
+const (
+	// Too few chunks have been transferred to tell
+	BOTTLENECK_UNKNOWN Bottleneck = iota
+	// The connection to MEGA as a whole, such as the ISP, as the
+	// storage hosts are all about as fast
+	BOTTLENECK_NETWORK
+	// One storage host, LinkQualityReport.SlowHost, being much slower
+	// or failing more than the others
+	BOTTLENECK_HOST
+	// Encrypting, decrypting and computing the chunk MACs, which are
+	// slower than the connections
+	BOTTLENECK_CPU
+)
+
+func (b Bottleneck) String() string {
+	switch b {
+	case BOTTLENECK_NETWORK:
+		return "network"
+	case BOTTLENECK_HOST:
+		return "host"
+	case BOTTLENECK_CPU:
+		return "cpu"
+	}
+	return "unknown"
+}
+
+// HostQuality holds the chunk transfer statistics of one storage host
+type HostQuality struct {
+	// Host name and port of the storage server
+	Host string
+	// Chunks downloaded from and uploaded to the host, and their bytes
+	Downloads int64
+	Uploads   int64
+	Bytes     int64
+	// Chunk requests which failed, whether retried or not
+	Failures int64
+	// Average and worst time until the host answered a chunk request.
+	// For uploads this includes sending the chunk.
+	LatencyAvg time.Duration
+	LatencyMax time.Duration
+	// Bytes per second while transferring a chunk, per connection
+	Throughput float64
+}
+
+// LinkQualityReport says how fast chunks have been transferred to
+// and from each storage host and how fast they were encrypted or
+// decrypted, to tell a slow ISP from a slow storage cluster or a
+// transfer held up by the CPU.  The Bottleneck is a rough guide.
+type LinkQualityReport struct {
+	// The storage hosts by name
+	Hosts []HostQuality
+	// Bytes encrypted or decrypted with their chunk MACs, the time
+	// it took and the bytes per second per goroutine
+	CryptoBytes      int64
+	CryptoTime       time.Duration
+	CryptoThroughput float64
+	// What looks to be limiting the transfers, and the host if it is
+	// BOTTLENECK_HOST
+	Bottleneck Bottleneck
+	SlowHost   string
+}
+
+// hostStats accumulates the statistics of a storage host
+type hostStats struct {
+	downloads, uploads int64
+	bytes              int64
+	failures           int64
+	latency            time.Duration // total of the successful requests
+	latencyMax         time.Duration
+	elapsed            time.Duration // total of the successful requests
+}
+
+// linkStats accumulates the statistics for LinkQuality
+type linkStats struct {
+	mu          sync.Mutex
+	hosts       map[string]*hostStats
+	cryptoBytes int64
+	cryptoTime  time.Duration
+}
+
+// storageHost returns the host and port of the storage server URL u
+func storageHost(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// note records a chunk request to the storage server URL u which
+// answered after latency and was done after elapsed, moving n bytes.
+// Requests given up on because their context is done aren't counted.
+func (s *linkStats) note(u string, upload bool, n int, latency, elapsed time.Duration, err error) {
+	if err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return
+	}
+	host := storageHost(u)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]*hostStats)
+	}
+	h := s.hosts[host]
+	if h == nil {
+		h = &hostStats{}
+		s.hosts[host] = h
+	}
+	if err != nil {
+		h.failures++
+		return
+	}
+	if upload {
+		h.uploads++
+	} else {
+		h.downloads++
+	}
+	h.bytes += int64(n)
+	h.latency += latency
+	if latency > h.latencyMax {
+		h.latencyMax = latency
+	}
+	h.elapsed += elapsed
+}
+
+// noteCrypto records n bytes encrypted or decrypted with their MAC in d
+func (s *linkStats) noteCrypto(n int, d time.Duration) {
+	s.mu.Lock()
+	s.cryptoBytes += int64(n)
+	s.cryptoTime += d
+	s.mu.Unlock()
+}
+
+// rate returns bytes per second
+func rate(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) / d.Seconds()
+}
+
+// LinkQuality returns the chunk transfer statistics of each storage
+// host since the client was created or ResetLinkQuality was called
+func (m *Mega) LinkQuality() LinkQualityReport {
+	s := &m.links
+	s.mu.Lock()
+	r := LinkQualityReport{
+		CryptoBytes:      s.cryptoBytes,
+		CryptoTime:       s.cryptoTime,
+		CryptoThroughput: rate(s.cryptoBytes, s.cryptoTime),
+	}
+	var bytes int64
+	var elapsed time.Duration
+	for host, h := range s.hosts {
+		q := HostQuality{
+			Host:       host,
+			Downloads:  h.downloads,
+			Uploads:    h.uploads,
+			Bytes:      h.bytes,
+			Failures:   h.failures,
+			LatencyMax: h.latencyMax,
+			Throughput: rate(h.bytes, h.elapsed),
+		}
+		if chunks := h.downloads + h.uploads; chunks > 0 {
+			q.LatencyAvg = h.latency / time.Duration(chunks)
+		}
+		r.Hosts = append(r.Hosts, q)
+		bytes += h.bytes
+		elapsed += h.elapsed
+	}
+	s.mu.Unlock()
+	sort.Slice(r.Hosts, func(i, j int) bool {
+		return r.Hosts[i].Host < r.Hosts[j].Host
+	})
+	r.Bottleneck, r.SlowHost = r.bottleneck(rate(bytes, elapsed))
+	return r
+}
+
+// bottleneck judges what limits the transfers given the throughput
+// of all the hosts together
+func (r *LinkQualityReport) bottleneck(throughput float64) (Bottleneck, string) {
+	var judged []HostQuality
+	for _, h := range r.Hosts {
+		if h.Downloads+h.Uploads+h.Failures >= LINK_MIN_CHUNKS {
+			judged = append(judged, h)
+		}
+	}
+	if len(judged) == 0 {
+		return BOTTLENECK_UNKNOWN, ""
+	}
+	if r.CryptoBytes > 0 && r.CryptoThroughput < throughput {
+		return BOTTLENECK_CPU, ""
+	}
+	if len(judged) < 2 {
+		return BOTTLENECK_NETWORK, ""
+	}
+
+	// A host failing a fifth of its requests or at under half the
+	// median speed stands out
+	speeds := make([]float64, len(judged))
+	for i, h := range judged {
+		speeds[i] = h.Throughput
+	}
+	sort.Float64s(speeds)
+	median := speeds[len(speeds)/2]
+	slow, worst := "", 1.0
+	for _, h := range judged {
+		chunks := h.Downloads + h.Uploads + h.Failures
+		score := 1.0
+		if median > 0 {
+			score = h.Throughput / median
+		}
+		if failed := float64(h.Failures) / float64(chunks); failed >= 0.2 && 1-failed < score {
+			score = 1 - failed
+		}
+		if score < 0.5 && score < worst {
+			slow, worst = h.Host, score
+		}
+	}
+	if slow != "" {
+		return BOTTLENECK_HOST, slow
+	}
+	return BOTTLENECK_NETWORK, ""
+}
+
+// ResetLinkQuality forgets the statistics LinkQuality reports, say
+// after the network has changed
+func (m *Mega) ResetLinkQuality() {
+	m.links.mu.Lock()
+	defer m.links.mu.Unlock()
+	m.links.hosts = nil
+	m.links.cryptoBytes, m.links.cryptoTime = 0, 0
+}
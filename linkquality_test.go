@@ -0,0 +1,85 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLinkQuality(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if r := m.LinkQuality(); len(r.Hosts) != 0 || r.Bottleneck != BOTTLENECK_UNKNOWN {
+		t.Errorf("new client: %+v", r)
+	}
+
+	dir, err := ioutil.TempDir("", "mega-link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const size = 600 * 1024 // 3 chunks
+	data := randomFile(t, dir, "in.bin", size)
+	n, err := m.UploadFile(filepath.Join(dir, "in.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "out.bin"), data)
+
+	r := m.LinkQuality()
+	if len(r.Hosts) != 1 {
+		t.Fatalf("hosts %+v", r.Hosts)
+	}
+	h := r.Hosts[0]
+	if h.Host != storageHost(b.URL) || h.Uploads != 3 || h.Downloads != 3 || h.Bytes != 2*size || h.Failures != 0 {
+		t.Errorf("host %+v", h)
+	}
+	if h.LatencyMax <= 0 || h.LatencyAvg > h.LatencyMax || h.Throughput <= 0 {
+		t.Errorf("timings %+v", h)
+	}
+	if r.CryptoBytes != 2*size || r.CryptoTime <= 0 {
+		t.Errorf("crypto %d bytes in %v", r.CryptoBytes, r.CryptoTime)
+	}
+
+	m.ResetLinkQuality()
+	if r = m.LinkQuality(); len(r.Hosts) != 0 || r.CryptoBytes != 0 {
+		t.Errorf("after reset: %+v", r)
+	}
+
+	// Timed with the client's clock
+	m.SetClock(&stepClock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)})
+	if _, err = m.UploadFile(filepath.Join(dir, "in.bin"), m.FS.GetRoot(), "again", nil); err != nil {
+		t.Fatal(err)
+	}
+	r = m.LinkQuality()
+	if len(r.Hosts) != 1 || r.Hosts[0].LatencyMax != 0 || r.CryptoTime != 0 {
+		t.Errorf("timings with a stopped clock %+v", r)
+	}
+}
+
+func TestLinkBottleneck(t *testing.T) {
+	host := func(name string, chunks, failures int64, throughput float64) HostQuality {
+		return HostQuality{Host: name, Downloads: chunks, Failures: failures, Throughput: throughput}
+	}
+	for _, c := range []struct {
+		name       string
+		r          LinkQualityReport
+		throughput float64
+		want       Bottleneck
+		slow       string
+	}{
+		{"too few", LinkQualityReport{Hosts: []HostQuality{host("a", 3, 0, 100)}}, 100, BOTTLENECK_UNKNOWN, ""},
+		{"one host", LinkQualityReport{Hosts: []HostQuality{host("a", 10, 0, 100)}}, 100, BOTTLENECK_NETWORK, ""},
+		{"even", LinkQualityReport{Hosts: []HostQuality{host("a", 10, 0, 100), host("b", 10, 0, 80), host("c", 10, 0, 120)}}, 100, BOTTLENECK_NETWORK, ""},
+		{"slow", LinkQualityReport{Hosts: []HostQuality{host("a", 10, 0, 100), host("b", 10, 0, 20), host("c", 10, 0, 120)}}, 100, BOTTLENECK_HOST, "b"},
+		{"failing", LinkQualityReport{Hosts: []HostQuality{host("a", 10, 0, 100), host("b", 10, 0, 100), host("c", 4, 6, 100)}}, 100, BOTTLENECK_HOST, "c"},
+		{"cpu", LinkQualityReport{Hosts: []HostQuality{host("a", 10, 0, 100), host("b", 10, 0, 20)}, CryptoBytes: 1000, CryptoThroughput: 50}, 100, BOTTLENECK_CPU, ""},
+	} {
+		got, slow := c.r.bottleneck(c.throughput)
+		if got != c.want || slow != c.slow {
+			t.Errorf("%s: got %v %q", c.name, got, slow)
+		}
+	}
+}
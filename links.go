@@ -0,0 +1,91 @@
+package mega
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/SeyitDurmus/go-mega/urlparse"
+)
+
+// PublicLink describes a file or folder exported with a public link
+type PublicLink struct {
+	// The node, nil if it isn't in the tree, say because lazy loading
+	// hasn't fetched its folder yet
+	Node *Node
+	// Handle of the node
+	Hash string
+	// Public handle of the link
+	PublicHandle string
+	// URL of the link without the decryption key
+	URL string
+	// When the link was made
+	Created time.Time
+	// When the link expires, the zero time if it doesn't
+	Expires time.Time
+	// Set if MEGA has taken the link down
+	TakenDown bool
+}
+
+// ListPublicLinks returns the nodes of the account which have public
+// links, oldest link first, so what has been shared can be audited.
+// The URLs are built without the keys - use Link or ExportNodeKey on
+// the node to get those.
+//
+// The server only lists the links along with the whole tree so this
+// fetches it all again, which takes a while for big accounts.
+func (m *Mega) ListPublicLinks() ([]PublicLink, error) {
+	if m.flink != nil {
+		return nil, EARGS
+	}
+	var msg [1]FilesMsg
+	var res [1]FilesResp
+
+	msg[0].Cmd = "f"
+	msg[0].C = 1
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]NodeType, len(res[0].F))
+	for _, itm := range res[0].F {
+		types[itm.Hash] = itm.T
+	}
+
+	links := make([]PublicLink, 0, len(res[0].Ph))
+	m.FS.mutex.Lock()
+	for _, ph := range res[0].Ph {
+		t := urlparse.LINK_FILE
+		if types[ph.Hash] == FOLDER {
+			t = urlparse.LINK_FOLDER
+		}
+		l := PublicLink{
+			Node:         m.FS.lookup[ph.Hash],
+			Hash:         ph.Hash,
+			PublicHandle: ph.PublicHandle,
+			URL:          urlparse.BuildLink(t, ph.PublicHandle, ""),
+			Created:      time.Unix(ph.Ts, 0),
+			TakenDown:    ph.Down != 0,
+		}
+		if ph.Ets != 0 {
+			l.Expires = time.Unix(ph.Ets, 0)
+		}
+		links = append(links, l)
+	}
+	m.FS.mutex.Unlock()
+
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Created.Before(links[j].Created)
+	})
+	return links, nil
+}
@@ -0,0 +1,54 @@
+package mega
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListPublicLinks(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("shared", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, root, "f.txt", "data")
+
+	expires := time.Now().Add(time.Hour).Unix()
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] != "f" {
+			return nil
+		}
+		var nodes []FSNode
+		for _, n := range b.nodes {
+			nodes = append(nodes, *n)
+		}
+		return map[string]interface{}{
+			"f": nodes,
+			"ph": []PublicLinkResp{
+				{Hash: f.GetHash(), PublicHandle: "FilePubH", Ts: 2000, Ets: expires},
+				{Hash: dir.GetHash(), PublicHandle: "DirPubHa", Ts: 1000, Down: 1},
+			},
+		}
+	}
+	b.mu.Unlock()
+
+	links, err := m.ListPublicLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 {
+		t.Fatalf("got %d links, want 2", len(links))
+	}
+	d, l := links[0], links[1]
+	if d.Node != dir || d.URL != "https://mega.nz/folder/DirPubHa" || !d.TakenDown || !d.Expires.IsZero() {
+		t.Errorf("folder link %+v", d)
+	}
+	if l.Node != f || l.URL != "https://mega.nz/file/FilePubH" || l.TakenDown || l.Expires.Unix() != expires || l.Created.Unix() != 2000 {
+		t.Errorf("file link %+v", l)
+	}
+}
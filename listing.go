@@ -0,0 +1,139 @@
+package mega
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+)
+
+// ListOrder is the order ListChildren returns the children of a folder
+// in.  Those which sort the same are ordered by name then handle so the
+// order is always the same.
+type ListOrder int
+
+// Orders for ListChildren
+const (
+	LIST_BY_NAME ListOrder = iota // by name
+	LIST_BY_SIZE                  // smallest first
+	LIST_BY_TIME                  // oldest first
+)
+
+// LIST_LIMIT is the number of children ListChildren returns if no
+// limit is given
+const LIST_LIMIT = 1000
+
+// ListPage is a page of the children of a folder
+type ListPage struct {
+	// The children on this page
+	Nodes []*Node
+	// Cursor to pass to ListChildren for the next page, empty if
+	// this is the last
+	Cursor string
+	// Number of children in the folder
+	Total int
+}
+
+// listKey is where a node sorts, and what a cursor holds to carry on
+// after it
+type listKey struct {
+	Order ListOrder `json:"o"`
+	Name  string    `json:"n"`
+	Size  int64     `json:"s,omitempty"`
+	Time  int64     `json:"t,omitempty"`
+	Hash  string    `json:"h"`
+}
+
+// keyOf returns where n sorts in order
+//
+// Call with the FS mutex held
+func keyOf(n *Node, order ListOrder) listKey {
+	k := listKey{Order: order, Name: n.name, Hash: n.hash}
+	switch order {
+	case LIST_BY_SIZE:
+		k.Size = n.size
+	case LIST_BY_TIME:
+		k.Time = n.ts.UnixNano()
+	}
+	return k
+}
+
+// before returns true if a sorts before b
+func (a listKey) before(b listKey) bool {
+	switch {
+	case a.Size != b.Size:
+		return a.Size < b.Size
+	case a.Time != b.Time:
+		return a.Time < b.Time
+	case a.Name != b.Name:
+		return a.Name < b.Name
+	}
+	return a.Hash < b.Hash
+}
+
+// ListChildren returns up to limit children of the folder n, LIST_LIMIT
+// if limit isn't positive, sorted in order, for showing folders too big
+// to show all at once.  The first page is got with an empty cursor and
+// the next with the cursor of the one before until it is empty.
+//
+// The cursor holds where the last child returned sorts rather than a
+// count so children added or removed between pages don't make others
+// be skipped or shown twice.  The children of a folder not yet loaded
+// with WithLazyLoading are fetched first.
+func (fs *MegaFS) ListChildren(n *Node, order ListOrder, cursor string, limit int) (ListPage, error) {
+	var page ListPage
+	if n == nil || order < LIST_BY_NAME || order > LIST_BY_TIME {
+		return page, EARGS
+	}
+	if limit <= 0 {
+		limit = LIST_LIMIT
+	}
+	var after *listKey
+	if cursor != "" {
+		after = new(listKey)
+		buf, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(buf, after) != nil || after.Order != order {
+			return page, EARGS
+		}
+	}
+	err := fs.loadChildren(n)
+	if err != nil {
+		return page, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	node := fs.hashLookup(n.hash)
+	if node == nil {
+		return page, ENOENT
+	}
+
+	type item struct {
+		key  listKey
+		node *Node
+	}
+	children := node.getChildren()
+	page.Total = len(children)
+	items := make([]item, 0, len(children))
+	for _, c := range children {
+		k := keyOf(c, order)
+		if after == nil || after.before(k) {
+			items = append(items, item{key: k, node: c})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key.before(items[j].key)
+	})
+	if len(items) > limit {
+		items = items[:limit]
+		buf, err := json.Marshal(items[limit-1].key)
+		if err != nil {
+			return page, err
+		}
+		page.Cursor = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	page.Nodes = make([]*Node, len(items))
+	for i, it := range items {
+		page.Nodes[i] = it.node
+	}
+	return page, nil
+}
@@ -0,0 +1,70 @@
+package mega
+
+import (
+	"testing"
+)
+
+func TestListChildren(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"e", "b", "d", "a"} {
+		uploadString(t, m, dir, name, name+name+name)
+	}
+	uploadString(t, m, dir, "c", "c")
+
+	list := func(order ListOrder, limit int) []string {
+		var names []string
+		cursor := ""
+		for {
+			page, err := m.FS.ListChildren(dir, order, cursor, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != 5 || len(page.Nodes) > limit {
+				t.Fatalf("page %+v", page)
+			}
+			for _, n := range page.Nodes {
+				names = append(names, n.GetName())
+			}
+			if page.Cursor == "" {
+				return names
+			}
+			cursor = page.Cursor
+		}
+	}
+	if got := list(LIST_BY_NAME, 2); len(got) != 5 || got[0] != "a" || got[2] != "c" || got[4] != "e" {
+		t.Errorf("by name %v", got)
+	}
+	if got := list(LIST_BY_SIZE, 3); len(got) != 5 || got[0] != "c" || got[1] != "a" || got[4] != "e" {
+		t.Errorf("by size %v", got)
+	}
+
+	// A child added before the cursor isn't returned later
+	page, err := m.FS.ListChildren(dir, LIST_BY_NAME, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, dir, "aa", "aa")
+	page, err = m.FS.ListChildren(dir, LIST_BY_NAME, page.Cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Nodes) != 3 || page.Nodes[0].GetName() != "c" || page.Cursor != "" || page.Total != 6 {
+		t.Errorf("after adding: %d nodes, cursor %q", len(page.Nodes), page.Cursor)
+	}
+
+	// Cursors only work with the order they were got with
+	page, _ = m.FS.ListChildren(dir, LIST_BY_NAME, "", 2)
+	if _, err = m.FS.ListChildren(dir, LIST_BY_TIME, page.Cursor, 2); err != EARGS {
+		t.Errorf("cursor of another order: got %v", err)
+	}
+	if _, err = m.FS.ListChildren(dir, LIST_BY_NAME, "!!", 2); err != EARGS {
+		t.Errorf("bad cursor: got %v", err)
+	}
+}
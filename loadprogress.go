@@ -0,0 +1,60 @@
+package mega
+
+import "io"
+
+// Nodes added to the filesystem between progress reports and checks
+// that the load hasn't been given up
+const LOAD_PROGRESS_NODES = 1000
+
+// LoadProgress says how far loading the filesystem has got, so that a
+// UI can show it for big accounts, where it may take minutes
+type LoadProgress struct {
+	// Bytes of the tree read from the API and the size of the tree,
+	// -1 if the API didn't say
+	BytesRead  int64
+	BytesTotal int64
+	// Nodes added to the filesystem and the number in the tree, both 0
+	// until it has all been read
+	Nodes      int
+	NodesTotal int
+}
+
+// SetLoadProgress calls fn as the filesystem is loaded by Login,
+// OpenFolderLink and their Context variants, first as the tree is read
+// then every LOAD_PROGRESS_NODES nodes as they are added and once they
+// all have been.  A nil fn turns it off.
+//
+// fn is called with the filesystem locked so it mustn't call the
+// client, only hand the progress on.
+func (m *Mega) SetLoadProgress(fn func(LoadProgress)) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.loadProgress = fn
+}
+
+// WithLoadProgress calls fn as the filesystem is loaded, see
+// SetLoadProgress
+func WithLoadProgress(fn func(LoadProgress)) Option {
+	return func(m *Mega) error {
+		m.config.loadProgress = fn
+		return nil
+	}
+}
+
+// readCounter calls fn with the bytes read so far and total each time
+// r is read from
+type readCounter struct {
+	r     io.Reader
+	n     int64
+	total int64
+	fn    func(n, total int64)
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	if n > 0 {
+		rc.n += int64(n)
+		rc.fn(rc.n, rc.total)
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package mega
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLoadProgress(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	root := m.FS.GetRoot()
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := m.CreateDir(name, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []LoadProgress
+	s := newMockSession(t, b.mockServer)
+	s.k, s.sid = m.k, m.sid
+	s.SetLoadProgress(func(p LoadProgress) {
+		got = append(got, p)
+	})
+	if err := s.getFileSystemContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 2 {
+		t.Fatalf("got %+v", got)
+	}
+	last := got[len(got)-1]
+	if last.Nodes != 5 || last.NodesTotal != 5 || last.BytesRead == 0 || last.BytesRead != last.BytesTotal {
+		t.Errorf("last %+v", last)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].BytesRead < got[i-1].BytesRead || got[i].Nodes < got[i-1].Nodes {
+			t.Errorf("went back from %+v to %+v", got[i-1], got[i])
+		}
+	}
+	if children, err := s.FS.GetChildren(s.FS.GetRoot()); err != nil || len(children) != 3 {
+		t.Errorf("tree not loaded: %d children, %v", len(children), err)
+	}
+
+	// Given up before anything is loaded
+	s = newMockSession(t, b.mockServer)
+	s.k, s.sid = m.k, m.sid
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.getFileSystemContext(ctx); err != context.Canceled {
+		t.Errorf("cancelled: got %v", err)
+	}
+	if s.FS.GetRoot() != nil {
+		t.Error("loaded when cancelled")
+	}
+}
+
+func TestLoadCancelKeepsTree(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if _, err := m.CreateDir("a", m.FS.GetRoot()); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMockSession(t, b.mockServer)
+	s.k, s.sid = m.k, m.sid
+	if err := s.getFileSystem(); err != nil {
+		t.Fatal(err)
+	}
+	root := s.FS.GetRoot()
+
+	// Given up once every node is added, while another goroutine
+	// uses the filesystem
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, _ = s.FS.GetChildren(s.FS.GetRoot())
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.SetLoadProgress(func(p LoadProgress) {
+		if p.NodesTotal > 0 && p.Nodes == p.NodesTotal {
+			cancel()
+		}
+	})
+	err := s.getFileSystemContext(ctx)
+	close(done)
+	<-stopped
+	if err != context.Canceled {
+		t.Errorf("cancelled: got %v", err)
+	}
+	if s.FS.GetRoot() != root {
+		t.Error("tree replaced when cancelled")
+	}
+	if children, err := s.FS.GetChildren(root); err != nil || len(children) != 1 {
+		t.Errorf("tree lost: %d children, %v", len(children), err)
+	}
+}
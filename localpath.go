@@ -0,0 +1,111 @@
+package mega
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// localRel returns the local relative path for rel, a slash separated
+// path of remote names
+func localRel(rel string) string {
+	elems := strings.Split(rel, "/")
+	for i, e := range elems {
+		if e != "" && e != "." && e != ".." {
+			elems[i] = localName(e)
+		}
+	}
+	return filepath.Join(elems...)
+}
+
+// remoteRel returns the slash separated path of remote names for the
+// local relative path rel
+func remoteRel(rel string) string {
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for i, e := range elems {
+		if e != "" && e != "." && e != ".." {
+			elems[i] = remoteName(e)
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
+// Names Windows keeps for devices, with or without an extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// isHex returns true if s starts with two hex digits
+func isHex(s string) bool {
+	return len(s) >= 2 && strings.IndexByte("0123456789abcdefABCDEF", s[0]) >= 0 &&
+		strings.IndexByte("0123456789abcdefABCDEF", s[1]) >= 0
+}
+
+// escapeWindowsName returns name with the characters Windows doesn't
+// allow in file names replaced by %xx escapes as the MEGA desktop app
+// does, eg "a:b" becomes "a%3ab".  Trailing dots and spaces, which
+// Windows strips, and the last character of reserved device names
+// such as "CON.txt" are escaped too.  A "%" which would be read as an
+// escape is itself escaped so unescapeWindowsName always gets the
+// name back.
+func escapeWindowsName(name string) string {
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	reserved := -1
+	if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+		reserved = len(strings.TrimRight(base, " ")) - 1
+	}
+	trailing := len(strings.TrimRight(name, ". "))
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c < 0x20, strings.IndexByte(`<>:"/\|?*`, c) >= 0,
+			c == '%' && isHex(name[i+1:]),
+			i == reserved, i >= trailing:
+			fmt.Fprintf(&b, "%%%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeWindowsName reverses escapeWindowsName
+func unescapeWindowsName(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && isHex(name[i+1:]) {
+			c, _ := strconv.ParseUint(name[i+1:i+3], 16, 8)
+			b.WriteByte(byte(c))
+			i += 2
+			continue
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// windowsLongPath returns the absolute Windows path p with the \\?\
+// prefix which lifts the MAX_PATH limit of 260 characters and stops
+// Windows interpreting device names and trailing dots
+func windowsLongPath(p string) string {
+	switch {
+	case strings.HasPrefix(p, `\\?\`):
+		return p
+	case strings.HasPrefix(p, `\\`):
+		return `\\?\UNC\` + p[2:]
+	}
+	return `\\?\` + p
+}
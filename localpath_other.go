@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package mega
+
+// localName returns the local file name for the remote name
+func localName(name string) string {
+	return name
+}
+
+// remoteName returns the remote name for the local file name
+func remoteName(name string) string {
+	return name
+}
+
+// localKey returns the key under which names collide locally
+func localKey(name string) string {
+	return name
+}
+
+// longPath returns the local directory p unchanged as only Windows
+// limits the length of paths
+func longPath(p string) string {
+	return p
+}
@@ -0,0 +1,60 @@
+package mega
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapeWindowsName(t *testing.T) {
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"a:b?.txt", "a%3ab%3f.txt"},
+		{`back\slash`, "back%5cslash"},
+		{"tab\there", "tab%09here"},
+		{"trailing. ", "trailing%2e%20"},
+		{"CON", "CO%4e"},
+		{"con.txt", "co%6e.txt"},
+		{"lpt1 .tar.gz", "lpt%31 .tar.gz"},
+		{"CONSOLE", "CONSOLE"},
+		{"100%", "100%"},
+		{"%41", "%2541"},
+	} {
+		got := escapeWindowsName(test.name)
+		if got != test.want {
+			t.Errorf("escapeWindowsName(%q) = %q, want %q", test.name, got, test.want)
+		}
+		if back := unescapeWindowsName(got); back != test.name {
+			t.Errorf("unescapeWindowsName(%q) = %q, want %q", got, back, test.name)
+		}
+	}
+}
+
+func TestWindowsLongPath(t *testing.T) {
+	for _, test := range []struct {
+		path, want string
+	}{
+		{`C:\Users\me`, `\\?\C:\Users\me`},
+		{`\\server\share\dir`, `\\?\UNC\server\share\dir`},
+		{`\\?\C:\already`, `\\?\C:\already`},
+	} {
+		if got := windowsLongPath(test.path); got != test.want {
+			t.Errorf("windowsLongPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestLocalRel(t *testing.T) {
+	rel := "dir/sub/file.txt"
+	local := localRel(rel)
+	if local != filepath.Join(localName("dir"), localName("sub"), localName("file.txt")) {
+		t.Errorf("localRel(%q) = %q", rel, local)
+	}
+	if back := remoteRel(local); back != rel {
+		t.Errorf("remoteRel(%q) = %q, want %q", local, back, rel)
+	}
+	if localRel(".") != "." || remoteRel(".") != "." {
+		t.Errorf("root path not kept")
+	}
+}
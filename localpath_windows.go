@@ -0,0 +1,33 @@
+package mega
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// localName returns the local file name for the remote name
+func localName(name string) string {
+	return escapeWindowsName(name)
+}
+
+// remoteName returns the remote name for the local file name
+func remoteName(name string) string {
+	return unescapeWindowsName(name)
+}
+
+// localKey returns the key under which names collide locally, as
+// Windows file names are case insensitive
+func localKey(name string) string {
+	return strings.ToLower(localName(name))
+}
+
+// longPath returns the local directory p made absolute and prefixed
+// so that paths below it can be longer than MAX_PATH.  Separators
+// are normalized to backslashes.
+func longPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return windowsLongPath(abs)
+}
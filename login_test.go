@@ -0,0 +1,64 @@
+package mega
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoginRefused(t *testing.T) {
+	for _, test := range []struct {
+		errno ErrorMsg
+		want  error
+	}{
+		{-16, EBLOCKED},
+		{-6, ETOOMANY},
+	} {
+		requests := 0
+		srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+			requests++
+			if cmd["a"] == "us0" {
+				return map[string]interface{}{"v": 1}
+			}
+			return test.errno
+		})
+		m := newMockSession(t, srv)
+		err := m.Login("user@example.com", "password")
+		srv.Close()
+
+		var loginErr *LoginError
+		if !errors.As(err, &loginErr) || loginErr.Guidance == "" {
+			t.Errorf("%v: got %#v, want a LoginError", test.want, err)
+		}
+		if !errors.Is(err, test.want) {
+			t.Errorf("got %v, want %v", err, test.want)
+		}
+		if requests != 2 {
+			t.Errorf("%v: made %d requests, want 2", test.want, requests)
+		}
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	m := New().SetLogger(nil)
+	m.SetAPIUrl(srv.URL)
+
+	err := m.Login("user@example.com", "password")
+	if !errors.Is(err, ERATELIMIT) {
+		t.Errorf("got %v, want ERATELIMIT", err)
+	}
+	var loginErr *LoginError
+	if !errors.As(err, &loginErr) {
+		t.Errorf("got %#v, want a LoginError", err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, want 1", requests)
+	}
+}
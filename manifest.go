@@ -0,0 +1,206 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// ManifestEntry describes a file in a Manifest
+type ManifestEntry struct {
+	// Path relative to the folder using forward slashes
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Fingerprint attribute set by the uploader, "" if there was none
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// MAC of the contents from the node key, hex encoded
+	MetaMAC string `json:"metaMac"`
+	// Key of the file, needed to work out the MAC of a local copy
+	Key string `json:"key"`
+}
+
+// Manifest lists the files below a remote folder with checksums so
+// copies downloaded from a link can be verified, say when distributing
+// a dataset.  It is made by Mega.Manifest and marshals to JSON.
+//
+// The manifest holds the keys of the files, as a folder link with its
+// key does, so share it only with those who may read them.
+type Manifest struct {
+	// Files in Path order
+	Files []ManifestEntry `json:"files"`
+}
+
+// Manifest returns a manifest of the files below the folder n.  Files
+// whose keys couldn't be decrypted fail it with their DecryptionError.
+func (m *Mega) Manifest(n *Node) (*Manifest, error) {
+	if n == nil {
+		return nil, EARGS
+	}
+	err := m.LoadTree(n)
+	if err != nil {
+		return nil, err
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	if n.ntype == FILE {
+		return nil, EARGS
+	}
+	mf := &Manifest{}
+	err = m.FS.manifestTree(mf, n, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(mf.Files, func(i, j int) bool {
+		return mf.Files[i].Path < mf.Files[j].Path
+	})
+	return mf, nil
+}
+
+// manifestTree adds the files below n to mf, rel being the path of n
+//
+// Call with the FS mutex held
+func (fs *MegaFS) manifestTree(mf *Manifest, n *Node, rel string) error {
+	for _, c := range n.children {
+		p := path.Join(rel, c.name)
+		if c.ntype != FILE {
+			err := fs.manifestTree(mf, c, p)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if c.meta.compkey == nil {
+			if c.decryptErr != nil {
+				return c.decryptErr
+			}
+			return EKEY
+		}
+		mf.Files = append(mf.Files, ManifestEntry{
+			Path:        p,
+			Size:        c.size,
+			Fingerprint: c.fingerprint,
+			MetaMAC:     hex.EncodeToString(c.meta.mac),
+			Key:         base64urlencode(c.meta.compkey),
+		})
+	}
+	return nil
+}
+
+// Verify checks the files below the local directory against the
+// manifest, reporting each one as done if its size and MAC match or
+// failed with ESIZE, a *MACError or the error reading it if not.
+// Local files which aren't in the manifest are ignored.
+//
+// Errors on individual files are logged and checking carries on, the
+// first one is returned.
+func (mf *Manifest) Verify(local string) (*Report, error) {
+	report := newReport(0)
+	var firstErr error
+	for _, e := range mf.Files {
+		err := e.verify(filepath.Join(longPath(local), localRel(e.Path)))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			report.add(e.Path, ITEM_FAILED, err)
+			continue
+		}
+		report.add(e.Path, ITEM_DONE, nil)
+	}
+	return report, firstErr
+}
+
+// verify checks the local file p matches e
+func (e *ManifestEntry) verify(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != e.Size {
+		return ESIZE
+	}
+	// Nothing to MAC in an empty file
+	if e.Size == 0 {
+		return nil
+	}
+	compkey, err := base64urldecode(e.Key)
+	if err != nil {
+		return err
+	}
+	mac, err := fileMetaMAC(p, compkey)
+	if err != nil {
+		return err
+	}
+	if computed := hex.EncodeToString(mac); computed != e.MetaMAC {
+		return &MACError{Name: e.Path, Expected: e.MetaMAC, Computed: computed, Size: e.Size, Err: EMACMISMATCH}
+	}
+	return nil
+}
+
+// fileMetaMAC works out the MAC of the local file p as it would be
+// stored in the file key compkey
+func fileMetaMAC(p string, compkey []byte) ([]byte, error) {
+	t, err := bytes_to_a32(compkey)
+	if err != nil {
+		return nil, err
+	}
+	if len(t) != 8 {
+		return nil, EKEY
+	}
+	key, err := a32_to_bytes([]uint32{t[0] ^ t[4], t[1] ^ t[5], t[2] ^ t[6], t[3] ^ t[7]})
+	if err != nil {
+		return nil, err
+	}
+	iv, err := a32_to_bytes([]uint32{t[4], t[5], t[4], t[5]})
+	if err != nil {
+		return nil, err
+	}
+	aes_block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	chunks := getChunkSizes(fi.Size())
+	macs := make([][]byte, len(chunks))
+	for i, c := range chunks {
+		chunk := make([]byte, c.size)
+		_, err = io.ReadFull(f, chunk)
+		if err != nil {
+			return nil, err
+		}
+		macs[i] = chunkMAC(aes_block, iv, chunk)
+	}
+	return condenseMACs(aes_block, macs)
+}
+
+// condenseMACs works out the 8 byte MAC of a file from the MACs of its
+// chunks
+func condenseMACs(aes_block cipher.Block, chunk_macs [][]byte) ([]byte, error) {
+	mac_enc := cipher.NewCBCEncrypter(aes_block, zero_iv)
+	mac_data := make([]byte, 16)
+	for _, v := range chunk_macs {
+		mac_enc.CryptBlocks(mac_data, v)
+	}
+	t, err := bytes_to_a32(mac_data)
+	if err != nil {
+		return nil, err
+	}
+	return a32_to_bytes([]uint32{t[0] ^ t[1], t[2] ^ t[3]})
+}
@@ -0,0 +1,90 @@
+package mega
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	data, err := m.CreateDir("data", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := m.CreateDir("sub", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, data, "a.txt", "first file")
+	uploadString(t, m, sub, "b.txt", "second file")
+	uploadString(t, m, sub, "empty", "")
+
+	mf, err := m.Manifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range mf.Files {
+		paths = append(paths, e.Path)
+		if e.Key == "" || (e.Size > 0 && len(e.MetaMAC) != 16) {
+			t.Errorf("%q: incomplete entry %+v", e.Path, e)
+		}
+	}
+	if len(paths) != 3 || paths[0] != "a.txt" || paths[1] != "sub/b.txt" || paths[2] != "sub/empty" {
+		t.Fatalf("manifest lists %q", paths)
+	}
+
+	// Survives a round trip through JSON
+	buf, err := json.Marshal(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf = &Manifest{}
+	if err = json.Unmarshal(buf, mf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "mega-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = m.DownloadDir(data, dir); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "data")
+	report, err := mf.Verify(local)
+	if err != nil || report.Count(ITEM_DONE) != 3 {
+		t.Fatalf("Verify: %v %+v", err, report.Items)
+	}
+
+	// Same size, different contents
+	if err = ioutil.WriteFile(filepath.Join(local, "a.txt"), []byte("First file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(local, "sub", "b.txt"), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	report, err = mf.Verify(local)
+	var merr *MACError
+	if !errors.As(err, &merr) || merr.Err != EMACMISMATCH || merr.Name != "a.txt" || merr.Expected == merr.Computed {
+		t.Errorf("got %v, want EMACMISMATCH", err)
+	}
+	if report.Count(ITEM_FAILED) != 2 || report.Items[1].Err != ESIZE {
+		t.Errorf("report %+v", report.Items)
+	}
+
+	if _, err = mf.Verify(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing directory: got %v", err)
+	}
+	if _, err = m.Manifest(nil); err != EARGS {
+		t.Errorf("nil node: got %v, want EARGS", err)
+	}
+}
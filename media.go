@@ -0,0 +1,481 @@
+package mega
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	// image formats ProbeMedia recognises
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// File attribute type of MEGA's media attribute
+const FA_MEDIA = 8
+
+// DetectContentType returns the MIME type of a file called name which
+// starts with head, going by the extension of the name and then the
+// contents.  Up to 512 bytes of head are looked at.
+func DetectContentType(name string, head []byte) string {
+	if t := mime.TypeByExtension(strings.ToLower(path.Ext(name))); t != "" {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+// MediaInfo describes an image, video or audio file
+type MediaInfo struct {
+	// Dimensions of the image or video in pixels, 0 for audio
+	Width, Height int
+	// Duration of the video or audio, 0 for images
+	Duration time.Duration
+	// Frames per second of a video, 0 if not known
+	FPS int
+}
+
+// ProbeMedia reads the dimensions of a GIF, JPEG or PNG image or the
+// dimensions, duration and frame rate of an MP4 or QuickTime video in
+// r, size bytes long.  Other files give ENOTMEDIA.
+func ProbeMedia(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+	if err == nil {
+		return &MediaInfo{Width: cfg.Width, Height: cfg.Height}, nil
+	}
+	var ftyp [8]byte
+	_, err = r.ReadAt(ftyp[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch string(ftyp[4:]) {
+	case "ftyp", "moov", "mdat", "wide", "free":
+		return probeMP4(r, size)
+	}
+	return nil, ENOTMEDIA
+}
+
+// mp4Box is a box of an MP4 file
+type mp4Box struct {
+	typ string
+	// position and size of the contents
+	start, size int64
+}
+
+// mp4Boxes returns the boxes in the size bytes of r from start
+func mp4Boxes(r io.ReaderAt, start, size int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	end := start + size
+	for pos := start; pos+8 <= end; {
+		var hdr [16]byte
+		_, err := r.ReadAt(hdr[:8], pos)
+		if err != nil {
+			return nil, err
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		hdrSize := int64(8)
+		switch n {
+		case 0:
+			// to the end
+			n = end - pos
+		case 1:
+			_, err = r.ReadAt(hdr[8:], pos+8)
+			if err != nil {
+				return nil, err
+			}
+			n = int64(binary.BigEndian.Uint64(hdr[8:]))
+			hdrSize = 16
+		}
+		if n < hdrSize || pos+n > end {
+			return nil, ENOTMEDIA
+		}
+		boxes = append(boxes, mp4Box{typ: string(hdr[4:8]), start: pos + hdrSize, size: n - hdrSize})
+		pos += n
+	}
+	return boxes, nil
+}
+
+// mp4Child returns the first box of type typ in boxes
+func mp4Child(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// mp4Path returns the box found by following the types in path down
+// from box
+func mp4Path(r io.ReaderAt, box mp4Box, path ...string) (mp4Box, bool) {
+	for _, typ := range path {
+		children, err := mp4Boxes(r, box.start, box.size)
+		if err != nil {
+			return mp4Box{}, false
+		}
+		var ok bool
+		box, ok = mp4Child(children, typ)
+		if !ok {
+			return mp4Box{}, false
+		}
+	}
+	return box, true
+}
+
+// mp4Read returns the contents of box, which must be small
+func mp4Read(r io.ReaderAt, box mp4Box) ([]byte, error) {
+	if box.size > 1<<20 {
+		return nil, ENOTMEDIA
+	}
+	buf := make([]byte, box.size)
+	_, err := r.ReadAt(buf, box.start)
+	return buf, err
+}
+
+// mp4Timing returns the timescale and duration in a mvhd or mdhd box
+func mp4Timing(buf []byte) (timescale uint32, duration uint64, err error) {
+	switch {
+	case len(buf) >= 32 && buf[0] == 1:
+		return binary.BigEndian.Uint32(buf[20:]), binary.BigEndian.Uint64(buf[24:]), nil
+	case len(buf) >= 20:
+		return binary.BigEndian.Uint32(buf[12:]), uint64(binary.BigEndian.Uint32(buf[16:])), nil
+	}
+	return 0, 0, ENOTMEDIA
+}
+
+// probeMP4 reads the MediaInfo from the movie header and the first
+// video track of an MP4 or QuickTime file
+func probeMP4(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	top, err := mp4Boxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	moov, ok := mp4Child(top, "moov")
+	if !ok {
+		return nil, ENOTMEDIA
+	}
+	mvhd, ok := mp4Path(r, moov, "mvhd")
+	if !ok {
+		return nil, ENOTMEDIA
+	}
+	buf, err := mp4Read(r, mvhd)
+	if err != nil {
+		return nil, err
+	}
+	timescale, duration, err := mp4Timing(buf)
+	if err != nil || timescale == 0 {
+		return nil, ENOTMEDIA
+	}
+	info := &MediaInfo{Duration: time.Duration(float64(duration) / float64(timescale) * float64(time.Second))}
+
+	tracks, err := mp4Boxes(r, moov.start, moov.size)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range tracks {
+		if trak.typ != "trak" {
+			continue
+		}
+		hdlr, ok := mp4Path(r, trak, "mdia", "hdlr")
+		if !ok {
+			continue
+		}
+		buf, err = mp4Read(r, hdlr)
+		if err != nil || len(buf) < 12 || string(buf[8:12]) != "vide" {
+			continue
+		}
+		if tkhd, ok := mp4Path(r, trak, "tkhd"); ok {
+			buf, err = mp4Read(r, tkhd)
+			off := 76
+			if err == nil && len(buf) > 0 && buf[0] == 1 {
+				off = 88
+			}
+			if err == nil && len(buf) >= off+8 {
+				// 16.16 fixed point
+				info.Width = int(binary.BigEndian.Uint32(buf[off:]) >> 16)
+				info.Height = int(binary.BigEndian.Uint32(buf[off+4:]) >> 16)
+			}
+		}
+		info.FPS = mp4FPS(r, trak)
+		break
+	}
+	return info, nil
+}
+
+// mp4FPS returns the frame rate of a video track from the duration of
+// its first samples, 0 if it can't be found
+func mp4FPS(r io.ReaderAt, trak mp4Box) int {
+	mdhd, ok := mp4Path(r, trak, "mdia", "mdhd")
+	if !ok {
+		return 0
+	}
+	buf, err := mp4Read(r, mdhd)
+	if err != nil {
+		return 0
+	}
+	timescale, _, err := mp4Timing(buf)
+	if err != nil {
+		return 0
+	}
+	stts, ok := mp4Path(r, trak, "mdia", "minf", "stbl", "stts")
+	if !ok {
+		return 0
+	}
+	buf, err = mp4Read(r, stts)
+	if err != nil || len(buf) < 16 || binary.BigEndian.Uint32(buf[4:]) == 0 {
+		return 0
+	}
+	delta := binary.BigEndian.Uint32(buf[12:])
+	if delta == 0 {
+		return 0
+	}
+	return int(math.Round(float64(timescale) / float64(delta)))
+}
+
+// xxteaDelta is the key schedule constant of XXTEA
+const xxteaDelta = 0x9e3779b9
+
+// xxteaMX is the XXTEA round function
+func xxteaMX(sum, y, z uint32, p uint32, e uint32, k [4]uint32) uint32 {
+	return ((z>>5 ^ y<<2) + (y>>3 ^ z<<4)) ^ ((sum ^ y) + (k[(p&3)^e] ^ z))
+}
+
+// xxteaEncrypt encrypts v in place with XXTEA under k
+func xxteaEncrypt(v []uint32, k [4]uint32) {
+	n := uint32(len(v))
+	z := v[n-1]
+	var sum uint32
+	for rounds := 6 + 52/n; rounds > 0; rounds-- {
+		sum += xxteaDelta
+		e := sum >> 2 & 3
+		for p := uint32(0); p < n; p++ {
+			y := v[(p+1)%n]
+			v[p] += xxteaMX(sum, y, z, p, e, k)
+			z = v[p]
+		}
+	}
+}
+
+// xxteaDecrypt reverses xxteaEncrypt
+func xxteaDecrypt(v []uint32, k [4]uint32) {
+	n := uint32(len(v))
+	y := v[0]
+	for sum := (6 + 52/n) * xxteaDelta; sum != 0; sum -= xxteaDelta {
+		e := sum >> 2 & 3
+		for p := n - 1; ; p-- {
+			z := v[(p+n-1)%n]
+			v[p] -= xxteaMX(sum, y, z, p, e, k)
+			y = v[p]
+			if p == 0 {
+				break
+			}
+		}
+	}
+}
+
+// mediaKey returns the key of the media attribute of a file with the
+// given key, the words of which are little endian as in the SDK
+func mediaKey(key []byte) (k [4]uint32, err error) {
+	if len(key) != 16 {
+		return k, EARGS
+	}
+	for i := range k {
+		k[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	return k, nil
+}
+
+// mediaScale packs v into bits bits the way MEGA does: doubled if it
+// fits, otherwise a coarser value with the low bit set
+func mediaScale(v int, bits uint, div int, offset int) int {
+	limit := 1 << bits
+	v <<= 1
+	if v >= limit {
+		v = ((v - offset) / div) | 1
+	}
+	if v >= limit {
+		v = limit - 1
+	}
+	return v
+}
+
+// mediaUnscale reverses mediaScale
+func mediaUnscale(v int, div int, offset int) int {
+	if v&1 == 0 {
+		return v >> 1
+	}
+	return ((v&^1)*div + offset) >> 1
+}
+
+// encodeMediaAttr returns info as the value of MEGA's media attribute
+// for a file with the given key, packed and encrypted as the official
+// clients do
+func encodeMediaAttr(info *MediaInfo, key []byte) (string, error) {
+	k, err := mediaKey(key)
+	if err != nil {
+		return "", err
+	}
+	width := mediaScale(info.Width, 15, 8, 32768)
+	height := mediaScale(info.Height, 15, 8, 32768)
+	fps := mediaScale(info.FPS, 8, 8, 256)
+	playtime := mediaScale(int(info.Duration/time.Second), 18, 60, 262200)
+
+	var v [8]byte
+	v[7] = 0 // format given by the codec attribute, which isn't set
+	v[6] = byte(playtime >> 10)
+	v[5] = byte(playtime >> 2)
+	v[4] = byte((playtime&3)<<6 | fps>>2)
+	v[3] = byte((fps&3)<<6 | (height>>9)&63)
+	v[2] = byte(height >> 1)
+	v[1] = byte((width>>8)&127 | (height&1)<<7)
+	v[0] = byte(width)
+
+	words := []uint32{binary.LittleEndian.Uint32(v[:4]), binary.LittleEndian.Uint32(v[4:])}
+	xxteaEncrypt(words, k)
+	binary.LittleEndian.PutUint32(v[:4], words[0])
+	binary.LittleEndian.PutUint32(v[4:], words[1])
+	return base64urlencode(v[:]), nil
+}
+
+// decodeMediaAttr reverses encodeMediaAttr
+func decodeMediaAttr(attr string, key []byte) (*MediaInfo, error) {
+	k, err := mediaKey(key)
+	if err != nil {
+		return nil, err
+	}
+	v, err := base64urldecode(attr)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 8 {
+		return nil, EBADATTR
+	}
+	words := []uint32{binary.LittleEndian.Uint32(v[:4]), binary.LittleEndian.Uint32(v[4:])}
+	xxteaDecrypt(words, k)
+	binary.LittleEndian.PutUint32(v[:4], words[0])
+	binary.LittleEndian.PutUint32(v[4:], words[1])
+
+	width := int(v[0]) | int(v[1]&127)<<8
+	height := int(v[1]>>7) | int(v[2])<<1 | int(v[3]&63)<<9
+	fps := int(v[3]>>6) | int(v[4]&63)<<2
+	playtime := int(v[4]>>6) | int(v[5])<<2 | int(v[6])<<10
+	return &MediaInfo{
+		Width:    mediaUnscale(width, 8, 32768),
+		Height:   mediaUnscale(height, 8, 32768),
+		FPS:      mediaUnscale(fps, 8, 256),
+		Duration: time.Duration(mediaUnscale(playtime, 60, 262200)) * time.Second,
+	}, nil
+}
+
+// fileAttr returns the value of the file attribute of type t in fa,
+// "" if there isn't one.  fa is a list of "id:type*value" separated
+// by "/".
+func fileAttr(fa string, t int) string {
+	prefix := strconv.Itoa(t) + "*"
+	for _, a := range strings.Split(fa, "/") {
+		if i := strings.IndexByte(a, ':'); i >= 0 {
+			a = a[i+1:]
+		}
+		if strings.HasPrefix(a, prefix) {
+			return a[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// GetMediaInfo returns the dimensions and duration stored in the
+// media attribute of the file n, nil if it hasn't one
+func (n *Node) GetMediaInfo() *MediaInfo {
+	n.fs.mutex.Lock()
+	fa, key := n.fa, n.meta.key
+	n.fs.mutex.Unlock()
+	attr := fileAttr(fa, FA_MEDIA)
+	if attr == "" {
+		return nil
+	}
+	info, err := decodeMediaAttr(attr, key)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// putFileAttr sets the file attribute fa, "type*value", of n
+func (m *Mega) putFileAttr(n *Node, fa string) error {
+	if m.getConfig().readonly {
+		return EREADONLY
+	}
+	m.FS.mutex.Lock()
+	err := m.FS.checkAccess(n, ACCESS_FULL)
+	m.FS.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	var msg [1]FileAttrPutMsg
+	var res [1]string
+	msg[0].Cmd = "pfa"
+	msg[0].N = n.GetHash()
+	msg[0].Fa = fa
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return err
+	}
+	m.FS.mutex.Lock()
+	n.fa = res[0]
+	m.FS.mutex.Unlock()
+	return nil
+}
+
+// SetMediaInfo stores info as MEGA's media attribute of the file n so
+// the official clients show its dimensions and duration and offer to
+// play it.  The attribute is only meaningful for videos and audio.
+//
+// The codec attribute which goes with it isn't set so clients may not
+// know which player to use.
+func (m *Mega) SetMediaInfo(n *Node, info *MediaInfo) error {
+	if n == nil || info == nil {
+		return EARGS
+	}
+	m.FS.mutex.Lock()
+	ntype, key := n.ntype, n.meta.key
+	m.FS.mutex.Unlock()
+	if ntype != FILE {
+		return EARGS
+	}
+	attr, err := encodeMediaAttr(info, key)
+	if err != nil {
+		return err
+	}
+	return m.putFileAttr(n, strconv.Itoa(FA_MEDIA)+"*"+attr)
+}
+
+// probeUpload returns the MIME type and, for images and videos, the
+// MediaInfo of the file being uploaded from r
+func probeUpload(name string, r io.ReaderAt, size int64) (contentType string, info *MediaInfo, err error) {
+	head := make([]byte, 512)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	contentType = DetectContentType(name, head[:n])
+	info, err = ProbeMedia(r, size)
+	if err == ENOTMEDIA {
+		err = nil
+	}
+	return contentType, info, err
+}
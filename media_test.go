@@ -0,0 +1,174 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeBox builds an MP4 box of typ holding the parts
+func makeBox(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(body)))
+	copy(buf[4:], typ)
+	return append(buf, body...)
+}
+
+// be32 returns the big endian words
+func be32(words ...uint32) []byte {
+	buf := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint32(buf[i*4:], w)
+	}
+	return buf
+}
+
+// testMP4 returns a 90.5s 640x360 MP4 at 29.97 frames a second with no
+// media data
+func testMP4() []byte {
+	tkhd := make([]byte, 84)
+	copy(tkhd[76:], be32(640<<16, 360<<16))
+	return bytes.Join([][]byte{
+		makeBox("ftyp", []byte("isom"), be32(0x200), []byte("isommp41")),
+		makeBox("moov",
+			makeBox("mvhd", be32(0, 0, 0, 1000, 90500), make([]byte, 80)),
+			makeBox("trak",
+				makeBox("tkhd", tkhd),
+				makeBox("mdia",
+					makeBox("mdhd", be32(0, 0, 0, 30000, 2712000), make([]byte, 4)),
+					makeBox("hdlr", be32(0, 0), []byte("vide"), make([]byte, 13)),
+					makeBox("minf",
+						makeBox("stbl",
+							makeBox("stts", be32(0, 1, 2712, 1001))))))),
+	}, nil)
+}
+
+func TestDetectContentType(t *testing.T) {
+	var pngData bytes.Buffer
+	_ = png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 1, 1)))
+	for _, test := range []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"photo.JPG", nil, "image/jpeg"},
+		{"noext", pngData.Bytes(), "image/png"},
+		{"notes", []byte("plain text"), "text/plain; charset=utf-8"},
+	} {
+		if got := DetectContentType(test.name, test.head); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestProbeMedia(t *testing.T) {
+	var pngData bytes.Buffer
+	_ = png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 30, 20)))
+	mp4 := testMP4()
+	for _, test := range []struct {
+		name string
+		data []byte
+		want MediaInfo
+	}{
+		{"png", pngData.Bytes(), MediaInfo{Width: 30, Height: 20}},
+		{"mp4", mp4, MediaInfo{Width: 640, Height: 360, Duration: 90500 * time.Millisecond, FPS: 30}},
+	} {
+		info, err := ProbeMedia(bytes.NewReader(test.data), int64(len(test.data)))
+		if err != nil || *info != test.want {
+			t.Errorf("%s: got %+v %v, want %+v", test.name, info, err, test.want)
+		}
+	}
+	for _, data := range [][]byte{[]byte("not media at all"), mp4[:100], nil} {
+		if _, err := ProbeMedia(bytes.NewReader(data), int64(len(data))); err != ENOTMEDIA {
+			t.Errorf("%q: got %v, want ENOTMEDIA", data, err)
+		}
+	}
+}
+
+func TestMediaAttr(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	v := []uint32{0x01234567, 0x89abcdef}
+	k, _ := mediaKey(key)
+	xxteaEncrypt(v, k)
+	if v[0] == 0x01234567 {
+		t.Error("xxtea didn't encrypt")
+	}
+	xxteaDecrypt(v, k)
+	if v[0] != 0x01234567 || v[1] != 0x89abcdef {
+		t.Errorf("xxtea round trip: %x", v)
+	}
+
+	for _, test := range []struct {
+		in, want MediaInfo
+	}{
+		{MediaInfo{Width: 1920, Height: 1080, Duration: 90 * time.Second, FPS: 25}, MediaInfo{Width: 1920, Height: 1080, Duration: 90 * time.Second, FPS: 25}},
+		{MediaInfo{Duration: 3 * time.Minute}, MediaInfo{Duration: 3 * time.Minute}},
+		// too big to keep exactly
+		{MediaInfo{Width: 20001, Height: 16401, Duration: 100*time.Hour + 17*time.Second, FPS: 241}, MediaInfo{Width: 20000, Height: 16400, Duration: 100 * time.Hour, FPS: 240}},
+	} {
+		attr, err := encodeMediaAttr(&test.in, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeMediaAttr(attr, key)
+		if err != nil || *got != test.want {
+			t.Errorf("%+v: got %+v %v, want %+v", test.in, got, err, test.want)
+		}
+	}
+
+	fa := "470:0*thumb/471:8*media/472:9*codecs"
+	if fileAttr(fa, FA_MEDIA) != "media" || fileAttr(fa, 0) != "thumb" || fileAttr(fa, 1) != "" {
+		t.Errorf("fileAttr parsed %q wrongly", fa)
+	}
+}
+
+func TestUploadMedia(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "clip.mp4")
+	if err = ioutil.WriteFile(p, testMP4(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := m.UploadFileWith(p, m.FS.GetRoot(), "", UploadOptions{Media: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Media == nil || res.Media.Width != 640 {
+		t.Errorf("media %+v", res.Media)
+	}
+	if !strings.HasPrefix(res.ContentType, "video/") && res.ContentType != "application/octet-stream" {
+		t.Errorf("content type %q", res.ContentType)
+	}
+	info := res.Node.GetMediaInfo()
+	want := MediaInfo{Width: 640, Height: 360, Duration: 90 * time.Second, FPS: 30}
+	if info == nil || *info != want {
+		t.Errorf("media attribute %+v, want %+v", info, want)
+	}
+
+	// Without Media nothing is stored
+	res, err = m.UploadFileWith(p, m.FS.GetRoot(), "plain.mp4", UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Media != nil || res.Node.GetMediaInfo() != nil {
+		t.Errorf("media stored without Media")
+	}
+	if err = m.SetMediaInfo(m.FS.GetRoot(), &want); err != EARGS {
+		t.Errorf("folder: got %v, want EARGS", err)
+	}
+}
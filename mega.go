@@ -2,21 +2,26 @@ package mega
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
-	mrand "math/rand"
+	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -45,6 +50,47 @@ type config struct {
 	ul_workers int
 	timeout    time.Duration
 	https      bool
+	appid      string
+	limiter    *RateLimiter
+	journal    JournalSink
+	readonly   bool
+	keys       io.Reader
+	ids        io.Reader
+	clock      Clock
+	lazy       bool
+	dedupe     DedupeMode
+	// what CreateDir and Move do about names already taken
+	collision Collision
+	// failures before bulk operations stop, 0 for no limit
+	failureThreshold int
+	tracer           Tracer
+	// looks up the hosts the default HTTP clients connect to
+	resolver Resolver
+	// goroutines decrypting downloaded chunks, 0 for one per CPU
+	cpu_workers int
+	// checks the contents of files uploaded and downloaded
+	filter ContentFilter
+	// where the event stream starts, "" for where the tree fetched
+	// is up to, and called each time it moves on
+	cursor     string
+	cursorFunc func(cursor string)
+	// where partial downloads and spooled data go, "" for beside
+	// the destination and the system temporary directory, and the
+	// most bytes put in one temporary file, 0 for no limit
+	tempDir  string
+	maxSpill int64
+	// fail on replies from the API which aren't as expected
+	strict bool
+	// called with misuse found in audit mode, nil if it is off
+	audit func(Misuse)
+	// where fetched thumbnails and previews are kept, nil for nowhere
+	thumbs *thumbCache
+	// fractions of the storage capacity alerted on and the callback,
+	// nil if storage alerts are off
+	storageThresholds []float64
+	storageAlert      func(StorageAlert)
+	// called as the filesystem is loaded
+	loadProgress func(LoadProgress)
 }
 
 func newConfig() config {
@@ -58,21 +104,14 @@ func newConfig() config {
 	}
 }
 
-// Set mega service base url
-func (c *config) SetAPIUrl(u string) {
+func (c *config) setAPIUrl(u string) {
 	if strings.HasSuffix(u, "/") {
 		u = strings.TrimRight(u, "/")
 	}
 	c.baseurl = u
 }
 
-// Set number of retries for api calls
-func (c *config) SetRetries(r int) {
-	c.retries = r
-}
-
-// Set concurrent download workers
-func (c *config) SetDownloadWorkers(w int) error {
+func (c *config) setDownloadWorkers(w int) error {
 	if w <= MAX_DOWNLOAD_WORKERS {
 		c.dl_workers = w
 		return nil
@@ -81,13 +120,16 @@ func (c *config) SetDownloadWorkers(w int) error {
 	return EWORKER_LIMIT_EXCEEDED
 }
 
-// Set connection timeout
-func (c *config) SetTimeOut(t time.Duration) {
-	c.timeout = t
+// decryptWorkers returns the number of goroutines to decrypt the
+// chunks of a download with
+func (c *config) decryptWorkers() int {
+	if c.cpu_workers > 0 {
+		return c.cpu_workers
+	}
+	return runtime.NumCPU()
 }
 
-// Set concurrent upload workers
-func (c *config) SetUploadWorkers(w int) error {
+func (c *config) setUploadWorkers(w int) error {
 	if w <= MAX_UPLOAD_WORKERS {
 		c.ul_workers = w
 		return nil
@@ -96,20 +138,133 @@ func (c *config) SetUploadWorkers(w int) error {
 	return EWORKER_LIMIT_EXCEEDED
 }
 
+// getConfig returns a snapshot of the configuration.  Transfers and
+// requests take one of these when they start so changing the
+// configuration doesn't affect them part way through.
+func (m *Mega) getConfig() config {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	return m.config
+}
+
+// Set mega service base url
+func (m *Mega) SetAPIUrl(u string) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.setAPIUrl(u)
+}
+
+// Set number of retries for api calls
+func (m *Mega) SetRetries(r int) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.retries = r
+}
+
+// Set concurrent download workers
+func (m *Mega) SetDownloadWorkers(w int) error {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.config.setDownloadWorkers(w)
+}
+
+// SetDecryptWorkers sets the number of goroutines which decrypt and
+// check the chunks of each download, apart from the download workers
+// reading them from the network, 0 for one per CPU
+func (m *Mega) SetDecryptWorkers(w int) error {
+	if w < 0 {
+		return EARGS
+	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.cpu_workers = w
+	return nil
+}
+
+// Set connection timeout
+func (m *Mega) SetTimeOut(t time.Duration) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.timeout = t
+}
+
+// Set concurrent upload workers
+func (m *Mega) SetUploadWorkers(w int) error {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.config.setUploadWorkers(w)
+}
+
 // Set use https for transfers
-func (c *config) SetHTTPS(e bool) {
-	c.https = e
+func (m *Mega) SetHTTPS(e bool) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.https = e
+}
+
+// SetReadOnly stops the client changing anything in the account.  Any
+// API request other than logging in, reading the filesystem, account
+// details, sessions and public keys, fetching thumbnails and
+// downloading fails with EREADONLY, as does uploading chunks.
+func (m *Mega) SetReadOnly(readonly bool) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.readonly = readonly
+}
+
+// readOnlyCommands are the API commands allowed in read only mode
+var readOnlyCommands = map[string]bool{
+	"us0": true, // prelogin
+	"us":  true, // login
+	"ug":  true, // user details
+	"uq":  true, // quota
+	"f":   true, // fetch nodes
+	"g":   true, // download URL
+	"usl": true, // session history
+	"uk":  true, // public key of a user
+}
+
+// checkReadOnly returns EREADONLY if the request contains a command
+// not allowed in read only mode
+func checkReadOnly(r []byte) error {
+	var cmds []struct {
+		Cmd string `json:"a"`
+		Fah string `json:"fah"`
+	}
+	err := json.Unmarshal(r, &cmds)
+	if err != nil {
+		return EREADONLY
+	}
+	for _, cmd := range cmds {
+		// ufa fetches the file attributes with handle fah, without
+		// one it is for uploading them
+		if cmd.Cmd == "ufa" && cmd.Fah != "" {
+			continue
+		}
+		if !readOnlyCommands[cmd.Cmd] {
+			return EREADONLY
+		}
+	}
+	return nil
 }
 
 type Mega struct {
-	config
+	// Settings, read with getConfig
+	config config
+	// mutex to protect config
+	configMu sync.RWMutex
+	// Region selection requested with WithAutoRegion
+	autoRegion bool
+	regions    []string
+	regionOnce sync.Once
 	// Version of the account
 	accountVersion int
 	// Salt for the account if accountVersion > 1
 	accountSalt []byte
 	// Sequence number
 	sn int64
-	// Server state sn
+	// Server state sn, the cursor of the event stream, guarded by the
+	// FS mutex
 	ssn string
 	// Session ID
 	sid string
@@ -117,10 +272,19 @@ type Mega struct {
 	k []byte
 	// User handle
 	uh []byte
+	// Account handle as returned by login
+	handle string
+	// RSA private key of the account
+	privk *rsaPrivateKey
+	// Folder link if this is a folder link session
+	flink *folderLink
 	// Filesystem object
 	FS *MegaFS
-	// HTTP Client
+	// HTTP Client for API calls and the event stream
 	client *http.Client
+	// HTTP Client for chunk transfers, with its own connections so
+	// throttled transfers can't hold up the API calls
+	storage *http.Client
 	// Loggers
 	logf   func(format string, v ...interface{})
 	debugf func(format string, v ...interface{})
@@ -130,17 +294,95 @@ type Mega struct {
 	waitEventsMu sync.Mutex
 	// Outstanding channels to close to indicate events all received
 	waitEvents []chan struct{}
-}
+	// mutex to protect subscribers
+	subscribersMu sync.Mutex
+	// Callbacks for filesystem events
+	subscribers map[int]*subscriber
+	// Id to give the next subscriber
+	nextSubscriber int
+	// Limits storage connections across all transfers
+	conns *connLimiter
+	// Bounds the memory of chunk buffers and caches
+	mem *memBudget
+	// Counts the API calls and transfers
+	metrics *metrics
+	// Bytes transferred each day
+	usage *usageLog
+	// mutex to protect unknown
+	unknownMu sync.Mutex
+	// Fields seen in API replies which aren't known, see UnknownFields
+	unknown map[string]json.RawMessage
+	// mutex to protect busy
+	auditMu sync.Mutex
+	// Nodes being changed in audit mode and by what, see SetAudit
+	busy map[string]string
+	// mutex to protect uploaded
+	uploadedMu sync.Mutex
+	// Handles of the files uploaded by their contents, see
+	// UploadOptions.Dedupe
+	uploaded map[string]string
+	// Storage usage last seen, see SetStorageAlerts
+	quota storageState
+	// Chunk transfer statistics, see LinkQuality
+	links linkStats
+}
+
+// NodeType is the kind of a filesystem node
+type NodeType int
 
 // Filesystem node types
 const (
-	FILE   = 0
-	FOLDER = 1
-	ROOT   = 2
-	INBOX  = 3
-	TRASH  = 4
+	FILE   NodeType = 0
+	FOLDER NodeType = 1
+	ROOT   NodeType = 2
+	INBOX  NodeType = 3
+	TRASH  NodeType = 4
 )
 
+// nodeTypeNames are the names of the node types as returned by String
+var nodeTypeNames = [...]string{
+	FILE:   "file",
+	FOLDER: "folder",
+	ROOT:   "root",
+	INBOX:  "inbox",
+	TRASH:  "trash",
+}
+
+// String returns the name of the node type, such as "folder"
+func (t NodeType) String() string {
+	if t >= 0 && int(t) < len(nodeTypeNames) {
+		return nodeTypeNames[t]
+	}
+	return "NodeType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// IsContainer returns true for node types which hold other nodes, that
+// is everything but files
+func (t NodeType) IsContainer() bool {
+	return t > FILE && int(t) < len(nodeTypeNames)
+}
+
+// MarshalJSON encodes the node type as its name
+func (t NodeType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON decodes a node type from its name or, as MEGA sends
+// it, its number
+func (t *NodeType) UnmarshalJSON(b []byte) error {
+	var name string
+	if json.Unmarshal(b, &name) != nil {
+		return json.Unmarshal(b, (*int)(t))
+	}
+	for i, n := range nodeTypeNames {
+		if n == name {
+			*t = NodeType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown node type %q", name)
+}
+
 // Filesystem node
 type Node struct {
 	fs       *MegaFS
@@ -148,10 +390,29 @@ type Node struct {
 	hash     string
 	parent   *Node
 	children []*Node
-	ntype    int
+	ntype    NodeType
 	size     int64
 	ts       time.Time
 	meta     NodeMeta
+	// why the key or attributes couldn't be decrypted, nil if they were
+	decryptErr *DecryptionError
+	// children haven't been fetched yet when lazy loading
+	unloaded bool
+	// fingerprint attribute, "" if the uploader didn't set one
+	fingerprint string
+	// other attributes, kept so they survive renames
+	attrs map[string]json.RawMessage
+	// file attributes such as the media attribute
+	fa string
+	// totals of the nodes below a folder, kept up to date as nodes
+	// are added, moved and removed
+	treeSize    int64
+	treeFiles   int
+	treeFolders int
+	// handles of the user the node belongs to and of the user who
+	// added it, "" if not known
+	owner   string
+	creator string
 }
 
 func (n *Node) removeChild(c *Node) bool {
@@ -164,6 +425,7 @@ func (n *Node) removeChild(c *Node) bool {
 	}
 
 	if index >= 0 {
+		n.addTree(n.children[index], -1)
 		n.children[index] = n.children[len(n.children)-1]
 		n.children = n.children[:len(n.children)-1]
 		return true
@@ -175,6 +437,24 @@ func (n *Node) removeChild(c *Node) bool {
 func (n *Node) addChild(c *Node) {
 	if n != nil {
 		n.children = append(n.children, c)
+		n.addTree(c, 1)
+	}
+}
+
+// addTree adds the totals of c and the nodes below it, times sign, to
+// n and each folder above it
+func (n *Node) addTree(c *Node, sign int) {
+	size, files, folders := c.treeSize, c.treeFiles, c.treeFolders
+	if c.ntype == FILE {
+		size += c.size
+		files++
+	} else {
+		folders++
+	}
+	for p := n; p != nil; p = p.parent {
+		p.treeSize += int64(sign) * size
+		p.treeFiles += sign * files
+		p.treeFolders += sign * folders
 	}
 }
 
@@ -182,12 +462,44 @@ func (n *Node) getChildren() []*Node {
 	return n.children
 }
 
-func (n *Node) GetType() int {
+func (n *Node) GetType() NodeType {
 	n.fs.mutex.Lock()
 	defer n.fs.mutex.Unlock()
 	return n.ntype
 }
 
+// GetTreeSize returns the size of the file n or the total size of the
+// files below the folder n.  When lazy loading only the folders loaded
+// so far are counted.
+func (n *Node) GetTreeSize() int64 {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	if n.ntype == FILE {
+		return n.size
+	}
+	return n.treeSize
+}
+
+// GetTreeCounts returns the number of files and folders below the
+// folder n, 0 for a file.  When lazy loading only the folders loaded
+// so far are counted.
+func (n *Node) GetTreeCounts() (files, folders int) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.treeFiles, n.treeFolders
+}
+
+// IsFile returns true if n is a file
+func (n *Node) IsFile() bool {
+	return n.GetType() == FILE
+}
+
+// IsFolder returns true if n is a folder, not counting the root, inbox
+// and trash
+func (n *Node) IsFolder() bool {
+	return n.GetType() == FOLDER
+}
+
 func (n *Node) GetSize() int64 {
 	n.fs.mutex.Lock()
 	defer n.fs.mutex.Unlock()
@@ -212,6 +524,15 @@ func (n *Node) GetHash() string {
 	return n.hash
 }
 
+// GetFingerprint returns the fingerprint of the contents of a file as
+// set by the client which uploaded it, "" if there is none.  Files
+// with the same fingerprint and size have the same contents.
+func (n *Node) GetFingerprint() string {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.fingerprint
+}
+
 type NodeMeta struct {
 	key     []byte
 	compkey []byte
@@ -227,7 +548,25 @@ type MegaFS struct {
 	sroots []*Node
 	lookup map[string]*Node
 	skmap  map[string]string
-	mutex  sync.Mutex
+	// shares announced by events whose root node hasn't arrived yet
+	spending map[string]bool
+	// access levels of the incoming shares by their handles
+	saccess map[string]AccessLevel
+	// emails of users by their handles
+	emails map[string]string
+	// where nodes in the trash were, and where nodes removed by the
+	// events being processed were in case they are being moved
+	origins map[string]trashOrigin
+	moving  map[string]trashOrigin
+	// nodes which couldn't be decrypted, to retry when keys arrive
+	broken map[string]FSNode
+	// nodes sent to the inbox whose keys are still RSA encrypted
+	rsaKeyed map[string]bool
+	// fetches the children of unloaded folders when lazy loading
+	load func(n *Node) error
+	// reused for decoding node keys
+	scratch []byte
+	mutex   sync.Mutex
 }
 
 // Get filesystem root node
@@ -269,14 +608,18 @@ func (fs *MegaFS) hashLookup(h string) *Node {
 
 // Get the list of child nodes for a given node
 func (fs *MegaFS) GetChildren(n *Node) ([]*Node, error) {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
-
 	var empty []*Node
 
 	if n == nil {
 		return empty, EARGS
 	}
+	err := fs.loadChildren(n)
+	if err != nil {
+		return empty, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
 
 	node := fs.hashLookup(n.hash)
 	if node == nil {
@@ -290,14 +633,17 @@ func (fs *MegaFS) GetChildren(n *Node) ([]*Node, error) {
 // This method returns array of nodes upto the matched subpath
 // (in same order as input names array) even if the target node is not located.
 func (fs *MegaFS) PathLookup(root *Node, ns []string) ([]*Node, error) {
-	fs.mutex.Lock()
-	defer fs.mutex.Unlock()
-
 	if root == nil {
 		return nil, EARGS
 	}
+	err := fs.loadPath(root, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
 
-	var err error
 	var found bool = true
 
 	nodepath := []*Node{}
@@ -333,36 +679,194 @@ func (fs *MegaFS) GetSharedRoots() []*Node {
 	return fs.sroots
 }
 
+// AllNodes returns every node known, each after its parent: the root,
+// inbox and trash trees, then the folders shared by other users, then
+// any nodes whose parent isn't known.  When lazy loading the children
+// of folders not loaded yet aren't included.
+func (fs *MegaFS) AllNodes() []*Node {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	nodes := make([]*Node, 0, len(fs.lookup))
+	var add func(n *Node)
+	add = func(n *Node) {
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			add(c)
+		}
+	}
+	var top []*Node
+	for _, n := range fs.lookup {
+		if n.parent == nil && n != fs.root && n != fs.inbox && n != fs.trash {
+			top = append(top, n)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		si, sj := fs.isShareRoot(top[i]), fs.isShareRoot(top[j])
+		if si != sj {
+			return si
+		}
+		return top[i].hash < top[j].hash
+	})
+	for _, n := range append([]*Node{fs.root, fs.inbox, fs.trash}, top...) {
+		if n != nil {
+			add(n)
+		}
+	}
+	return nodes
+}
+
+// isShareRoot returns true if n is the top of a folder shared by
+// another user
+//
+// Call with the FS mutex held
+func (fs *MegaFS) isShareRoot(n *Node) bool {
+	for _, r := range fs.sroots {
+		if r == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Range calls fn with each node returned by AllNodes until it returns
+// false.  fn is called without the FS mutex held so it may use the
+// node methods.
+func (fs *MegaFS) Range(fn func(n *Node) bool) {
+	for _, n := range fs.AllNodes() {
+		if !fn(n) {
+			return
+		}
+	}
+}
+
 func newMegaFS() *MegaFS {
 	fs := &MegaFS{
-		lookup: make(map[string]*Node),
-		skmap:  make(map[string]string),
+		lookup:   make(map[string]*Node),
+		skmap:    make(map[string]string),
+		spending: make(map[string]bool),
+		saccess:  make(map[string]AccessLevel),
+		emails:   make(map[string]string),
+		origins:  make(map[string]trashOrigin),
+		moving:   make(map[string]trashOrigin),
+		broken:   make(map[string]FSNode),
+		rsaKeyed: make(map[string]bool),
 	}
 	return fs
 }
 
-func New() *Mega {
-	max := big.NewInt(0x100000000)
-	bigx, err := rand.Int(rand.Reader, max)
-	if err != nil {
-		panic(err) // this should be returned, but this is a public interface
+// replace moves the nodes, keys and shares of src into fs, keeping
+// the emails fs already knows.  fs keeps its own mutex so other
+// goroutines can go on locking it.
+//
+// Call with the fs mutex held
+func (fs *MegaFS) replace(src *MegaFS) {
+	for _, n := range src.lookup {
+		n.fs = fs
+	}
+	for h, email := range fs.emails {
+		if _, ok := src.emails[h]; !ok {
+			src.emails[h] = email
+		}
+	}
+	fs.root = src.root
+	fs.trash = src.trash
+	fs.inbox = src.inbox
+	fs.sroots = src.sroots
+	fs.lookup = src.lookup
+	fs.skmap = src.skmap
+	fs.spending = src.spending
+	fs.saccess = src.saccess
+	fs.emails = src.emails
+	fs.origins = src.origins
+	fs.moving = src.moving
+	fs.broken = src.broken
+	fs.rsaKeyed = src.rsaKeyed
+	fs.load = src.load
+	fs.scratch = src.scratch
+}
+
+// New creates a Mega client configured with the options given
+//
+// Invalid options are logged and ignored, as is failing to read the
+// ID source set with WithIDSource - use NewWithOptions to have them
+// returned instead.
+func New(opts ...Option) *Mega {
+	m, errs := newMega(opts)
+	for _, err := range errs {
+		m.logf("New: ignoring option: %v", err)
+	}
+	return m
+}
+
+// NewWithOptions creates a Mega client configured with the options
+// given.  It returns the error of the first invalid option, or of
+// reading the ID source set with WithIDSource.
+func NewWithOptions(opts ...Option) (*Mega, error) {
+	m, errs := newMega(opts)
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
+	return m, nil
+}
+
+// newMega creates a Mega client configured with opts, returning the
+// errors of those which were invalid
+func newMega(opts []Option) (*Mega, []error) {
 	cfg := newConfig()
 	mgfs := newMegaFS()
 	m := &Mega{
-		config: cfg,
-		sn:     bigx.Int64(),
-		FS:     mgfs,
-		client: newHttpClient(cfg.timeout),
+		config:  cfg,
+		FS:      mgfs,
+		conns:   newConnLimiter(0),
+		mem:     newMemBudget(0),
+		metrics: &metrics{},
+		usage:   newUsageLog(),
 	}
 	m.SetLogger(log.Printf)
 	m.SetDebugger(nil)
-	return m
+	var errs []error
+	for _, opt := range opts {
+		err := opt(m)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// after the options as the ID source may be set
+	max := big.NewInt(0x100000000)
+	bigx, err := rand.Int(m.config.idSource(), max)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading ID source: %w", err))
+		bigx, err = rand.Int(rand.Reader, max)
+		if err != nil {
+			bigx = big.NewInt(0)
+		}
+	}
+	m.sn = bigx.Int64()
+	if m.client == nil {
+		m.client = newHttpClient(m.config.timeout, m.config.resolver)
+	}
+	if m.storage == nil {
+		m.storage = newHttpClient(m.config.timeout, m.config.resolver)
+	}
+	return m, errs
 }
 
-// SetClient sets the HTTP client in use
+// SetClient sets the HTTP client used for all requests.  By default
+// the API calls and the chunk transfers use separate clients so that
+// busy or throttled transfers never delay the API - use
+// SetStorageClient after this to keep them apart.
 func (m *Mega) SetClient(client *http.Client) *Mega {
 	m.client = client
+	m.storage = client
+	return m
+}
+
+// SetStorageClient sets the HTTP client used for fetching and sending
+// file chunks to the storage servers, leaving the one for API calls
+// and the event stream alone
+func (m *Mega) SetStorageClient(client *http.Client) *Mega {
+	m.storage = client
 	return m
 }
 
@@ -394,8 +898,8 @@ func (m *Mega) SetDebugger(debugf func(format string, v ...interface{})) *Mega {
 // doubling it up to a maximum of maxSleepTime.
 //
 // This produces a truncated exponential backoff sleep
-func backOffSleep(pt *time.Duration) {
-	time.Sleep(*pt)
+func (m *Mega) backOffSleep(pt *time.Duration) {
+	m.sleep(*pt)
 	*pt *= 2
 	if *pt > maxSleepTime {
 		*pt = maxSleepTime
@@ -404,7 +908,33 @@ func backOffSleep(pt *time.Duration) {
 
 // API request method
 func (m *Mega) api_request(r []byte) (buf []byte, err error) {
+	return m.apiRequestContext(context.Background(), r, nil)
+}
+
+// apiRequestContext is api_request giving up when ctx is done and
+// calling read, if not nil, as the reply is read, see readCounter
+func (m *Mega) apiRequestContext(ctx context.Context, r []byte, read func(n, total int64)) (buf []byte, err error) {
+	return m.apiRequestRetries(ctx, r, read, m.getConfig().retries)
+}
+
+// apiRequestRetries is apiRequestContext retrying up to maxRetries
+// times rather than as configured
+func (m *Mega) apiRequestRetries(ctx context.Context, r []byte, read func(n, total int64), maxRetries int) (buf []byte, err error) {
+	var req *http.Request
 	var resp *http.Response
+	if m.getConfig().readonly {
+		err = checkReadOnly(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.ensureRegion()
+	// after the API mutex is released
+	defer func() {
+		if err == EOVERQUOTA {
+			m.noteStorage(0, 0, err)
+		}
+	}()
 	// serialize the API requests
 	m.apiMu.Lock()
 	defer func() {
@@ -412,31 +942,75 @@ func (m *Mega) api_request(r []byte) (buf []byte, err error) {
 		m.apiMu.Unlock()
 	}()
 
-	url := fmt.Sprintf("%s/cs?id=%d", m.baseurl, m.sn)
+	m.metrics.add(apiRequests, 1)
+	defer func() {
+		if err != nil {
+			m.metrics.add(apiErrors, 1)
+		} else {
+			m.metrics.touch(m.now())
+		}
+	}()
+
+	cfg := m.getConfig()
+	var span Span = noopSpan{}
+	if cfg.tracer != nil {
+		_, span = cfg.startSpan(context.Background(), SPAN_API_REQUEST, TraceAttr{ATTR_COMMANDS, traceCommands(r)})
+	}
+	retries := 0
+	defer func() {
+		span.SetAttributes(TraceAttr{ATTR_RETRIES, int64(retries)})
+		span.End(err)
+	}()
 
-	if m.sid != "" {
-		url = fmt.Sprintf("%s&sid=%s", url, m.sid)
+	url := fmt.Sprintf("%s/cs?id=%d%s", cfg.baseurl, m.sn, m.authQuery())
+	if cfg.appid != "" {
+		url = fmt.Sprintf("%s&ak=%s", url, cfg.appid)
 	}
 
 	sleepTime := minSleepTime // inital backoff time
-	for i := 0; i < m.retries+1; i++ {
+	for i := 0; i < maxRetries+1; i++ {
 		if i != 0 {
-			m.debugf("Retry API request %d/%d: %v", i, m.retries, err)
-			backOffSleep(&sleepTime)
+			m.debugf("Retry API request %d/%d: %v", i, maxRetries, err)
+			m.metrics.add(apiRetries, 1)
+			retries++
+			m.backOffSleep(&sleepTime)
 		}
-		resp, err = m.client.Post(url, "application/json", bytes.NewBuffer(r))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		req, err = http.NewRequest("POST", url, bytes.NewBuffer(r))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = m.client.Do(req.WithContext(ctx))
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			continue
 		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// retrying only prolongs the throttling
+			_ = resp.Body.Close()
+			return nil, ERATELIMIT
+		}
 		if resp.StatusCode != 200 {
 			// err must be not-nil on a continue
 			err = errors.New("Http Status: " + resp.Status)
 			_ = resp.Body.Close()
 			continue
 		}
-		buf, err = ioutil.ReadAll(resp.Body)
+		var body io.Reader = resp.Body
+		if read != nil {
+			body = &readCounter{r: resp.Body, total: resp.ContentLength, fn: read}
+		}
+		buf, err = ioutil.ReadAll(body)
 		if err != nil {
 			_ = resp.Body.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			continue
 		}
 		err = resp.Body.Close()
@@ -493,7 +1067,7 @@ func (m *Mega) prelogin(email string) error {
 		return err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	if err != nil {
 		return err
 	}
@@ -524,6 +1098,7 @@ func (m *Mega) login(email string, passwd string, multiFactor string) error {
 	var result []byte
 
 	email = strings.ToLower(email) // mega uses lowercased emails for login purposes
+	m.flink = nil
 
 	passkey, err := password_key(passwd)
 	if err != nil {
@@ -549,7 +1124,8 @@ func (m *Mega) login(email string, passwd string, multiFactor string) error {
 		passkey = derivedKey[:aes.BlockSize]
 
 		sessionKey := make([]byte, aes.BlockSize)
-		_, err = rand.Read(sessionKey)
+		cfg := m.getConfig()
+		_, err = io.ReadFull(cfg.keySource(), sessionKey)
 		if err != nil {
 			return err
 		}
@@ -566,7 +1142,7 @@ func (m *Mega) login(email string, passwd string, multiFactor string) error {
 		return err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	if err != nil {
 		return err
 	}
@@ -584,6 +1160,14 @@ func (m *Mega) login(email string, passwd string, multiFactor string) error {
 	if err != nil {
 		return err
 	}
+	m.privk, err = decryptPrivateKey(res[0].Privk, m.k)
+	if err != nil {
+		return err
+	}
+	m.handle = res[0].U
+	m.FS.mutex.Lock()
+	m.FS.emails[m.handle] = email
+	m.FS.mutex.Unlock()
 	return nil
 }
 
@@ -594,19 +1178,27 @@ func (m *Mega) Login(email string, passwd string) error {
 
 // MultiFactorLogin - Authenticate and start a session with 2FA
 func (m *Mega) MultiFactorLogin(email, passwd, multiFactor string) error {
+	return m.LoginContext(context.Background(), email, passwd, multiFactor)
+}
+
+// LoginContext authenticates and starts a session as MultiFactorLogin
+// does, multiFactor being "" without 2FA.  Loading the filesystem is
+// given up if ctx is done, returning its error, and reports its
+// progress to the function set with SetLoadProgress.
+func (m *Mega) LoginContext(ctx context.Context, email, passwd, multiFactor string) error {
 	err := m.prelogin(email)
 	if err != nil {
-		return err
+		return loginError(err)
 	}
 
 	err = m.login(email, passwd, multiFactor)
 	if err != nil {
-		return err
+		return loginError(err)
 	}
 
 	waitEvent := m.WaitEventsStart()
 
-	err = m.getFileSystem()
+	err = m.getFileSystemContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -635,16 +1227,14 @@ func (m *Mega) WaitEventsStart() <-chan struct{} {
 // If the timeout elapsed then it returns true otherwise false.
 func (m *Mega) WaitEvents(eventChan <-chan struct{}, duration time.Duration) (timedout bool) {
 	m.debugf("Waiting for events to be finished for %v", duration)
-	timer := time.NewTimer(duration)
 	select {
 	case <-eventChan:
 		m.debugf("Events received")
 		timedout = false
-	case <-timer.C:
+	case <-m.after(duration):
 		m.debugf("Timeout waiting for events")
 		timedout = true
 	}
-	timer.Stop()
 	return timedout
 }
 
@@ -677,7 +1267,7 @@ func (m *Mega) GetUser() (UserResp, error) {
 		return res[0], err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	return res[0], err
 }
 
@@ -699,16 +1289,110 @@ func (m *Mega) GetQuota() (QuotaResp, error) {
 		return res[0], err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	return res[0], err
 }
 
+// nodeKey decrypts the key of the file or folder itm of fs
+//
+// Call with the FS mutex held
+func (m *Mega) nodeKey(fs *MegaFS, master_aes cipher.Block, itm FSNode) ([]uint32, error) {
+	i := strings.IndexByte(itm.Key, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("not enough : in item.Key: %q", itm.Key)
+	}
+	itemUser, itemKey := itm.Key[:i], itm.Key[i+1:]
+	if i = strings.IndexAny(itemKey, ":/"); i >= 0 {
+		// what follows is maybe a share key handle?
+		itemKey = itemKey[:i]
+	}
+
+	// Sent to the inbox by another user, encrypted to our public key
+	// until it is rewritten under the master key
+	if len(itemKey) > 43 && m.flink == nil && itemUser == itm.User {
+		size := 16
+		if itm.T == FILE {
+			size = 32
+		}
+		buf, err := decryptRSAKey(itemKey, m.privk, size)
+		if err != nil {
+			return nil, err
+		}
+		fs.rsaKeyed[itm.Hash] = true
+		return bytes_to_a32(buf)
+	}
+	delete(fs.rsaKeyed, itm.Hash)
+
+	var block cipher.Block
+	switch {
+	// Folder link session - all keys are under the folder key
+	case m.flink != nil:
+		block = master_aes
+	// File or folder owned by current user
+	case itemUser == itm.User:
+		block = master_aes
+	// Shared folder
+	case itm.SUser != "" && itm.SKey != "":
+		sk, err := base64urldecode(itm.SKey)
+		if err != nil {
+			return nil, err
+		}
+		err = blockDecrypt(master_aes, sk, sk)
+		if err != nil {
+			return nil, err
+		}
+		block, err = aes.NewCipher(sk)
+		if err != nil {
+			return nil, err
+		}
+		fs.skmap[itm.Hash] = itm.SKey
+	// Shared file
+	default:
+		k, ok := fs.skmap[itemUser]
+		if !ok {
+			return nil, errors.New("couldn't find decryption key for shared file")
+		}
+		b, err := base64urldecode(k)
+		if err != nil {
+			return nil, err
+		}
+		err = blockDecrypt(master_aes, b, b)
+		if err != nil {
+			return nil, err
+		}
+		block, err = aes.NewCipher(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := appendBase64urldecode(fs.scratch[:0], itemKey)
+	if err != nil {
+		return nil, err
+	}
+	fs.scratch = buf
+	err = blockDecrypt(block, buf, buf)
+	if err != nil {
+		return nil, err
+	}
+	return bytes_to_a32(buf)
+}
+
 // Add a node into filesystem
+//
+// Files and folders whose key or attributes can't be decrypted are
+// added anyway, named "BAD ATTRIBUTE" and marked with a
+// DecryptionError, so they can be repaired when the keys arrive.
 func (m *Mega) addFSNode(itm FSNode) (*Node, error) {
+	return m.addNode(m.FS, itm)
+}
+
+// addNode is addFSNode adding to fs, which needn't be m.FS yet
+func (m *Mega) addNode(fs *MegaFS, itm FSNode) (*Node, error) {
 	var compkey, key []uint32
 	var attr FileAttr
 	var node, parent *Node
-	var err error
+	var decryptErr error
 
 	master_aes, err := aes.NewCipher(m.k)
 	if err != nil {
@@ -717,132 +1401,49 @@ func (m *Mega) addFSNode(itm FSNode) (*Node, error) {
 
 	switch {
 	case itm.T == FOLDER || itm.T == FILE:
-		args := strings.Split(itm.Key, ":")
-		if len(args) < 2 {
-			return nil, fmt.Errorf("not enough : in item.Key: %q", itm.Key)
-		}
-		itemUser, itemKey := args[0], args[1]
-		itemKeyParts := strings.Split(itemKey, "/")
-		if len(itemKeyParts) >= 2 {
-			itemKey = itemKeyParts[0]
-			// the other part is maybe a share key handle?
+		compkey, err = m.nodeKey(fs, master_aes, itm)
+		if err != nil {
+			decryptErr = err
+			break
 		}
 
 		switch {
-		// File or folder owned by current user
-		case itemUser == itm.User:
-			buf, err := base64urldecode(itemKey)
-			if err != nil {
-				return nil, err
-			}
-			err = blockDecrypt(master_aes, buf, buf)
-			if err != nil {
-				return nil, err
-			}
-			compkey, err = bytes_to_a32(buf)
-			if err != nil {
-				return nil, err
-			}
-			// Shared folder
-		case itm.SUser != "" && itm.SKey != "":
-			sk, err := base64urldecode(itm.SKey)
-			if err != nil {
-				return nil, err
-			}
-			err = blockDecrypt(master_aes, sk, sk)
-			if err != nil {
-				return nil, err
-			}
-			sk_aes, err := aes.NewCipher(sk)
-			if err != nil {
-				return nil, err
-			}
-
-			m.FS.skmap[itm.Hash] = itm.SKey
-			buf, err := base64urldecode(itemKey)
-			if err != nil {
-				return nil, err
-			}
-			err = blockDecrypt(sk_aes, buf, buf)
-			if err != nil {
-				return nil, err
-			}
-			compkey, err = bytes_to_a32(buf)
-			if err != nil {
-				return nil, err
+		case itm.T == FILE:
+			if len(compkey) < 8 {
+				m.logf("ignoring item: compkey too short (%d): %#v", len(compkey), itm)
+				return nil, nil
 			}
-			// Shared file
-		default:
-			k, ok := m.FS.skmap[itemUser]
-			if !ok {
-				return nil, errors.New("couldn't find decryption key for shared file")
-			}
-			b, err := base64urldecode(k)
-			if err != nil {
-				return nil, err
-			}
-			err = blockDecrypt(master_aes, b, b)
-			if err != nil {
-				return nil, err
-			}
-			block, err := aes.NewCipher(b)
-			if err != nil {
-				return nil, err
-			}
-			buf, err := base64urldecode(itemKey)
-			if err != nil {
-				return nil, err
-			}
-			err = blockDecrypt(block, buf, buf)
-			if err != nil {
-				return nil, err
-			}
-			compkey, err = bytes_to_a32(buf)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		switch {
-		case itm.T == FILE:
-			if len(compkey) < 8 {
-				m.logf("ignoring item: compkey too short (%d): %#v", len(compkey), itm)
-				return nil, nil
-			}
-			key = []uint32{compkey[0] ^ compkey[4], compkey[1] ^ compkey[5], compkey[2] ^ compkey[6], compkey[3] ^ compkey[7]}
+			key = []uint32{compkey[0] ^ compkey[4], compkey[1] ^ compkey[5], compkey[2] ^ compkey[6], compkey[3] ^ compkey[7]}
 		default:
 			key = compkey
 		}
 
-		bkey, err := a32_to_bytes(key)
+		var kbuf [32]byte
+		attr, err = decryptAttr(appendA32Bytes(kbuf[:0], key), itm.Attr)
 		if err != nil {
-			// FIXME:
-			attr.Name = "BAD ATTRIBUTE"
-		} else {
-			attr, err = decryptAttr(bkey, itm.Attr)
-			// FIXME:
-			if err != nil {
-				attr.Name = "BAD ATTRIBUTE"
-			}
+			decryptErr = err
 		}
 	}
+	if decryptErr != nil {
+		attr.Name = "BAD ATTRIBUTE"
+	}
 
-	n, ok := m.FS.lookup[itm.Hash]
+	n, ok := fs.lookup[itm.Hash]
 	switch {
 	case ok:
 		node = n
 	default:
 		node = &Node{
-			fs:    m.FS,
+			fs:    fs,
 			ntype: itm.T,
 			size:  itm.Sz,
 			ts:    time.Unix(itm.Ts, 0),
 		}
 
-		m.FS.lookup[itm.Hash] = node
+		fs.lookup[itm.Hash] = node
 	}
 
-	n, ok = m.FS.lookup[itm.Parent]
+	n, ok = fs.lookup[itm.Parent]
 	switch {
 	case ok:
 		parent = n
@@ -852,107 +1453,181 @@ func (m *Mega) addFSNode(itm FSNode) (*Node, error) {
 		parent = nil
 		if itm.Parent != "" {
 			parent = &Node{
-				fs:       m.FS,
-				children: []*Node{node},
-				ntype:    FOLDER,
+				fs:    fs,
+				ntype: FOLDER,
 			}
-			m.FS.lookup[itm.Parent] = parent
+			parent.addChild(node)
+			fs.lookup[itm.Parent] = parent
 		}
 	}
 
 	switch {
+	case (itm.T == FILE || itm.T == FOLDER) && compkey == nil:
+		// no key to set
+		node.meta = NodeMeta{}
 	case itm.T == FILE:
-		var meta NodeMeta
-		meta.key, err = a32_to_bytes(key)
-		if err != nil {
-			return nil, err
-		}
-		meta.iv, err = a32_to_bytes([]uint32{compkey[4], compkey[5], 0, 0})
-		if err != nil {
-			return nil, err
-		}
-		meta.mac, err = a32_to_bytes([]uint32{compkey[6], compkey[7]})
-		if err != nil {
-			return nil, err
-		}
-		meta.compkey, err = a32_to_bytes(compkey)
-		if err != nil {
-			return nil, err
-		}
-		node.meta = meta
+		// the keys share one allocation, capped so appending to one
+		// can't overwrite the next
+		buf := make([]byte, 0, 4*(len(key)+6+len(compkey)))
+		buf = appendA32Bytes(buf, key)
+		k := len(buf)
+		buf = appendA32Bytes(buf, []uint32{compkey[4], compkey[5], 0, 0})
+		iv := len(buf)
+		buf = appendA32Bytes(buf, compkey[6:8])
+		mac := len(buf)
+		buf = appendA32Bytes(buf, compkey)
+		node.meta = NodeMeta{key: buf[:k:k], iv: buf[k:iv:iv], mac: buf[iv:mac:mac], compkey: buf[mac:]}
 	case itm.T == FOLDER:
-		var meta NodeMeta
-		meta.key, err = a32_to_bytes(key)
-		if err != nil {
-			return nil, err
-		}
-		meta.compkey, err = a32_to_bytes(compkey)
-		if err != nil {
-			return nil, err
-		}
-		node.meta = meta
+		buf := appendA32Bytes(make([]byte, 0, 4*(len(key)+len(compkey))), key)
+		k := len(buf)
+		buf = appendA32Bytes(buf, compkey)
+		node.meta = NodeMeta{key: buf[:k:k], compkey: buf[k:]}
 	case itm.T == ROOT:
 		attr.Name = "Cloud Drive"
-		m.FS.root = node
+		fs.root = node
 	case itm.T == INBOX:
 		attr.Name = "InBox"
-		m.FS.inbox = node
+		fs.inbox = node
 	case itm.T == TRASH:
 		attr.Name = "Trash"
-		m.FS.trash = node
+		fs.trash = node
 	}
 
 	// Shared directories
 	if itm.SUser != "" && itm.SKey != "" {
-		m.FS.sroots = append(m.FS.sroots, node)
+		fs.setShareAccess(itm.Hash, itm.R)
+	}
+	if (itm.SUser != "" && itm.SKey != "") || fs.spending[itm.Hash] {
+		fs.addSharedRoot(node)
+		delete(fs.spending, itm.Hash)
 	}
 
 	node.name = attr.Name
+	node.fingerprint = attr.Fingerprint
+	node.attrs = attr.Extra
+	node.fa = itm.Fa
 	node.hash = itm.Hash
 	node.parent = parent
 	node.ntype = itm.T
+	node.owner = itm.User
+	fs.setDecryptionError(node, itm, decryptErr)
 
 	return node, nil
 }
 
 // Get all nodes from filesystem
 func (m *Mega) getFileSystem() error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
+	return m.getFileSystemContext(context.Background())
+}
 
+// getFileSystemContext is getFileSystem giving up when ctx is done,
+// leaving the filesystem as it was, and reporting its progress to the
+// function set with SetLoadProgress
+//
+// The nodes are added to a new MegaFS which replaces the contents of
+// m.FS only once they are all loaded.
+func (m *Mega) getFileSystemContext(ctx context.Context) error {
 	var msg [1]FilesMsg
 	var res [1]FilesResp
 
+	lazy := m.getConfig().lazy && m.flink == nil
 	msg[0].Cmd = "f"
 	msg[0].C = 1
-
-	req, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	result, err := m.api_request(req)
-	if err != nil {
-		return err
+	if m.flink != nil {
+		msg[0].R = 1
+	}
+	progress := m.getConfig().loadProgress
+	var read func(n, total int64)
+	if progress != nil {
+		read = func(n, total int64) {
+			progress(LoadProgress{BytesRead: n, BytesTotal: total})
+		}
 	}
 
-	err = json.Unmarshal(result, &res)
-	if err != nil {
-		return err
+	var size int64
+	var unloaded []string
+	var err error
+	if lazy {
+		res[0], size, unloaded, err = m.fetchRoots(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		var req, result []byte
+		req, err = json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		result, err = m.apiRequestContext(ctx, req, read)
+		if err != nil {
+			return err
+		}
+		size = int64(len(result))
+		err = m.decodeResponse(result, &res)
+		if err != nil {
+			return err
+		}
 	}
 
+	fs := newMegaFS()
 	for _, sk := range res[0].Ok {
-		m.FS.skmap[sk.Hash] = sk.Key
+		fs.skmap[sk.Hash] = sk.Key
 	}
+	fs.addContacts(res[0].User)
 
-	for _, itm := range res[0].F {
-		_, err = m.addFSNode(itm)
+	items := res[0].F
+	total := len(items)
+	for i, itm := range items {
+		if i%LOAD_PROGRESS_NODES == 0 && i > 0 {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if progress != nil {
+				progress(LoadProgress{BytesRead: size, BytesTotal: size, Nodes: i, NodesTotal: total})
+			}
+		}
+		_, err = m.addNode(fs, itm)
 		if err != nil {
 			m.debugf("couldn't decode FSNode %#v: %v ", itm, err)
 			continue
 		}
 	}
+	if progress != nil {
+		progress(LoadProgress{BytesRead: size, BytesTotal: size, Nodes: total, NodesTotal: total})
+	}
+	// Share roots may come after the nodes in them
+	for _, itm := range fs.brokenItems() {
+		_, _ = m.addNode(fs, itm)
+	}
+
+	if lazy {
+		fs.load = m.loadChildren
+		for _, h := range unloaded {
+			if n := fs.lookup[h]; n != nil {
+				n.unloaded = true
+			}
+		}
+	}
+
+	// The root of a folder link is the first node returned
+	if m.flink != nil && len(res[0].F) > 0 {
+		fs.root = fs.lookup[res[0].F[0].Hash]
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+	m.FS.replace(fs)
 
 	m.ssn = res[0].Sn
+	m.configMu.Lock()
+	if m.config.cursor != "" {
+		// only the first time
+		m.ssn, m.config.cursor = m.config.cursor, ""
+	}
+	m.configMu.Unlock()
 
 	go m.pollEvents()
 
@@ -961,15 +1636,22 @@ func (m *Mega) getFileSystem() error {
 
 // Download contains the internal state of a download
 type Download struct {
-	m           *Mega
-	src         *Node
-	resourceUrl string
-	aes_block   cipher.Block
-	iv          []byte
-	mac_enc     cipher.BlockMode
-	mutex       sync.Mutex // to protect the following
-	chunks      []chunkSize
-	chunk_macs  [][]byte
+	m          *Mega
+	cfg        config
+	ctx        context.Context // cancels the chunk requests
+	src        *Node
+	size       int64
+	aes_block  cipher.Block
+	key        []byte
+	iv         []byte
+	conns      *connLimiter
+	mutex      sync.Mutex // to protect the following
+	chunks     []chunkSize
+	chunk_macs [][]byte
+	mirrors    []string // storage server URLs, the API's first
+	mirror     int      // index of the mirror in use
+	retries    int      // chunk requests retried
+	audit      transferAudit
 }
 
 // an all nil IV for mac calculations
@@ -981,6 +1663,11 @@ var zero_iv = make([]byte, 16)
 // 0..chunks-1 call DownloadChunk.  Finally call Finish() to receive
 // the error status.
 func (m *Mega) NewDownload(src *Node) (*Download, error) {
+	return m.newDownload(m.getConfig(), src)
+}
+
+// newDownload is NewDownload with the configuration cfg
+func (m *Mega) newDownload(cfg config, src *Node) (*Download, error) {
 	if src == nil {
 		return nil, EARGS
 	}
@@ -992,10 +1679,15 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 	msg[0].Cmd = "g"
 	msg[0].G = 1
 	msg[0].N = src.hash
-	if m.config.https {
+	if cfg.https {
 		msg[0].SSL = 2
 	}
 	key := src.meta.key
+	if src.decryptErr != nil && key == nil {
+		err := src.decryptErr
+		m.FS.mutex.Unlock()
+		return nil, err
+	}
 	m.FS.mutex.Unlock()
 
 	request, err := json.Marshal(msg)
@@ -1007,7 +1699,7 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 		return nil, err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	if err != nil {
 		return nil, err
 	}
@@ -1029,7 +1721,6 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 		return nil, err
 	}
 
-	mac_enc := cipher.NewCBCEncrypter(aes_block, zero_iv)
 	m.FS.mutex.Lock()
 	t, err := bytes_to_a32(src.meta.iv)
 	m.FS.mutex.Unlock()
@@ -1042,19 +1733,22 @@ func (m *Mega) NewDownload(src *Node) (*Download, error) {
 	}
 
 	downloadUrl := res[0].G
-	if m.config.https && strings.HasPrefix(downloadUrl, "http://") {
+	if cfg.https && strings.HasPrefix(downloadUrl, "http://") {
 		downloadUrl = "https://" + strings.TrimPrefix(downloadUrl, "http://")
 	}
 
 	d := &Download{
-		m:           m,
-		src:         src,
-		resourceUrl: downloadUrl,
-		aes_block:   aes_block,
-		iv:          iv,
-		mac_enc:     mac_enc,
-		chunks:      chunks,
-		chunk_macs:  make([][]byte, len(chunks)),
+		m:          m,
+		cfg:        cfg,
+		src:        src,
+		size:       int64(res[0].Size),
+		mirrors:    storageMirrors(downloadUrl, res[0].IP),
+		aes_block:  aes_block,
+		iv:         iv,
+		key:        key,
+		conns:      newConnLimiter(0),
+		chunks:     chunks,
+		chunk_macs: make([][]byte, len(chunks)),
 	}
 	return d, nil
 }
@@ -1064,6 +1758,12 @@ func (d *Download) Chunks() int {
 	return len(d.chunks)
 }
 
+// Size returns the size of the file being downloaded as reported by
+// the server.
+func (d *Download) Size() int64 {
+	return d.size
+}
+
 // ChunkLocation returns the position in the file and the size of the chunk
 func (d *Download) ChunkLocation(id int) (position int64, size int, err error) {
 	if id < 0 || id >= len(d.chunks) {
@@ -1074,43 +1774,45 @@ func (d *Download) ChunkLocation(id int) (position int64, size int, err error) {
 	return d.chunks[id].position, d.chunks[id].size, nil
 }
 
-// DownloadChunk gets a chunk with the given number and update the
-// mac, returning the position in the file of the chunk
-func (d *Download) DownloadChunk(id int) (chunk []byte, err error) {
-	if id < 0 || id >= len(d.chunks) {
-		return nil, EARGS
-	}
+// fetchChunk reads the chunk at chunk_url checking it is exactly
+// chk_size bytes long.  A server closing the connection early gives
+// ESIZE rather than a short chunk.
+func (d *Download) fetchChunk(chunk_url string, chk_size int) (chunk []byte, err error) {
+	d.conns.acquire()
+	defer d.conns.release()
+	d.m.conns.acquire()
+	defer d.m.conns.release()
 
-	chk_start, chk_size, err := d.ChunkLocation(id)
+	start := d.m.now()
+	var latency time.Duration
+	defer func() {
+		d.m.links.note(chunk_url, false, len(chunk), latency, d.m.now().Sub(start), err)
+	}()
+	req, err := http.NewRequest("GET", chunk_url, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	var resp *http.Response
-	chunk_url := fmt.Sprintf("%s/%d-%d", d.resourceUrl, chk_start, chk_start+int64(chk_size)-1)
-	sleepTime := minSleepTime // inital backoff time
-	for retry := 0; retry < d.m.retries+1; retry++ {
-		resp, err = d.m.client.Get(chunk_url)
-		if err == nil {
-			if resp.StatusCode == 200 {
-				break
-			}
-			err = errors.New("Http Status: " + resp.Status)
-			_ = resp.Body.Close()
-		}
-		d.m.debugf("%s: Retry download chunk %d/%d: %v", d.src.name, retry, d.m.retries, err)
-		backOffSleep(&sleepTime)
-	}
+	resp, err := d.m.storage.Do(req.WithContext(d.context()))
+	latency = d.m.now().Sub(start)
 	if err != nil {
 		return nil, err
 	}
-	if resp == nil {
-		return nil, errors.New("retries exceeded")
+	if resp.StatusCode != 200 {
+		_ = resp.Body.Close()
+		return nil, errors.New("Http Status: " + resp.Status)
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != int64(chk_size) {
+		_ = resp.Body.Close()
+		d.m.debugf("%s: chunk %s has Content-Length %d, expecting %d", d.src.name, chunk_url, resp.ContentLength, chk_size)
+		return nil, ESIZE
 	}
 
-	chunk, err = ioutil.ReadAll(resp.Body)
+	chunk, err = ioutil.ReadAll(d.cfg.limiter.reader(resp.Body))
 	if err != nil {
 		_ = resp.Body.Close()
+		if err == io.ErrUnexpectedEOF {
+			err = ESIZE
+		}
 		return nil, err
 	}
 
@@ -1119,80 +1821,284 @@ func (d *Download) DownloadChunk(id int) (chunk []byte, err error) {
 		return nil, err
 	}
 
-	// body is read and closed here
-
 	if len(chunk) != chk_size {
-		return nil, errors.New("wrong size for downloaded chunk")
+		d.m.debugf("%s: chunk %s is %d bytes, expecting %d", d.src.name, chunk_url, len(chunk), chk_size)
+		return nil, ESIZE
+	}
+
+	return chunk, nil
+}
+
+// storageMirrors returns the URLs the download at u can be fetched
+// from: u itself then u with its host swapped for each of the storage
+// server addresses in ips.  Only plain http URLs are fetched by
+// address as the certificates of https ones are for the host name.
+func storageMirrors(u string, ips []string) []string {
+	mirrors := []string{u}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "http" {
+		return mirrors
+	}
+	seen := map[string]bool{parsed.Hostname(): true}
+	for _, ip := range ips {
+		if seen[ip] || net.ParseIP(ip) == nil {
+			continue
+		}
+		seen[ip] = true
+		alt := *parsed
+		if port := parsed.Port(); port != "" {
+			alt.Host = net.JoinHostPort(ip, port)
+		} else if strings.Contains(ip, ":") {
+			alt.Host = "[" + ip + "]"
+		} else {
+			alt.Host = ip
+		}
+		mirrors = append(mirrors, alt.String())
+	}
+	return mirrors
+}
+
+// mirrorURL returns the URL of the storage server in use
+func (d *Download) mirrorURL() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.mirrors) == 0 {
+		return ""
+	}
+	return d.mirrors[d.mirror]
+}
+
+// failMirror moves the download on to the next storage server after a
+// request to mirror failed, unless another chunk has already
+func (d *Download) failMirror(mirror string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.mirrors) < 2 || d.mirrors[d.mirror] != mirror {
+		return
+	}
+	d.mirror = (d.mirror + 1) % len(d.mirrors)
+	d.m.debugf("%s: switching to storage server %s", d.src.name, d.mirrors[d.mirror])
+}
+
+// DownloadChunk gets a chunk with the given number and update the
+// mac, returning the position in the file of the chunk
+func (d *Download) DownloadChunk(id int) (chunk []byte, err error) {
+	end := d.audit.begin(d.m, "Download.DownloadChunk", "download of "+d.src.hash, id)
+	defer func() {
+		end(err == nil)
+	}()
+	chunk, err = d.fetchEncrypted(id)
+	if err != nil {
+		return nil, err
+	}
+	err = d.decryptChunk(id, chunk)
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// fetchEncrypted gets the chunk with the given number from the storage
+// servers, retrying as needed, without decrypting it
+func (d *Download) fetchEncrypted(id int) (chunk []byte, err error) {
+	if id < 0 || id >= len(d.chunks) {
+		return nil, EARGS
 	}
 
-	// Decrypt the block
-	ctr_iv, err := bytes_to_a32(d.src.meta.iv)
+	chk_start, chk_size, err := d.ChunkLocation(id)
 	if err != nil {
 		return nil, err
 	}
-	ctr_iv[2] = uint32(uint64(chk_start) / 0x1000000000)
-	ctr_iv[3] = uint32(chk_start / 0x10)
-	bctr_iv, err := a32_to_bytes(ctr_iv)
+
+	var span Span = noopSpan{}
+	if d.cfg.tracer != nil {
+		_, span = d.cfg.startSpan(d.context(), SPAN_DOWNLOAD_CHUNK,
+			TraceAttr{ATTR_NODE, traceHandle(d.src.GetHash())},
+			TraceAttr{ATTR_CHUNK, int64(id)},
+			TraceAttr{ATTR_BYTES, int64(chk_size)})
+	}
+	defer func() {
+		span.End(err)
+	}()
+
+	sleepTime := minSleepTime // inital backoff time
+	for retry := 0; retry < d.cfg.retries+1; retry++ {
+		mirror := d.mirrorURL()
+		chunk_url := fmt.Sprintf("%s/%d-%d", mirror, chk_start, chk_start+int64(chk_size)-1)
+		chunk, err = d.fetchChunk(chunk_url, chk_size)
+		if err == nil {
+			break
+		}
+		if e := d.context().Err(); e != nil {
+			return nil, e
+		}
+		d.failMirror(mirror)
+		d.m.debugf("%s: Retry download chunk %d/%d: %v", d.src.name, retry, d.cfg.retries, err)
+		if retry < d.cfg.retries {
+			d.m.metrics.add(downloadRetries, 1)
+			d.mutex.Lock()
+			d.retries++
+			d.mutex.Unlock()
+		}
+		d.m.backOffSleep(&sleepTime)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return chunk, nil
+}
+
+// decryptChunk decrypts the chunk with the given number in place and
+// records its mac
+func (d *Download) decryptChunk(id int, chunk []byte) error {
+	chk_start, _, err := d.ChunkLocation(id)
+	if err != nil {
+		return err
+	}
+	bctr_iv, err := ctrIV(d.src.meta.iv, chk_start)
+	if err != nil {
+		return err
+	}
+	start := d.m.now()
 	ctr_aes := cipher.NewCTR(d.aes_block, bctr_iv)
 	ctr_aes.XORKeyStream(chunk, chunk)
 
-	// Update the chunk_macs
-	enc := cipher.NewCBCEncrypter(d.aes_block, d.iv)
+	d.chunkMac(id, chunk)
+	d.m.links.noteCrypto(len(chunk), d.m.now().Sub(start))
+	d.m.metrics.add(downloadChunks, 1)
+	d.m.metrics.add(downloadBytes, int64(len(chunk)))
+	d.m.usage.add(int64(len(chunk)), 0)
+	return nil
+}
+
+// chunkMAC returns the MAC of the decrypted chunk
+func chunkMAC(aes_block cipher.Block, iv []byte, chunk []byte) []byte {
+	enc := cipher.NewCBCEncrypter(aes_block, iv)
 	i := 0
 	block := make([]byte, 16)
 	paddedChunk := paddnull(chunk, 16)
 	for i = 0; i < len(paddedChunk); i += 16 {
 		enc.CryptBlocks(block, paddedChunk[i:i+16])
 	}
+	return block
+}
+
+// chunkMac updates the chunk_macs from the decrypted chunk
+func (d *Download) chunkMac(id int, chunk []byte) {
+	d.setChunkMac(id, chunkMAC(d.aes_block, d.iv, chunk))
+}
 
+// setChunkMac records the MAC of chunk id
+func (d *Download) setChunkMac(id int, mac []byte) {
 	d.mutex.Lock()
 	if len(d.chunk_macs) > 0 {
 		d.chunk_macs[id] = make([]byte, 16)
-		copy(d.chunk_macs[id], block)
+		copy(d.chunk_macs[id], mac)
 	}
 	d.mutex.Unlock()
+}
 
-	return chunk, nil
+// context returns the context of the chunk requests
+func (d *Download) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// ChunkDone returns true if chunk id has been downloaded or resumed
+func (d *Download) ChunkDone(id int) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return id >= 0 && id < len(d.chunk_macs) && d.chunk_macs[id] != nil
+}
+
+// ResumeChunk records the decrypted chunk id which was downloaded
+// earlier, say by a previous run, and read back from disk.  Call it
+// instead of DownloadChunk so that Finish can still check the MAC of
+// the whole file.
+func (d *Download) ResumeChunk(id int, chunk []byte) error {
+	_, chk_size, err := d.ChunkLocation(id)
+	if err != nil {
+		return err
+	}
+	if len(chunk) != chk_size {
+		return ESIZE
+	}
+	d.chunkMac(id, chunk)
+	return nil
 }
 
 // Finish checks the accumulated MAC for each block.
 //
 // If all the chunks weren't downloaded then it will just return nil
 func (d *Download) Finish() (err error) {
+	partial := false
+	end := d.audit.begin(d.m, "Download.Finish", "download of "+d.src.hash, auditFinish)
+	defer func() {
+		end(err == nil && !partial)
+	}()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	// Can't check a 0 sized file
 	if len(d.chunk_macs) == 0 {
 		return nil
 	}
-	mac_data := make([]byte, 16)
 	for _, v := range d.chunk_macs {
 		// If a chunk_macs hasn't been set then the whole file
 		// wasn't downloaded and we can't check it
 		if v == nil {
+			partial = true
 			return nil
 		}
-		d.mac_enc.CryptBlocks(mac_data, v)
 	}
 
-	tmac, err := bytes_to_a32(mac_data)
-	if err != nil {
-		return err
-	}
-	btmac, err := a32_to_bytes([]uint32{tmac[0] ^ tmac[1], tmac[2] ^ tmac[3]})
+	btmac, err := condenseMACs(d.aes_block, d.chunk_macs)
 	if err != nil {
 		return err
 	}
 	if bytes.Equal(btmac, d.src.meta.mac) == false {
-		return EMACMISMATCH
+		return &MACError{
+			Name:     d.src.GetName(),
+			Expected: hex.EncodeToString(d.src.meta.mac),
+			Computed: hex.EncodeToString(btmac),
+			Size:     d.size,
+			Chunks:   len(d.chunks),
+			Retries:  d.retries,
+			Err:      EMACMISMATCH,
+		}
 	}
 
 	return nil
 }
 
+// drainErrors returns err, or if that is nil the first error left in
+// errch by the transfer workers.  Any other errors are logged.  Call
+// only once all the workers have finished.
+func drainErrors(m *Mega, name string, err error, errch chan error) error {
+	for {
+		select {
+		case e := <-errch:
+			if err == nil {
+				err = e
+			} else {
+				m.debugf("%s: additional transfer error: %v", name, e)
+			}
+		default:
+			return err
+		}
+	}
+}
+
 // Download file from filesystem reporting progress if not nil
 func (m *Mega) DownloadFile(src *Node, dstpath string, progress *chan int) error {
+	return m.DownloadFileWith(src, dstpath, DownloadOptions{Progress: progress})
+}
+
+// DownloadTo downloads the file src writing each chunk at its offset
+// in w, reporting progress if not nil.  It is DownloadFile for
+// destinations which aren't local files, such as memory in a browser.
+func (m *Mega) DownloadTo(src *Node, w io.WriterAt, progress *chan int) error {
 	defer func() {
 		if progress != nil {
 			close(*progress)
@@ -1203,26 +2109,84 @@ func (m *Mega) DownloadFile(src *Node, dstpath string, progress *chan int) error
 	if err != nil {
 		return err
 	}
-
-	_, err = os.Stat(dstpath)
-	if os.IsExist(err) {
-		err = os.Remove(dstpath)
-		if err != nil {
-			return err
-		}
+	err = m.downloadChunks(d, w, progress)
+	if err != nil {
+		return err
 	}
-
-	outfile, err := os.OpenFile(dstpath, os.O_RDWR|os.O_CREATE, 0600)
+	err = d.Finish()
 	if err != nil {
 		return err
 	}
+	if r, ok := w.(io.ReaderAt); ok {
+		return m.checkDownload(src, r, d.Size())
+	}
+	return nil
+}
+
+// fetchedChunk is a chunk read by a download worker waiting to be
+// decrypted, or read from the source of an upload waiting to be sent
+type fetchedChunk struct {
+	id    int
+	start int64
+	chunk []byte
+}
 
+// downloadChunks downloads all the chunks of d writing them to w.  The
+// download workers only read the chunks from the network, handing
+// them to the decrypt workers, so that a slow CPU doesn't hold up the
+// connections.
+func (m *Mega) downloadChunks(d *Download, w io.WriterAt, progress *chan int) error {
 	workch := make(chan int)
-	errch := make(chan error, m.dl_workers)
+	cpuch := make(chan fetchedChunk)
+	cpuWorkers := d.cfg.decryptWorkers()
+	errch := make(chan error, d.cfg.dl_workers+cpuWorkers)
 	wg := sync.WaitGroup{}
+	cpuWg := sync.WaitGroup{}
+
+	// Fire chunk decrypt workers.  After an error they carry on
+	// taking chunks, dropping them, so the download workers never
+	// block.
+	for i := 0; i < cpuWorkers; i++ {
+		cpuWg.Add(1)
+
+		go func() {
+			defer cpuWg.Done()
+
+			failed := false
+			for c := range cpuch {
+				size := int64(len(c.chunk))
+				if failed {
+					m.mem.release(size)
+					continue
+				}
+				err := d.decryptChunk(c.id, c.chunk)
+				if err != nil {
+					m.mem.release(size)
+					errch <- &ChunkError{Op: "decrypt", Chunk: c.id, Offset: c.start, Err: err}
+					failed = true
+					continue
+				}
+
+				n, err := w.WriteAt(c.chunk, c.start)
+				m.mem.release(size)
+				if err == nil && n != len(c.chunk) {
+					err = io.ErrShortWrite
+				}
+				if err != nil {
+					errch <- &ChunkError{Op: "write", Chunk: c.id, Offset: c.start, Err: err}
+					failed = true
+					continue
+				}
+
+				if progress != nil {
+					*progress <- len(c.chunk)
+				}
+			}
+		}()
+	}
 
 	// Fire chunk download workers
-	for w := 0; w < m.dl_workers; w++ {
+	for i := 0; i < d.cfg.dl_workers; i++ {
 		wg.Add(1)
 
 		go func() {
@@ -1230,72 +2194,82 @@ func (m *Mega) DownloadFile(src *Node, dstpath string, progress *chan int) error
 
 			// Wait for work blocked on channel
 			for id := range workch {
-				chunk, err := d.DownloadChunk(id)
+				chk_start, chk_size, err := d.ChunkLocation(id)
 				if err != nil {
 					errch <- err
 					return
 				}
 
-				chk_start, _, err := d.ChunkLocation(id)
+				err = m.mem.acquire(d.context(), int64(chk_size))
 				if err != nil {
 					errch <- err
 					return
 				}
-
-				_, err = outfile.WriteAt(chunk, chk_start)
+				chunk, err := d.fetchEncrypted(id)
 				if err != nil {
-					errch <- err
+					m.mem.release(int64(chk_size))
+					errch <- &ChunkError{Op: "download", Chunk: id, Offset: chk_start, Err: err}
 					return
 				}
-
-				if progress != nil {
-					*progress <- len(chunk)
-				}
+				cpuch <- fetchedChunk{id: id, start: chk_start, chunk: chunk}
 			}
 		}()
 	}
 
-	// Place chunk download jobs to chan
-	err = nil
+	// Place chunk download jobs to chan skipping those resumed
+	var err error
 	for id := 0; id < d.Chunks() && err == nil; {
+		if d.ChunkDone(id) {
+			id++
+			continue
+		}
 		select {
 		case workch <- id:
 			id++
 		case err = <-errch:
+		case <-d.context().Done():
+			err = d.context().Err()
 		}
 	}
 	close(workch)
 
 	wg.Wait()
+	close(cpuch)
+	cpuWg.Wait()
 
-	closeErr := outfile.Close()
-	if err != nil {
-		_ = os.Remove(dstpath)
-		return err
-	}
-	if closeErr != nil {
-		return closeErr
-	}
-
-	return d.Finish()
+	// Collect errors from chunks which failed after the last was
+	// dispatched
+	return drainErrors(m, d.src.name, err, errch)
 }
 
 // Upload contains the internal state of a upload
 type Upload struct {
 	m                 *Mega
+	cfg               config
+	ctx               context.Context // cancels the chunk requests
 	parenthash        string
 	name              string
-	uploadUrl         string
+	size              int64
 	aes_block         cipher.Block
 	iv                []byte
 	kiv               []byte
-	mac_enc           cipher.BlockMode
 	kbytes            []byte
 	ukey              []uint32
+	conns             *connLimiter
 	mutex             sync.Mutex // to protect the following
+	uploadUrl         string
 	chunks            []chunkSize
 	chunk_macs        [][]byte
 	completion_handle []byte
+	completion_id     string
+	meta_mac          []byte
+	sent              int64
+	retries           int
+	audit             transferAudit
+	// FileFingerprint of the chunks read so far by sendChunks, which
+	// only it uses, and the chunk to add next.  nil if not wanted.
+	fp     hash.Hash
+	fpNext int
 }
 
 // Create a new Upload of name into parent of fileSize
@@ -1303,45 +2277,77 @@ type Upload struct {
 // Call Chunks to find out how many chunks there are, then for id =
 // 0..chunks-1 Call ChunkLocation then UploadChunk.  Finally call
 // Finish() to receive the error status and the *Node.
+//
+// parent may be in an incoming share with read-write access or
+// better, or one of our own shares, in which case the key of the new
+// file is sent encrypted with the share key too so the other users of
+// the share can decrypt it.
 func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, error) {
+	return m.startUpload(m.getConfig(), parent, name, fileSize)
+}
+
+// startUpload is NewUpload with the configuration cfg
+func (m *Mega) startUpload(cfg config, parent *Node, name string, fileSize int64) (*Upload, error) {
 	if parent == nil {
 		return nil, EARGS
 	}
+	m.FS.mutex.Lock()
+	parenthash := parent.hash
+	err := m.FS.checkAccess(parent, ACCESS_READWRITE)
+	m.FS.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	uploadUrl, err := m.uploadURL(cfg, fileSize)
+	if err != nil {
+		return nil, err
+	}
 
+	ukey, err := cfg.randomA32(6)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.newUpload(cfg, parenthash, name, fileSize, uploadUrl, ukey)
+}
+
+// uploadURL asks the server for a URL to upload fileSize bytes to
+func (m *Mega) uploadURL(cfg config, fileSize int64) (string, error) {
 	var msg [1]UploadMsg
 	var res [1]UploadResp
-	parenthash := parent.GetHash()
 
 	msg[0].Cmd = "u"
 	msg[0].S = fileSize
-	if m.config.https {
+	if cfg.https {
 		msg[0].SSL = 2
 	}
 
 	request, err := json.Marshal(msg)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	result, err := m.api_request(request)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	if err != nil {
-		return nil, err
-	}
-
-	ukey := []uint32{0, 0, 0, 0, 0, 0}
-	for i, _ := range ukey {
-		ukey[i] = uint32(mrand.Int31())
-
+		return "", err
 	}
+	return res[0].P, nil
+}
 
+// newUpload sets up an Upload to uploadUrl using the key ukey
+func (m *Mega) newUpload(cfg config, parenthash string, name string, fileSize int64, uploadUrl string, ukey []uint32) (*Upload, error) {
 	kbytes, err := a32_to_bytes(ukey[:4])
 	if err != nil {
 		return nil, err
 	}
+	completion_id, err := m.newRequestID()
+	if err != nil {
+		return nil, err
+	}
 	kiv, err := a32_to_bytes([]uint32{ukey[4], ukey[5], 0, 0})
 	if err != nil {
 		return nil, err
@@ -1351,7 +2357,6 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 		return nil, err
 	}
 
-	mac_enc := cipher.NewCBCEncrypter(aes_block, zero_iv)
 	iv, err := a32_to_bytes([]uint32{ukey[4], ukey[5], ukey[4], ukey[5]})
 	if err != nil {
 		return nil, err
@@ -1365,25 +2370,113 @@ func (m *Mega) NewUpload(parent *Node, name string, fileSize int64) (*Upload, er
 		chunks = append(chunks, chunkSize{position: 0, size: 0})
 	}
 
-	uploadUrl := res[0].P
-	if m.config.https && strings.HasPrefix(uploadUrl, "http://") {
+	if cfg.https && strings.HasPrefix(uploadUrl, "http://") {
 		uploadUrl = "https://" + strings.TrimPrefix(uploadUrl, "http://")
 	}
 
 	u := &Upload{
 		m:                 m,
+		cfg:               cfg,
 		parenthash:        parenthash,
 		name:              name,
+		size:              fileSize,
 		uploadUrl:         uploadUrl,
 		aes_block:         aes_block,
 		iv:                iv,
 		kiv:               kiv,
-		mac_enc:           mac_enc,
 		kbytes:            kbytes,
 		ukey:              ukey,
+		conns:             newConnLimiter(0),
 		chunks:            chunks,
 		chunk_macs:        make([][]byte, len(chunks)),
 		completion_handle: []byte{},
+		completion_id:     completion_id,
+	}
+	return u, nil
+}
+
+// UploadState is what is needed to carry on with an Upload after a
+// restart.  It contains the file key so must be kept private.
+type UploadState struct {
+	// Upload URL from the server
+	URL string `json:"url"`
+	// File key and nonce
+	Key []uint32 `json:"key"`
+	// MACs of the chunks uploaded, nil for the ones still to do
+	ChunkMACs [][]byte `json:"macs"`
+	// Completion handle if the server has sent it
+	CompletionHandle string `json:"ch,omitempty"`
+	// Request ID for creating the node so a completion which is
+	// resumed after an error isn't done twice
+	CompletionID string `json:"ci,omitempty"`
+}
+
+// State returns the state of the upload for ResumeUpload
+func (u *Upload) State() UploadState {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	macs := make([][]byte, len(u.chunk_macs))
+	for i, mac := range u.chunk_macs {
+		if mac != nil {
+			macs[i] = append([]byte(nil), mac...)
+		}
+	}
+	return UploadState{
+		URL:              u.uploadUrl,
+		Key:              append([]uint32(nil), u.ukey...),
+		ChunkMACs:        macs,
+		CompletionHandle: string(u.completion_handle),
+		CompletionID:     u.completion_id,
+	}
+}
+
+// context returns the context of the chunk requests
+func (u *Upload) context() context.Context {
+	if u.ctx == nil {
+		return context.Background()
+	}
+	return u.ctx
+}
+
+// ChunkDone returns true if chunk id has been uploaded
+func (u *Upload) ChunkDone(id int) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return id >= 0 && id < len(u.chunk_macs) && u.chunk_macs[id] != nil
+}
+
+// ResumeUpload recreates an Upload of name into parent of fileSize
+// from the state returned by State so only the chunks which weren't
+// done need uploading.  The server may have expired the upload URL in
+// which case UploadChunk returns EEXPIRED and the upload must be
+// started again with NewUpload.  UploadFile and the TransferManager do
+// that themselves.
+func (m *Mega) ResumeUpload(parent *Node, name string, fileSize int64, state UploadState) (*Upload, error) {
+	return m.resumeUpload(m.getConfig(), parent, name, fileSize, state)
+}
+
+// resumeUpload is ResumeUpload with the configuration cfg
+func (m *Mega) resumeUpload(cfg config, parent *Node, name string, fileSize int64, state UploadState) (*Upload, error) {
+	if parent == nil || len(state.Key) != 6 || state.URL == "" {
+		return nil, EARGS
+	}
+	u, err := m.newUpload(cfg, parent.GetHash(), name, fileSize, state.URL, state.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.ChunkMACs) != len(u.chunks) {
+		return nil, EARGS
+	}
+	for i, mac := range state.ChunkMACs {
+		if mac != nil && len(mac) != 16 {
+			return nil, EARGS
+		}
+		u.chunk_macs[i] = mac
+	}
+	u.completion_handle = []byte(state.CompletionHandle)
+	if state.CompletionID != "" {
+		u.completion_id = state.CompletionID
 	}
 	return u, nil
 }
@@ -1403,6 +2496,10 @@ func (u *Upload) ChunkLocation(id int) (position int64, size int, err error) {
 
 // UploadChunk uploads the chunk of id
 func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
+	end := u.audit.begin(u.m, "Upload.UploadChunk", "upload of "+u.name, id)
+	defer func() {
+		end(err == nil)
+	}()
 	chk_start, chk_size, err := u.ChunkLocation(id)
 	if err != nil {
 		return err
@@ -1410,16 +2507,24 @@ func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
 	if len(chunk) != chk_size {
 		return errors.New("upload chunk is wrong size")
 	}
-	ctr_iv, err := bytes_to_a32(u.kiv)
-	if err != nil {
-		return err
+	if u.m.getConfig().readonly {
+		return EREADONLY
+	}
+	var span Span = noopSpan{}
+	if u.cfg.tracer != nil {
+		_, span = u.cfg.startSpan(u.context(), SPAN_UPLOAD_CHUNK,
+			TraceAttr{ATTR_NODE, traceHandle(u.parenthash)},
+			TraceAttr{ATTR_CHUNK, int64(id)},
+			TraceAttr{ATTR_BYTES, int64(chk_size)})
 	}
-	ctr_iv[2] = uint32(uint64(chk_start) / 0x1000000000)
-	ctr_iv[3] = uint32(chk_start / 0x10)
-	bctr_iv, err := a32_to_bytes(ctr_iv)
+	defer func() {
+		span.End(err)
+	}()
+	bctr_iv, err := ctrIV(u.kiv, chk_start)
 	if err != nil {
 		return err
 	}
+	start := u.m.now()
 	ctr_aes := cipher.NewCTR(u.aes_block, bctr_iv)
 
 	enc := cipher.NewCBCEncrypter(u.aes_block, u.iv)
@@ -1435,26 +2540,51 @@ func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
 	var rsp *http.Response
 	var req *http.Request
 	ctr_aes.XORKeyStream(chunk, chunk)
+	u.m.links.noteCrypto(len(chunk), u.m.now().Sub(start))
+	u.mutex.Lock()
 	chk_url := fmt.Sprintf("%s/%d", u.uploadUrl, chk_start)
+	u.mutex.Unlock()
+
+	// Hold the connection slots through the retries so a failing
+	// chunk doesn't lose its place
+	u.conns.acquire()
+	defer u.conns.release()
+	u.m.conns.acquire()
+	defer u.m.conns.release()
 
 	chunk_resp := []byte{}
 	sleepTime := minSleepTime // inital backoff time
-	for retry := 0; retry < u.m.retries+1; retry++ {
+	for retry := 0; retry < u.cfg.retries+1; retry++ {
 		reader := bytes.NewBuffer(chunk)
 		req, err = http.NewRequest("POST", chk_url, reader)
 		if err != nil {
 			return err
 		}
-		rsp, err = u.m.client.Do(req)
-		if err == nil {
-			if rsp.StatusCode == 200 {
-				break
-			}
+		if u.cfg.limiter != nil {
+			req.Body = ioutil.NopCloser(u.cfg.limiter.reader(req.Body))
+		}
+		start = u.m.now()
+		rsp, err = u.m.storage.Do(req.WithContext(u.context()))
+		if err == nil && rsp.StatusCode != 200 {
 			err = errors.New("Http Status: " + rsp.Status)
 			_ = rsp.Body.Close()
 		}
-		u.m.debugf("%s: Retry upload chunk %d/%d: %v", u.name, retry, u.m.retries, err)
-		backOffSleep(&sleepTime)
+		elapsed := u.m.now().Sub(start)
+		u.m.links.note(chk_url, true, len(chunk), elapsed, elapsed, err)
+		if err == nil {
+			break
+		}
+		if e := u.context().Err(); e != nil {
+			return e
+		}
+		u.m.debugf("%s: Retry upload chunk %d/%d: %v", u.name, retry, u.cfg.retries, err)
+		if retry < u.cfg.retries {
+			u.mutex.Lock()
+			u.retries++
+			u.mutex.Unlock()
+			u.m.metrics.add(uploadRetries, 1)
+		}
+		u.m.backOffSleep(&sleepTime)
 	}
 	if err != nil {
 		return err
@@ -1474,28 +2604,77 @@ func (u *Upload) UploadChunk(id int, chunk []byte) (err error) {
 		return err
 	}
 
-	if bytes.Equal(chunk_resp, nil) == false {
-		u.mutex.Lock()
-		u.completion_handle = chunk_resp
-		u.mutex.Unlock()
+	// The server answers with an error code or, for the chunk which
+	// completes the upload, the completion handle.  With several
+	// workers that needn't be the last chunk sent nor the last
+	// response read so keep whichever response carries it.
+	if errno, ok := chunkErrno(chunk_resp); ok {
+		return parseError(errno)
 	}
 
+	u.m.metrics.add(uploadChunks, 1)
+	u.m.metrics.add(uploadBytes, int64(len(chunk)))
+	u.m.usage.add(0, int64(len(chunk)))
+
 	// Update chunk MACs on success only
 	u.mutex.Lock()
+	u.sent += int64(len(chunk))
 	if len(u.chunk_macs) > 0 {
 		u.chunk_macs[id] = make([]byte, 16)
 		copy(u.chunk_macs[id], block)
 	}
+	if len(chunk_resp) > 0 {
+		if len(u.completion_handle) > 0 && !bytes.Equal(u.completion_handle, chunk_resp) {
+			u.m.debugf("%s: chunk %d replaced completion handle", u.name, id)
+		}
+		u.completion_handle = chunk_resp
+	}
 	u.mutex.Unlock()
 
 	return nil
 }
 
-// Finish completes the upload and returns the created node
+// chunkErrno returns the error code if resp, the body of the response
+// to an upload chunk, is one
+func chunkErrno(resp []byte) (ErrorMsg, bool) {
+	if len(resp) == 0 || len(resp) > 3 || resp[0] != '-' {
+		return 0, false
+	}
+	errno, err := strconv.Atoi(string(resp))
+	if err != nil || errno >= 0 {
+		return 0, false
+	}
+	return ErrorMsg(errno), true
+}
+
+// Finish completes the upload and returns the created node.  It may
+// be called again if it fails.
+//
+// It returns EINCOMPLETE if any chunks haven't been uploaded or the
+// server hasn't sent the completion handle yet.
 func (u *Upload) Finish() (node *Node, err error) {
+	end := u.audit.begin(u.m, "Upload.Finish", "upload of "+u.name, auditFinish)
+	defer func() {
+		end(err == nil)
+	}()
+	u.mutex.Lock()
+	chunk_macs := u.chunk_macs
+	completion_handle := string(u.completion_handle)
+	u.mutex.Unlock()
+	for _, v := range chunk_macs {
+		if v == nil {
+			return nil, EINCOMPLETE
+		}
+	}
+	if completion_handle == "" {
+		return nil, EINCOMPLETE
+	}
+
+	// A fresh CBC chain each time so a retry gets the same MAC
+	mac_enc := cipher.NewCBCEncrypter(u.aes_block, zero_iv)
 	mac_data := make([]byte, 16)
-	for _, v := range u.chunk_macs {
-		u.mac_enc.CryptBlocks(mac_data, v)
+	for _, v := range chunk_macs {
+		mac_enc.CryptBlocks(mac_data, v)
 	}
 
 	t, err := bytes_to_a32(mac_data)
@@ -1503,8 +2682,12 @@ func (u *Upload) Finish() (node *Node, err error) {
 		return nil, err
 	}
 	meta_mac := []uint32{t[0] ^ t[1], t[2] ^ t[3]}
+	u.meta_mac, err = a32_to_bytes(meta_mac)
+	if err != nil {
+		return nil, err
+	}
 
-	attr := FileAttr{u.name}
+	attr := FileAttr{Name: u.name}
 
 	attr_data, err := encryptAttr(u.kbytes, attr)
 	if err != nil {
@@ -1519,6 +2702,15 @@ func (u *Upload) Finish() (node *Node, err error) {
 	if err != nil {
 		return nil, err
 	}
+	var cr []interface{}
+	u.m.FS.mutex.Lock()
+	if parent := u.m.FS.hashLookup(u.parenthash); parent != nil {
+		cr, err = u.m.newNodeCr(parent, completion_handle, buf)
+	}
+	u.m.FS.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
 	master_aes, err := aes.NewCipher(u.m.k)
 	if err != nil {
 		return nil, err
@@ -1533,10 +2725,13 @@ func (u *Upload) Finish() (node *Node, err error) {
 
 	cmsg[0].Cmd = "p"
 	cmsg[0].T = u.parenthash
-	cmsg[0].N[0].H = string(u.completion_handle)
-	cmsg[0].N[0].T = FILE
+	cmsg[0].N[0].H = completion_handle
+	cmsg[0].N[0].T = int(FILE)
 	cmsg[0].N[0].A = attr_data
 	cmsg[0].N[0].K = base64urlencode(buf)
+	cmsg[0].Cr = cr
+	// The same ID each time so a retried Finish can't make two nodes
+	cmsg[0].I = u.completion_id
 
 	request, err := json.Marshal(cmsg)
 	if err != nil {
@@ -1547,100 +2742,261 @@ func (u *Upload) Finish() (node *Node, err error) {
 		return nil, err
 	}
 
-	err = json.Unmarshal(result, &cres)
+	err = u.m.decodeResponse(result, &cres)
 	if err != nil {
 		return nil, err
 	}
 
 	u.m.FS.mutex.Lock()
-	defer u.m.FS.mutex.Unlock()
-	return u.m.addFSNode(cres[0].F[0])
+	node, err = u.m.addFSNode(cres[0].F[0])
+	var entry *JournalEntry
+	if err == nil {
+		node.creator = u.m.handle
+		entry = u.m.journalEntry(JOURNAL_CREATE, JOURNAL_LOCAL, u.m.handle, node, "")
+	}
+	u.m.FS.mutex.Unlock()
+	u.m.journal(entry)
+	return node, err
 }
 
-// Upload a file to the filesystem
-func (m *Mega) UploadFile(srcpath string, parent *Node, name string, progress *chan int) (node *Node, err error) {
-	defer func() {
-		if progress != nil {
-			close(*progress)
-		}
-	}()
+// COMPLETION_RETRIES is the number of times creating the node of an
+// upload is tried before giving up with a CompletionError
+const COMPLETION_RETRIES = 3
 
-	var infile *os.File
-	var fileSize int64
+// permanentError returns true for API errors which won't go away by
+// trying the same request again
+func permanentError(err error) bool {
+	for _, e := range []error{EREADONLY, EARGS, ENOENT, ECIRCULAR, EACCESS, EEXIST, EKEY, ESID, EBLOCKED, EOVERQUOTA, EGOINGOVERQUOTA, EAPPKEY} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
 
-	info, err := os.Stat(srcpath)
-	if err == nil {
-		fileSize = info.Size()
+// finishRetry calls Finish until it works, trying again after errors
+// which may be temporary.  If it fails the error is a CompletionError
+// holding what is needed to finish the upload later.
+func (u *Upload) finishRetry() (node *Node, err error) {
+	sleepTime := minSleepTime
+	for try := 0; try < COMPLETION_RETRIES; try++ {
+		if try != 0 {
+			u.m.debugf("%s: Retry upload completion %d/%d: %v", u.name, try, COMPLETION_RETRIES-1, err)
+			u.m.backOffSleep(&sleepTime)
+		}
+		node, err = u.Finish()
+		// retrying won't help if chunks are missing
+		if err == nil || err == EINCOMPLETE || permanentError(err) {
+			break
+		}
+	}
+	if err != nil {
+		st := u.State()
+		return nil, &CompletionError{Name: u.name, Handle: st.CompletionHandle, State: st, Err: err}
 	}
+	return node, nil
+}
 
-	infile, err = os.OpenFile(srcpath, os.O_RDONLY, 0666)
+// Upload a file to the filesystem
+//
+// srcpath may be a FIFO or a device, which is read to the end into a
+// temporary file first, see SetTempDir, as the size must be known
+// before the upload starts.
+//
+// If the file is sent but the node can't be created the error is a
+// *CompletionError which can be used to finish the upload later.
+func (m *Mega) UploadFile(srcpath string, parent *Node, name string, progress *chan int) (*Node, error) {
+	res, err := m.UploadFileResult(srcpath, parent, name, progress)
 	if err != nil {
 		return nil, err
 	}
+	return res.Node, nil
+}
+
+// UploadResult describes a completed upload
+type UploadResult struct {
+	// The node created
+	Node *Node
+	// FileFingerprint of the file uploaded
+	Fingerprint string
+	// MAC of the contents as stored in the node key, 8 bytes
+	MetaMAC []byte
+	// Bytes of file data sent
+	Bytes int64
+	// Number of chunk requests which were retried
+	Retries int
+	// How long the upload took
+	Elapsed time.Duration
+	// MIME type of the file, set by UploadFileWith
+	ContentType string
+	// Dimensions and duration of an image or video, set by
+	// UploadFileWith with UploadOptions.Media
+	Media *MediaInfo
+	// Copied is set if a file with the same contents was copied on
+	// the server instead of uploading, see UploadOptions.Dedupe, and
+	// BytesSaved is how many bytes weren't sent because of it
+	Copied     bool
+	BytesSaved int64
+}
+
+// result returns what is known about the upload once Finish has
+// created node
+func (u *Upload) result(node *Node) *UploadResult {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return &UploadResult{
+		Node:    node,
+		MetaMAC: append([]byte(nil), u.meta_mac...),
+		Bytes:   u.sent,
+		Retries: u.retries,
+	}
+}
+
+// UploadFileResult uploads a file like UploadFile returning the details
+// of the upload for logging and auditing
+func (m *Mega) UploadFileResult(srcpath string, parent *Node, name string, progress *chan int) (res *UploadResult, err error) {
+	return m.UploadFileWith(srcpath, parent, name, UploadOptions{Progress: progress})
+}
+
+// UploadFrom uploads size bytes read from r into parent as name,
+// reporting progress if not nil.  It is UploadFile for sources which
+// aren't local files, such as memory in a browser.
+//
+// If the data is sent but the node can't be created the error is a
+// *CompletionError which can be used to finish the upload later.
+func (m *Mega) UploadFrom(r io.ReaderAt, size int64, parent *Node, name string, progress *chan int) (*Node, error) {
 	defer func() {
-		e := infile.Close()
-		if err == nil {
-			err = e
+		if progress != nil {
+			close(*progress)
 		}
 	}()
 
 	if name == "" {
-		name = filepath.Base(srcpath)
+		return nil, EARGS
 	}
-
-	u, err := m.NewUpload(parent, name, fileSize)
+	u, err := m.NewUpload(parent, name, size)
+	if err != nil {
+		return nil, err
+	}
+	err = m.uploadChunks(u, r, progress)
+	if err != nil {
+		return nil, err
+	}
+	err = m.checkUpload(name, r, size)
 	if err != nil {
 		return nil, err
 	}
+	return u.finishRetry()
+}
 
-	workch := make(chan int)
-	errch := make(chan error, m.ul_workers)
+// UPLOAD_URL_RENEWALS is the number of times a fresh upload URL is
+// fetched when the old one expires part way through an upload
+const UPLOAD_URL_RENEWALS = 3
+
+// renewURL replaces the expired upload URL of u with a fresh one.  The
+// chunks sent to the old URL went with it so they must all be sent
+// again, but the key is kept.
+func (u *Upload) renewURL() error {
+	uploadUrl, err := u.m.uploadURL(u.cfg, u.size)
+	if err != nil {
+		return err
+	}
+	if u.cfg.https && strings.HasPrefix(uploadUrl, "http://") {
+		uploadUrl = "https://" + strings.TrimPrefix(uploadUrl, "http://")
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.uploadUrl = uploadUrl
+	u.chunk_macs = make([][]byte, len(u.chunks))
+	u.completion_handle = []byte{}
+	return nil
+}
+
+// uploadChunks uploads all the chunks of u with the upload workers
+// reading them from r.  If the upload URL expires a fresh one is
+// fetched and the chunks sent again.
+func (m *Mega) uploadChunks(u *Upload, r io.ReaderAt, progress *chan int) error {
+	// Chunks resumed count as done already and those sent again
+	// after a renewal aren't counted twice
+	reported := make([]bool, u.Chunks())
+	resumed := 0
+	for id := range reported {
+		if u.ChunkDone(id) {
+			_, size, _ := u.ChunkLocation(id)
+			reported[id] = true
+			resumed += size
+		}
+	}
+	if progress != nil && resumed > 0 {
+		*progress <- resumed
+	}
+
+	for renewals := 0; ; renewals++ {
+		err := m.sendChunks(u, r, progress, reported)
+		if !errors.Is(err, EEXPIRED) || renewals >= UPLOAD_URL_RENEWALS {
+			return err
+		}
+		m.debugf("%s: upload URL expired, starting again with a new one", u.name)
+		err = u.renewURL()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendChunks sends the chunks of u not done yet with the upload
+// workers, reporting the progress of those not in reported.  The
+// chunks are read from r in order here, adding them to the
+// fingerprint of u, and handed to the workers.
+func (m *Mega) sendChunks(u *Upload, r io.ReaderAt, progress *chan int, reported []bool) error {
+	workch := make(chan fetchedChunk)
+	errch := make(chan error, u.cfg.ul_workers)
 	wg := sync.WaitGroup{}
 
 	// Fire chunk upload workers
-	for w := 0; w < m.ul_workers; w++ {
+	for w := 0; w < u.cfg.ul_workers; w++ {
 		wg.Add(1)
 
 		go func() {
 			defer wg.Done()
 
-			for id := range workch {
-				chk_start, chk_size, err := u.ChunkLocation(id)
+			for c := range workch {
+				err := u.UploadChunk(c.id, c.chunk)
+				m.mem.release(int64(len(c.chunk)))
 				if err != nil {
-					errch <- err
-					return
-				}
-				chunk := make([]byte, chk_size)
-				n, err := infile.ReadAt(chunk, chk_start)
-				if err != nil && err != io.EOF {
-					errch <- err
-					return
-				}
-				if n != len(chunk) {
-					errch <- errors.New("chunk too short")
+					errch <- &ChunkError{Op: "upload", Chunk: c.id, Offset: c.start, Err: err}
 					return
 				}
 
-				err = u.UploadChunk(id, chunk)
-				if err != nil {
-					errch <- err
-					return
-				}
-
-				if progress != nil {
-					*progress <- chk_size
+				if progress != nil && !reported[c.id] {
+					reported[c.id] = true
+					*progress <- len(c.chunk)
 				}
 			}
 		}()
 	}
 
-	// Place chunk download jobs to chan
-	err = nil
+	// Read the chunks and place upload jobs to chan skipping those
+	// resumed
+	var err error
 	for id := 0; id < u.Chunks() && err == nil; {
+		if u.ChunkDone(id) {
+			id++
+			continue
+		}
+		var c fetchedChunk
+		c, err = u.readChunk(r, id)
+		if err != nil {
+			break
+		}
 		select {
-		case workch <- id:
+		case workch <- c:
 			id++
 		case err = <-errch:
+			m.mem.release(int64(len(c.chunk)))
+		case <-u.context().Done():
+			m.mem.release(int64(len(c.chunk)))
+			err = u.context().Err()
 		}
 	}
 
@@ -1648,28 +3004,98 @@ func (m *Mega) UploadFile(srcpath string, parent *Node, name string, progress *c
 
 	wg.Wait()
 
+	return drainErrors(m, u.name, err, errch)
+}
+
+// readChunk reads chunk id of u from r into a buffer counted against
+// the memory limit and adds it to the fingerprint
+func (u *Upload) readChunk(r io.ReaderAt, id int) (fetchedChunk, error) {
+	chk_start, chk_size, err := u.ChunkLocation(id)
 	if err != nil {
-		return nil, err
+		return fetchedChunk{}, err
+	}
+	err = u.m.mem.acquire(u.context(), int64(chk_size))
+	if err != nil {
+		return fetchedChunk{}, err
+	}
+	chunk := make([]byte, chk_size)
+	n, err := r.ReadAt(chunk, chk_start)
+	if err != nil && err != io.EOF {
+		u.m.mem.release(int64(chk_size))
+		return fetchedChunk{}, &ChunkError{Op: "read", Chunk: id, Offset: chk_start, Err: err}
+	}
+	if n != len(chunk) {
+		u.m.mem.release(int64(chk_size))
+		return fetchedChunk{}, &ChunkError{Op: "read", Chunk: id, Offset: chk_start, Err: errors.New("chunk too short")}
+	}
+
+	// Chunks already sent before the upload URL was renewed are in
+	// the fingerprint, and one skipped as resumed leaves a gap
+	switch {
+	case u.fp == nil || id < u.fpNext:
+	case id == u.fpNext:
+		_, _ = u.fp.Write(chunk)
+		u.fpNext++
+	default:
+		u.fp = nil
 	}
+	return fetchedChunk{id: id, start: chk_start, chunk: chunk}, nil
+}
 
-	return u.Finish()
+// fingerprint returns the FileFingerprint of the data sent, "" unless
+// every chunk was read by sendChunks with the fingerprint started
+func (u *Upload) fingerprint() string {
+	if u.fp == nil || u.fpNext != u.Chunks() {
+		return ""
+	}
+	return hex.EncodeToString(u.fp.Sum(nil))
 }
 
 // Move a file from one location to another
+//
+// When parent is in a share the keys of src and everything below it
+// are sent encrypted with the share key so the other users of the
+// share can decrypt them.
 func (m *Mega) Move(src *Node, parent *Node) error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
+	defer m.auditNodes("Move", src)()
+	return m.moveColliding(src, parent, m.getConfig().collision)
+}
 
+// moveAnyName is Move without the name collision handling, for the
+// package's own moves which put nodes where they belong
+func (m *Mega) moveAnyName(src *Node, parent *Node) error {
+	defer m.auditNodes("Move", src)()
+	return m.move(src, parent)
+}
+
+// move is Move without the name collision handling
+func (m *Mega) move(src *Node, parent *Node) error {
+	var entry *JournalEntry
+	defer func() {
+		m.journal(entry)
+	}()
 	if src == nil || parent == nil {
 		return EARGS
 	}
+
+	// every node moved into a share needs its key sent
+	m.FS.mutex.Lock()
+	shared := m.FS.shareOf(parent) != "" && src.ntype != FILE
+	m.FS.mutex.Unlock()
+	if shared {
+		err := m.LoadTree(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
 	var msg [1]MoveFileMsg
 	var err error
 
-	msg[0].Cmd = "m"
-	msg[0].N = src.hash
-	msg[0].T = parent.hash
-	msg[0].I, err = randString(10)
+	msg[0], err = m.moveMsg(src, parent)
 	if err != nil {
 		return err
 	}
@@ -1683,85 +3109,143 @@ func (m *Mega) Move(src *Node, parent *Node) error {
 		return err
 	}
 
+	entry = m.applyMove(src, parent)
+
+	return nil
+}
+
+// moveMsg returns the command which moves src into parent
+//
+// Call with the FS mutex held
+func (m *Mega) moveMsg(src *Node, parent *Node) (msg MoveFileMsg, err error) {
+	if err = m.FS.checkAccess(src, ACCESS_FULL); err != nil {
+		return msg, err
+	}
+	if err = m.FS.checkAccess(parent, ACCESS_READWRITE); err != nil {
+		return msg, err
+	}
+	msg.Cmd = "m"
+	msg.N = src.hash
+	msg.T = parent.hash
+	msg.Cr, err = m.moveCr(src, parent)
+	if err != nil {
+		return msg, err
+	}
+	msg.I, err = m.newRequestID()
+	return msg, err
+}
+
+// applyMove moves src into parent in the tree once the server has,
+// returning the journal entry for it
+//
+// Call with the FS mutex held
+func (m *Mega) applyMove(src *Node, parent *Node) *JournalEntry {
+	oldPath := m.FS.pathOf(src)
+	oldParent := src.parent
 	if src.parent != nil {
 		src.parent.removeChild(src)
 	}
 
 	parent.addChild(src)
 	src.parent = parent
-
-	return nil
+	m.FS.noteMove(src, oldParent)
+	return m.journalEntry(JOURNAL_MOVE, JOURNAL_LOCAL, m.handle, src, oldPath)
 }
 
 // Rename a file or folder
 func (m *Mega) Rename(src *Node, name string) error {
+	defer m.auditNodes("Rename", src)()
+	return m.rename(src, name)
+}
+
+// rename is Rename without auditing
+func (m *Mega) rename(src *Node, name string) error {
+	var entry *JournalEntry
+	defer func() {
+		m.journal(entry)
+	}()
 	m.FS.mutex.Lock()
 	defer m.FS.mutex.Unlock()
 
 	if src == nil {
 		return EARGS
 	}
-	var msg [1]FileAttrMsg
-
-	master_aes, err := aes.NewCipher(m.k)
-	if err != nil {
-		return err
-	}
-	attr := FileAttr{name}
-	attr_data, err := encryptAttr(src.meta.key, attr)
-	if err != nil {
-		return err
-	}
-	key := make([]byte, len(src.meta.compkey))
-	err = blockEncrypt(master_aes, key, src.meta.compkey)
+	err := m.setNodeAttr(src, FileAttr{Name: name, Fingerprint: src.fingerprint, Extra: src.attrs})
 	if err != nil {
 		return err
 	}
 
-	msg[0].Cmd = "a"
-	msg[0].Attr = attr_data
-	msg[0].Key = base64urlencode(key)
-	msg[0].N = src.hash
-	msg[0].I, err = randString(10)
-	if err != nil {
-		return err
-	}
+	entry = m.applyRename(src, name)
 
-	req, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-	_, err = m.api_request(req)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
+// applyRename renames src in the tree once the server has, returning
+// the journal entry for it
+//
+// Call with the FS mutex held
+func (m *Mega) applyRename(src *Node, name string) *JournalEntry {
+	oldPath := m.FS.pathOf(src)
 	src.name = name
-
-	return nil
+	return m.journalEntry(JOURNAL_RENAME, JOURNAL_LOCAL, m.handle, src, oldPath)
 }
 
-// Create a directory in the filesystem
+// Create a directory in the filesystem.  As with NewUpload, parent may
+// be in a share.
 func (m *Mega) CreateDir(name string, parent *Node) (*Node, error) {
+	id, err := m.newRequestID()
+	if err != nil {
+		return nil, err
+	}
+	return m.CreateDirWithID(name, parent, id)
+}
+
+// CreateDirWithID creates a directory like CreateDir using id as the
+// request ID.  If creating it fails part way, say on a network error,
+// calling again with the same id won't make a second folder if the
+// first attempt reached the server.
+func (m *Mega) CreateDirWithID(name string, parent *Node, id string) (*Node, error) {
+	name, dir, err := m.dirName(name, parent)
+	if err != nil || dir != nil {
+		return dir, err
+	}
+
+	var entry *JournalEntry
+	defer func() {
+		m.journal(entry)
+	}()
 	m.FS.mutex.Lock()
 	defer m.FS.mutex.Unlock()
 
-	if parent == nil {
+	if parent == nil || id == "" {
 		return nil, EARGS
 	}
+	if err := m.FS.checkAccess(parent, ACCESS_READWRITE); err != nil {
+		return nil, err
+	}
 	var msg [1]UploadCompleteMsg
 	var res [1]UploadCompleteResp
 
-	compkey := []uint32{0, 0, 0, 0, 0, 0}
-	for i, _ := range compkey {
-		compkey[i] = uint32(mrand.Int31())
+	// Temporary handle for the new folder within the request, made
+	// like a node handle from 6 bytes
+	cfg := m.getConfig()
+	handle := make([]byte, 6)
+	_, err = io.ReadFull(cfg.idSource(), handle)
+	if err != nil {
+		return nil, err
+	}
+	tmpHandle := base64urlencode(handle)
+
+	compkey, err := cfg.randomA32(6)
+	if err != nil {
+		return nil, err
 	}
 
 	master_aes, err := aes.NewCipher(m.k)
 	if err != nil {
 		return nil, err
 	}
-	attr := FileAttr{name}
+	attr := FileAttr{Name: name}
 	ukey, err := a32_to_bytes(compkey[:4])
 	if err != nil {
 		return nil, err
@@ -1778,14 +3262,15 @@ func (m *Mega) CreateDir(name string, parent *Node) (*Node, error) {
 
 	msg[0].Cmd = "p"
 	msg[0].T = parent.hash
-	msg[0].N[0].H = "xxxxxxxx"
-	msg[0].N[0].T = FOLDER
+	msg[0].N[0].H = tmpHandle
+	msg[0].N[0].T = int(FOLDER)
 	msg[0].N[0].A = attr_data
 	msg[0].N[0].K = base64urlencode(key)
-	msg[0].I, err = randString(10)
+	msg[0].Cr, err = m.newNodeCr(parent, tmpHandle, ukey)
 	if err != nil {
 		return nil, err
 	}
+	msg[0].I = id
 
 	req, err := json.Marshal(msg)
 	if err != nil {
@@ -1796,11 +3281,15 @@ func (m *Mega) CreateDir(name string, parent *Node) (*Node, error) {
 		return nil, err
 	}
 
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	if err != nil {
 		return nil, err
 	}
 	node, err := m.addFSNode(res[0].F[0])
+	if err == nil {
+		node.creator = m.handle
+		entry = m.journalEntry(JOURNAL_CREATE, JOURNAL_LOCAL, m.handle, node, "")
+	}
 
 	return node, err
 }
@@ -1813,15 +3302,22 @@ func (m *Mega) Delete(node *Node, destroy bool) error {
 	if destroy == false {
 		return m.Move(node, m.FS.trash)
 	}
+	defer m.auditNodes("Delete", node)()
+	return m.destroy(node)
+}
 
+// destroy deletes node for good without auditing
+func (m *Mega) destroy(node *Node) error {
+	var entry *JournalEntry
+	defer func() {
+		m.journal(entry)
+	}()
 	m.FS.mutex.Lock()
 	defer m.FS.mutex.Unlock()
 
 	var msg [1]FileDeleteMsg
 	var err error
-	msg[0].Cmd = "d"
-	msg[0].N = node.hash
-	msg[0].I, err = randString(10)
+	msg[0], err = m.deleteMsg(node)
 	if err != nil {
 		return err
 	}
@@ -1835,221 +3331,332 @@ func (m *Mega) Delete(node *Node, destroy bool) error {
 		return err
 	}
 
-	parent := m.FS.lookup[node.hash]
-	parent.removeChild(node)
-	delete(m.FS.lookup, node.hash)
+	entry = m.applyDelete(node)
 
 	return nil
 }
 
+// deleteMsg returns the command which deletes node for good
+//
+// Call with the FS mutex held
+func (m *Mega) deleteMsg(node *Node) (msg FileDeleteMsg, err error) {
+	// leaving an incoming share is allowed whatever its level
+	if _, root := m.FS.saccess[node.hash]; !root {
+		if err = m.FS.checkAccess(node, ACCESS_FULL); err != nil {
+			return msg, err
+		}
+	}
+	msg.Cmd = "d"
+	msg.N = node.hash
+	msg.I, err = m.newRequestID()
+	return msg, err
+}
+
+// applyDelete removes node from the tree once the server has deleted
+// it, returning the journal entry for it
+//
+// Call with the FS mutex held
+func (m *Mega) applyDelete(node *Node) *JournalEntry {
+	entry := m.journalEntry(JOURNAL_DELETE, JOURNAL_LOCAL, m.handle, node, m.FS.pathOf(node))
+	// the nodes below it go with it
+	m.FS.removeTree(node)
+	return entry
+}
+
 // process an add node event
 func (m *Mega) processAddNode(evRaw []byte) error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
 	var ev FSEvent
 	err := json.Unmarshal(evRaw, &ev)
 	if err != nil {
 		return err
 	}
 
+	var events []Event
+	var entries []*JournalEntry
+	newKeys := false
+	m.FS.mutex.Lock()
 	for _, itm := range ev.T.Files {
-		_, err = m.addFSNode(itm)
+		if p := m.FS.lookup[itm.Parent]; p != nil && p.unloaded {
+			// fetched with the rest of the folder when it is loaded
+			continue
+		}
+		share := m.FS.spending[itm.Hash]
+		newKeys = newKeys || itm.SKey != ""
+		node, err := m.addFSNode(itm)
 		if err != nil {
+			m.FS.mutex.Unlock()
+			m.journal(entries...)
 			return err
 		}
+		if node == nil {
+			continue
+		}
+		if ev.Owner != "" {
+			node.creator = ev.Owner
+		}
+		m.FS.noteArrived(node)
+		entries = append(entries, m.journalEntry(JOURNAL_CREATE, JOURNAL_SERVER, itm.User, node, ""))
+		events = append(events, Event{Type: EVENT_NODE_ADDED, Node: node, Hash: itm.Hash})
+		if share {
+			events = append(events, Event{Type: EVENT_SHARE_ADDED, Node: node, Hash: itm.Hash})
+		}
 	}
+	if newKeys {
+		repaired, repairedEntries := m.repairNodes()
+		events = append(events, repaired...)
+		entries = append(entries, repairedEntries...)
+	}
+	m.FS.mutex.Unlock()
+
+	m.journal(entries...)
+	m.emitEvents(events)
 	return nil
 }
 
 // process an update node event
 func (m *Mega) processUpdateNode(evRaw []byte) error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
 	var ev FSEvent
 	err := json.Unmarshal(evRaw, &ev)
 	if err != nil {
 		return err
 	}
 
+	m.FS.mutex.Lock()
 	node := m.FS.hashLookup(ev.N)
 	if node == nil {
+		m.FS.mutex.Unlock()
 		return ENOENT
 	}
+	oldPath := m.FS.pathOf(node)
+	oldName := node.name
 	attr, err := decryptAttr(node.meta.key, ev.Attr)
 	if err == nil {
 		node.name = attr.Name
+		node.fingerprint = attr.Fingerprint
+		node.attrs = attr.Extra
 	} else {
 		node.name = "BAD ATTRIBUTE"
 	}
 
 	node.ts = time.Unix(ev.Ts, 0)
+	if itm, ok := m.FS.broken[ev.N]; ok {
+		// keep the attributes to retry with when the key arrives
+		itm.Attr = ev.Attr
+		itm.Ts = ev.Ts
+		m.FS.setDecryptionError(node, itm, err)
+	} else if err != nil {
+		node.decryptErr = &DecryptionError{Hash: ev.N, Err: err}
+	} else {
+		node.decryptErr = nil
+	}
+	var entry *JournalEntry
+	if node.name != oldName {
+		entry = m.journalEntry(JOURNAL_RENAME, JOURNAL_SERVER, ev.User, node, oldPath)
+	} else {
+		entry = m.journalEntry(JOURNAL_UPDATE, JOURNAL_SERVER, ev.User, node, "")
+	}
+	m.FS.mutex.Unlock()
+
+	m.journal(entry)
+	m.emitEvents([]Event{{Type: EVENT_NODE_UPDATED, Node: node, Hash: ev.N}})
 	return nil
 }
 
 // process a delete node event
 func (m *Mega) processDeleteNode(evRaw []byte) error {
-	m.FS.mutex.Lock()
-	defer m.FS.mutex.Unlock()
-
 	var ev FSEvent
 	err := json.Unmarshal(evRaw, &ev)
 	if err != nil {
 		return err
 	}
 
+	m.FS.mutex.Lock()
 	node := m.FS.hashLookup(ev.N)
-	if node != nil && node.parent != nil {
-		node.parent.removeChild(node)
-		delete(m.FS.lookup, node.hash)
+	if node == nil || node.parent == nil {
+		m.FS.mutex.Unlock()
+		return nil
 	}
+	entry := m.journalEntry(JOURNAL_DELETE, JOURNAL_SERVER, ev.User, node, m.FS.pathOf(node))
+	m.FS.noteGone(node)
+	node.parent.removeChild(node)
+	delete(m.FS.lookup, node.hash)
+	delete(m.FS.broken, node.hash)
+	m.FS.mutex.Unlock()
+
+	m.journal(entry)
+	m.emitEvents([]Event{{Type: EVENT_NODE_DELETED, Node: node, Hash: ev.N}})
 	return nil
 }
 
-// Listen for server event notifications and play actions
+// Listen for server event notifications and play actions.  After
+// errors it waits before trying again, twice as long each time up to
+// EVENT_MAX_BACKOFF.  If the server has lost the events since the
+// cursor the tree is fetched again.
 func (m *Mega) pollEvents() {
-	var err error
-	var resp *http.Response
 	sleepTime := minSleepTime // inital backoff time
 	for {
-		if err != nil {
-			m.debugf("pollEvents: error from server", err)
-			backOffSleep(&sleepTime)
-		} else {
+		err := m.pollOnce()
+		if err == ETOOMANY {
+			m.logf("pollEvents: events since %q are lost, reloading the tree", m.EventCursor())
+			err = m.reloadTree()
+		}
+		switch {
+		case err == nil:
 			// reset sleep time to minimum on success
 			sleepTime = minSleepTime
-		}
-
-		url := fmt.Sprintf("%s/sc?sn=%s&sid=%s", m.baseurl, m.ssn, m.sid)
-		resp, err = m.client.Post(url, "application/xml", nil)
-		if err != nil {
-			m.logf("pollEvents: Error fetching status: %s", err)
 			continue
+		case err == EAGAIN:
+			m.debugf("pollEvents: server busy, trying again in %v", sleepTime)
+		default:
+			m.logf("pollEvents: %v, trying again in %v", err, sleepTime)
+		}
+		m.sleep(sleepTime)
+		sleepTime *= 2
+		if sleepTime > EVENT_MAX_BACKOFF {
+			sleepTime = EVENT_MAX_BACKOFF
 		}
+	}
+}
 
-		if resp.StatusCode != 200 {
-			m.logf("pollEvents: Error from server: %s", resp.Status)
-			_ = resp.Body.Close()
-			continue
+// pollOnce fetches the events after the cursor and processes them,
+// moving the cursor on, or waits for some to arrive
+func (m *Mega) pollOnce() error {
+	url := fmt.Sprintf("%s/sc?sn=%s%s", m.getConfig().baseurl, m.EventCursor(), m.authQuery())
+	resp, err := m.client.Post(url, "application/xml", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		_ = resp.Body.Close()
+		return errors.New("Http Status: " + resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		_ = resp.Body.Close()
+		return err
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	// First attempt to parse an array
+	var events Events
+	err = json.Unmarshal(buf, &events)
+	if err != nil {
+		// Try parsing as a lone error message
+		var emsg ErrorMsg
+		err = json.Unmarshal(buf, &emsg)
+		if err != nil || emsg == 0 {
+			m.debugf("pollEvents: Bad response received from server: %s", buf)
+			return EBADRESP
 		}
+		return parseError(emsg)
+	}
 
-		buf, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			m.logf("pollEvents: Error reading body: %v", err)
-			_ = resp.Body.Close()
-			continue
+	// if wait URL is set, then fetch it and continue - we
+	// don't expect anything else if we have a wait URL.
+	if events.W != "" {
+		m.waitEventsFire()
+		if len(events.E) > 0 {
+			m.logf("pollEvents: Unexpected event with w set: %s", buf)
 		}
-		err = resp.Body.Close()
+		resp, err = m.client.Get(events.W)
 		if err != nil {
-			m.logf("pollEvents: Error closing body: %v", err)
-			continue
+			return err
 		}
+		return resp.Body.Close()
+	}
 
-		// body is read and closed here
-
-		// First attempt to parse an array
-		var events Events
-		err = json.Unmarshal(buf, &events)
-		if err != nil {
-			// Try parsing as a lone error message
-			var emsg ErrorMsg
-			err = json.Unmarshal(buf, &emsg)
+	// For each event in the array, parse it
+	for _, evRaw := range events.E {
+		// First attempt to unmarshal as an error message
+		var emsg ErrorMsg
+		err = json.Unmarshal(evRaw, &emsg)
+		if err == nil {
+			m.logf("pollEvents: Error message received %s", evRaw)
+			err = parseError(emsg)
 			if err != nil {
-				m.logf("pollEvents: Bad response received from server: %s", buf)
-			} else {
-				err = parseError(emsg)
-				if err == EAGAIN {
-				} else if err != nil {
-					m.logf("pollEvents: Error received from server: %v", err)
-				}
+				m.logf("pollEvents: Event from server was error: %v", err)
 			}
 			continue
 		}
 
-		// if wait URL is set, then fetch it and continue - we
-		// don't expect anything else if we have a wait URL.
-		if events.W != "" {
-			m.waitEventsFire()
-			if len(events.E) > 0 {
-				m.logf("pollEvents: Unexpected event with w set: %s", buf)
-			}
-			resp, err = m.client.Get(events.W)
-			if err == nil {
-				_ = resp.Body.Close()
-			}
+		// Now unmarshal as a generic event
+		var gev GenericEvent
+		err = json.Unmarshal(evRaw, &gev)
+		if err != nil {
+			m.logf("pollEvents: Couldn't parse event from server: %v: %s", err, evRaw)
 			continue
 		}
-		m.ssn = events.Sn
-
-		// For each event in the array, parse it
-		for _, evRaw := range events.E {
-			// First attempt to unmarshal as an error message
-			var emsg ErrorMsg
-			err = json.Unmarshal(evRaw, &emsg)
-			if err == nil {
-				m.logf("pollEvents: Error message received %s", evRaw)
-				err = parseError(emsg)
-				if err != nil {
-					m.logf("pollEvents: Event from server was error: %v", err)
-				}
-				continue
-			}
+		m.debugf("pollEvents: Parsing event %q: %s", gev.Cmd, evRaw)
+
+		// Work out what to do with the event
+		var process func([]byte) error
+		switch gev.Cmd {
+		case "t": // node addition
+			process = m.processAddNode
+		case "u": // node update
+			process = m.processUpdateNode
+		case "d": // node deletion
+			process = m.processDeleteNode
+		case "s", "s2": // share addition/update/revocation
+			process = m.processShare
+		case "c": // contact addition/update
+			process = m.processContact
+		case "k": // crypto key request
+			process = m.processKeys
+		case "fa": // file attribute update
+		case "ua": // user attribute update
+		case "psts": // account updated
+		case "ipc": // incoming pending contact request (to us)
+		case "opc": // outgoing pending contact request (from us)
+		case "upci": // incoming pending contact request update (accept/deny/ignore)
+		case "upco": // outgoing pending contact request update (from them, accept/deny/ignore)
+		case "ph": // public links handles
+		case "se": // set email
+		case "mcc": // chat creation / peer's invitation / peer's removal
+		case "mcna": // granted / revoked access to a node
+		case "uac": // user access control
+		default:
+			m.debugf("pollEvents: Unknown message %q received: %s", gev.Cmd, evRaw)
+		}
 
-			// Now unmarshal as a generic event
-			var gev GenericEvent
-			err = json.Unmarshal(evRaw, &gev)
+		// process the event if we can
+		if process != nil {
+			err := process(evRaw)
 			if err != nil {
-				m.logf("pollEvents: Couldn't parse event from server: %v: %s", err, evRaw)
-				continue
-			}
-			m.debugf("pollEvents: Parsing event %q: %s", gev.Cmd, evRaw)
-
-			// Work out what to do with the event
-			var process func([]byte) error
-			switch gev.Cmd {
-			case "t": // node addition
-				process = m.processAddNode
-			case "u": // node update
-				process = m.processUpdateNode
-			case "d": // node deletion
-				process = m.processDeleteNode
-			case "s", "s2": // share addition/update/revocation
-			case "c": // contact addition/update
-			case "k": // crypto key request
-			case "fa": // file attribute update
-			case "ua": // user attribute update
-			case "psts": // account updated
-			case "ipc": // incoming pending contact request (to us)
-			case "opc": // outgoing pending contact request (from us)
-			case "upci": // incoming pending contact request update (accept/deny/ignore)
-			case "upco": // outgoing pending contact request update (from them, accept/deny/ignore)
-			case "ph": // public links handles
-			case "se": // set email
-			case "mcc": // chat creation / peer's invitation / peer's removal
-			case "mcna": // granted / revoked access to a node
-			case "uac": // user access control
-			default:
-				m.debugf("pollEvents: Unknown message %q received: %s", gev.Cmd, evRaw)
-			}
-
-			// process the event if we can
-			if process != nil {
-				err := process(evRaw)
-				if err != nil {
-					m.logf("pollEvents: Error processing event %q '%s': %v", gev.Cmd, evRaw, err)
-				}
+				m.logf("pollEvents: Error processing event %q '%s': %v", gev.Cmd, evRaw, err)
 			}
 		}
 	}
+
+	// removals which weren't moves
+	m.FS.mutex.Lock()
+	m.FS.moving = make(map[string]trashOrigin)
+	m.FS.mutex.Unlock()
+
+	// only once they are applied so a saved cursor never skips any
+	m.setCursor(events.Sn)
+	return nil
 }
 
 func (m *Mega) getLink(n *Node) (string, error) {
 	var msg [1]GetLinkMsg
 	var res [1]string
 
+	m.FS.mutex.Lock()
+	err := m.FS.checkAccess(n, ACCESS_OWNER)
+	m.FS.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
 	msg[0].Cmd = "l"
 	msg[0].N = n.GetHash()
+	msg[0].I, err = m.newRequestID()
+	if err != nil {
+		return "", err
+	}
 
 	req, err := json.Marshal(msg)
 	if err != nil {
@@ -2059,7 +3666,7 @@ func (m *Mega) getLink(n *Node) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	err = json.Unmarshal(result, &res)
+	err = m.decodeResponse(result, &res)
 	if err != nil {
 		return "", err
 	}
@@ -3,6 +3,7 @@ package mega
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -137,6 +138,14 @@ func TestGetUser(t *testing.T) {
 	}
 }
 
+func TestGetAccountDetails(t *testing.T) {
+	session := initSession(t)
+	_, err := session.GetAccountDetails()
+	if err != nil {
+		t.Fatal("GetAccountDetails failed", err)
+	}
+}
+
 func TestUploadDownload(t *testing.T) {
 	session := initSession(t)
 	for i := range []int{0, 1} {
@@ -277,10 +286,34 @@ func TestConfig(t *testing.T) {
 
 }
 
+func TestNodeType(t *testing.T) {
+	if FOLDER.String() != "folder" || NodeType(9).String() != "NodeType(9)" {
+		t.Errorf("String: %q, %q", FOLDER, NodeType(9))
+	}
+	if FILE.IsContainer() || !TRASH.IsContainer() || NodeType(9).IsContainer() {
+		t.Errorf("IsContainer wrong")
+	}
+
+	buf, err := json.Marshal([]NodeType{FILE, ROOT})
+	if err != nil || string(buf) != `["file","root"]` {
+		t.Errorf("Marshal: %s, %v", buf, err)
+	}
+	var types []NodeType
+	if err = json.Unmarshal([]byte(`["inbox",1]`), &types); err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0] != INBOX || types[1] != FOLDER {
+		t.Errorf("Unmarshal: %v", types)
+	}
+	if err = json.Unmarshal([]byte(`["link"]`), &types); err == nil {
+		t.Errorf("Unmarshal unknown name: no error")
+	}
+}
+
 func TestPathLookup(t *testing.T) {
 	session := initSession(t)
 
-	rs, err := randString(5)
+	rs, err := randString(rand.Reader, 5)
 	if err != nil {
 		t.Fatalf("failed to make random string: %v", err)
 	}
@@ -412,3 +445,96 @@ func TestWaitEvents(t *testing.T) {
 	// Check nothing happens if we fire the event with no listeners
 	m.waitEventsFire()
 }
+
+func TestAllNodes(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, dir, "a", "a")
+	trashed := uploadString(t, m, root, "b", "b")
+	if err = m.Delete(trashed, false); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := m.FS.AllNodes()
+	if len(nodes) != 5 || nodes[0] != root {
+		t.Fatalf("got %d nodes starting with %q", len(nodes), nodes[0].GetName())
+	}
+	seen := make(map[*Node]bool)
+	for _, n := range nodes {
+		if p := n.parent; p != nil && !seen[p] {
+			t.Errorf("%q before its parent", n.GetName())
+		}
+		seen[n] = true
+	}
+	if !seen[trashed] || !seen[m.FS.GetTrash()] {
+		t.Errorf("trash missing")
+	}
+
+	count := 0
+	m.FS.Range(func(n *Node) bool {
+		count++
+		return !n.IsFile()
+	})
+	if count != 3 {
+		t.Errorf("Range visited %d nodes, want 3", count)
+	}
+}
+
+func TestTreeSize(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := m.CreateDir("sub", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := uploadString(t, m, dir, "a", "12345")
+	c := uploadString(t, m, sub, "c", "123")
+	uploadString(t, m, root, "d", "1")
+
+	check := func(n *Node, size int64, files, folders int) {
+		t.Helper()
+		gotFiles, gotFolders := n.GetTreeCounts()
+		if n.GetTreeSize() != size || gotFiles != files || gotFolders != folders {
+			t.Errorf("%q: size %d, %d files, %d folders, want %d, %d, %d", n.GetName(),
+				n.GetTreeSize(), gotFiles, gotFolders, size, files, folders)
+		}
+	}
+	check(root, 9, 3, 2)
+	check(dir, 8, 2, 1)
+	check(sub, 3, 1, 0)
+	check(a, 5, 0, 0)
+
+	if err = m.Move(sub, root); err != nil {
+		t.Fatal(err)
+	}
+	check(root, 9, 3, 2)
+	check(dir, 5, 1, 0)
+	if err = m.Delete(c, false); err != nil {
+		t.Fatal(err)
+	}
+	check(root, 6, 2, 2)
+	check(m.FS.GetTrash(), 3, 1, 0)
+	if err = m.Delete(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	check(root, 1, 1, 1)
+
+	// Refreshing from the server counts the same
+	if err = m.RefreshNode(root); err != nil {
+		t.Fatal(err)
+	}
+	check(root, 1, 1, 1)
+	check(m.FS.GetTrash(), 3, 1, 0)
+}
@@ -0,0 +1,172 @@
+package mega
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryCache is a cache whose memory counts against the limit set
+// with SetMemoryLimit.  When transfers need room for chunk buffers
+// Shrink is called to free at least n bytes if it can, returning how
+// many it freed, least recently used first being the usual policy.
+//
+// Size and Shrink are called with the memory budget locked so mustn't
+// call back into the Mega.
+type MemoryCache interface {
+	// Size returns the bytes held by the cache
+	Size() int64
+	// Shrink frees at least n bytes if possible
+	Shrink(n int64) int64
+}
+
+// memBudget bounds the memory held by chunk buffers and caches
+type memBudget struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	max     int64 // 0 for unlimited
+	used    int64 // by chunk buffers
+	caches  map[int]MemoryCache
+	next    int
+}
+
+// newMemBudget returns a budget of max bytes, 0 for unlimited
+func newMemBudget(max int64) *memBudget {
+	b := &memBudget{max: max, caches: make(map[int]MemoryCache)}
+	b.changed = sync.NewCond(&b.mu)
+	return b
+}
+
+// setMax changes the limit, shrinking the caches to fit
+func (b *memBudget) setMax(max int64) {
+	b.mu.Lock()
+	b.max = max
+	b.shrink(0)
+	b.changed.Broadcast()
+	b.mu.Unlock()
+}
+
+// cacheSize returns the bytes held by the caches
+//
+// Call with the mutex held
+func (b *memBudget) cacheSize() (size int64) {
+	for _, c := range b.caches {
+		size += c.Size()
+	}
+	return size
+}
+
+// shrink asks the caches to free enough to leave room for n more bytes
+// of buffers, returning true if there is room
+//
+// Call with the mutex held
+func (b *memBudget) shrink(n int64) bool {
+	if b.max <= 0 {
+		return true
+	}
+	over := b.used + b.cacheSize() + n - b.max
+	for _, c := range b.caches {
+		if over <= 0 {
+			break
+		}
+		over -= c.Shrink(over)
+	}
+	return over <= 0
+}
+
+// acquire waits until there is room for a buffer of n bytes, shrinking
+// the caches if needed, or returns the error of ctx once it is done.
+// A buffer bigger than the whole budget is let through when no other
+// buffers are held so transfers can't stall.  A nil budget doesn't
+// limit.
+func (b *memBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.shrink(n) && b.used > 0 {
+		// wake the wait below when ctx is done
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				b.mu.Lock()
+				b.changed.Broadcast()
+				b.mu.Unlock()
+			case <-stop:
+			}
+		}()
+		for !b.shrink(n) && b.used > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			b.changed.Wait()
+		}
+	}
+	b.used += n
+	return nil
+}
+
+// release returns a buffer of n bytes from acquire
+func (b *memBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.changed.Broadcast()
+	b.mu.Unlock()
+}
+
+// register adds c to the caches charged to the budget
+func (b *memBudget) register(c MemoryCache) (unregister func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.caches[id] = c
+	b.shrink(0)
+	return func() {
+		b.mu.Lock()
+		delete(b.caches, id)
+		b.changed.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// SetMemoryLimit bounds the memory used by chunk buffers across all
+// the transfers plus any caches registered with RegisterMemoryCache
+// to about bytes, 0 for unlimited.  Transfers wait for buffers to be
+// freed, after the caches have been shrunk, before fetching or sending
+// each chunk, so a low limit reduces their concurrency.  A transfer
+// whose context is done stops waiting.
+//
+// Chunks returned from DownloadChunk and passed to UploadChunk by the
+// caller aren't counted.  It returns EARGS if bytes is negative.
+func (m *Mega) SetMemoryLimit(bytes int64) error {
+	if bytes < 0 {
+		return EARGS
+	}
+	m.mem.setMax(bytes)
+	return nil
+}
+
+// WithMemoryLimit bounds the memory used by chunk buffers and
+// registered caches, see SetMemoryLimit
+func WithMemoryLimit(bytes int64) Option {
+	return func(m *Mega) error {
+		if bytes < 0 {
+			return EARGS
+		}
+		m.mem.setMax(bytes)
+		return nil
+	}
+}
+
+// RegisterMemoryCache charges the memory held by c to the limit set
+// with SetMemoryLimit, shrinking it when transfers need buffers.  It
+// returns a function which removes it.
+func (m *Mega) RegisterMemoryCache(c MemoryCache) (unregister func()) {
+	return m.mem.register(c)
+}
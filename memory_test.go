@@ -0,0 +1,130 @@
+package mega
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCache is a MemoryCache holding size bytes
+type fakeCache struct {
+	size int64
+}
+
+func (c *fakeCache) Size() int64 {
+	return c.size
+}
+
+func (c *fakeCache) Shrink(n int64) int64 {
+	if n > c.size {
+		n = c.size
+	}
+	c.size -= n
+	return n
+}
+
+func TestMemBudget(t *testing.T) {
+	ctx := context.Background()
+	b := newMemBudget(100)
+	c := &fakeCache{size: 80}
+	unregister := b.register(c)
+
+	// The cache gives way to buffers
+	_ = b.acquire(ctx, 50)
+	if c.size != 50 {
+		t.Errorf("cache is %d bytes, want 50", c.size)
+	}
+
+	// Buffers wait for each other once the cache is empty
+	_ = b.acquire(ctx, 50)
+	if c.size != 0 {
+		t.Errorf("cache is %d bytes, want 0", c.size)
+	}
+	var mu sync.Mutex
+	acquired := false
+	go func() {
+		_ = b.acquire(ctx, 10)
+		mu.Lock()
+		acquired = true
+		mu.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	if acquired {
+		t.Errorf("acquired over the limit")
+	}
+	mu.Unlock()
+
+	// Waiting stops when the context is done
+	cctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error)
+	go func() {
+		errc <- b.acquire(cctx, 10)
+	}()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("acquire after cancel: %v", err)
+	}
+
+	b.release(50)
+	waitFor(t, "acquire", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return acquired
+	})
+	b.release(50)
+	b.release(10)
+
+	// A buffer bigger than the limit gets through on its own
+	_ = b.acquire(ctx, 1000)
+	b.release(1000)
+
+	unregister()
+	b.setMax(0)
+	_ = b.acquire(ctx, 1<<40)
+	b.release(1 << 40)
+}
+
+func TestMemoryLimitTransfers(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if err := m.SetMemoryLimit(-1); err != EARGS {
+		t.Errorf("SetMemoryLimit(-1): %v", err)
+	}
+	if err := m.SetMemoryLimit(64 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeCache{size: 32 * 1024}
+	defer m.RegisterMemoryCache(c)()
+
+	dir, err := ioutil.TempDir("", "mega-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "big", 1024*1024)
+	n, err := m.UploadFile(filepath.Join(dir, "big"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "back")
+	if err = m.DownloadFile(n, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil || string(got) != string(data) {
+		t.Errorf("downloaded data differs: %v", err)
+	}
+	m.mem.mu.Lock()
+	if m.mem.used != 0 {
+		t.Errorf("%d bytes of buffers not released", m.mem.used)
+	}
+	m.mem.mu.Unlock()
+	if c.size != 0 {
+		t.Errorf("cache not shrunk: %d bytes", c.size)
+	}
+}
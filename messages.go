@@ -54,6 +54,8 @@ type QuotaMsg struct {
 	Xfer int `json:"xfer"`
 	// Without strg=1 only reports total capacity for account
 	Strg int `json:"strg,omitempty"`
+	// pro=1 adds the plan and subscription details
+	Pro int `json:"pro,omitempty"`
 }
 
 type QuotaResp struct {
@@ -63,24 +65,50 @@ type QuotaResp struct {
 	Cstrg uint64 `json:"cstrg"`
 	// Per folder usage in bytes?
 	Cstrgn map[string][]int64 `json:"cstrgn"`
+	// Utype is the pro level of the account (only with pro=1)
+	Utype int `json:"utype"`
+	// Stype is the subscription type: "S" valid, "R" invalid, "O" none
+	Stype string `json:"stype"`
+	// Scycle is the subscription billing cycle, eg "1 M" or "1 Y"
+	Scycle string `json:"scycle"`
+	// Suntil is the unix time the pro plan expires
+	Suntil int64 `json:"suntil"`
+	// Srenew holds the unix times the subscription renews
+	Srenew []int64 `json:"srenew"`
+	// Mxfer is the transfer quota in bytes for accounts with a fixed quota
+	Mxfer uint64 `json:"mxfer"`
+	// Caxfer is the transfer quota used by the account's own downloads
+	Caxfer uint64 `json:"caxfer"`
+	// Csxfer is the transfer quota used serving others
+	Csxfer uint64 `json:"csxfer"`
+	// Tal is the transfer limit of accounts with a rolling quota
+	Tal uint64 `json:"tal"`
+	// Tah is the transfer used per hour in the rolling quota window
+	Tah []uint64 `json:"tah"`
 }
 
 type FilesMsg struct {
 	Cmd string `json:"a"`
 	C   int    `json:"c"`
+	R   int    `json:"r,omitempty"`
+	// N fetches only the folder with this handle and its children
+	N string `json:"n,omitempty"`
 }
 
 type FSNode struct {
-	Hash   string `json:"h"`
-	Parent string `json:"p"`
-	User   string `json:"u"`
-	T      int    `json:"t"`
-	Attr   string `json:"a"`
-	Key    string `json:"k"`
-	Ts     int64  `json:"ts"`
-	SUser  string `json:"su"`
-	SKey   string `json:"sk"`
-	Sz     int64  `json:"s"`
+	Hash   string   `json:"h"`
+	Parent string   `json:"p"`
+	User   string   `json:"u"`
+	T      NodeType `json:"t"`
+	Attr   string   `json:"a"`
+	Key    string   `json:"k"`
+	Ts     int64    `json:"ts"`
+	SUser  string   `json:"su"`
+	SKey   string   `json:"sk"`
+	Sz     int64    `json:"s"`
+	Fa     string   `json:"fa"`
+	// access level of an incoming share root
+	R *int `json:"r,omitempty"`
 }
 
 type FilesResp struct {
@@ -95,21 +123,90 @@ type FilesResp struct {
 		Hash string `json:"h"`
 		User string `json:"u"`
 	} `json:"s"`
-	User []struct {
-		User  string `json:"u"`
-		C     int    `json:"c"`
-		Email string `json:"m"`
-	} `json:"u"`
-	Sn string `json:"sn"`
+	User []ContactUser `json:"u"`
+	Sn   string        `json:"sn"`
+	// Public links to the nodes
+	Ph []PublicLinkResp `json:"ph"`
+}
+
+// PublicLinkResp describes a node exported with a public link
+type PublicLinkResp struct {
+	Hash         string `json:"h"`
+	PublicHandle string `json:"ph"`
+	// Ts is the unix time the link was made
+	Ts int64 `json:"ts"`
+	// Ets is the unix time the link expires, 0 if it doesn't
+	Ets int64 `json:"ets"`
+	// Down is set if the link has been taken down
+	Down int `json:"down"`
 }
 
+// FileAttr is the decrypted attributes of a node
 type FileAttr struct {
 	Name string `json:"n"`
+	// Fingerprint of the contents set by the official clients
+	Fingerprint string `json:"c,omitempty"`
+	// Any other attributes by key as raw JSON, such as labels set by
+	// other clients or the custom attributes set with SetAttr
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type GetLinkMsg struct {
 	Cmd string `json:"a"`
 	N   string `json:"n"`
+	W   string `json:"w,omitempty"`
+	I   string `json:"i,omitempty"`
+}
+
+// WritableLinkResp is the response to GetLinkMsg with w=1
+type WritableLinkResp struct {
+	Ph string `json:"ph"`
+	W  string `json:"w"`
+}
+
+// ShareUser is the user and access level for a share
+type ShareUser struct {
+	U string `json:"u"`
+	R int    `json:"r"`
+}
+
+// ShareMsg creates or updates a share of the folder N
+//
+// Cr holds the node keys encrypted with the share key as
+// [[share handles], [node handles], [share index, node index, key, ...]]
+type ShareMsg struct {
+	Cmd string        `json:"a"`
+	N   string        `json:"n"`
+	S   []ShareUser   `json:"s"`
+	Ok  string        `json:"ok"`
+	Ha  string        `json:"ha"`
+	Cr  []interface{} `json:"cr,omitempty"`
+	I   string        `json:"i"`
+}
+
+// KeyMsg asks for or supplies keys (a=k)
+//
+// Sr asks the owners of the shares listed for their share keys, or
+// answers such a request as [share handle, user handle, key, ...] with
+// each key RSA encrypted to the user.  Cr asks for the keys of nodes in
+// shares as [[share handles], [node handles]] or supplies them in the
+// same format as ShareMsg.
+type KeyMsg struct {
+	Cmd string        `json:"a"`
+	Sr  []string      `json:"sr,omitempty"`
+	Cr  []interface{} `json:"cr,omitempty"`
+	I   string        `json:"i"`
+}
+
+// PubKeyMsg fetches the RSA public key of user U (a=uk)
+type PubKeyMsg struct {
+	Cmd string `json:"a"`
+	U   string `json:"u"`
+}
+
+type PubKeyResp struct {
+	U    string `json:"u"`
+	Pubk string `json:"pubk"`
 }
 
 type DownloadMsg struct {
@@ -125,6 +222,7 @@ type DownloadResp struct {
 	Size uint64   `json:"s"`
 	Attr string   `json:"at"`
 	Err  ErrorMsg `json:"e"`
+	IP   []string `json:"ip"` // addresses of the storage servers
 }
 
 type UploadMsg struct {
@@ -146,7 +244,10 @@ type UploadCompleteMsg struct {
 		A string `json:"a"`
 		K string `json:"k"`
 	} `json:"n"`
-	I string `json:"i,omitempty"`
+	// Cr supplies the key of the new node encrypted with the key of
+	// each share it is in, in the same format as ShareMsg
+	Cr []interface{} `json:"cr,omitempty"`
+	I  string        `json:"i,omitempty"`
 }
 
 type UploadCompleteResp struct {
@@ -159,11 +260,16 @@ type FileInfoMsg struct {
 	P   string `json:"p"`
 }
 
+// MoveFileMsg moves the node N into the folder T
+//
+// Cr supplies the keys of the nodes moved into shares in the same
+// format as ShareMsg.
 type MoveFileMsg struct {
-	Cmd string `json:"a"`
-	N   string `json:"n"`
-	T   string `json:"t"`
-	I   string `json:"i"`
+	Cmd string        `json:"a"`
+	N   string        `json:"n"`
+	T   string        `json:"t"`
+	Cr  []interface{} `json:"cr,omitempty"`
+	I   string        `json:"i"`
 }
 
 type FileAttrMsg struct {
@@ -174,12 +280,36 @@ type FileAttrMsg struct {
 	I    string `json:"i"`
 }
 
+// FileAttrGetMsg asks where to fetch the file attributes Fah, their
+// handles concatenated, from
+type FileAttrGetMsg struct {
+	Cmd string `json:"a"`
+	Fah string `json:"fah"`
+	SSL int    `json:"ssl,omitempty"`
+	R   int    `json:"r"`
+}
+
+// FileAttrPutMsg sets the file attribute Fa, "type*value", of the
+// node N
+type FileAttrPutMsg struct {
+	Cmd string `json:"a"`
+	N   string `json:"n"`
+	Fa  string `json:"fa"`
+}
+
 type FileDeleteMsg struct {
 	Cmd string `json:"a"`
 	N   string `json:"n"`
 	I   string `json:"i"`
 }
 
+// NodeKeysMsg replaces the keys of nodes, Nk holding pairs of node
+// handle and key encrypted with the master key (a=k)
+type NodeKeysMsg struct {
+	Cmd string   `json:"a"`
+	Nk  []string `json:"nk"`
+}
+
 // GenericEvent is a generic event for parsing the Cmd type before
 // decoding more specifically
 type GenericEvent struct {
@@ -207,6 +337,19 @@ type FSEvent struct {
 	I    string `json:"i"`
 }
 
+// ContactUser is a user the account knows of
+type ContactUser struct {
+	User  string `json:"u"`
+	C     int    `json:"c"`
+	Email string `json:"m"`
+}
+
+// ContactEvent - event for contacts added or updated (a=c)
+type ContactEvent struct {
+	Cmd string        `json:"a"`
+	U   []ContactUser `json:"u"`
+}
+
 // Events is received from a poll of the server to read the events
 //
 // Each event can be an error message or a different field so we delay
@@ -216,3 +359,66 @@ type Events struct {
 	Sn string            `json:"sn"`
 	E  []json.RawMessage `json:"a"`
 }
+
+// UserAlertMsg is a single user alert as returned by sc?c=50
+type UserAlertMsg struct {
+	Type  string `json:"a"`
+	Td    int64  `json:"td"`
+	User  string `json:"u"`
+	Email string `json:"m"`
+	N     string `json:"n"`
+	F     []struct {
+		H string `json:"h"`
+		T int    `json:"t"`
+	} `json:"f"`
+}
+
+// UserAlertsResp is the response from sc?c=50
+type UserAlertsResp struct {
+	C []json.RawMessage `json:"c"`
+	U []struct {
+		User  string `json:"u"`
+		Email string `json:"m"`
+	} `json:"u"`
+	Lsn string `json:"lsn"`
+}
+
+// UserAlertsAckMsg acknowledges the user alerts as seen
+type UserAlertsAckMsg struct {
+	Cmd string `json:"a"`
+	I   string `json:"i"`
+}
+
+// SessionListMsg lists the sessions of the account (a=usl)
+//
+// The reply is a list of [created, last active, user agent, ip,
+// country, current, session handle, alive] for each session.
+type SessionListMsg struct {
+	Cmd string `json:"a"`
+	X   int    `json:"x"`
+}
+
+// KeyEvent is a crypto key request or reply (a=k)
+//
+// Sr lists share handle, user handle pairs of users asking for the key
+// of one of our shares.  Cr is [[share handles], [node handles]] asking
+// for the keys of nodes in our shares, or has a third element of
+// [share index, node index, key, ...] supplying them.
+type KeyEvent struct {
+	Cmd string            `json:"a"`
+	Sr  []string          `json:"sr"`
+	Cr  []json.RawMessage `json:"cr"`
+}
+
+// ShareEvent - event for share addition/update/revocation (a=s or a=s2)
+//
+// R is missing when the share is revoked
+type ShareEvent struct {
+	Cmd   string `json:"a"`
+	N     string `json:"n"`
+	Owner string `json:"o"`
+	User  string `json:"u"`
+	R     *int   `json:"r"`
+	Key   string `json:"k"`
+	Ts    int64  `json:"ts"`
+}
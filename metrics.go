@@ -0,0 +1,149 @@
+package mega
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// counter indexes the counters in metrics
+type counter int
+
+const (
+	apiRequests counter = iota
+	apiRetries
+	apiErrors
+	downloadChunks
+	downloadBytes
+	downloadRetries
+	uploadChunks
+	uploadBytes
+	uploadRetries
+	uploadBytesSaved
+	numCounters
+)
+
+// metrics counts the API calls and transfers of a Mega
+type metrics struct {
+	c      [numCounters]int64
+	active int64 // UnixNano of the last successful API request
+}
+
+// add adds n to counter i.  A nil metrics doesn't count.
+func (s *metrics) add(i counter, n int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.c[i], n)
+}
+
+// get returns counter i
+func (s *metrics) get(i counter) int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.c[i])
+}
+
+// touch records a successful API request at now
+func (s *metrics) touch(now time.Time) {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.active, now.UnixNano())
+}
+
+// lastActive returns the time of the last successful API request, the
+// zero time if there hasn't been one
+func (s *metrics) lastActive() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	t := atomic.LoadInt64(&s.active)
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// Stats is a snapshot of the counters of a Mega since it was created
+type Stats struct {
+	// API requests made, not counting retries
+	APIRequests int64
+	// API requests retried
+	APIRetries int64
+	// API requests which failed
+	APIErrors int64
+	// Chunks and bytes downloaded and download chunk retries
+	DownloadChunks  int64
+	DownloadBytes   int64
+	DownloadRetries int64
+	// Chunks and bytes uploaded and upload chunk retries
+	UploadChunks  int64
+	UploadBytes   int64
+	UploadRetries int64
+	// Bytes not uploaded as the file was copied on the server instead
+	UploadBytesSaved int64
+}
+
+// Stats returns the counters of API calls and transfers
+func (m *Mega) Stats() Stats {
+	s := m.metrics
+	return Stats{
+		APIRequests:     s.get(apiRequests),
+		APIRetries:      s.get(apiRetries),
+		APIErrors:       s.get(apiErrors),
+		DownloadChunks:  s.get(downloadChunks),
+		DownloadBytes:   s.get(downloadBytes),
+		DownloadRetries: s.get(downloadRetries),
+		UploadChunks:    s.get(uploadChunks),
+		UploadBytes:     s.get(uploadBytes),
+		UploadRetries:   s.get(uploadRetries),
+
+		UploadBytesSaved: s.get(uploadBytesSaved),
+	}
+}
+
+// PublishExpvar publishes the Stats under name with the expvar
+// package so they appear on /debug/vars.  Like expvar.Publish it
+// panics if name is already in use.
+func (m *Mega) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Stats()
+	}))
+}
+
+// metricDescs describes the counters for WriteMetrics
+var metricDescs = []struct {
+	name string
+	help string
+	c    counter
+}{
+	{"api_requests_total", "API requests made, not counting retries.", apiRequests},
+	{"api_retries_total", "API requests retried.", apiRetries},
+	{"api_errors_total", "API requests which failed.", apiErrors},
+	{"download_chunks_total", "Chunks downloaded.", downloadChunks},
+	{"download_bytes_total", "Bytes downloaded.", downloadBytes},
+	{"download_retries_total", "Download chunk requests retried.", downloadRetries},
+	{"upload_chunks_total", "Chunks uploaded.", uploadChunks},
+	{"upload_bytes_total", "Bytes uploaded.", uploadBytes},
+	{"upload_retries_total", "Upload chunk requests retried.", uploadRetries},
+	{"upload_bytes_saved_total", "Bytes not uploaded as the file was copied on the server instead.", uploadBytesSaved},
+}
+
+// WriteMetrics writes the Stats to w as counters in the Prometheus
+// text exposition format with names starting with prefix, say
+// "mega_", so an HTTP handler can serve them for scraping without
+// this package depending on the Prometheus client.
+func (m *Mega) WriteMetrics(w io.Writer, prefix string) error {
+	for _, d := range metricDescs {
+		name := prefix + d.name
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, d.help, name, name, m.metrics.get(d.c))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	start := m.Stats()
+	n := uploadString(t, m, m.FS.GetRoot(), "f.txt", "some data")
+	var w memWriterAt
+	if err := m.DownloadTo(n, &w, nil); err != nil || string(w.buf) != "some data" {
+		t.Fatalf("read %q: %v", w.buf, err)
+	}
+	_, err := m.CreateDir("x", m.FS.HashLookup("NOSUCHND"))
+	if err == nil {
+		t.Fatal("CreateDir in a missing folder succeeded")
+	}
+
+	s := m.Stats()
+	if s.APIRequests <= start.APIRequests || s.UploadChunks != 1 || s.UploadBytes != 9 ||
+		s.DownloadChunks != 1 || s.DownloadBytes != 9 {
+		t.Errorf("stats %+v", s)
+	}
+
+	var buf bytes.Buffer
+	if err = m.WriteMetrics(&buf, "mega_"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE mega_upload_bytes_total counter\n",
+		"\nmega_upload_bytes_total 9\n",
+		fmt.Sprintf("\nmega_api_requests_total %d\n", s.APIRequests),
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	m.PublishExpvar("mega_test_metrics")
+	var got Stats
+	if err = json.Unmarshal([]byte(expvar.Get("mega_test_metrics").String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.DownloadBytes != 9 {
+		t.Errorf("expvar gave %+v", got)
+	}
+}
@@ -0,0 +1,564 @@
+package mega
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DeletePolicy says what a Mirror does with a local file whose remote
+// copy has been deleted
+type DeletePolicy int
+
+// Delete policies
+const (
+	// Remove the local file
+	DELETE_REMOVE DeletePolicy = iota
+	// Leave the local file where it is and stop tracking it
+	DELETE_KEEP
+	// Move the local file into the Mirror's ArchiveDir
+	DELETE_ARCHIVE
+)
+
+// Mirror keeps a local directory as a read replica of a MEGA folder.
+//
+// Sync does a single pass, Watch follows the server event stream and
+// applies remote changes as they happen.  New and changed files are
+// downloaded and deleted files handled according to Policy.  Local
+// files which have been modified since they were downloaded are never
+// removed.
+//
+// If a file has changed both locally and remotely since it was last
+// synced the local version is renamed to a conflict copy such as
+// "report (conflict 2006-01-02 user).txt" before the remote version is
+// downloaded.
+//
+// A remote file keeps its handle when it is moved or renamed, so one
+// found under a new path is moved or renamed locally rather than
+// removed and downloaded again.
+type Mirror struct {
+	m      *Mega
+	remote *Node
+	local  string
+	state  StateStore
+	conflictReport
+	skipReport
+
+	// Policy for local files whose remote copy has gone
+	Policy DeletePolicy
+	// ArchiveDir receives deleted files for DELETE_ARCHIVE
+	ArchiveDir string
+	// Debounce is how long Watch waits for remote changes to settle
+	// before applying them, 0 for SYNC_DEBOUNCE
+	Debounce time.Duration
+	// Dedupe says whether files with the same contents as one already
+	// downloaded are linked or copied from it instead, which needs
+	// the fingerprints set by the official clients.  It defaults to
+	// the WithDownloadDedupe setting.
+	Dedupe DedupeMode
+	// FailureThreshold stops a pass once this many files have failed,
+	// 0 to carry on regardless.  It defaults to the
+	// WithFailureThreshold setting.
+	FailureThreshold int
+	// Selection picks the folders synced, all of them if nil
+	Selection *Selection
+
+	// remote files by contents for Dedupe
+	dupes map[string][]duplicate
+	// results of the current pass, nil outside Sync
+	report *Report
+
+	// set while Plan is running to record the actions instead
+	plan *Plan
+}
+
+// NewMirror returns a Mirror which replicates the remote folder into
+// the local directory, creating it if necessary.  If state is nil the
+// mirror state is only kept in memory.
+func (m *Mega) NewMirror(remote *Node, local string, state StateStore) (*Mirror, error) {
+	if remote == nil || (remote.GetType() != FOLDER && remote.GetType() != ROOT) {
+		return nil, EARGS
+	}
+	local = longPath(local)
+	err := os.MkdirAll(local, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &JSONStateStore{states: make(map[string]FileState)}
+	}
+	return &Mirror{
+		m:      m,
+		remote: remote,
+		local:  local,
+		state:  state,
+		Dedupe: m.getConfig().dedupe,
+
+		FailureThreshold: m.getConfig().failureThreshold,
+	}, nil
+}
+
+// localPath returns the local path of rel
+func (mr *Mirror) localPath(rel string) string {
+	return filepath.Join(mr.local, localRel(rel))
+}
+
+// safeName returns false for remote names which can't be used as a
+// single local path element
+func safeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(localName(name), `/\`)
+}
+
+// remoteTree returns the files below the remote folder by relative
+// path and the folders in parent first order
+func (mr *Mirror) remoteTree() (files map[string]*Node, dirs []string) {
+	files = make(map[string]*Node)
+
+	mr.m.FS.mutex.Lock()
+	defer mr.m.FS.mutex.Unlock()
+
+	var walk func(n *Node, rel string)
+	walk = func(n *Node, rel string) {
+		seen := make(map[string]bool, len(n.children))
+		for _, c := range n.children {
+			if !safeName(c.name) {
+				mr.m.logf("mirror: skipping %q in %q: unsafe name", c.name, rel)
+				mr.report.add(path.Join(rel, c.name), ITEM_SKIPPED, EARGS)
+				continue
+			}
+			if !mr.Selection.Selected(path.Join(rel, c.name)) {
+				continue
+			}
+			key := localKey(c.name)
+			if seen[key] {
+				mr.m.logf("mirror: skipping duplicate %q in %q", c.name, rel)
+				mr.report.add(path.Join(rel, c.name), ITEM_SKIPPED, EEXIST)
+				continue
+			}
+			seen[key] = true
+			p := path.Join(rel, c.name)
+			switch c.ntype {
+			case FILE:
+				files[p] = c
+			case FOLDER:
+				dirs = append(dirs, p)
+				walk(c, p)
+			}
+		}
+	}
+	walk(mr.remote, "")
+	return files, dirs
+}
+
+// fetch downloads the remote file n to rel if it differs from what
+// was last downloaded there.  Files which keep failing are skipped.
+func (mr *Mirror) fetch(rel string, n *Node) (err error) {
+	dst := mr.localPath(rel)
+	st, ok, err := mr.state.Get(rel)
+	if err != nil {
+		return err
+	}
+	version := n.GetHash()
+	if mr.skip(st, ok, version) {
+		mr.m.logf("mirror: skipping %q: failed %d times: %s", rel, st.Failures, st.Error)
+		mr.report.add(rel, ITEM_SKIPPED, fmt.Errorf("failed %d times: %s", st.Failures, st.Error))
+		return nil
+	}
+	if mr.plan == nil {
+		defer func() {
+			if err != nil {
+				if ferr := recordFailure(mr.state, rel, version, err); ferr != nil {
+					mr.m.logf("mirror: %q: recording failure: %v", rel, ferr)
+				}
+			}
+		}()
+	}
+	ok = ok && st.synced()
+	if ok {
+		fi, err := os.Stat(dst)
+		switch {
+		case err != nil:
+		case st.Hash == n.GetHash() && st.Unchanged(fi):
+			return nil
+		case st.Hash != n.GetHash() && !st.Unchanged(fi):
+			err = mr.conflict(rel)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if mr.plan != nil {
+		mr.plan.add(Action{Type: ACTION_DOWNLOAD, Path: rel, Size: n.GetSize()})
+		return nil
+	}
+
+	// Download alongside then rename so the local file is never
+	// half written
+	tmp := dst + ".mega-tmp"
+	linked, copied := false, false
+	if src := mr.localCopy(rel, n); src != "" {
+		mr.m.debugf("mirror: %q has the same contents as %q", rel, src)
+		linked, err = mr.dedupe(src, tmp)
+		copied = err == nil
+	}
+	if !copied {
+		mr.m.debugf("mirror: downloading %q", rel)
+		err = mr.m.DownloadFile(n, tmp, nil)
+		if err != nil {
+			return err
+		}
+	}
+	// A link shares its times with the original
+	if !linked {
+		ts := n.GetTimeStamp()
+		err = os.Chtimes(tmp, ts, ts)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	mr.report.add(rel, ITEM_DONE, nil)
+	return mr.state.Put(FileState{
+		Path:     rel,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		Hash:     n.GetHash(),
+		SyncTime: mr.m.now(),
+	})
+}
+
+// conflict renames the local file rel which has changed on both sides
+// to a conflict copy
+func (mr *Mirror) conflict(rel string) error {
+	now := mr.m.now()
+	cname := conflictName(rel, now, mr.user(), func(p string) bool {
+		_, err := os.Lstat(mr.localPath(p))
+		return err == nil
+	})
+	if mr.plan != nil {
+		mr.plan.add(Action{Type: ACTION_CONFLICT, Path: rel, To: cname})
+		return nil
+	}
+	mr.m.logf("mirror: %q changed on both sides, saving local version as %q", rel, cname)
+
+	err := os.Rename(mr.localPath(rel), mr.localPath(cname))
+	if err != nil {
+		return err
+	}
+	mr.add(Conflict{Path: rel, ConflictPath: cname, Time: now})
+	return nil
+}
+
+// followMoves moves or renames the local copies of the remote files
+// in files found under a new path, returning the old paths by the new.
+// Files which fail to move are logged and left to be downloaded again.
+func (mr *Mirror) followMoves(files map[string]*Node) (map[string]string, error) {
+	byHash := make(map[string]FileState)
+	err := mr.state.Walk(func(st FileState) error {
+		if _, ok := files[st.Path]; !ok && st.synced() {
+			byHash[st.Hash] = st
+		}
+		return nil
+	})
+	if err != nil || len(byHash) == 0 {
+		return nil, err
+	}
+
+	moved := make(map[string]string)
+	for rel, n := range files {
+		st, ok := byHash[n.GetHash()]
+		if !ok {
+			continue
+		}
+		if _, tracked, err := mr.state.Get(rel); err != nil || tracked {
+			continue
+		}
+		if _, err := os.Lstat(mr.localPath(rel)); !os.IsNotExist(err) {
+			continue
+		}
+		// a local copy changed since is left to the delete policy
+		fi, err := os.Lstat(mr.localPath(st.Path))
+		if err != nil || !st.Unchanged(fi) {
+			continue
+		}
+		if mr.plan != nil {
+			mr.plan.add(Action{Type: ACTION_LOCAL_MOVE, Path: st.Path, To: rel})
+			moved[rel] = st.Path
+			continue
+		}
+
+		mr.m.debugf("mirror: moving %q to %q", st.Path, rel)
+		err = os.MkdirAll(filepath.Dir(mr.localPath(rel)), 0755)
+		if err == nil {
+			err = os.Rename(mr.localPath(st.Path), mr.localPath(rel))
+		}
+		if err == nil {
+			err = mr.state.Delete(st.Path)
+		}
+		if err == nil {
+			moved[rel] = st.Path
+			st.Path = rel
+			st.SyncTime = mr.m.now()
+			err = mr.state.Put(st)
+		}
+		if err != nil {
+			mr.m.logf("mirror: moving %q to %q: %v", moved[rel], rel, err)
+			continue
+		}
+		mr.report.add(rel, ITEM_DONE, nil)
+	}
+	return moved, nil
+}
+
+// removeLocal applies the delete policy to the local file with state
+// st whose remote copy has gone
+func (mr *Mirror) removeLocal(st FileState) error {
+	if !st.synced() {
+		// only failures were recorded
+		if mr.plan != nil {
+			return nil
+		}
+		return mr.state.Delete(st.Path)
+	}
+	p := mr.localPath(st.Path)
+	fi, err := os.Lstat(p)
+	switch {
+	case os.IsNotExist(err) && mr.plan != nil:
+		return nil
+	case os.IsNotExist(err):
+		return mr.state.Delete(st.Path)
+	case err != nil:
+		return err
+	case !st.Unchanged(fi):
+		if mr.plan != nil {
+			return nil
+		}
+		mr.m.logf("mirror: keeping %q: changed locally", st.Path)
+		return mr.state.Delete(st.Path)
+	}
+
+	if mr.plan != nil {
+		switch mr.Policy {
+		case DELETE_REMOVE:
+			mr.plan.add(Action{Type: ACTION_LOCAL_DELETE, Path: st.Path, Size: fi.Size()})
+		case DELETE_ARCHIVE:
+			mr.plan.add(Action{Type: ACTION_LOCAL_ARCHIVE, Path: st.Path, To: filepath.Join(mr.ArchiveDir, localRel(st.Path)), Size: fi.Size()})
+		}
+		return nil
+	}
+
+	switch mr.Policy {
+	case DELETE_REMOVE:
+		mr.m.debugf("mirror: removing %q", st.Path)
+		err = os.Remove(p)
+	case DELETE_ARCHIVE:
+		if mr.ArchiveDir == "" {
+			return EARGS
+		}
+		dst := filepath.Join(mr.ArchiveDir, localRel(st.Path))
+		mr.m.debugf("mirror: archiving %q to %q", st.Path, dst)
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			err = os.Rename(p, dst)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	mr.report.add(st.Path, ITEM_DONE, nil)
+	return mr.state.Delete(st.Path)
+}
+
+// Sync makes a single pass downloading new and changed files,
+// creating folders and applying the delete policy to files which
+// have gone from the remote folder.
+//
+// Errors on individual files are logged and the pass carries on, the
+// first one is returned.  After FailureThreshold failures the pass
+// stops with ETOOMANYFAILURES.
+func (mr *Mirror) Sync() error {
+	_, err := mr.SyncReport()
+	return err
+}
+
+// SyncReport is Sync returning a report of what happened to each file
+// it acted on
+func (mr *Mirror) SyncReport() (*Report, error) {
+	report := newReport(mr.FailureThreshold)
+	mr.report = report
+	defer func() {
+		mr.report = nil
+	}()
+	err := mr.sync()
+	if report.Aborted {
+		err = ETOOMANYFAILURES
+	}
+	return report, err
+}
+
+// sync makes a single pass for Sync, stopping at the failure
+// threshold
+func (mr *Mirror) sync() error {
+	var firstErr error
+	fail := func(rel string, err error) bool {
+		mr.m.logf("mirror: %q: %v", rel, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		return mr.report.add(rel, ITEM_FAILED, err)
+	}
+	done := func() error {
+		err := flushState(mr.state)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return firstErr
+	}
+
+	err := mr.m.LoadTree(mr.remote)
+	if err != nil {
+		return err
+	}
+	files, dirs := mr.remoteTree()
+	mr.indexDuplicates(files)
+	for _, rel := range dirs {
+		if mr.plan != nil {
+			if _, err := os.Stat(mr.localPath(rel)); os.IsNotExist(err) {
+				mr.plan.add(Action{Type: ACTION_LOCAL_MKDIR, Path: rel})
+			}
+			continue
+		}
+		err := os.MkdirAll(mr.localPath(rel), 0755)
+		if err != nil && fail(rel, err) {
+			return done()
+		}
+	}
+	moved, err := mr.followMoves(files)
+	if err != nil {
+		return err
+	}
+	movedFrom := make(map[string]bool, len(moved))
+	for _, from := range moved {
+		movedFrom[from] = true
+	}
+	paths := make([]string, 0, len(files))
+	for rel := range files {
+		if _, ok := moved[rel]; !ok || mr.plan == nil {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		err := mr.fetch(rel, files[rel])
+		if err != nil && fail(rel, err) {
+			return done()
+		}
+	}
+
+	var gone []FileState
+	err = mr.state.Walk(func(st FileState) error {
+		if _, ok := files[st.Path]; !ok && !movedFrom[st.Path] {
+			gone = append(gone, st)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, st := range gone {
+		switch {
+		case !mr.Selection.Selected(st.Path) && mr.plan != nil:
+			continue
+		case !mr.Selection.Selected(st.Path):
+			// left out by the selection rather than deleted
+			err = mr.state.Delete(st.Path)
+		default:
+			err = mr.removeLocal(st)
+		}
+		if err != nil && fail(st.Path, err) {
+			return done()
+		}
+	}
+	return done()
+}
+
+// inTree returns true if n is the remote folder or below it
+func (mr *Mirror) inTree(n *Node) bool {
+	mr.m.FS.mutex.Lock()
+	defer mr.m.FS.mutex.Unlock()
+	for ; n != nil; n = n.parent {
+		if n == mr.remote {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch syncs once then applies remote changes received from the
+// server until ctx is cancelled.  Bursts of changes are applied
+// together once none have arrived for Debounce.
+func (mr *Mirror) Watch(ctx context.Context) error {
+	changed := make(chan struct{}, 1)
+	unsubscribe := mr.m.Subscribe(func(ev Event) {
+		// Deleted nodes have left the tree so can't be checked
+		if ev.Type != EVENT_NODE_DELETED && !mr.inTree(ev.Node) {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	err := mr.Sync()
+	if err != nil {
+		mr.m.logf("mirror: initial sync: %v", err)
+	}
+
+	debounce := mr.Debounce
+	if debounce <= 0 {
+		debounce = SYNC_DEBOUNCE
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+			settled = mr.m.after(debounce)
+		case <-settled:
+			settled = nil
+			err = mr.Sync()
+			if err != nil {
+				mr.m.logf("mirror: %v", err)
+			}
+		}
+	}
+}
+
+// Plan does a dry run of Sync returning what it would do without
+// changing anything locally or in the mirror state.  Don't call it
+// while Sync or Watch are running.
+func (mr *Mirror) Plan() (*Plan, error) {
+	mr.plan = &Plan{}
+	defer func() {
+		mr.plan = nil
+	}()
+	err := mr.Sync()
+	return mr.plan, err
+}
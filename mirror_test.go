@@ -0,0 +1,199 @@
+package mega
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// uploadString uploads data as name into parent
+func uploadString(t *testing.T, m *Mega, parent *Node, name, data string) *Node {
+	f, err := ioutil.TempFile("", "mega-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(data)
+	_ = f.Close()
+
+	n, err := m.UploadFile(f.Name(), parent, name, nil)
+	if err != nil {
+		t.Fatalf("upload %q: %v", name, err)
+	}
+	return n
+}
+
+// readString returns the contents of a local file or "" if missing
+func readString(dir, rel string) string {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+func TestMirrorSync(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	a := uploadString(t, m, root, "a.txt", "hello")
+	sub, err := m.CreateDir("sub", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, sub, "b.txt", "world")
+	uploadString(t, m, root, "..", "evil")
+
+	dir, err := ioutil.TempDir("", "mega-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "archive")
+	local := filepath.Join(dir, "local")
+
+	mr, err := m.NewMirror(root, local, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Policy = DELETE_ARCHIVE
+	mr.ArchiveDir = archive
+	err = mr.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(local, "a.txt"); got != "hello" {
+		t.Errorf("a.txt: got %q", got)
+	}
+	if got := readString(local, "sub/b.txt"); got != "world" {
+		t.Errorf("sub/b.txt: got %q", got)
+	}
+	if got := readString(dir, ".."); got != "" {
+		t.Errorf("unsafe name was written")
+	}
+
+	err = m.Delete(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mr.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readString(local, "a.txt") != "" {
+		t.Errorf("deleted file still present")
+	}
+	if got := readString(archive, "a.txt"); got != "hello" {
+		t.Errorf("deleted file not archived: %q", got)
+	}
+}
+
+func TestMirrorWatch(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := m.FS.GetRoot()
+	mr, err := m.NewMirror(root, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Debounce = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- mr.Watch(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch: %v", err)
+		}
+	}()
+
+	// The fake doesn't send events so do as the event poller would
+	n := uploadString(t, m, root, "new.txt", "data")
+	m.emitEvents([]Event{{Type: EVENT_NODE_ADDED, Node: n, Hash: n.GetHash()}})
+	waitFor(t, "download", func() bool { return readString(dir, "new.txt") == "data" })
+
+	err = m.Delete(n, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.emitEvents([]Event{{Type: EVENT_NODE_DELETED, Node: n, Hash: n.GetHash()}})
+	waitFor(t, "delete", func() bool { return readString(dir, "new.txt") == "" })
+}
+
+func TestMirrorRemoteMove(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	a := uploadString(t, m, root, "a.txt", "hello")
+	sub, err := m.CreateDir("sub", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mega-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mr, err := m.NewMirror(root, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Move(a, sub); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Rename(a, "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := mr.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Action{{Type: ACTION_LOCAL_MOVE, Path: "a.txt", To: "sub/c.txt"}}
+	if !reflect.DeepEqual(plan.Actions, want) {
+		t.Errorf("planned %v", plan.Actions)
+	}
+
+	if err = mr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filepath.Join(dir, "sub", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("downloaded again rather than moved")
+	}
+	if readString(dir, "a.txt") != "" {
+		t.Error("old path still present")
+	}
+	if st, ok, _ := mr.state.Get("sub/c.txt"); !ok || st.Hash != a.GetHash() {
+		t.Errorf("state %+v", st)
+	}
+	if _, ok, _ := mr.state.Get("a.txt"); ok {
+		t.Error("old state kept")
+	}
+}
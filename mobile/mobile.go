@@ -0,0 +1,361 @@
+// Package mobile is a simplified binding of go-mega for gomobile so
+// the library can be used from Android and iOS apps.
+//
+// gomobile can only bind a limited set of types so everything here
+// uses strings, bools and signed integers, nodes are named by
+// their handles and results which are lists come as types with Len
+// and Get methods.  Progress and events are delivered to callback
+// objects implemented on the app side instead of channels.
+//
+// Build the bindings with, for example
+//
+//	gomobile bind -target=android github.com/SeyitDurmus/go-mega/mobile
+package mobile
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	mega "github.com/SeyitDurmus/go-mega"
+)
+
+// Node types as returned by Node.Type
+const (
+	TypeFile   = mega.FILE
+	TypeFolder = mega.FOLDER
+	TypeRoot   = mega.ROOT
+	TypeInbox  = mega.INBOX
+	TypeTrash  = mega.TRASH
+)
+
+// Client is a MEGA session
+type Client struct {
+	m *mega.Mega
+}
+
+// NewClient returns a Client which isn't logged in yet
+func NewClient() *Client {
+	m := mega.New()
+	m.SetLogger(nil)
+	return &Client{m: m}
+}
+
+// Login logs in with email and password and fetches the tree
+func (c *Client) Login(email, password string) error {
+	return c.m.Login(email, password)
+}
+
+// MultiFactorLogin logs in like Login with a two factor code
+func (c *Client) MultiFactorLogin(email, password, code string) error {
+	return c.m.MultiFactorLogin(email, password, code)
+}
+
+// SessionString returns the logged in session for LoginWithSession,
+// to be kept as safe as the password
+func (c *Client) SessionString() (string, error) {
+	return c.m.SessionString()
+}
+
+// LoginWithSession carries on with a session saved by SessionString
+// and fetches the tree
+func (c *Client) LoginWithSession(session string) error {
+	return c.m.LoginWithSession(session)
+}
+
+// OpenFolderLink starts an anonymous session on a folder link
+func (c *Client) OpenFolderLink(link string) error {
+	return c.m.OpenFolderLink(link)
+}
+
+// Node describes a file or folder
+type Node struct {
+	// Handle of the node, used to name it in the Client methods
+	Handle string
+	Name   string
+	// One of TypeFile, TypeFolder, TypeRoot, TypeInbox or TypeTrash
+	Type int
+	// Size in bytes of files
+	Size int64
+	// Modification time in seconds since the Unix epoch
+	Modified int64
+}
+
+// newNode describes n
+func (c *Client) newNode(n *mega.Node) *Node {
+	return &Node{
+		Handle:   n.GetHash(),
+		Name:     n.GetName(),
+		Type:     int(n.GetType()),
+		Size:     n.GetSize(),
+		Modified: n.GetTimeStamp().Unix(),
+	}
+}
+
+// NodeList is a list of nodes
+type NodeList struct {
+	nodes []*Node
+}
+
+// Len returns the number of nodes in the list
+func (l *NodeList) Len() int {
+	return len(l.nodes)
+}
+
+// Get returns node i of the list, nil if out of range
+func (l *NodeList) Get(i int) *Node {
+	if i < 0 || i >= len(l.nodes) {
+		return nil
+	}
+	return l.nodes[i]
+}
+
+// lookup returns the node with handle h
+func (c *Client) lookup(h string) (*mega.Node, error) {
+	n := c.m.FS.HashLookup(h)
+	if n == nil {
+		return nil, mega.ENOENT
+	}
+	return n, nil
+}
+
+// RootHandle returns the handle of the Cloud Drive or of the folder of
+// a folder link session, "" if not logged in
+func (c *Client) RootHandle() string {
+	if n := c.m.FS.GetRoot(); n != nil {
+		return n.GetHash()
+	}
+	return ""
+}
+
+// TrashHandle returns the handle of the trash, "" if there is none
+func (c *Client) TrashHandle() string {
+	if n := c.m.FS.GetTrash(); n != nil {
+		return n.GetHash()
+	}
+	return ""
+}
+
+// InboxHandle returns the handle of the inbox, "" if there is none
+func (c *Client) InboxHandle() string {
+	if n := c.m.FS.GetInbox(); n != nil {
+		return n.GetHash()
+	}
+	return ""
+}
+
+// MoveFromInbox moves the node with handle h out of the inbox into the
+// folder with handle parent, see mega.MoveFromInbox
+func (c *Client) MoveFromInbox(h, parent string) error {
+	n, err := c.lookup(h)
+	if err != nil {
+		return err
+	}
+	p, err := c.lookup(parent)
+	if err != nil {
+		return err
+	}
+	return c.m.MoveFromInbox(n, p)
+}
+
+// Node returns the node with handle h
+func (c *Client) Node(h string) (*Node, error) {
+	n, err := c.lookup(h)
+	if err != nil {
+		return nil, err
+	}
+	return c.newNode(n), nil
+}
+
+// Children returns the nodes in the folder with handle h
+func (c *Client) Children(h string) (*NodeList, error) {
+	n, err := c.lookup(h)
+	if err != nil {
+		return nil, err
+	}
+	children, err := c.m.FS.GetChildren(n)
+	if err != nil {
+		return nil, err
+	}
+	l := &NodeList{nodes: make([]*Node, 0, len(children))}
+	for _, child := range children {
+		l.nodes = append(l.nodes, c.newNode(child))
+	}
+	return l, nil
+}
+
+// Lookup returns the node at the slash separated path below the root
+func (c *Client) Lookup(path string) (*Node, error) {
+	root := c.m.FS.GetRoot()
+	if root == nil {
+		return nil, mega.ENOENT
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return c.newNode(root), nil
+	}
+	nodes, err := c.m.FS.PathLookup(root, strings.Split(path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return c.newNode(nodes[len(nodes)-1]), nil
+}
+
+// CreateDir creates the folder name in the folder with handle parent
+func (c *Client) CreateDir(name, parent string) (*Node, error) {
+	p, err := c.lookup(parent)
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.m.CreateDir(name, p)
+	if err != nil {
+		return nil, err
+	}
+	return c.newNode(n), nil
+}
+
+// Rename renames the node with handle h
+func (c *Client) Rename(h, name string) error {
+	n, err := c.lookup(h)
+	if err != nil {
+		return err
+	}
+	return c.m.Rename(n, name)
+}
+
+// Move moves the node with handle h into the folder with handle parent
+func (c *Client) Move(h, parent string) error {
+	n, err := c.lookup(h)
+	if err != nil {
+		return err
+	}
+	p, err := c.lookup(parent)
+	if err != nil {
+		return err
+	}
+	return c.m.Move(n, p)
+}
+
+// Delete moves the node with handle h to the trash, or removes it for
+// good if destroy is set
+func (c *Client) Delete(h string, destroy bool) error {
+	n, err := c.lookup(h)
+	if err != nil {
+		return err
+	}
+	return c.m.Delete(n, destroy)
+}
+
+// Link returns a public link to the node with handle h, with the key
+// included if includeKey is set
+func (c *Client) Link(h string, includeKey bool) (string, error) {
+	n, err := c.lookup(h)
+	if err != nil {
+		return "", err
+	}
+	return c.m.Link(n, includeKey)
+}
+
+// Progress receives the progress of a transfer
+type Progress interface {
+	// OnProgress is called as each chunk completes with the bytes
+	// transferred so far and the size of the file
+	OnProgress(done, total int64)
+}
+
+// progressChan returns a channel for the transfer functions which
+// passes the progress to p, and a function which waits for it to be
+// closed.  The channel is nil if p is.
+func progressChan(p Progress, total int64) (*chan int, func()) {
+	if p == nil {
+		return nil, func() {}
+	}
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var done int64
+		for n := range ch {
+			done += int64(n)
+			p.OnProgress(done, total)
+		}
+	}()
+	return &ch, wg.Wait
+}
+
+// DownloadFile downloads the file with handle h to the local path dst
+func (c *Client) DownloadFile(h, dst string, progress Progress) error {
+	n, err := c.lookup(h)
+	if err != nil {
+		return err
+	}
+	ch, wait := progressChan(progress, n.GetSize())
+	err = c.m.DownloadFile(n, dst, ch)
+	wait()
+	return err
+}
+
+// UploadFile uploads the local file src into the folder with handle
+// parent as name, or the base name of src if name is ""
+func (c *Client) UploadFile(src, parent, name string, progress Progress) (*Node, error) {
+	p, err := c.lookup(parent)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if fi, err := os.Stat(src); err == nil {
+		size = fi.Size()
+	}
+	ch, wait := progressChan(progress, size)
+	n, err := c.m.UploadFile(src, p, name, ch)
+	wait()
+	if err != nil {
+		return nil, err
+	}
+	return c.newNode(n), nil
+}
+
+// EventListener receives changes to the tree made elsewhere
+type EventListener interface {
+	// OnEvent is called with the kind of change, one of
+	// "NodeAdded", "NodeUpdated", "NodeDeleted", "ShareAdded" or
+	// "ShareRemoved", and the handle of the node
+	OnEvent(event string, handle string)
+}
+
+// Subscription is a registered EventListener
+type Subscription struct {
+	cancel func()
+}
+
+// Cancel stops the events
+func (s *Subscription) Cancel() {
+	s.cancel()
+}
+
+// Subscribe calls l for each change to the tree received from the
+// server until the Subscription is cancelled
+func (c *Client) Subscribe(l EventListener) *Subscription {
+	cancel := c.m.Subscribe(func(ev mega.Event) {
+		l.OnEvent(ev.Type.String(), ev.Hash)
+	})
+	return &Subscription{cancel: cancel}
+}
+
+// Quota describes the storage used by the account
+type Quota struct {
+	// Bytes used
+	Used int64
+	// Total bytes available
+	Total int64
+}
+
+// Quota returns the storage used by the account
+func (c *Client) Quota() (*Quota, error) {
+	q, err := c.m.GetQuota()
+	if err != nil {
+		return nil, err
+	}
+	return &Quota{Used: int64(q.Cstrg), Total: int64(q.Mstrg)}, nil
+}
@@ -0,0 +1,63 @@
+package mobile
+
+import (
+	"testing"
+
+	mega "github.com/SeyitDurmus/go-mega"
+)
+
+type recordProgress struct {
+	done, total []int64
+}
+
+func (p *recordProgress) OnProgress(done, total int64) {
+	p.done = append(p.done, done)
+	p.total = append(p.total, total)
+}
+
+func TestProgressChan(t *testing.T) {
+	p := &recordProgress{}
+	ch, wait := progressChan(p, 30)
+	*ch <- 10
+	*ch <- 20
+	close(*ch)
+	wait()
+	if len(p.done) != 2 || p.done[0] != 10 || p.done[1] != 30 || p.total[1] != 30 {
+		t.Errorf("progress %v of %v", p.done, p.total)
+	}
+
+	ch, wait = progressChan(nil, 30)
+	wait()
+	if ch != nil {
+		t.Errorf("channel without a Progress")
+	}
+}
+
+func TestNotLoggedIn(t *testing.T) {
+	c := NewClient()
+	if h := c.RootHandle(); h != "" {
+		t.Errorf("root handle %q before login", h)
+	}
+	if _, err := c.Node("missing"); err != mega.ENOENT {
+		t.Errorf("Node: %v", err)
+	}
+	if _, err := c.Children("missing"); err != mega.ENOENT {
+		t.Errorf("Children: %v", err)
+	}
+	if _, err := c.Lookup("a/b"); err != mega.ENOENT {
+		t.Errorf("Lookup: %v", err)
+	}
+	if err := c.Move("a", "b"); err != mega.ENOENT {
+		t.Errorf("Move: %v", err)
+	}
+}
+
+func TestNodeList(t *testing.T) {
+	l := &NodeList{nodes: []*Node{{Handle: "a"}, {Handle: "b"}}}
+	if l.Len() != 2 || l.Get(1).Handle != "b" {
+		t.Errorf("list %v", l.nodes)
+	}
+	if l.Get(2) != nil || l.Get(-1) != nil {
+		t.Errorf("Get out of range")
+	}
+}
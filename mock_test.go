@@ -0,0 +1,83 @@
+package mega
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockServer is a fake MEGA API server for tests
+type mockServer struct {
+	*httptest.Server
+	t *testing.T
+	// handle is called for each command received on /cs and should
+	// return the response for it
+	handle func(cmd map[string]interface{}, r *http.Request) interface{}
+	// events, if set, is called for each request to /sc with the
+	// cursor and returns the reply, "" for a wait URL, or an HTTP
+	// status code to fail with
+	eventsMu sync.Mutex
+	events   func(sn string) (reply string, status int)
+}
+
+// newMockServer starts a fake MEGA API server calling handle for each
+// API command.  The event channel always returns a wait URL.
+func newMockServer(t *testing.T, handle func(cmd map[string]interface{}, r *http.Request) interface{}) *mockServer {
+	s := &mockServer{t: t, handle: handle}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cs", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("mock: read body: %v", err)
+			return
+		}
+		var cmds []map[string]interface{}
+		err = json.Unmarshal(body, &cmds)
+		if err != nil {
+			t.Errorf("mock: bad request %s: %v", body, err)
+			return
+		}
+		res := make([]interface{}, 0, len(cmds))
+		for _, cmd := range cmds {
+			res = append(res, s.handle(cmd, r))
+		}
+		// no trailing newline so short error replies are recognised
+		buf, _ := json.Marshal(res)
+		_, _ = w.Write(buf)
+	})
+	mux.HandleFunc("/sc", func(w http.ResponseWriter, r *http.Request) {
+		s.eventsMu.Lock()
+		events := s.events
+		s.eventsMu.Unlock()
+		if events != nil {
+			reply, status := events(r.URL.Query().Get("sn"))
+			if status != 0 {
+				http.Error(w, "injected failure", status)
+				return
+			}
+			if reply != "" {
+				_, _ = w.Write([]byte(reply))
+				return
+			}
+		}
+		fmt.Fprintf(w, `{"w":%q}`, s.URL+"/wait")
+	})
+	mux.HandleFunc("/wait", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// newMockSession returns a Mega pointed at the mock server
+func newMockSession(t *testing.T, s *mockServer) *Mega {
+	m := New()
+	m.SetLogger(nil)
+	m.SetAPIUrl(s.URL)
+	return m
+}
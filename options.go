@@ -0,0 +1,148 @@
+package mega
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Option configures a Mega when it is created with New
+type Option func(m *Mega) error
+
+// WithAPIURL sets the mega service base url
+func WithAPIURL(u string) Option {
+	return func(m *Mega) error {
+		if u == "" {
+			return errors.New("empty API URL")
+		}
+		m.config.setAPIUrl(u)
+		return nil
+	}
+}
+
+// WithRetries sets the number of retries for api calls and chunk
+// transfers
+func WithRetries(r int) Option {
+	return func(m *Mega) error {
+		if r < 0 {
+			return EARGS
+		}
+		m.config.retries = r
+		return nil
+	}
+}
+
+// WithWorkers sets the number of concurrent download and upload
+// workers used per transfer
+func WithWorkers(download, upload int) Option {
+	return func(m *Mega) error {
+		if download < 1 || upload < 1 {
+			return EARGS
+		}
+		err := m.config.setDownloadWorkers(download)
+		if err != nil {
+			return err
+		}
+		return m.config.setUploadWorkers(upload)
+	}
+}
+
+// WithDecryptWorkers sets the number of goroutines which decrypt the
+// chunks of each download, see SetDecryptWorkers
+func WithDecryptWorkers(w int) Option {
+	return func(m *Mega) error {
+		if w < 0 {
+			return EARGS
+		}
+		m.config.cpu_workers = w
+		return nil
+	}
+}
+
+// WithTimeout sets the connection timeout of the default HTTP client
+func WithTimeout(t time.Duration) Option {
+	return func(m *Mega) error {
+		m.config.timeout = t
+		return nil
+	}
+}
+
+// WithResolver sets how the default HTTP clients look up the API and
+// storage hosts, in place of the system's DNS.  It has no effect on
+// clients given with WithHTTPClient, on requests sent through a proxy,
+// which looks up the host itself, or in the browser.
+func WithResolver(r Resolver) Option {
+	return func(m *Mega) error {
+		if r == nil {
+			return errors.New("nil resolver")
+		}
+		m.config.resolver = r
+		return nil
+	}
+}
+
+// WithHTTPS sets whether https is used for transfers
+func WithHTTPS(e bool) Option {
+	return func(m *Mega) error {
+		m.config.https = e
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for all requests, see
+// SetClient
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *Mega) error {
+		if client == nil {
+			return errors.New("nil HTTP client")
+		}
+		m.client = client
+		m.storage = client
+		return nil
+	}
+}
+
+// WithStorageHTTPClient sets the HTTP client used for chunk transfers,
+// see SetStorageClient.  Give it after any WithHTTPClient.
+func WithStorageHTTPClient(client *http.Client) Option {
+	return func(m *Mega) error {
+		if client == nil {
+			return errors.New("nil HTTP client")
+		}
+		m.storage = client
+		return nil
+	}
+}
+
+// WithLogger sets the logger for important messages.  Use nil to
+// discard the messages.
+func WithLogger(logf func(format string, v ...interface{})) Option {
+	return func(m *Mega) error {
+		m.SetLogger(logf)
+		return nil
+	}
+}
+
+// WithDebugger sets the logger for debug messages
+func WithDebugger(debugf func(format string, v ...interface{})) Option {
+	return func(m *Mega) error {
+		m.SetDebugger(debugf)
+		return nil
+	}
+}
+
+// WithReadOnly makes the client read only, see SetReadOnly
+func WithReadOnly() Option {
+	return func(m *Mega) error {
+		m.config.readonly = true
+		return nil
+	}
+}
+
+// WithAppID sets the application key sent with each API request
+func WithAppID(id string) Option {
+	return func(m *Mega) error {
+		m.config.appid = id
+		return nil
+	}
+}
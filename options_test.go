@@ -0,0 +1,72 @@
+package mega
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewOptions(t *testing.T) {
+	client := &http.Client{}
+	var logged []string
+	logf := func(format string, v ...interface{}) {
+		logged = append(logged, format)
+	}
+	m := New(
+		WithAPIURL("https://example.com/"),
+		WithRetries(2),
+		WithWorkers(4, 5),
+		WithTimeout(time.Minute),
+		WithHTTPS(true),
+		WithHTTPClient(client),
+		WithAppID("appkey"),
+		WithLogger(logf),
+		WithWorkers(100, 1), // invalid - ignored
+	)
+	cfg := m.getConfig()
+	if cfg.baseurl != "https://example.com" {
+		t.Errorf("wrong baseurl %q", cfg.baseurl)
+	}
+	if cfg.retries != 2 || cfg.dl_workers != 4 || cfg.ul_workers != 5 {
+		t.Errorf("wrong settings %+v", cfg)
+	}
+	if cfg.timeout != time.Minute || !cfg.https || cfg.appid != "appkey" {
+		t.Errorf("wrong settings %+v", cfg)
+	}
+	if m.client != client {
+		t.Error("HTTP client not set")
+	}
+	if len(logged) != 1 {
+		t.Errorf("expecting invalid option to be logged, got %v", logged)
+	}
+
+	// Old setters still work
+	m.SetRetries(7)
+	if m.getConfig().retries != 7 {
+		t.Error("SetRetries didn't work")
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	m, err := NewWithOptions(WithLogger(nil), WithRetries(3))
+	if err != nil || m.getConfig().retries != 3 {
+		t.Errorf("valid options: %v", err)
+	}
+	for _, opt := range []Option{WithAPIURL(""), WithRetries(-1), WithWorkers(0, 0), WithMaxConnections(-1), WithMemoryLimit(-1)} {
+		if m, err = NewWithOptions(WithLogger(nil), opt); err == nil || m != nil {
+			t.Errorf("invalid option: got %v, %v", m, err)
+		}
+	}
+
+	// An ID source which runs short is an error, not a panic
+	short := bytes.NewReader([]byte{1})
+	if _, err = NewWithOptions(WithLogger(nil), WithIDSource(short)); !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		t.Errorf("short ID source: got %v", err)
+	}
+	if New(WithLogger(nil), WithIDSource(bytes.NewReader(nil))) == nil {
+		t.Error("New with a short ID source failed")
+	}
+}
@@ -0,0 +1,57 @@
+package mega
+
+import "encoding/json"
+
+// GetOwner returns the handle of the user the node belongs to and
+// their email if known.  Nodes in incoming shares belong to the user
+// sharing them.
+func (n *Node) GetOwner() (handle, email string) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.owner, n.fs.emails[n.owner]
+}
+
+// GetCreator returns the handle of the user who added the node and
+// their email if known, so those browsing a share can see who put
+// what in it.  The server only says who for nodes added while the
+// event stream is running, so it is "" for nodes which were already
+// there when the tree was fetched.  Nodes made by this client are its
+// own.
+func (n *Node) GetCreator() (handle, email string) {
+	n.fs.mutex.Lock()
+	defer n.fs.mutex.Unlock()
+	return n.creator, n.fs.emails[n.creator]
+}
+
+// UserEmail returns the email of the user with handle, "" if it isn't
+// known.  The emails of contacts are sent with the tree and as they
+// change.
+func (fs *MegaFS) UserEmail(handle string) string {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.emails[handle]
+}
+
+// addContacts records the emails of the users
+//
+// Call with the FS mutex held
+func (fs *MegaFS) addContacts(users []ContactUser) {
+	for _, u := range users {
+		if u.User != "" && u.Email != "" {
+			fs.emails[u.User] = u.Email
+		}
+	}
+}
+
+// process a contact addition/update event
+func (m *Mega) processContact(evRaw []byte) error {
+	var ev ContactEvent
+	err := json.Unmarshal(evRaw, &ev)
+	if err != nil {
+		return err
+	}
+	m.FS.mutex.Lock()
+	m.FS.addContacts(ev.U)
+	m.FS.mutex.Unlock()
+	return nil
+}
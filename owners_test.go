@@ -0,0 +1,54 @@
+package mega
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOwnerCreator(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	m.handle = "MEMEMEMEMEM"
+
+	dir, err := m.CreateDir("dir", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := dir.GetCreator(); h != "MEMEMEMEMEM" {
+		t.Errorf("own folder created by %q", h)
+	}
+
+	// A node added by someone else
+	b.mu.Lock()
+	itm := *b.nodes[dir.GetHash()]
+	b.mu.Unlock()
+	itm.Hash = "ADDEDNOD"
+	itm.User = "OWNERUSERXX"
+	ev := FSEvent{Cmd: "t", Owner: "CREATORUSER"}
+	ev.T.Files = []FSNode{itm}
+	evRaw, _ := json.Marshal(ev)
+	if err = m.processAddNode(evRaw); err != nil {
+		t.Fatal(err)
+	}
+	n := m.FS.HashLookup("ADDEDNOD")
+	if n == nil {
+		t.Fatal("node not added")
+	}
+	if h, email := n.GetOwner(); h != "OWNERUSERXX" || email != "" {
+		t.Errorf("owner %q %q", h, email)
+	}
+
+	err = m.processContact([]byte(`{"a":"c","u":[{"u":"CREATORUSER","c":1,"m":"creator@example.com"},{"u":"OWNERUSERXX","c":1,"m":"owner@example.com"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, email := n.GetCreator(); h != "CREATORUSER" || email != "creator@example.com" {
+		t.Errorf("creator %q %q", h, email)
+	}
+	if _, email := n.GetOwner(); email != "owner@example.com" {
+		t.Errorf("owner email %q", email)
+	}
+	if m.FS.UserEmail("NOBODYXXXXX") != "" {
+		t.Errorf("unknown user has an email")
+	}
+}
@@ -0,0 +1,18 @@
+package mega
+
+import (
+	"context"
+)
+
+// Ping checks the API can be reached and, when logged in, that the
+// session is still valid, returning ESID if it isn't.  It makes a
+// single cheap request without the retries of the other calls so it
+// suits readiness probes in services - bound it with ctx.
+func (m *Mega) Ping(ctx context.Context) error {
+	req := []byte("[]")
+	if m.flink == nil && m.sid != "" {
+		req = []byte(`[{"a":"ug"}]`)
+	}
+	_, err := m.apiRequestRetries(ctx, req, nil, 0)
+	return err
+}
@@ -0,0 +1,58 @@
+package mega
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestPing(t *testing.T) {
+	var commands int
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		commands++
+		if cmd["a"] != "ug" {
+			t.Errorf("unexpected command %v", cmd)
+		}
+		if r.URL.Query().Get("sid") != "good" {
+			return ErrorMsg(-15)
+		}
+		return map[string]interface{}{"u": "me"}
+	})
+	defer srv.Close()
+	m := newMockSession(t, srv)
+
+	// Not logged in only checks the API is there
+	if err := m.Ping(context.Background()); err != nil {
+		t.Errorf("anonymous ping: %v", err)
+	}
+	if commands != 0 {
+		t.Errorf("anonymous ping sent %d commands", commands)
+	}
+
+	// Pings are traced as API requests
+	tr := &recordingTracer{}
+	m.SetTracer(tr)
+	m.sid = "good"
+	if err := m.Ping(context.Background()); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+	if spans := tr.find(SPAN_API_REQUEST); len(spans) != 1 || spans[0].attrs[ATTR_COMMANDS] != "ug" {
+		t.Errorf("ping not traced")
+	}
+	m.SetTracer(nil)
+	m.sid = "expired"
+	if err := m.Ping(context.Background()); err != ESID {
+		t.Errorf("expired session: got %v, want ESID", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Ping(ctx); err == nil {
+		t.Errorf("cancelled ping succeeded")
+	}
+
+	srv.Close()
+	if err := m.Ping(context.Background()); err == nil {
+		t.Errorf("ping of a closed server succeeded")
+	}
+}
@@ -0,0 +1,120 @@
+package mega
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ActionType is the kind of change an Action makes
+type ActionType int
+
+// Plan action types
+const (
+	ACTION_UPLOAD        ActionType = iota // upload a local file
+	ACTION_DOWNLOAD                        // download a remote file
+	ACTION_MKDIR                           // create a remote folder
+	ACTION_LOCAL_MKDIR                     // create a local directory
+	ACTION_TRASH                           // move a remote node to the trash
+	ACTION_DELETE                          // delete a remote node permanently
+	ACTION_LOCAL_DELETE                    // remove a local file
+	ACTION_LOCAL_ARCHIVE                   // move a local file to the archive
+	ACTION_CONFLICT                        // save a conflicting version under another name
+	ACTION_MOVE                            // move or rename a remote file
+	ACTION_LOCAL_MOVE                      // move or rename a local file
+)
+
+func (t ActionType) String() string {
+	switch t {
+	case ACTION_UPLOAD:
+		return "upload"
+	case ACTION_DOWNLOAD:
+		return "download"
+	case ACTION_MKDIR:
+		return "mkdir"
+	case ACTION_LOCAL_MKDIR:
+		return "local-mkdir"
+	case ACTION_TRASH:
+		return "trash"
+	case ACTION_DELETE:
+		return "delete"
+	case ACTION_LOCAL_DELETE:
+		return "local-delete"
+	case ACTION_LOCAL_ARCHIVE:
+		return "local-archive"
+	case ACTION_CONFLICT:
+		return "conflict"
+	case ACTION_MOVE:
+		return "move"
+	case ACTION_LOCAL_MOVE:
+		return "local-move"
+	}
+	return "unknown"
+}
+
+// Action is a single step of a Plan
+type Action struct {
+	// What would be done
+	Type ActionType
+	// Path affected, relative to the root of the operation using
+	// forward slashes
+	Path string
+	// Destination path for ACTION_CONFLICT, ACTION_LOCAL_ARCHIVE and
+	// the moves
+	To string
+	// Bytes transferred for uploads and downloads, or the size of
+	// what is removed for deletions
+	Size int64
+}
+
+func (a Action) String() string {
+	s := fmt.Sprintf("%s %s", a.Type, a.Path)
+	if a.To != "" {
+		s += " -> " + a.To
+	}
+	if a.Size > 0 {
+		s += fmt.Sprintf(" (%d bytes)", a.Size)
+	}
+	return s
+}
+
+// Plan lists the actions a bulk operation would take.  It is returned
+// by the Plan methods which do a dry run without changing anything.
+type Plan struct {
+	Actions []Action
+}
+
+// add appends an action to the plan
+func (p *Plan) add(a Action) {
+	p.Actions = append(p.Actions, a)
+}
+
+// TransferSize returns the total bytes which would be uploaded and
+// downloaded
+func (p *Plan) TransferSize() (size int64) {
+	for _, a := range p.Actions {
+		if a.Type == ACTION_UPLOAD || a.Type == ACTION_DOWNLOAD {
+			size += a.Size
+		}
+	}
+	return size
+}
+
+// Count returns the number of actions of type t
+func (p *Plan) Count(t ActionType) (n int) {
+	for _, a := range p.Actions {
+		if a.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// String returns the plan one action per line
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, a := range p.Actions {
+		b.WriteString(a.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
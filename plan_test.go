@@ -0,0 +1,178 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// actions returns the plan as strings for comparing
+func actions(p *Plan) (as []string) {
+	for _, a := range p.Actions {
+		as = append(as, a.String())
+	}
+	return as
+}
+
+func checkActions(t *testing.T, p *Plan, want ...string) {
+	got := actions(p)
+	if len(got) != len(want) {
+		t.Fatalf("want actions %q got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("action %d: want %q got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSyncerPlan(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.txt", "hello")
+	writeFile(t, dir, "sub/deeper/b.txt", "world!")
+	writeFile(t, dir, "sub/c.txt", "c")
+
+	s, err := m.NewSyncer(dir, m.FS.GetRoot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(t, plan,
+		"upload a.txt (5 bytes)",
+		"mkdir sub",
+		"upload sub/c.txt (1 bytes)",
+		"mkdir sub/deeper",
+		"upload sub/deeper/b.txt (6 bytes)",
+	)
+	if plan.TransferSize() != 12 || plan.Count(ACTION_MKDIR) != 2 {
+		t.Errorf("bad totals %d %d", plan.TransferSize(), plan.Count(ACTION_MKDIR))
+	}
+	if b.lookupPath(m, "a.txt") != "" || b.lookupPath(m, "sub") != "" {
+		t.Errorf("plan changed the remote")
+	}
+
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(dir, "sub", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(t, plan, "trash sub/c.txt (1 bytes)")
+	if b.lookupPath(m, "sub/c.txt") == "" {
+		t.Errorf("plan changed the remote")
+	}
+}
+
+func TestUploadDownloadDirPlan(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	writeFile(t, src, "a.txt", "hello")
+	writeFile(t, src, "sub/b.txt", "world!")
+
+	root := m.FS.GetRoot()
+	plan, err := m.PlanUploadDir(src, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(t, plan,
+		"mkdir .",
+		"upload a.txt (5 bytes)",
+		"mkdir sub",
+		"upload sub/b.txt (6 bytes)",
+	)
+	err = m.UploadDir(src, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.lookupPath(m, "src/sub/b.txt") == "" {
+		t.Fatalf("UploadDir didn't upload")
+	}
+
+	folder, err := m.FS.PathLookup(root, []string{"src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	plan, err = m.PlanDownloadDir(folder[0], dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(t, plan,
+		"local-mkdir .",
+		"local-mkdir sub",
+		"download a.txt (5 bytes)",
+		"download sub/b.txt (6 bytes)",
+	)
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("plan created the local directory")
+	}
+	err = m.DownloadDir(folder[0], dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(dst, "src/sub/b.txt"); got != "world!" {
+		t.Errorf("DownloadDir: got %q", got)
+	}
+
+	plan, err = m.PlanDelete(folder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(t, plan, "delete Cloud Drive/src (11 bytes)")
+	err = m.DeleteNodes(folder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.lookupPath(m, "src") != "" {
+		t.Errorf("DeleteNodes didn't delete")
+	}
+}
+
+func TestDeleteNodes(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	a := uploadString(t, m, root, "a.txt", "hello")
+	dir := createDir(t, m, "dir", root)
+	uploadString(t, m, dir, "b.txt", "world!")
+
+	err := m.DeleteNodes([]*Node{a, dir}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := m.FS.GetChildren(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 0 {
+		t.Errorf("deleted nodes still in their parent: %d children", len(children))
+	}
+	if m.FS.HashLookup(a.GetHash()) != nil || m.FS.HashLookup(dir.GetHash()) != nil {
+		t.Errorf("deleted nodes still looked up")
+	}
+}
@@ -0,0 +1,88 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, root, "f.txt", "hello")
+	m.SetReadOnly(true)
+
+	tmp, err := ioutil.TempDir("", "mega-readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	randomFile(t, tmp, "up.bin", 1000)
+
+	for name, fn := range map[string]func() error{
+		"upload": func() error {
+			_, err := m.UploadFile(filepath.Join(tmp, "up.bin"), root, "", nil)
+			return err
+		},
+		"mkdir": func() error {
+			_, err := m.CreateDir("new", root)
+			return err
+		},
+		"move":    func() error { return m.Move(f, dir) },
+		"rename":  func() error { return m.Rename(f, "g.txt") },
+		"trash":   func() error { return m.Delete(f, false) },
+		"destroy": func() error { return m.Delete(f, true) },
+		"link": func() error {
+			_, err := m.Link(f, true)
+			return err
+		},
+	} {
+		if err := fn(); err != EREADONLY {
+			t.Errorf("%s: want EREADONLY, got %v", name, err)
+		}
+	}
+	if f.GetName() != "f.txt" || f.parent != root {
+		t.Error("node changed")
+	}
+
+	// Reading still works
+	err = m.DownloadFile(f, filepath.Join(tmp, "f.txt"), nil)
+	if err != nil {
+		t.Errorf("download: %v", err)
+	}
+
+	m.SetReadOnly(false)
+	if err = m.Rename(f, "g.txt"); err != nil {
+		t.Errorf("rename after leaving read only mode: %v", err)
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	for _, test := range []struct {
+		req     string
+		allowed bool
+	}{
+		{`[{"a":"f","c":1}]`, true},
+		{`[{"a":"usl","x":1}]`, true},
+		{`[{"a":"uk","u":"user"}]`, true},
+		{`[{"a":"ufa","fah":"AAAAAAAAAAA","r":1}]`, true},
+		{`[{"a":"ufa","s":1000}]`, false},
+		{`[{"a":"pfa","n":"node","fa":"0*AAAAAAAAAAA"}]`, false},
+		{`[{"a":"sla"}]`, false},
+		{`[{"a":"k","sr":[]}]`, false},
+		{`[{"a":"ug"},{"a":"m","n":"node","t":"dir"}]`, false},
+		{`[]`, true},
+	} {
+		err := checkReadOnly([]byte(test.req))
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: allowed %v, want %v", test.req, allowed, test.allowed)
+		}
+	}
+}
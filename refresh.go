@@ -0,0 +1,224 @@
+package mega
+
+import (
+	"encoding/json"
+)
+
+// fetchNodes fetches the node with handle h and, if it is a folder,
+// its children from the server.  Any share keys sent with them are
+// stored.
+func (m *Mega) fetchNodes(h string) ([]FSNode, error) {
+	var msg [1]FilesMsg
+	var res [1]FilesResp
+
+	msg[0].Cmd = "f"
+	msg[0].C = 1
+	msg[0].N = h
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res[0].Ok) > 0 {
+		m.FS.mutex.Lock()
+		for _, sk := range res[0].Ok {
+			m.FS.skmap[sk.Hash] = sk.Key
+		}
+		m.FS.mutex.Unlock()
+	}
+	if len(res[0].User) > 0 {
+		m.FS.mutex.Lock()
+		m.FS.addContacts(res[0].User)
+		m.FS.mutex.Unlock()
+	}
+	return res[0].F, nil
+}
+
+// fetchFolder fetches the folder with handle h and its children from
+// the server, returning the children
+func (m *Mega) fetchFolder(h string) ([]FSNode, error) {
+	nodes, err := m.fetchNodes(h)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]FSNode, 0, len(nodes))
+	for _, itm := range nodes {
+		if itm.Parent == h {
+			items = append(items, itm)
+		}
+	}
+	return items, nil
+}
+
+// RefreshNode fetches the children of the folder node from the server
+// again and brings the tree up to date with them.  This is much
+// cheaper than fetching the whole filesystem when events may have been
+// missed, say while the event stream was down.
+//
+// Children which were added, changed or removed are reported with
+// events and journaled as though they came from the server.  Children
+// which are no longer in the folder are fetched by themselves so those
+// moved elsewhere are moved rather than deleted.  The children of
+// subfolders aren't fetched - call RefreshNode on those too if needed.
+func (m *Mega) RefreshNode(node *Node) error {
+	if node == nil {
+		return EARGS
+	}
+	m.FS.mutex.Lock()
+	h := node.hash
+	switch {
+	case m.FS.lookup[h] != node:
+		m.FS.mutex.Unlock()
+		return ENOENT
+	case node.ntype == FILE:
+		m.FS.mutex.Unlock()
+		return EARGS
+	}
+	m.FS.mutex.Unlock()
+
+	items, err := m.fetchFolder(h)
+	if err != nil {
+		return err
+	}
+	moved, err := m.fetchMoved(node, items)
+	if err != nil {
+		return err
+	}
+
+	m.FS.mutex.Lock()
+	events, entries := m.reconcileChildren(node, items, moved)
+	repaired, repairedEntries := m.repairNodes()
+	events = append(events, repaired...)
+	entries = append(entries, repairedEntries...)
+	m.FS.mutex.Unlock()
+
+	m.journal(entries...)
+	m.emitEvents(events)
+	return nil
+}
+
+// fetchMoved fetches the children of parent which aren't in items,
+// returning those which still exist elsewhere by handle
+func (m *Mega) fetchMoved(parent *Node, items []FSNode) (map[string]FSNode, error) {
+	seen := make(map[string]bool, len(items))
+	for _, itm := range items {
+		seen[itm.Hash] = true
+	}
+	var missing []string
+	m.FS.mutex.Lock()
+	h := parent.hash
+	for _, c := range parent.children {
+		if !seen[c.hash] {
+			missing = append(missing, c.hash)
+		}
+	}
+	m.FS.mutex.Unlock()
+
+	moved := make(map[string]FSNode)
+	for _, ch := range missing {
+		nodes, err := m.fetchNodes(ch)
+		if err == ENOENT {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, itm := range nodes {
+			if itm.Hash == ch && itm.Parent != h {
+				moved[ch] = itm
+			}
+		}
+	}
+	return moved, nil
+}
+
+// reconcileChildren makes the children of parent match items, adding
+// and updating the nodes in items, moving the other children found in
+// moved and removing the rest
+//
+// Call with the FS mutex held
+func (m *Mega) reconcileChildren(parent *Node, items []FSNode, moved map[string]FSNode) (events []Event, entries []*JournalEntry) {
+	seen := make(map[string]bool, len(items))
+	for _, itm := range items {
+		var ok bool
+		events, entries, ok = m.reconcileNode(itm, m.FS.load != nil, events, entries)
+		if ok {
+			seen[itm.Hash] = true
+		}
+	}
+
+	var gone []*Node
+	for _, c := range parent.children {
+		if !seen[c.hash] {
+			gone = append(gone, c)
+		}
+	}
+	for _, c := range gone {
+		if itm, ok := moved[c.hash]; ok {
+			var found bool
+			events, entries, found = m.reconcileNode(itm, m.FS.load != nil, events, entries)
+			if found {
+				continue
+			}
+		}
+		entries = append(entries, m.journalEntry(JOURNAL_DELETE, JOURNAL_SERVER, "", c, m.FS.pathOf(c)))
+		m.FS.removeTree(c)
+		events = append(events, Event{Type: EVENT_NODE_DELETED, Node: c, Hash: c.hash})
+	}
+	return events, entries
+}
+
+// reconcileNode adds or updates the node itm, moving it if its parent
+// has changed, and appends the events and journal entries for what
+// changed.  New folders are marked unloaded if lazy is set.  It
+// returns false if the node couldn't be added.
+//
+// Call with the FS mutex held
+func (m *Mega) reconcileNode(itm FSNode, lazy bool, events []Event, entries []*JournalEntry) ([]Event, []*JournalEntry, bool) {
+	old := m.FS.lookup[itm.Hash]
+	var oldPath, oldName string
+	var oldParent *Node
+	if old != nil {
+		oldPath = m.FS.pathOf(old)
+		oldName = old.name
+		oldParent = old.parent
+		// addFSNode doesn't detach nodes from their old parent
+		if oldParent != nil && oldParent != m.FS.lookup[itm.Parent] {
+			oldParent.removeChild(old)
+		}
+	}
+	node, err := m.addFSNode(itm)
+	if err != nil {
+		m.debugf("couldn't decode FSNode %#v: %v ", itm, err)
+		return events, entries, false
+	}
+	if node == nil {
+		return events, entries, false
+	}
+	if old == nil && node.ntype == FOLDER && lazy {
+		// lazy loading - its children haven't been fetched
+		node.unloaded = true
+	}
+	switch {
+	case old == nil:
+		entries = append(entries, m.journalEntry(JOURNAL_CREATE, JOURNAL_SERVER, itm.User, node, ""))
+		events = append(events, Event{Type: EVENT_NODE_ADDED, Node: node, Hash: itm.Hash})
+	case oldParent != node.parent:
+		m.FS.noteMove(node, oldParent)
+		entries = append(entries, m.journalEntry(JOURNAL_MOVE, JOURNAL_SERVER, itm.User, node, oldPath))
+		events = append(events, Event{Type: EVENT_NODE_UPDATED, Node: node, Hash: itm.Hash})
+	case oldName != node.name:
+		entries = append(entries, m.journalEntry(JOURNAL_RENAME, JOURNAL_SERVER, itm.User, node, oldPath))
+		events = append(events, Event{Type: EVENT_NODE_UPDATED, Node: node, Hash: itm.Hash})
+	}
+	return events, entries, true
+}
@@ -0,0 +1,139 @@
+package mega
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestRefreshNode(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := m.CreateDir("other", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := uploadString(t, m, dir, "gone.txt", "a")
+	renamed := uploadString(t, m, dir, "renamed.txt", "b")
+	moved := uploadString(t, m, other, "moved.txt", "c")
+
+	var mu sync.Mutex
+	var events []string
+	unsubscribe := m.Subscribe(func(ev Event) {
+		mu.Lock()
+		events = append(events, ev.Type.String()+" "+ev.Hash)
+		mu.Unlock()
+	})
+	defer unsubscribe()
+
+	// Change the account behind the client's back
+	attr, err := encryptAttr(renamed.meta.key, FileAttr{Name: "new name.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.remove(gone.GetHash())
+	b.nodes[renamed.GetHash()].Attr = attr
+	b.nodes[moved.GetHash()].Parent = dir.GetHash()
+	b.mu.Unlock()
+
+	if err = m.RefreshNode(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	children, _ := m.FS.GetChildren(dir)
+	for _, c := range children {
+		names = append(names, c.GetName())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "moved.txt" || names[1] != "new name.txt" {
+		t.Errorf("children after refresh %q", names)
+	}
+	if children, _ := m.FS.GetChildren(other); len(children) != 0 {
+		t.Errorf("moved node still in old folder")
+	}
+	if m.FS.HashLookup(gone.GetHash()) != nil {
+		t.Errorf("removed node still in the tree")
+	}
+
+	mu.Lock()
+	sort.Strings(events)
+	want := []string{
+		"NodeDeleted " + gone.GetHash(),
+		"NodeUpdated " + renamed.GetHash(),
+		"NodeUpdated " + moved.GetHash(),
+	}
+	sort.Strings(want)
+	if len(events) != len(want) {
+		t.Errorf("events %q, want %q", events, want)
+	} else {
+		for i := range want {
+			if events[i] != want[i] {
+				t.Errorf("events %q, want %q", events, want)
+				break
+			}
+		}
+	}
+	mu.Unlock()
+
+	// Nothing changed
+	before := len(events)
+	if err = m.RefreshNode(dir); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(events) != before {
+		t.Errorf("refresh without changes sent events %q", events[before:])
+	}
+	mu.Unlock()
+
+	if err = m.RefreshNode(moved); err != EARGS {
+		t.Errorf("RefreshNode of a file: %v", err)
+	}
+	if err = m.RefreshNode(nil); err != EARGS {
+		t.Errorf("RefreshNode(nil): %v", err)
+	}
+}
+
+func TestRefreshNodeMovedAway(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := m.CreateDir("other", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := uploadString(t, m, dir, "moved.txt", "a")
+	gone := uploadString(t, m, dir, "gone.txt", "b")
+
+	// Move one child out of the folder and delete the other
+	b.mu.Lock()
+	b.nodes[moved.GetHash()].Parent = other.GetHash()
+	b.remove(gone.GetHash())
+	b.mu.Unlock()
+
+	if err = m.RefreshNode(dir); err != nil {
+		t.Fatal(err)
+	}
+	if children, _ := m.FS.GetChildren(dir); len(children) != 0 {
+		t.Errorf("folder has %d children after refresh", len(children))
+	}
+	if children, _ := m.FS.GetChildren(other); len(children) != 1 || children[0] != moved {
+		t.Errorf("node moved away wasn't moved")
+	}
+	if m.FS.HashLookup(gone.GetHash()) != nil {
+		t.Errorf("removed node still in the tree")
+	}
+}
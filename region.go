@@ -0,0 +1,150 @@
+package mega
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIRegions are the MEGA API endpoints probed by SelectAPIRegion
+// when no candidates are given
+var APIRegions = []string{
+	"https://g.api.mega.co.nz",
+	"https://eu.api.mega.co.nz",
+}
+
+// How long the result of a region probe is reused for
+const REGION_CACHE_TTL = time.Hour
+
+// regionCacheEntry is a cached result of probing a set of regions
+type regionCacheEntry struct {
+	url     string
+	expires time.Time
+}
+
+var (
+	regionCacheMu sync.Mutex
+	regionCache   = make(map[string]regionCacheEntry)
+)
+
+// probeRegion measures the time for the API endpoint u to respond by
+// clock
+func probeRegion(ctx context.Context, client *http.Client, clock Clock, u string) (time.Duration, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/cs?id=0", u), bytes.NewBufferString("[]"))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	start := clock.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := clock.Now().Sub(start)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return 0, errors.New("Http Status: " + resp.Status)
+	}
+	return elapsed, nil
+}
+
+// SelectAPIRegion probes the API endpoints in candidates, or
+// APIRegions if none are given, in parallel and sets the API URL to
+// the one which responds fastest, returning it.
+//
+// The result is cached for REGION_CACHE_TTL so new clients probing
+// the same candidates don't pay for the probe again.  ctx may be used
+// to bound how long the probe takes.
+func (m *Mega) SelectAPIRegion(ctx context.Context, candidates ...string) (string, error) {
+	if len(candidates) == 0 {
+		candidates = APIRegions
+	}
+	urls := make([]string, len(candidates))
+	for i, c := range candidates {
+		urls[i] = strings.TrimRight(c, "/")
+	}
+	candidates = urls
+	cacheKey := strings.Join(candidates, " ")
+
+	regionCacheMu.Lock()
+	entry, ok := regionCache[cacheKey]
+	regionCacheMu.Unlock()
+	if ok && m.now().Before(entry.expires) {
+		m.SetAPIUrl(entry.url)
+		return entry.url, nil
+	}
+
+	type result struct {
+		url     string
+		latency time.Duration
+		err     error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(candidates))
+	cfg := m.getConfig()
+	for _, c := range candidates {
+		go func(u string) {
+			latency, err := probeRegion(ctx, m.client, cfg.timeSource(), u)
+			results <- result{url: u, latency: latency, err: err}
+		}(c)
+	}
+
+	// The first successful response is the fastest
+	var err error
+	for range candidates {
+		r := <-results
+		if r.err != nil {
+			m.debugf("SelectAPIRegion: %s failed: %v", r.url, r.err)
+			err = r.err
+			continue
+		}
+		m.debugf("SelectAPIRegion: selected %s (%v)", r.url, r.latency)
+		regionCacheMu.Lock()
+		regionCache[cacheKey] = regionCacheEntry{url: r.url, expires: m.now().Add(REGION_CACHE_TTL)}
+		regionCacheMu.Unlock()
+		m.SetAPIUrl(r.url)
+		return r.url, nil
+	}
+
+	return "", err
+}
+
+// WithAutoRegion makes the client select the fastest of candidates,
+// or APIRegions if none are given, before its first API request.
+//
+// If every candidate fails the configured API URL is used.
+func WithAutoRegion(candidates ...string) Option {
+	return func(m *Mega) error {
+		m.regions = append([]string{}, candidates...)
+		m.autoRegion = true
+		return nil
+	}
+}
+
+// ensureRegion runs the region selection requested by WithAutoRegion
+// once
+func (m *Mega) ensureRegion() {
+	if !m.autoRegion {
+		return
+	}
+	m.regionOnce.Do(func() {
+		timeout := m.getConfig().timeout
+		if timeout <= 0 {
+			timeout = TIMEOUT
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*timeout)
+		defer cancel()
+		_, err := m.SelectAPIRegion(ctx, m.regions...)
+		if err != nil {
+			m.logf("Region selection failed, using %s: %v", m.getConfig().baseurl, err)
+		}
+	})
+}
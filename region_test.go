@@ -0,0 +1,57 @@
+package mega
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelectAPIRegion(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("-2"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("-2"))
+	}))
+	defer fast.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	m := New(WithLogger(nil))
+	u, err := m.SelectAPIRegion(context.Background(), broken.URL, slow.URL, fast.URL)
+	if err != nil {
+		t.Fatalf("SelectAPIRegion failed: %v", err)
+	}
+	if u != fast.URL || m.getConfig().baseurl != fast.URL {
+		t.Errorf("expecting %q to be selected, got %q", fast.URL, u)
+	}
+
+	// Cached result is reused even when the server has gone
+	fast.Close()
+	m2 := New(WithLogger(nil))
+	u, err = m2.SelectAPIRegion(context.Background(), broken.URL, slow.URL, fast.URL)
+	if err != nil || u != fast.URL {
+		t.Errorf("expecting cached result, got %q, %v", u, err)
+	}
+
+	_, err = m2.SelectAPIRegion(context.Background(), broken.URL)
+	if err == nil {
+		t.Error("expecting error when all regions fail")
+	}
+
+	// The cache expires by the client's clock
+	clock := &stepClock{now: time.Now().Add(REGION_CACHE_TTL + time.Minute)}
+	m3 := New(WithLogger(nil), WithClock(clock))
+	if _, err = m3.SelectAPIRegion(context.Background(), broken.URL, slow.URL, fast.URL); err != nil {
+		t.Fatal(err)
+	}
+	if u := m3.getConfig().baseurl; u != slow.URL {
+		t.Errorf("expired cache entry used, got %q", u)
+	}
+}
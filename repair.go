@@ -0,0 +1,101 @@
+package mega
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// repairFile repairs the chunks of the download d in the file at path
+// which are corrupt, see repairChunks, and checks the MAC of the whole
+// file again.
+func (m *Mega) repairFile(d *Download, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	repaired, err := m.repairChunks(d, f)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if len(repaired) == 0 {
+		return d.Finish()
+	}
+	m.logf("%s: MAC mismatch, downloaded chunks %v again", d.src.GetName(), repaired)
+	return d.Finish()
+}
+
+// repairChunks finds the chunks of d in f which are corrupt and
+// downloads them again, returning the ids of those rewritten.
+//
+// The MAC of each chunk was saved as it was downloaded, or resumed, so
+// first the chunks in f are checked against those, which finds those
+// damaged since.  If none are, the damage was done before the MACs
+// were made, say by a resumed chunk with a hole in it, so each chunk is
+// fetched again and those which differ from the saved MAC are
+// rewritten.  This costs a whole download but only writes what is bad.
+func (m *Mega) repairChunks(d *Download, f io.WriterAt) (repaired []int, err error) {
+	d.mutex.Lock()
+	saved := append([][]byte(nil), d.chunk_macs...)
+	d.mutex.Unlock()
+
+	rewrite := func(id int, chunk []byte) error {
+		pos, _, err := d.ChunkLocation(id)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(chunk, pos)
+		if err != nil {
+			return err
+		}
+		repaired = append(repaired, id)
+		return nil
+	}
+
+	if r, ok := f.(io.ReaderAt); ok {
+		for id := 0; id < d.Chunks(); id++ {
+			pos, size, err := d.ChunkLocation(id)
+			if err != nil {
+				return nil, err
+			}
+			chunk := make([]byte, size)
+			_, err = r.ReadAt(chunk, pos)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if bytes.Equal(chunkMAC(d.aes_block, d.iv, chunk), saved[id]) {
+				continue
+			}
+			m.debugf("%s: chunk %d changed on disk", d.src.GetName(), id)
+			chunk, err = d.DownloadChunk(id)
+			if err != nil {
+				return nil, err
+			}
+			if err = rewrite(id, chunk); err != nil {
+				return nil, err
+			}
+		}
+		if len(repaired) > 0 {
+			return repaired, nil
+		}
+	}
+
+	for id := 0; id < d.Chunks(); id++ {
+		chunk, err := d.DownloadChunk(id)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(chunkMAC(d.aes_block, d.iv, chunk), saved[id]) {
+			continue
+		}
+		m.debugf("%s: chunk %d differs when downloaded again", d.src.GetName(), id)
+		if err = rewrite(id, chunk); err != nil {
+			return nil, err
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,85 @@
+package mega
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairDownload(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "src", 600000)
+	n, err := m.UploadFile(filepath.Join(dir, "src"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := n.GetHash()
+	dst := filepath.Join(dir, "dst")
+	if err = m.DownloadFile(n, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resumed chunk is damaged so its MAC is wrong from the start
+	// and every chunk has to be fetched again to find it
+	damage := func(f string, off int64) {
+		t.Helper()
+		fh, err := os.OpenFile(f, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fh.WriteAt(make([]byte, 100), off)
+		_ = fh.Close()
+	}
+	damage(dst, 200000)
+	if err = m.DownloadFileWith(n, dst, DownloadOptions{Resume: true}); !errors.Is(err, EMACMISMATCH) {
+		t.Fatalf("without Repair: got %v", err)
+	}
+	if err = m.DownloadFileWith(n, dst, DownloadOptions{Resume: true, Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Errorf("repaired download differs")
+	}
+
+	// Damage done after downloading is found on disk so only that
+	// chunk is fetched again
+	f, err := os.OpenFile(filepath.Join(dir, "dst2"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := m.NewDownload(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.downloadChunks(d, f, nil); err != nil {
+		t.Fatal(err)
+	}
+	pos, _, _ := d.ChunkLocation(2)
+	_, _ = f.WriteAt([]byte("oops"), pos+10)
+	before := chunkRequests(b, h+"/")
+	repaired, err := m.repairChunks(d, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 1 || repaired[0] != 2 || chunkRequests(b, h+"/")-before != 1 {
+		t.Errorf("repaired %v fetching %d chunks", repaired, chunkRequests(b, h+"/")-before)
+	}
+	if err = d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err = f.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("repaired file differs: %v", err)
+	}
+}
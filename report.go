@@ -0,0 +1,103 @@
+package mega
+
+// ItemStatus is what happened to a single file in a bulk operation
+type ItemStatus int
+
+// Item statuses
+const (
+	ITEM_DONE    ItemStatus = iota // transferred or removed
+	ITEM_SKIPPED                   // left alone, see the error for why
+	ITEM_FAILED                    // failed with the error
+)
+
+func (s ItemStatus) String() string {
+	switch s {
+	case ITEM_DONE:
+		return "done"
+	case ITEM_SKIPPED:
+		return "skipped"
+	case ITEM_FAILED:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ItemResult is the outcome for a single file of a bulk operation
+type ItemResult struct {
+	// Path affected, relative to the root of the operation using
+	// forward slashes
+	Path   string
+	Status ItemStatus
+	// Why the item failed or was skipped
+	Err error
+}
+
+// Report lists what happened to each file a bulk operation or sync
+// pass acted on.  Files which were already up to date aren't listed.
+type Report struct {
+	Items []ItemResult
+	// Aborted is set if the operation stopped early because the
+	// failure threshold was reached
+	Aborted bool
+
+	threshold int
+	failures  int
+}
+
+// newReport returns a report for an operation which stops after
+// threshold failures, 0 for no limit
+func newReport(threshold int) *Report {
+	return &Report{threshold: threshold}
+}
+
+// add records the result for path, returning true if the operation
+// should stop.  A nil report records nothing.
+func (r *Report) add(path string, status ItemStatus, err error) bool {
+	if r == nil {
+		return false
+	}
+	r.Items = append(r.Items, ItemResult{Path: path, Status: status, Err: err})
+	if status != ITEM_FAILED {
+		return false
+	}
+	r.failures++
+	if r.threshold > 0 && r.failures >= r.threshold {
+		r.Aborted = true
+	}
+	return r.Aborted
+}
+
+// Count returns the number of items with status
+func (r *Report) Count(status ItemStatus) int {
+	n := 0
+	for _, it := range r.Items {
+		if it.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the items which failed
+func (r *Report) Failed() []ItemResult {
+	var failed []ItemResult
+	for _, it := range r.Items {
+		if it.Status == ITEM_FAILED {
+			failed = append(failed, it)
+		}
+	}
+	return failed
+}
+
+// WithFailureThreshold makes DownloadDir, UploadDir and new Syncers and
+// Mirrors stop once n files have failed, returning ETOOMANYFAILURES.
+// The default of 0 carries on regardless.
+func WithFailureThreshold(n int) Option {
+	return func(m *Mega) error {
+		if n < 0 {
+			return EARGS
+		}
+		m.config.failureThreshold = n
+		return nil
+	}
+}
@@ -0,0 +1,88 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadDirReport(t *testing.T) {
+	m, b := newFakeMegaWith(t, func(m *Mega) {
+		if err := WithFailureThreshold(2)(m); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer b.Close()
+
+	top, err := m.CreateDir("top", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, top, "a.txt", "a")
+	bad1 := uploadString(t, m, top, "b.txt", "b")
+	uploadString(t, m, top, "..", "evil")
+
+	dir, err := ioutil.TempDir("", "mega-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b.mu.Lock()
+	b.failDownload = func(h string, start int) bool {
+		return h == bad1.GetHash()
+	}
+	b.mu.Unlock()
+	report, err := m.DownloadDirReport(top, dir)
+	if err == nil || err == ETOOMANYFAILURES {
+		t.Fatalf("want the download error, got %v", err)
+	}
+	if report.Aborted || report.Count(ITEM_DONE) != 1 || report.Count(ITEM_SKIPPED) != 1 {
+		t.Errorf("wrong report %+v", report)
+	}
+	failed := report.Failed()
+	if len(failed) != 1 || failed[0].Path != "b.txt" || failed[0].Err == nil {
+		t.Errorf("wrong failures %+v", failed)
+	}
+
+	// A second failure reaches the threshold
+	bad2 := uploadString(t, m, top, "c.txt", "c")
+	b.mu.Lock()
+	b.failDownload = func(h string, start int) bool {
+		return h == bad1.GetHash() || h == bad2.GetHash()
+	}
+	b.mu.Unlock()
+	report, err = m.DownloadDirReport(top, dir)
+	if err != ETOOMANYFAILURES || !report.Aborted || len(report.Failed()) != 2 {
+		t.Errorf("want abort after 2 failures, got %v %+v", err, report)
+	}
+}
+
+func TestUploadDirReport(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err = os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"x.txt", "sub/y.txt"} {
+		if err = ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(p)), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := m.UploadDirReport(src, m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Count(ITEM_DONE) != 2 || len(report.Failed()) != 0 {
+		t.Errorf("wrong report %+v", report)
+	}
+}
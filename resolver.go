@@ -0,0 +1,39 @@
+package mega
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver looks up the addresses of the API and storage hosts for
+// the default HTTP clients, see WithResolver.  *net.Resolver is one.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// StaticHosts is a Resolver with fixed addresses for hosts, say to
+// point the library at a test server in an air-gapped environment or
+// work around broken DNS.  A key of "*.example.com" matches every host
+// under example.com, so "*.userstorage.mega.co.nz" covers all the
+// storage servers.  Hosts not listed are looked up in DNS.
+type StaticHosts map[string][]string
+
+// LookupHost returns the addresses listed for host
+func (s StaticHosts) LookupHost(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := s[host]; ok {
+		return append([]string(nil), addrs...), nil
+	}
+	for domain := host; ; {
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+		if addrs, ok := s["*."+domain]; ok {
+			return append([]string(nil), addrs...), nil
+		}
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
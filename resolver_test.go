@@ -0,0 +1,64 @@
+//go:build !js
+// +build !js
+
+package mega
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStaticHosts(t *testing.T) {
+	hosts := StaticHosts{
+		"g.api.mega.co.nz":         {"10.0.0.1"},
+		"*.userstorage.mega.co.nz": {"10.0.0.2", "10.0.0.3"},
+	}
+	for _, test := range []struct {
+		host string
+		want string
+	}{
+		{"g.api.mega.co.nz", "[10.0.0.1]"},
+		{"G.API.mega.co.nz.", "[10.0.0.1]"},
+		{"gfs262n300.userstorage.mega.co.nz", "[10.0.0.2 10.0.0.3]"},
+	} {
+		addrs, err := hosts.LookupHost(context.Background(), test.host)
+		if err != nil {
+			t.Errorf("%s: %v", test.host, err)
+			continue
+		}
+		if got := fmt.Sprint(addrs); got != test.want {
+			t.Errorf("%s: want %s got %s", test.host, test.want, got)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		return map[string]interface{}{"u": "me"}
+	})
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The API host only exists in the static mapping
+	m := New(
+		WithLogger(nil),
+		WithAPIURL("http://api.mega.invalid:"+u.Port()),
+		WithResolver(StaticHosts{"api.mega.invalid": {"192.0.2.1", u.Hostname()}}),
+		WithTimeout(500*time.Millisecond),
+	)
+	m.sid = "good"
+	if err = m.Ping(context.Background()); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+
+	if err = WithResolver(nil)(m); err == nil {
+		t.Errorf("nil resolver accepted")
+	}
+}
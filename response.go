@@ -0,0 +1,204 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SetStrictDecoding makes replies from the API which aren't the shape
+// expected, or which have fields this package doesn't know, fail with
+// a *SchemaError rather than being made sense of.  It is meant for
+// debugging against a server which has changed; by default the replies
+// are decoded as tolerantly as they can be.
+func (m *Mega) SetStrictDecoding(strict bool) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.strict = strict
+}
+
+// WithStrictDecoding makes replies which aren't as expected fail
+func WithStrictDecoding() Option {
+	return func(m *Mega) error {
+		m.config.strict = true
+		return nil
+	}
+}
+
+// UnknownFields returns the fields seen in replies from the API which
+// this package doesn't know, keyed by the type of the reply and the
+// name of the field, for example "FilesResp.x", with the first value
+// seen.  They are kept so the server adding fields can be spotted
+// without stopping the client.
+func (m *Mega) UnknownFields() map[string]json.RawMessage {
+	m.unknownMu.Lock()
+	defer m.unknownMu.Unlock()
+	fields := make(map[string]json.RawMessage, len(m.unknown))
+	for k, v := range m.unknown {
+		fields[k] = v
+	}
+	return fields
+}
+
+// skipValue is decoded into to find the keys of an object without
+// keeping the values
+type skipValue struct{}
+
+func (*skipValue) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// knownFields caches the JSON field names of the reply types
+var knownFields sync.Map // reflect.Type -> map[string]bool
+
+// fieldsOf returns the JSON field names of the struct type t
+func fieldsOf(t reflect.Type) map[string]bool {
+	if f, ok := knownFields.Load(t); ok {
+		return f.(map[string]bool)
+	}
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			for n := range fieldsOf(f.Type) {
+				fields[n] = true
+			}
+			continue
+		}
+		fields[name] = true
+		// encoding/json matches names without regard to case
+		fields[strings.ToLower(name)] = true
+	}
+	knownFields.Store(t, fields)
+	return fields
+}
+
+// decodeResponse decodes buf, the reply to a single command, into res,
+// a pointer to a one element array as the commands are sent.
+//
+// The server has been seen to change the shape of its replies so an
+// object on its own is taken as the array holding it, and an error
+// code, bare or as {"err":code}, in place of the reply returns the
+// error.  Fields which aren't known are noted for UnknownFields.  In
+// strict mode a change of shape or an unknown field returns a
+// *SchemaError instead.
+func (m *Mega) decodeResponse(buf []byte, res interface{}) error {
+	rt := reflect.TypeOf(res)
+	if rt == nil || rt.Kind() != reflect.Ptr || rt.Elem().Kind() != reflect.Array {
+		return json.Unmarshal(buf, res)
+	}
+	et := rt.Elem().Elem()
+	name := et.Name()
+	strict := m.getConfig().strict
+
+	buf = bytes.TrimSpace(buf)
+	if bytes.HasPrefix(buf, []byte("{")) {
+		if strict {
+			return &SchemaError{Type: name, Reason: "object instead of array"}
+		}
+		buf = append(append([]byte("["), buf...), ']')
+	}
+
+	// Look at the first element as a stream of tokens, which doesn't
+	// build the values, before decoding the reply
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	_, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if !dec.More() {
+		return EBADRESP
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	numeric := et.Kind() >= reflect.Int && et.Kind() <= reflect.Float64
+	if num, ok := tok.(json.Number); ok && !numeric {
+		if errno, err := num.Int64(); err == nil {
+			if err = parseError(ErrorMsg(errno)); err != nil {
+				return err
+			}
+		}
+		return EBADRESP
+	}
+	if tok != json.Delim('{') || et.Kind() != reflect.Struct {
+		return json.Unmarshal(buf, res)
+	}
+
+	// The keys of the object and the values of those not known
+	known := fieldsOf(et)
+	keys := 0
+	var unknown []string
+	values := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		k, _ := tok.(string)
+		keys++
+		if known[k] || known[strings.ToLower(k)] {
+			err = dec.Decode(&skipValue{})
+		} else {
+			var v json.RawMessage
+			err = dec.Decode(&v)
+			unknown = append(unknown, k)
+			values[k] = v
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if v, ok := values["err"]; ok && keys == 1 {
+		var errno ErrorMsg
+		if json.Unmarshal(v, &errno) == nil {
+			if err = parseError(errno); err != nil {
+				return err
+			}
+		}
+	}
+	for _, k := range unknown {
+		if strict {
+			return &SchemaError{Type: name, Field: k, Reason: "unknown field"}
+		}
+		m.noteUnknown(name+"."+k, values[k])
+	}
+	return json.Unmarshal(buf, res)
+}
+
+// noteUnknown keeps value, that of an unknown field, the first time
+// key is seen
+func (m *Mega) noteUnknown(key string, value json.RawMessage) {
+	m.unknownMu.Lock()
+	_, seen := m.unknown[key]
+	m.unknownMu.Unlock()
+	if seen {
+		return
+	}
+	m.debugf("API reply has unknown field %s", key)
+	m.unknownMu.Lock()
+	defer m.unknownMu.Unlock()
+	if m.unknown == nil {
+		m.unknown = make(map[string]json.RawMessage)
+	}
+	if _, seen = m.unknown[key]; !seen {
+		m.unknown[key] = value
+	}
+}
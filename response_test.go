@@ -0,0 +1,79 @@
+package mega
+
+import (
+	"testing"
+)
+
+type testReply struct {
+	Name  string `json:"name"`
+	Count int
+}
+
+func TestDecodeResponse(t *testing.T) {
+	m := New()
+	var res [1]testReply
+
+	// An object on its own is taken as the array holding it
+	err := m.decodeResponse([]byte(` {"name":"a","count":2}`), &res)
+	if err != nil || res[0].Name != "a" || res[0].Count != 2 {
+		t.Errorf("object: got %+v, %v", res[0], err)
+	}
+	for _, reply := range []string{`[-9]`, `[ -9 ]`, `[{"err":-9}]`, `{"err":-9}`} {
+		if err = m.decodeResponse([]byte(reply), &res); err != ENOENT {
+			t.Errorf("%s: got %v, want ENOENT", reply, err)
+		}
+	}
+	if err = m.decodeResponse([]byte(`[]`), &res); err != EBADRESP {
+		t.Errorf("empty: got %v, want EBADRESP", err)
+	}
+
+	// Unknown fields are kept
+	err = m.decodeResponse([]byte(`[{"name":"b","new":{"x":1},"Count":3}]`), &res)
+	if err != nil || res[0].Name != "b" || res[0].Count != 3 {
+		t.Errorf("unknown field: got %+v, %v", res[0], err)
+	}
+	err = m.decodeResponse([]byte(`[{"new":2}]`), &res)
+	if err != nil {
+		t.Error(err)
+	}
+	fields := m.UnknownFields()
+	if len(fields) != 1 || string(fields["testReply.new"]) != `{"x":1}` {
+		t.Errorf("unknown fields %q", fields)
+	}
+
+	// Strict mode fails instead
+	m.SetStrictDecoding(true)
+	err = m.decodeResponse([]byte(`{"name":"a"}`), &res)
+	if e, ok := err.(*SchemaError); !ok || e.Type != "testReply" || e.Field != "" {
+		t.Errorf("strict object: got %v", err)
+	}
+	err = m.decodeResponse([]byte(`[{"name":"a","other":1}]`), &res)
+	if e, ok := err.(*SchemaError); !ok || e.Field != "other" {
+		t.Errorf("strict unknown field: got %v", err)
+	}
+	if err = m.decodeResponse([]byte(`[{"err":-9}]`), &res); err != ENOENT {
+		t.Errorf("strict error code: got %v, want ENOENT", err)
+	}
+	if err = m.decodeResponse([]byte(`[{"name":"c"}]`), &res); err != nil || res[0].Name != "c" {
+		t.Errorf("strict: got %+v, %v", res[0], err)
+	}
+}
+
+func TestStrictDecodingFake(t *testing.T) {
+	m, b := newFakeMegaWith(t, func(m *Mega) {
+		_ = WithStrictDecoding()(m)
+	})
+	defer b.Close()
+
+	dir, err := m.CreateDir("dir", m.FS.GetRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := uploadString(t, m, dir, "f.txt", "hello")
+	if _, err = m.NewDownload(n); err != nil {
+		t.Fatal(err)
+	}
+	if fields := m.UnknownFields(); len(fields) != 0 {
+		t.Errorf("unknown fields %q", fields)
+	}
+}
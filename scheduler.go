@@ -0,0 +1,132 @@
+package mega
+
+import (
+	"sync"
+)
+
+// TransferPriority orders transfers in a TransferManager
+type TransferPriority int
+
+// Transfer priorities.  The zero value is PRIORITY_NORMAL.
+const (
+	PRIORITY_LOW    TransferPriority = -1
+	PRIORITY_NORMAL TransferPriority = 0
+	PRIORITY_HIGH   TransferPriority = 1
+)
+
+func (p TransferPriority) String() string {
+	switch p {
+	case PRIORITY_LOW:
+		return "low"
+	case PRIORITY_NORMAL:
+		return "normal"
+	case PRIORITY_HIGH:
+		return "high"
+	}
+	return "unknown"
+}
+
+// weight returns the share of chunk slots a priority gets relative to
+// the others when they compete
+func (p TransferPriority) weight() float64 {
+	switch {
+	case p >= PRIORITY_HIGH:
+		return 4
+	case p <= PRIORITY_LOW:
+		return 1
+	}
+	return 2
+}
+
+// chunkScheduler hands out a fixed number of chunk slots to the
+// running transfers using weighted fair queueing between the priority
+// classes.  When classes compete, high gets 4 chunks for every 2 of
+// normal and 1 of low, so a high priority download overtakes a low
+// priority backup while letting it carry on slowly.
+type chunkScheduler struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	slots   int
+	waiting map[TransferPriority]int
+	// virtual time of each class, advanced by 1/weight per chunk
+	vtime map[TransferPriority]float64
+	// virtual time of the last chunk handed out
+	now float64
+}
+
+// newChunkScheduler returns a scheduler with slots chunk slots
+func newChunkScheduler(slots int) *chunkScheduler {
+	s := &chunkScheduler{
+		slots:   slots,
+		waiting: make(map[TransferPriority]int),
+		vtime:   make(map[TransferPriority]float64),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+// turn returns the class which should get the next slot
+//
+// Call with the mutex held
+func (s *chunkScheduler) turn() TransferPriority {
+	first := true
+	var best TransferPriority
+	for p, n := range s.waiting {
+		if n == 0 {
+			continue
+		}
+		if first || s.vtime[p] < s.vtime[best] || (s.vtime[p] == s.vtime[best] && p > best) {
+			best = p
+			first = false
+		}
+	}
+	return best
+}
+
+// acquire waits for a chunk slot for a transfer of priority p.  It
+// returns false without a slot if stop is closed.
+func (s *chunkScheduler) acquire(p TransferPriority, stop <-chan struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.waiting[p] == 0 && s.vtime[p] < s.now {
+		// an idle class doesn't bank its unused share
+		s.vtime[p] = s.now
+	}
+	s.waiting[p]++
+	defer func() {
+		s.waiting[p]--
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		if s.slots > 0 && s.turn() == p {
+			s.slots--
+			s.now = s.vtime[p]
+			s.vtime[p] += 1 / p.weight()
+			// someone else may be next
+			s.changed.Broadcast()
+			return true
+		}
+		s.changed.Wait()
+	}
+}
+
+// release returns a chunk slot
+func (s *chunkScheduler) release() {
+	s.mu.Lock()
+	s.slots++
+	s.changed.Broadcast()
+	s.mu.Unlock()
+}
+
+// wake makes waiters check their stop channels
+func (s *chunkScheduler) wake() {
+	s.mu.Lock()
+	s.changed.Broadcast()
+	s.mu.Unlock()
+}
@@ -0,0 +1,46 @@
+package mega
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkSchedulerWeights(t *testing.T) {
+	s := newChunkScheduler(0)
+	stop := make(chan struct{})
+	got := make(chan TransferPriority)
+	for i := 0; i < 10; i++ {
+		for _, p := range []TransferPriority{PRIORITY_LOW, PRIORITY_HIGH} {
+			go func(p TransferPriority) {
+				if s.acquire(p, stop) {
+					got <- p
+				}
+			}(p)
+		}
+	}
+	waitFor(t, "waiters", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.waiting[PRIORITY_LOW] == 10 && s.waiting[PRIORITY_HIGH] == 10
+	})
+
+	// Hand out the slots one at a time
+	high := 0
+	for i := 0; i < 10; i++ {
+		s.release()
+		if <-got == PRIORITY_HIGH {
+			high++
+		}
+	}
+	if high != 8 {
+		t.Errorf("high priority got %d of 10 slots, want 8", high)
+	}
+
+	close(stop)
+	s.wake()
+	select {
+	case p := <-got:
+		t.Errorf("%s waiter got a slot after stop", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
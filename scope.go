@@ -0,0 +1,232 @@
+package mega
+
+import (
+	"strings"
+)
+
+// Scope is a view of a Mega client confined to one folder.  Paths are
+// relative to the folder and nodes outside it can't be used, so an
+// application storing each tenant under its own folder can hand a
+// tenant's code a Scope rather than the whole account.
+//
+// Operations on nodes outside the folder fail with EACCESS.  The Scope
+// shares the session, configuration and filesystem of the Mega it came
+// from.
+type Scope struct {
+	m    *Mega
+	root *Node
+}
+
+// Scoped returns a view of the client whose root is the folder root
+func (m *Mega) Scoped(root *Node) (*Scope, error) {
+	if root == nil || (root.GetType() != FOLDER && root.GetType() != ROOT) {
+		return nil, EARGS
+	}
+	return &Scope{m: m, root: root}, nil
+}
+
+// Root returns the folder the scope is confined to
+func (s *Scope) Root() *Node {
+	return s.root
+}
+
+// Contains returns true if n is the root of the scope or below it
+func (s *Scope) Contains(n *Node) bool {
+	s.m.FS.mutex.Lock()
+	defer s.m.FS.mutex.Unlock()
+	return s.contains(n)
+}
+
+// contains is Contains with the FS mutex held
+func (s *Scope) contains(n *Node) bool {
+	for ; n != nil; n = n.parent {
+		if n == s.root {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns EACCESS unless all the nodes are in the scope
+func (s *Scope) check(nodes ...*Node) error {
+	for _, n := range nodes {
+		if n == nil {
+			return EARGS
+		}
+		if !s.Contains(n) {
+			return EACCESS
+		}
+	}
+	return nil
+}
+
+// checkBelow returns EACCESS unless n is in the scope and isn't its
+// root
+func (s *Scope) checkBelow(n *Node) error {
+	err := s.check(n)
+	if err == nil && n == s.root {
+		return EACCESS
+	}
+	return err
+}
+
+// splitPath splits a slash separated path relative to the root into
+// names, rejecting ones which try to climb out
+func splitPath(p string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(p, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			return nil, EACCESS
+		default:
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Lookup returns the node at the slash separated path relative to the
+// root, the root itself for ""
+func (s *Scope) Lookup(p string) (*Node, error) {
+	names, err := splitPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return s.root, nil
+	}
+	nodes, err := s.m.FS.PathLookup(s.root, names)
+	if err != nil {
+		return nil, err
+	}
+	return nodes[len(nodes)-1], nil
+}
+
+// Path returns the slash separated path of n relative to the root, ""
+// for the root itself
+func (s *Scope) Path(n *Node) (string, error) {
+	s.m.FS.mutex.Lock()
+	defer s.m.FS.mutex.Unlock()
+	if n == nil {
+		return "", EARGS
+	}
+	var names []string
+	for ; n != s.root; n = n.parent {
+		if n == nil {
+			return "", EACCESS
+		}
+		names = append([]string{n.name}, names...)
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// Children returns the nodes in the folder n
+func (s *Scope) Children(n *Node) ([]*Node, error) {
+	err := s.check(n)
+	if err != nil {
+		return nil, err
+	}
+	return s.m.FS.GetChildren(n)
+}
+
+// CreateDir creates the folder name in parent
+func (s *Scope) CreateDir(name string, parent *Node) (*Node, error) {
+	err := s.check(parent)
+	if err != nil {
+		return nil, err
+	}
+	return s.m.CreateDir(name, parent)
+}
+
+// MkdirAll returns the folder at the slash separated path relative to
+// the root, creating it and any missing parents
+func (s *Scope) MkdirAll(p string) (*Node, error) {
+	names, err := splitPath(p)
+	if err != nil {
+		return nil, err
+	}
+	n := s.root
+	for _, name := range names {
+		nodes, err := s.m.FS.PathLookup(n, []string{name})
+		switch {
+		case err == nil:
+			n = nodes[0]
+			if !n.IsFolder() {
+				return nil, EEXIST
+			}
+		case err == ENOENT:
+			n, err = s.m.CreateDir(name, n)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// UploadFile uploads srcpath into parent, see Mega.UploadFile
+func (s *Scope) UploadFile(srcpath string, parent *Node, name string, progress *chan int) (*Node, error) {
+	err := s.check(parent)
+	if err != nil {
+		if progress != nil {
+			close(*progress)
+		}
+		return nil, err
+	}
+	return s.m.UploadFile(srcpath, parent, name, progress)
+}
+
+// DownloadFile downloads src to dstpath, see Mega.DownloadFile
+func (s *Scope) DownloadFile(src *Node, dstpath string, progress *chan int) error {
+	err := s.check(src)
+	if err != nil {
+		if progress != nil {
+			close(*progress)
+		}
+		return err
+	}
+	return s.m.DownloadFile(src, dstpath, progress)
+}
+
+// Move moves src into parent.  Both must be in the scope.
+func (s *Scope) Move(src *Node, parent *Node) error {
+	err := s.checkBelow(src)
+	if err == nil {
+		err = s.check(parent)
+	}
+	if err != nil {
+		return err
+	}
+	return s.m.Move(src, parent)
+}
+
+// Rename renames src which mustn't be the root
+func (s *Scope) Rename(src *Node, name string) error {
+	err := s.checkBelow(src)
+	if err != nil {
+		return err
+	}
+	return s.m.Rename(src, name)
+}
+
+// Delete moves node to the trash of the account, or deletes it
+// permanently if destroy is set.  The root can't be deleted.
+func (s *Scope) Delete(node *Node, destroy bool) error {
+	err := s.checkBelow(node)
+	if err != nil {
+		return err
+	}
+	return s.m.Delete(node, destroy)
+}
+
+// Link returns a public link to n, see Mega.Link
+func (s *Scope) Link(n *Node, includeKey bool) (string, error) {
+	err := s.check(n)
+	if err != nil {
+		return "", err
+	}
+	return s.m.Link(n, includeKey)
+}
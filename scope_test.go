@@ -0,0 +1,83 @@
+package mega
+
+import (
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	tenantA, err := m.CreateDir("tenant-a", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantB, err := m.CreateDir("tenant-b", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := uploadString(t, m, tenantB, "secret.txt", "not yours")
+
+	s, err := m.Scoped(tenantA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := s.MkdirAll("docs/2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.MkdirAll("/docs/2024/")
+	if err != nil || again != docs {
+		t.Errorf("MkdirAll of existing path gave %v %v", again, err)
+	}
+	f := uploadString(t, m, docs, "report.txt", "hello")
+
+	n, err := s.Lookup("docs/2024/report.txt")
+	if err != nil || n != f {
+		t.Errorf("Lookup: %v %v", n, err)
+	}
+	if n, err := s.Lookup(""); err != nil || n != tenantA {
+		t.Errorf("Lookup of root: %v %v", n, err)
+	}
+	if p, err := s.Path(f); err != nil || p != "docs/2024/report.txt" {
+		t.Errorf("Path: %q %v", p, err)
+	}
+	if _, err := s.Lookup("../tenant-b/secret.txt"); err != EACCESS {
+		t.Errorf("Lookup escaping the scope: %v", err)
+	}
+	if _, err := s.Lookup("docs/missing"); err != ENOENT {
+		t.Errorf("Lookup of missing path: %v", err)
+	}
+
+	// Nothing outside can be touched
+	for name, err := range map[string]error{
+		"path":     func() error { _, err := s.Path(other); return err }(),
+		"children": func() error { _, err := s.Children(tenantB); return err }(),
+		"mkdir":    func() error { _, err := s.CreateDir("x", tenantB); return err }(),
+		"move in":  s.Move(other, docs),
+		"move out": s.Move(f, tenantB),
+		"rename":   s.Rename(other, "mine.txt"),
+		"delete":   s.Delete(other, true),
+		"root":     s.Delete(tenantA, true),
+		"download": s.DownloadFile(other, "unused", nil),
+	} {
+		if err != EACCESS {
+			t.Errorf("%s: want EACCESS, got %v", name, err)
+		}
+	}
+	if other.parent != tenantB || other.GetName() != "secret.txt" {
+		t.Error("node outside the scope moved")
+	}
+
+	// Inside works
+	if err := s.Rename(f, "final.txt"); err != nil {
+		t.Errorf("Rename: %v", err)
+	}
+	if err := s.Move(f, tenantA); err != nil {
+		t.Errorf("Move: %v", err)
+	}
+	if n, err := s.Lookup("final.txt"); err != nil || n != f {
+		t.Errorf("Lookup after move: %v %v", n, err)
+	}
+}
@@ -0,0 +1,181 @@
+package mega
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Selection is a selective sync configuration for a Syncer or Mirror,
+// as in the official clients.  Folders are named by their slash
+// separated path relative to the root of the sync.
+//
+// Everything is synced until folders are excluded or included.  Once
+// any folder is included only the included folders and the folders
+// leading to them are synced.  The deepest rule above a path wins, so
+// a folder can be excluded from inside an included one and the other
+// way round.
+//
+// Files already synced in a folder which is then left out stay where
+// they are but are no longer tracked.
+type Selection struct {
+	mu    sync.Mutex
+	path  string
+	rules map[string]bool // true to include
+}
+
+// selectionFile is the on disk format of a Selection
+type selectionFile struct {
+	Version int      `json:"version"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// NewSelection returns an empty Selection kept only in memory
+func NewSelection() *Selection {
+	return &Selection{rules: make(map[string]bool)}
+}
+
+// LoadSelection opens the Selection saved in the file at path,
+// starting empty if it doesn't exist yet.  Save writes it back.
+func LoadSelection(path string) (*Selection, error) {
+	s := NewSelection()
+	s.path = path
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file selectionFile
+	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range file.Include {
+		s.rules[cleanRel(rel)] = true
+	}
+	for _, rel := range file.Exclude {
+		s.rules[cleanRel(rel)] = false
+	}
+	return s, nil
+}
+
+// cleanRel returns the slash separated relative path rel in canonical
+// form, "" for the root
+func cleanRel(rel string) string {
+	return strings.Trim(path.Clean("/"+rel), "/")
+}
+
+// Include syncs the folder rel and everything below it
+func (s *Selection) Include(rel string) {
+	s.mu.Lock()
+	s.rules[cleanRel(rel)] = true
+	s.mu.Unlock()
+}
+
+// Exclude leaves the folder rel and everything below it out
+func (s *Selection) Exclude(rel string) {
+	s.mu.Lock()
+	s.rules[cleanRel(rel)] = false
+	s.mu.Unlock()
+}
+
+// Clear removes any rule for the folder rel
+func (s *Selection) Clear(rel string) {
+	s.mu.Lock()
+	delete(s.rules, cleanRel(rel))
+	s.mu.Unlock()
+}
+
+// rulePaths returns the folders with rules set to include, sorted
+//
+// Call with the mutex held
+func (s *Selection) rulePaths(include bool) []string {
+	var paths []string
+	for rel, inc := range s.rules {
+		if inc == include {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Included returns the included folders
+func (s *Selection) Included() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rulePaths(true)
+}
+
+// Excluded returns the excluded folders
+func (s *Selection) Excluded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rulePaths(false)
+}
+
+// Selected returns true if the file or folder rel is synced.  Every
+// path is selected by a nil Selection.
+func (s *Selection) Selected(rel string) bool {
+	if s == nil {
+		return true
+	}
+	rel = cleanRel(rel)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the deepest rule at or above rel
+	for p := rel; ; p = path.Dir(p) {
+		if p == "." {
+			p = ""
+		}
+		if include, ok := s.rules[p]; ok {
+			return include
+		}
+		if p == "" {
+			break
+		}
+	}
+
+	// no rule applies - selected unless something is included, when
+	// only the folders leading to it are
+	included := false
+	for p, include := range s.rules {
+		if !include {
+			continue
+		}
+		included = true
+		if rel == "" || strings.HasPrefix(p, rel+"/") {
+			return true
+		}
+	}
+	return !included
+}
+
+// Save writes the Selection to the file it was loaded from.  It does
+// nothing for one made with NewSelection.
+func (s *Selection) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(selectionFile{
+		Version: 1,
+		Include: s.rulePaths(true),
+		Exclude: s.rulePaths(false),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, buf)
+}
@@ -0,0 +1,160 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelection(t *testing.T) {
+	var none *Selection
+	if !none.Selected("any/path") {
+		t.Errorf("nil selection should select everything")
+	}
+
+	s := NewSelection()
+	s.Exclude("/photos/")
+	for rel, want := range map[string]bool{
+		"":                  true,
+		"docs/a.txt":        true,
+		"photos":            false,
+		"photos/2020/x.jpg": false,
+		"photosx":           true,
+	} {
+		if got := s.Selected(rel); got != want {
+			t.Errorf("exclude: Selected(%q) = %v, want %v", rel, got, want)
+		}
+	}
+
+	s.Include("docs/work")
+	s.Exclude("docs/work/old")
+	for rel, want := range map[string]bool{
+		"":                  true,
+		"docs":              true,
+		"docs/a.txt":        false,
+		"docs/work/b.txt":   true,
+		"docs/work/old":     false,
+		"docs/work/old/c":   false,
+		"other":             false,
+		"photos/2020/x.jpg": false,
+	} {
+		if got := s.Selected(rel); got != want {
+			t.Errorf("include: Selected(%q) = %v, want %v", rel, got, want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "mega-selection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "selection.json")
+	saved, err := LoadSelection(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.Include("docs/work")
+	saved.Exclude("photos")
+	saved.Exclude("tmp")
+	saved.Clear("tmp")
+	if err = saved.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSelection(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inc, exc := loaded.Included(), loaded.Excluded(); len(inc) != 1 || inc[0] != "docs/work" || len(exc) != 1 || exc[0] != "photos" {
+		t.Errorf("loaded %q %q", inc, exc)
+	}
+}
+
+func TestMirrorSelection(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	keep, err := m.CreateDir("keep", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skip, err := m.CreateDir("skip", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadString(t, m, keep, "a.txt", "a")
+	uploadString(t, m, skip, "b.txt", "b")
+
+	dir, err := ioutil.TempDir("", "mega-selection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mr, err := m.NewMirror(root, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if readString(dir, "skip/b.txt") != "b" {
+		t.Fatalf("skip/b.txt not downloaded before it was excluded")
+	}
+
+	// Excluding leaves the local copy alone but stops tracking it
+	mr.Selection = NewSelection()
+	mr.Selection.Exclude("skip")
+	uploadString(t, m, skip, "c.txt", "c")
+	if err = mr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if readString(dir, "skip/c.txt") != "" {
+		t.Errorf("excluded folder synced")
+	}
+	if readString(dir, "skip/b.txt") != "b" {
+		t.Errorf("local copy in excluded folder removed")
+	}
+	if _, ok, _ := mr.state.Get("skip/b.txt"); ok {
+		t.Errorf("excluded file still tracked")
+	}
+	if readString(dir, "keep/a.txt") != "a" {
+		t.Errorf("keep/a.txt: not synced")
+	}
+}
+
+func TestSyncerSelection(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-selection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"keep/a.txt", "skip/b.txt"} {
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if err = os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(full, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := m.NewSyncer(dir, m.FS.GetRoot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Selection = NewSelection()
+	s.Selection.Include("keep")
+	if err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if b.lookupPath(m, "keep/a.txt") == "" {
+		t.Errorf("included file not uploaded")
+	}
+	if b.lookupPath(m, "skip") != "" {
+		t.Errorf("excluded folder uploaded")
+	}
+}
@@ -0,0 +1,196 @@
+package mega
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+)
+
+// Session is a login to the account.  The list of them is the access
+// history the MEGA clients show under security settings, so it can be
+// used to audit who has been using a shared account.
+type Session struct {
+	// Handle of the session
+	ID string
+	// Time of the login
+	Created time.Time
+	// Time the session was last used
+	LastActive time.Time
+	// User agent of the client which logged in
+	UserAgent string
+	// IP address and two letter country code it was last used from
+	IP      string
+	Country string
+	// Current is set for the session making the request
+	Current bool
+	// Alive is false once the session has logged out or been killed
+	Alive bool
+}
+
+// GetSessions returns the sessions of the account, logged out ones
+// included, as recorded by the server.
+//
+// The API doesn't give a log of other security events, such as
+// password changes, beyond what GetUserAlerts returns.
+func (m *Mega) GetSessions() ([]Session, error) {
+	var msg [1]SessionListMsg
+	var res [1][][]json.RawMessage
+
+	msg[0].Cmd = "usl"
+	msg[0].X = 1
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(res[0]))
+	for _, fields := range res[0] {
+		var created, active, current, alive int64
+		var s Session
+		for i, dst := range []interface{}{&created, &active, &s.UserAgent, &s.IP, &s.Country, &current, &s.ID, &alive} {
+			if i >= len(fields) {
+				break
+			}
+			if err := json.Unmarshal(fields[i], dst); err != nil {
+				m.debugf("GetSessions: couldn't parse field %d of %s: %v", i, fields, err)
+			}
+		}
+		s.Created = time.Unix(created, 0)
+		s.LastActive = time.Unix(active, 0)
+		s.Current = current != 0
+		s.Alive = alive != 0
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// Version of the SessionString format
+const sessionVersion = 1
+
+// sessionState is a logged in session as SessionString encodes it
+type sessionState struct {
+	Version int    `json:"v"`
+	Sid     string `json:"sid"`
+	Key     string `json:"k"`
+	Handle  string `json:"u"`
+	Email   string `json:"email,omitempty"`
+	// RSA private key
+	P string `json:"p,omitempty"`
+	Q string `json:"q,omitempty"`
+	D string `json:"d,omitempty"`
+	// Event cursor
+	Sn string `json:"sn,omitempty"`
+}
+
+// SessionString returns the state of the logged in session, its ID,
+// the master and private keys and where the event stream is up to, so
+// that LoginWithSession can carry on with it later without the
+// password.  It returns ESID if there is no session, as before logging
+// in or with a folder link.
+//
+// The string gives full access to the account until the session is
+// logged out, so keep it as safe as the password, say with the
+// credstore package.
+func (m *Mega) SessionString() (string, error) {
+	if m.sid == "" || m.flink != nil {
+		return "", ESID
+	}
+	st := sessionState{
+		Version: sessionVersion,
+		Sid:     m.sid,
+		Key:     base64urlencode(m.k),
+		Handle:  m.handle,
+	}
+	if m.privk != nil {
+		st.P = base64urlencode(m.privk.p.Bytes())
+		st.Q = base64urlencode(m.privk.q.Bytes())
+		st.D = base64urlencode(m.privk.d.Bytes())
+	}
+	m.FS.mutex.Lock()
+	st.Email = m.FS.emails[m.handle]
+	st.Sn = m.ssn
+	m.FS.mutex.Unlock()
+
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	return base64urlencode(buf), nil
+}
+
+// parseSessionString decodes s as made by SessionString, returning
+// EARGS if it isn't one
+func parseSessionString(s string) (st sessionState, privk *rsaPrivateKey, k []byte, err error) {
+	buf, err := base64urldecode(s)
+	if err != nil {
+		return st, nil, nil, EARGS
+	}
+	err = json.Unmarshal(buf, &st)
+	if err != nil || st.Version != sessionVersion || st.Sid == "" {
+		return st, nil, nil, EARGS
+	}
+	k, err = base64urldecode(st.Key)
+	if err != nil || len(k) != 16 {
+		return st, nil, nil, EARGS
+	}
+	if st.P != "" || st.Q != "" || st.D != "" {
+		var parts [3]*big.Int
+		for i, v := range []string{st.P, st.Q, st.D} {
+			b, err := base64urldecode(v)
+			if err != nil || len(b) == 0 {
+				return st, nil, nil, EARGS
+			}
+			parts[i] = new(big.Int).SetBytes(b)
+		}
+		privk = &rsaPrivateKey{p: parts[0], q: parts[1], d: parts[2]}
+	}
+	return st, privk, k, nil
+}
+
+// LoginWithSession carries on with the session s saved by
+// SessionString instead of logging in again, then fetches the tree as
+// Login does.  The changes made since s was saved are sent as events,
+// as with WithEventCursor.  It returns EARGS if s isn't a session
+// string and ESID if the session has been logged out or has expired,
+// when the password is needed after all.
+func (m *Mega) LoginWithSession(s string) error {
+	st, privk, k, err := parseSessionString(s)
+	if err != nil {
+		return err
+	}
+	m.flink = nil
+	m.sid = st.Sid
+	m.k = k
+	m.privk = privk
+	m.handle = st.Handle
+	if st.Email != "" {
+		m.FS.mutex.Lock()
+		m.FS.emails[m.handle] = st.Email
+		m.FS.mutex.Unlock()
+	}
+	if st.Sn != "" {
+		m.configMu.Lock()
+		m.config.cursor = st.Sn
+		m.configMu.Unlock()
+	}
+
+	waitEvent := m.WaitEventsStart()
+
+	err = m.getFileSystem()
+	if err != nil {
+		return err
+	}
+
+	m.WaitEvents(waitEvent, 5*time.Second)
+
+	return nil
+}
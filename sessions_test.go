@@ -0,0 +1,109 @@
+package mega
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestGetSessions(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] != "usl" || cmd["x"] != float64(1) {
+			return nil
+		}
+		return json.RawMessage(`[[1600000000,1600000500,"Mozilla/5.0","10.0.0.1","GB",1,"SESSION1",1],[1500000000,1500000100,"MEGAsync","10.0.0.2","NZ",0,"SESSION2",0]]`)
+	}
+	b.mu.Unlock()
+
+	sessions, err := m.GetSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("want 2 sessions, got %d", len(sessions))
+	}
+	s := sessions[0]
+	if s.ID != "SESSION1" || s.Created.Unix() != 1600000000 || s.LastActive.Unix() != 1600000500 ||
+		s.UserAgent != "Mozilla/5.0" || s.IP != "10.0.0.1" || s.Country != "GB" || !s.Current || !s.Alive {
+		t.Errorf("wrong session %+v", s)
+	}
+	if s = sessions[1]; s.ID != "SESSION2" || s.Current || s.Alive {
+		t.Errorf("wrong session %+v", s)
+	}
+}
+
+func TestSessionString(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	m.handle = fakeUser
+	m.privk = &rsaPrivateKey{p: big.NewInt(61), q: big.NewInt(53), d: big.NewInt(2753)}
+	m.FS.mutex.Lock()
+	m.FS.emails[fakeUser] = "user@example.com"
+	m.FS.mutex.Unlock()
+
+	if _, err := newMockSession(t, b.mockServer).SessionString(); err != ESID {
+		t.Errorf("not logged in: got %v", err)
+	}
+	s, err := m.SessionString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := m.EventCursor()
+
+	var mu sync.Mutex
+	var sids, sns []string
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "f" {
+			mu.Lock()
+			sids = append(sids, r.URL.Query().Get("sid"))
+			mu.Unlock()
+		}
+		return nil
+	}
+	b.mu.Unlock()
+	b.mockServer.eventsMu.Lock()
+	b.mockServer.events = func(sn string) (string, int) {
+		mu.Lock()
+		sns = append(sns, sn)
+		mu.Unlock()
+		return "", 0
+	}
+	b.mockServer.eventsMu.Unlock()
+
+	r := newMockSession(t, b.mockServer)
+	for _, bad := range []string{"", "garbage", base64urlencode([]byte(`{"v":2,"sid":"x"}`))} {
+		if err = r.LoginWithSession(bad); err != EARGS {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+	if err = r.LoginWithSession(s); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.k, m.k) || r.handle != fakeUser || r.FS.emails[fakeUser] != "user@example.com" {
+		t.Errorf("restored k %x handle %q emails %v", r.k, r.handle, r.FS.emails)
+	}
+	if r.privk == nil || r.privk.p.Int64() != 61 || r.privk.q.Int64() != 53 || r.privk.d.Int64() != 2753 {
+		t.Errorf("private key %+v", r.privk)
+	}
+	if r.FS.HashLookup(m.FS.GetRoot().GetHash()) == nil {
+		t.Error("tree not loaded")
+	}
+	waitFor(t, "event poll", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sns) > 0
+	})
+	mu.Lock()
+	if len(sids) != 1 || sids[0] != m.sid || sns[0] != cursor {
+		t.Errorf("fetched the tree with %v, polled from %v", sids, sns)
+	}
+	mu.Unlock()
+}
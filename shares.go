@@ -0,0 +1,249 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+)
+
+// addSharedRoot adds n to the shared roots if it isn't there
+// already, returning true if it was added
+//
+// Call with the FS mutex held
+func (fs *MegaFS) addSharedRoot(n *Node) bool {
+	for _, r := range fs.sroots {
+		if r == n {
+			return false
+		}
+	}
+	fs.sroots = append(fs.sroots, n)
+	return true
+}
+
+// removeSharedRoot removes n from the shared roots
+//
+// Call with the FS mutex held
+func (fs *MegaFS) removeSharedRoot(n *Node) {
+	for i, r := range fs.sroots {
+		if r == n {
+			fs.sroots = append(fs.sroots[:i], fs.sroots[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeTree removes n and all its descendants from the lookup table
+// and detaches it from its parent
+//
+// Call with the FS mutex held
+func (fs *MegaFS) removeTree(n *Node) {
+	if n.parent != nil {
+		n.parent.removeChild(n)
+	}
+	var remove func(n *Node)
+	remove = func(n *Node) {
+		for _, c := range n.children {
+			remove(c)
+		}
+		delete(fs.lookup, n.hash)
+		delete(fs.broken, n.hash)
+		delete(fs.origins, n.hash)
+	}
+	remove(n)
+}
+
+// storeShareKey stores the share key k for the share with handle h
+// into skmap, encrypted with the master key as the server does.
+//
+// k may be already encrypted with the master key or RSA encrypted
+// with our public key as it is for freshly created incoming shares.
+//
+// Call with the FS mutex held
+func (m *Mega) storeShareKey(h string, k string) error {
+	buf, err := base64urldecode(k)
+	if err != nil {
+		return err
+	}
+	if len(buf) == aes.BlockSize {
+		m.FS.skmap[h] = k
+		return nil
+	}
+
+	sk, err := decryptShareKey(k, m.privk)
+	if err != nil {
+		return err
+	}
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return err
+	}
+	err = blockEncrypt(master_aes, sk, sk)
+	if err != nil {
+		return err
+	}
+	m.FS.skmap[h] = base64urlencode(sk)
+	return nil
+}
+
+// process a share addition/update/revocation event
+//
+// New incoming shares are accepted automatically - the share key is
+// stored so the nodes which follow can be decrypted and the share
+// root is added to the shared roots.
+func (m *Mega) processShare(evRaw []byte) error {
+	var ev ShareEvent
+	err := json.Unmarshal(evRaw, &ev)
+	if err != nil {
+		return err
+	}
+
+	// Only interested in shares from other users to us
+	if ev.Owner == "" || ev.Owner == m.handle || ev.N == "" {
+		return nil
+	}
+
+	m.FS.mutex.Lock()
+
+	// Share revoked
+	if ev.R == nil {
+		delete(m.FS.skmap, ev.N)
+		delete(m.FS.spending, ev.N)
+		delete(m.FS.saccess, ev.N)
+		node := m.FS.hashLookup(ev.N)
+		if node == nil {
+			m.FS.mutex.Unlock()
+			return nil
+		}
+		m.FS.removeSharedRoot(node)
+		m.FS.removeTree(node)
+		m.FS.mutex.Unlock()
+
+		m.emitEvents([]Event{{Type: EVENT_SHARE_REMOVED, Node: node, Hash: ev.N}})
+		return nil
+	}
+
+	m.FS.setShareAccess(ev.N, ev.R)
+
+	// Access level change only
+	if ev.Key == "" {
+		m.FS.mutex.Unlock()
+		return nil
+	}
+
+	err = m.storeShareKey(ev.N, ev.Key)
+	if err != nil {
+		m.FS.mutex.Unlock()
+		return err
+	}
+
+	// Nodes which arrived before the key can be decrypted now
+	events, entries := m.repairNodes()
+
+	// If the nodes haven't arrived yet mark the share root so it is
+	// added when they do
+	node := m.FS.hashLookup(ev.N)
+	if node == nil || node.hash != ev.N {
+		m.FS.spending[ev.N] = true
+	} else if m.FS.addSharedRoot(node) {
+		events = append(events, Event{Type: EVENT_SHARE_ADDED, Node: node, Hash: ev.N})
+	}
+	m.FS.mutex.Unlock()
+
+	m.journal(entries...)
+	m.emitEvents(events)
+	return nil
+}
+
+// moveCr returns the cr element for moving src into parent, which
+// supplies the keys of src and everything below it encrypted with the
+// key of each share parent is in that src isn't in already, so the
+// other users of those shares can decrypt them.  It returns nil if
+// there are no such shares.
+//
+// Call with the FS mutex held
+func (m *Mega) moveCr(src, parent *Node) ([]interface{}, error) {
+	inSrc := make(map[*Node]bool)
+	for n := src.parent; n != nil; n = n.parent {
+		inSrc[n] = true
+	}
+	shares, sks, err := m.shareCiphers(parent, inSrc)
+	if err != nil || len(shares) == 0 {
+		return nil, err
+	}
+
+	var handles []string
+	var keys []interface{}
+	var walk func(n *Node) error
+	walk = func(n *Node) error {
+		if len(n.meta.compkey) > 0 {
+			for i, sk_aes := range sks {
+				buf := make([]byte, len(n.meta.compkey))
+				err := blockEncrypt(sk_aes, buf, n.meta.compkey)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, i, len(handles), base64urlencode(buf))
+			}
+			handles = append(handles, n.hash)
+		}
+		for _, c := range n.children {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(src); err != nil {
+		return nil, err
+	}
+	return []interface{}{shares, handles, keys}, nil
+}
+
+// shareCiphers returns the handles and ciphers of the keys of the
+// shares, incoming or our own, which parent is in, leaving out those
+// rooted at the nodes in skip
+//
+// Call with the FS mutex held
+func (m *Mega) shareCiphers(parent *Node, skip map[*Node]bool) (shares []string, sks []cipher.Block, err error) {
+	for n := parent; n != nil; n = n.parent {
+		if _, ok := m.FS.skmap[n.hash]; !ok || n.hash == "" || skip[n] {
+			continue
+		}
+		sk, err := m.shareKey(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		sk_aes, err := aes.NewCipher(sk)
+		if err != nil {
+			return nil, nil, err
+		}
+		shares = append(shares, n.hash)
+		sks = append(sks, sk_aes)
+	}
+	return shares, sks, nil
+}
+
+// newNodeCr returns the cr element of a "p" command which creates a
+// node with the temporary handle h and the key compkey in parent.  It
+// supplies the key encrypted with the key of each share parent is in,
+// incoming or our own, as otherwise the other users of the share would
+// see the node as undecryptable.  It returns nil if parent isn't in a
+// share.
+//
+// Call with the FS mutex held
+func (m *Mega) newNodeCr(parent *Node, h string, compkey []byte) ([]interface{}, error) {
+	shares, sks, err := m.shareCiphers(parent, nil)
+	if err != nil || len(shares) == 0 {
+		return nil, err
+	}
+	keys := make([]interface{}, 0, 3*len(sks))
+	for i, sk_aes := range sks {
+		buf := make([]byte, len(compkey))
+		err = blockEncrypt(sk_aes, buf, compkey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, i, 0, base64urlencode(buf))
+	}
+	return []interface{}{shares, []string{h}, keys}, nil
+}
@@ -0,0 +1,264 @@
+package mega
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+)
+
+func TestDecryptShareKey(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &rsaPrivateKey{p: priv.Primes[0], q: priv.Primes[1], d: priv.D}
+
+	// share key with a leading zero to check padding is restored
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk[1:])
+	plain := make([]byte, priv.N.BitLen()/8-2)
+	copy(plain, sk)
+	_, _ = rand.Read(plain[16:])
+	c := new(big.Int).Exp(new(big.Int).SetBytes(plain), big.NewInt(int64(priv.E)), priv.N)
+
+	got, err := decryptShareKey(base64urlencode(encodeMPI(c)), key)
+	if err != nil {
+		t.Fatalf("decryptShareKey failed: %v", err)
+	}
+	if string(got) != string(sk) {
+		t.Errorf("wrong share key: want %x, got %x", sk, got)
+	}
+
+	_, err = decryptShareKey("AA", key)
+	if err != EKEY {
+		t.Errorf("expecting EKEY for short key, got %v", err)
+	}
+}
+
+func TestProcessShare(t *testing.T) {
+	m := New()
+	m.SetLogger(t.Logf)
+	m.k = make([]byte, 16)
+	_, _ = rand.Read(m.k)
+	m.handle = "MEMEMEMEMEM"
+	master_aes, _ := aes.NewCipher(m.k)
+
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk)
+	sk_aes, _ := aes.NewCipher(sk)
+	esk := make([]byte, 16)
+	_ = blockEncrypt(master_aes, esk, sk)
+
+	var events []Event
+	m.Subscribe(func(ev Event) {
+		events = append(events, ev)
+	})
+
+	// share announced before its nodes
+	err := m.processShare([]byte(fmt.Sprintf(`{"a":"s2","n":"SHAREHND","o":"OTHERUSERXX","u":"MEMEMEMEMEM","r":0,"k":%q}`, base64urlencode(esk))))
+	if err != nil {
+		t.Fatalf("processShare failed: %v", err)
+	}
+	if len(m.FS.GetSharedRoots()) != 0 {
+		t.Fatal("share root added before nodes arrived")
+	}
+
+	fkey := make([]byte, 16)
+	_, _ = rand.Read(fkey)
+	attr, _ := encryptAttr(fkey, FileAttr{Name: "shared"})
+	efkey := make([]byte, 16)
+	_ = blockEncrypt(sk_aes, efkey, fkey)
+	ev := FSEvent{Cmd: "t"}
+	ev.T.Files = []FSNode{{
+		Hash:   "SHAREHND",
+		User:   "OTHERUSERXX",
+		T:      FOLDER,
+		Attr:   attr,
+		Key:    "SHAREHND:" + base64urlencode(efkey),
+		Parent: "",
+	}}
+	evRaw, _ := json.Marshal(ev)
+	err = m.processAddNode(evRaw)
+	if err != nil {
+		t.Fatalf("processAddNode failed: %v", err)
+	}
+
+	roots := m.FS.GetSharedRoots()
+	if len(roots) != 1 || roots[0].GetName() != "shared" {
+		t.Fatalf("share root not mounted: %v", roots)
+	}
+	if len(events) != 2 || events[0].Type != EVENT_NODE_ADDED || events[1].Type != EVENT_SHARE_ADDED {
+		t.Fatalf("wrong events: %v", events)
+	}
+
+	// revoke it
+	err = m.processShare([]byte(`{"a":"s2","n":"SHAREHND","o":"OTHERUSERXX","u":"MEMEMEMEMEM"}`))
+	if err != nil {
+		t.Fatalf("processShare failed: %v", err)
+	}
+	if len(m.FS.GetSharedRoots()) != 0 || m.FS.HashLookup("SHAREHND") != nil {
+		t.Fatal("share not removed")
+	}
+	if len(events) != 3 || events[2].Type != EVENT_SHARE_REMOVED {
+		t.Fatalf("wrong events: %v", events)
+	}
+}
+
+func TestMoveIntoShare(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	shared, err := m.CreateDir("shared", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := m.CreateDir("inner", shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, dir, "f.txt", "hello")
+
+	// Share the folder
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk)
+	master_aes, _ := aes.NewCipher(m.k)
+	esk := make([]byte, 16)
+	_ = blockEncrypt(master_aes, esk, sk)
+	m.FS.mutex.Lock()
+	m.FS.skmap[shared.hash] = base64urlencode(esk)
+	m.FS.mutex.Unlock()
+
+	var moves []map[string]interface{}
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "m" {
+			moves = append(moves, cmd)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	if err = m.Move(dir, inner); err != nil {
+		t.Fatal(err)
+	}
+	// Moving within the share needn't send the keys again
+	if err = m.Move(f, shared); err != nil {
+		t.Fatal(err)
+	}
+	// Nor moving out of it
+	if err = m.Move(f, root); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(moves) != 3 {
+		t.Fatalf("%d moves sent, want 3", len(moves))
+	}
+	if moves[1]["cr"] != nil || moves[2]["cr"] != nil {
+		t.Errorf("keys sent for moves not into a share: %v %v", moves[1]["cr"], moves[2]["cr"])
+	}
+	cr, _ := json.Marshal(moves[0]["cr"])
+	var got [3][]interface{}
+	if err = json.Unmarshal(cr, &got); err != nil {
+		t.Fatalf("bad cr %s: %v", cr, err)
+	}
+	if len(got[0]) != 1 || got[0][0] != shared.hash {
+		t.Errorf("cr shares %v", got[0])
+	}
+	want := map[string][]byte{dir.hash: dir.meta.compkey, f.hash: f.meta.compkey}
+	if len(got[1]) != len(want) || len(got[2]) != 3*len(want) {
+		t.Fatalf("cr has the wrong nodes: %s", cr)
+	}
+	sk_aes, _ := aes.NewCipher(sk)
+	for i := 0; i < len(got[2]); i += 3 {
+		h := got[1][int(got[2][i+1].(float64))].(string)
+		enc, _ := base64urldecode(got[2][i+2].(string))
+		key := make([]byte, len(enc))
+		_ = blockDecrypt(sk_aes, key, enc)
+		if string(key) != string(want[h]) {
+			t.Errorf("wrong key sent for %q", h)
+		}
+	}
+}
+
+func TestCreateInIncomingShare(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	m.handle = "MEMEMEMEMEM"
+
+	root := m.FS.GetRoot()
+	in, err := m.CreateDir("in", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shared with us read-write
+	sk := make([]byte, 16)
+	_, _ = rand.Read(sk)
+	master_aes, _ := aes.NewCipher(m.k)
+	esk := make([]byte, 16)
+	_ = blockEncrypt(master_aes, esk, sk)
+	err = m.processShare([]byte(fmt.Sprintf(`{"a":"s2","n":%q,"o":"OTHERUSERXX","u":"MEMEMEMEMEM","r":1,"k":%q}`, in.GetHash(), base64urlencode(esk))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var puts []map[string]interface{}
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "p" {
+			puts = append(puts, cmd)
+		}
+		return nil
+	}
+	b.mu.Unlock()
+
+	dir, err := m.CreateDir("dir", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := uploadString(t, m, dir, "f.txt", "hello")
+	// Outside the share no keys are sent
+	if _, err = m.CreateDir("mine", root); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(puts) != 3 {
+		t.Fatalf("%d nodes created, want 3", len(puts))
+	}
+	if puts[2]["cr"] != nil {
+		t.Errorf("keys sent for a node not in a share: %v", puts[2]["cr"])
+	}
+	// The other users of the share decrypt the keys with the share key
+	sk_aes, _ := aes.NewCipher(sk)
+	for i, n := range []*Node{dir, f} {
+		cr, _ := json.Marshal(puts[i]["cr"])
+		var got [3][]interface{}
+		if err = json.Unmarshal(cr, &got); err != nil {
+			t.Fatalf("bad cr %s: %v", cr, err)
+		}
+		h := puts[i]["n"].([]interface{})[0].(map[string]interface{})["h"]
+		if len(got[0]) != 1 || got[0][0] != in.hash || len(got[1]) != 1 || got[1][0] != h || len(got[2]) != 3 {
+			t.Fatalf("cr %s for new node %v", cr, h)
+		}
+		enc, _ := base64urldecode(got[2][2].(string))
+		key := make([]byte, len(enc))
+		_ = blockDecrypt(sk_aes, key, enc)
+		if string(key) != string(n.meta.compkey) {
+			t.Errorf("%s: wrong key sent", n.name)
+		}
+	}
+}
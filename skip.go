@@ -0,0 +1,156 @@
+package mega
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// SYNC_MAX_FAILURES is how many times in a row a file may fail for
+// reasons of its own before Syncer and Mirror skip it
+const SYNC_MAX_FAILURES = 3
+
+// Skipped records a file which wasn't synced because it has failed
+// too many times in a row.  It is tried again once it changes or
+// after Retry.
+type Skipped struct {
+	// Path of the file relative to the root of the sync
+	Path string
+	// Number of failures in a row
+	Failures int
+	// The last error
+	Err string
+}
+
+// skipReport collects the files skipped by a Syncer or Mirror
+type skipReport struct {
+	mu      sync.Mutex
+	skipped []Skipped
+
+	// MaxFailures is how many times in a row a file may fail before
+	// it is skipped, 0 for SYNC_MAX_FAILURES
+	MaxFailures int
+	// OnSkip is called for each file skipped if set
+	OnSkip func(Skipped)
+}
+
+// Skipped returns the files skipped since the last call
+func (r *skipReport) Skipped() []Skipped {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	skipped := r.skipped
+	r.skipped = nil
+	return skipped
+}
+
+// skip returns true and records the file if the version of it with
+// state st has failed too often to try again
+func (r *skipReport) skip(st FileState, ok bool, version string) bool {
+	max := r.MaxFailures
+	if max <= 0 {
+		max = SYNC_MAX_FAILURES
+	}
+	if !ok || st.FailedVersion != version || st.Failures < max {
+		return false
+	}
+	s := Skipped{Path: st.Path, Failures: st.Failures, Err: st.Error}
+	r.mu.Lock()
+	r.skipped = append(r.skipped, s)
+	fn := r.OnSkip
+	r.mu.Unlock()
+	if fn != nil {
+		fn(s)
+	}
+	return true
+}
+
+// synced returns true if the state records a sync rather than only
+// failures
+func (s *FileState) synced() bool {
+	return s.Hash != ""
+}
+
+// localVersion identifies the version of a local file for
+// FileState.FailedVersion
+func localVersion(fi os.FileInfo) string {
+	return fmt.Sprintf("%d/%d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// itemFailure returns true if err is down to the file itself, such as
+// a permission problem or a node which can't be decrypted, rather
+// than say the network, so trying it again is unlikely to help
+func itemFailure(err error) bool {
+	var de *DecryptionError
+	switch {
+	case errors.As(err, &de),
+		errors.Is(err, os.ErrPermission),
+		errors.Is(err, EKEY),
+		errors.Is(err, EBADATTR),
+		errors.Is(err, EMACMISMATCH),
+		errors.Is(err, EACCESS):
+		return true
+	}
+	return false
+}
+
+// recordFailure counts a failure of the version of rel in state if
+// err is down to the file, keeping what was last synced
+func recordFailure(state StateStore, rel, version string, err error) error {
+	if !itemFailure(err) {
+		return nil
+	}
+	st, ok, getErr := state.Get(rel)
+	if getErr != nil {
+		return getErr
+	}
+	if !ok {
+		st = FileState{Path: rel}
+	}
+	if st.FailedVersion != version {
+		st.Failures = 0
+	}
+	st.Failures++
+	st.Error = err.Error()
+	st.FailedVersion = version
+	return state.Put(st)
+}
+
+// clearFailures removes the failures recorded in state, dropping the
+// states which only record failures
+func clearFailures(state StateStore) error {
+	var failed []FileState
+	err := state.Walk(func(st FileState) error {
+		if st.Failures > 0 {
+			failed = append(failed, st)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, st := range failed {
+		if !st.synced() {
+			err = state.Delete(st.Path)
+		} else {
+			st.Failures, st.Error, st.FailedVersion = 0, "", ""
+			err = state.Put(st)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return flushState(state)
+}
+
+// Retry forgets the failures of skipped files so they are tried again
+// on the next pass
+func (s *Syncer) Retry() error {
+	return clearFailures(s.state)
+}
+
+// Retry forgets the failures of skipped files so they are tried again
+// on the next pass
+func (mr *Mirror) Retry() error {
+	return clearFailures(mr.state)
+}
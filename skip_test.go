@@ -0,0 +1,95 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorSkipsFailures(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	uploadString(t, m, root, "good.txt", "good")
+	bad := uploadString(t, m, root, "bad.txt", "bad")
+	m.FS.mutex.Lock()
+	bad.decryptErr = &DecryptionError{Hash: bad.hash, Err: EKEY}
+	key := bad.meta.key
+	bad.meta.key = nil
+	m.FS.mutex.Unlock()
+
+	dir, err := ioutil.TempDir("", "mega-skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state, err := NewJSONStateStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "local")
+	mr, err := m.NewMirror(root, local, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.MaxFailures = 2
+
+	for i := 0; i < 2; i++ {
+		if err = mr.Sync(); err == nil {
+			t.Fatalf("pass %d: want error for bad.txt", i)
+		}
+		if s := mr.Skipped(); len(s) != 0 {
+			t.Fatalf("pass %d: skipped %v too soon", i, s)
+		}
+	}
+	st, ok, _ := state.Get("bad.txt")
+	if !ok || st.Failures != 2 || st.synced() {
+		t.Errorf("failures not recorded: %+v", st)
+	}
+
+	// Skipped, and remembered by the store
+	state2, err := NewJSONStateStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.state = state2
+	if err = mr.Sync(); err != nil {
+		t.Fatalf("failing file not skipped: %v", err)
+	}
+	s := mr.Skipped()
+	if len(s) != 1 || s[0].Path != "bad.txt" || s[0].Failures != 2 || s[0].Err == "" {
+		t.Errorf("wrong skip report %+v", s)
+	}
+	if got := readString(local, "good.txt"); got != "good" {
+		t.Errorf("good.txt: got %q", got)
+	}
+
+	// Fixed and retried
+	m.FS.mutex.Lock()
+	bad.decryptErr = nil
+	bad.meta.key = key
+	m.FS.mutex.Unlock()
+	if err = mr.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	if err = mr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(local, "bad.txt"); got != "bad" {
+		t.Errorf("bad.txt: got %q", got)
+	}
+	if st, _, _ := state2.Get("bad.txt"); st.Failures != 0 || !st.synced() {
+		t.Errorf("failures not cleared: %+v", st)
+	}
+}
+
+func TestItemFailure(t *testing.T) {
+	if !itemFailure(&ChunkError{Op: "write", Err: &os.PathError{Op: "open", Path: "x", Err: os.ErrPermission}}) {
+		t.Errorf("permission error not an item failure")
+	}
+	if itemFailure(EAGAIN) || itemFailure(ETEMPUNAVAIL) {
+		t.Errorf("transient error counted as an item failure")
+	}
+}
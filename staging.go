@@ -0,0 +1,194 @@
+package mega
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// STAGING_FOLDER is the hidden folder in the root which staging areas
+// are kept in
+const STAGING_FOLDER = ".mega-staging"
+
+// stagingAttr is the attribute of a staging area folder holding its
+// manifest
+const stagingAttr = "gomega:staged"
+
+// StagedNode records a node moved into a staging area and where it was
+type StagedNode struct {
+	// Handle of the node
+	Hash string `json:"h"`
+	// Handle of the folder it was in
+	Parent string `json:"p"`
+	// Path it was at, for showing
+	Path string `json:"path"`
+}
+
+// Staging is an undo window for deletions beyond the trash.  Nodes
+// slated for deletion are moved into a folder of their own below
+// STAGING_FOLDER in the root, along with a manifest of where they came
+// from kept in the folder's attributes, and later either deleted for
+// good with Commit or put back with Abort.  As the manifest is kept on
+// the server staging areas left open, say by a tool which crashed, can
+// be found again with Stagings.
+type Staging struct {
+	m      *Mega
+	mu     sync.Mutex
+	folder *Node
+	staged []StagedNode
+}
+
+// NewStaging makes a new staging area
+func (m *Mega) NewStaging() (*Staging, error) {
+	top, err := m.artifactDir(m.FS.GetRoot(), STAGING_FOLDER)
+	if err != nil {
+		return nil, err
+	}
+	cfg := m.getConfig()
+	name, err := randString(cfg.idSource(), 8)
+	if err != nil {
+		return nil, err
+	}
+	folder, err := m.CreateDir(name, top)
+	if err != nil {
+		return nil, err
+	}
+	return &Staging{m: m, folder: folder}, nil
+}
+
+// Stagings returns the staging areas which haven't been committed or
+// aborted, oldest first
+func (m *Mega) Stagings() ([]*Staging, error) {
+	top, err := m.FS.PathLookup(m.FS.GetRoot(), []string{STAGING_FOLDER})
+	if err == ENOENT {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	folder := top[len(top)-1]
+	children, err := m.FS.GetChildren(folder)
+	if err != nil {
+		return nil, err
+	}
+	var stagings []*Staging
+	for _, c := range children {
+		if !c.IsFolder() {
+			continue
+		}
+		s := &Staging{m: m, folder: c}
+		if raw, ok := c.GetAttr(stagingAttr); ok {
+			err = json.Unmarshal(raw, &s.staged)
+			if err != nil {
+				m.logf("staging: %q: bad manifest: %v", c.GetName(), err)
+				continue
+			}
+		}
+		stagings = append(stagings, s)
+	}
+	sort.SliceStable(stagings, func(i, j int) bool {
+		return stagings[i].folder.GetTimeStamp().Before(stagings[j].folder.GetTimeStamp())
+	})
+	return stagings, nil
+}
+
+// Folder returns the folder the staged nodes are kept in
+func (s *Staging) Folder() *Node {
+	return s.folder
+}
+
+// Nodes returns the nodes staged so far
+func (s *Staging) Nodes() []StagedNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StagedNode(nil), s.staged...)
+}
+
+// Stage moves n into the staging area, recording where it was.  The
+// manifest is saved before n is moved so it is never lost track of.
+func (s *Staging) Stage(n *Node) error {
+	if n == nil {
+		return EARGS
+	}
+	m := s.m
+	m.FS.mutex.Lock()
+	var inside bool
+	for p := n; p != nil; p = p.parent {
+		inside = inside || p == s.folder || (p.name == STAGING_FOLDER && p.parent == m.FS.root)
+	}
+	top := n == m.FS.root || n == m.FS.inbox || n == m.FS.trash
+	var staged StagedNode
+	if n.parent != nil {
+		staged = StagedNode{Hash: n.hash, Parent: n.parent.hash, Path: m.FS.pathOf(n)}
+	}
+	m.FS.mutex.Unlock()
+	if inside || top || staged.Hash == "" {
+		return EARGS
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.save(append(s.staged, staged))
+	if err != nil {
+		return err
+	}
+	err = m.moveAnyName(n, s.folder)
+	if err != nil {
+		// forget about it again
+		if e := s.save(s.staged); e != nil {
+			m.logf("staging: couldn't save manifest: %v", e)
+		}
+		return err
+	}
+	s.staged = append(s.staged, staged)
+	return nil
+}
+
+// save stores staged as the manifest
+//
+// Call with the mutex held
+func (s *Staging) save(staged []StagedNode) error {
+	return s.m.SetAttr(s.folder, stagingAttr, staged)
+}
+
+// Commit deletes the staged nodes, and the staging area, for good
+func (s *Staging) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.m.Delete(s.folder, true)
+	if err != nil {
+		return err
+	}
+	s.staged = nil
+	return nil
+}
+
+// Abort puts the staged nodes back where they were and removes the
+// staging area.  Nodes whose folder has gone since are put in the
+// root.  If one can't be put back Abort stops with its error and may
+// be called again.
+func (s *Staging) Abort() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.m
+	for len(s.staged) > 0 {
+		last := s.staged[len(s.staged)-1]
+		n := m.FS.HashLookup(last.Hash)
+		if n != nil {
+			parent := m.FS.HashLookup(last.Parent)
+			if parent == nil {
+				parent = m.FS.GetRoot()
+			}
+			err := m.moveAnyName(n, parent)
+			if err != nil {
+				return err
+			}
+		}
+		s.staged = s.staged[:len(s.staged)-1]
+		err := s.save(s.staged)
+		if err != nil {
+			return err
+		}
+	}
+	return m.Delete(s.folder, true)
+}
@@ -0,0 +1,89 @@
+package mega
+
+import (
+	"testing"
+)
+
+func TestStaging(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1 := uploadString(t, m, dir, "f1", "one")
+	f2 := uploadString(t, m, root, "f2", "two")
+	sub, err := m.CreateDir("sub", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := m.Stagings(); err != nil || len(s) != 0 {
+		t.Fatalf("Stagings before any: %v, %v", s, err)
+	}
+
+	s, err := m.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*Node{f1, f2, sub} {
+		if err = s.Stage(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Stage(s.Folder()); err != EARGS {
+		t.Errorf("staging the staging area: got %v", err)
+	}
+	if err = s.Stage(root); err != EARGS {
+		t.Errorf("staging the root: got %v", err)
+	}
+	if f1.parent != s.Folder() || f2.parent != s.Folder() || sub.parent != s.Folder() {
+		t.Fatalf("nodes not staged")
+	}
+	staged := s.Nodes()
+	if len(staged) != 3 || staged[0].Path != "Cloud Drive/dir/f1" || staged[1].Parent != root.GetHash() {
+		t.Errorf("staged %+v", staged)
+	}
+
+	// The staging area is found again from its manifest, and aborting
+	// puts the nodes back
+	open, err := m.Stagings()
+	if err != nil || len(open) != 1 || len(open[0].Nodes()) != 3 {
+		t.Fatalf("Stagings: %v, %v", open, err)
+	}
+	m.FS.mutex.Lock()
+	m.FS.removeTree(dir)
+	m.FS.mutex.Unlock()
+	b.mu.Lock()
+	b.remove(dir.GetHash())
+	b.mu.Unlock()
+	if err = open[0].Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if f2.parent != root || f1.parent != root || sub.parent != root {
+		t.Errorf("not put back: %v %v %v", f1.parent, f2.parent, sub.parent)
+	}
+	if m.FS.HashLookup(s.Folder().GetHash()) != nil {
+		t.Errorf("staging area left after Abort")
+	}
+
+	// Committing deletes them
+	s, err = m.NewStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Stage(f2); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if m.FS.HashLookup(f2.GetHash()) != nil || m.FS.HashLookup(s.Folder().GetHash()) != nil {
+		t.Errorf("not deleted by Commit")
+	}
+	if open, err = m.Stagings(); err != nil || len(open) != 0 {
+		t.Errorf("Stagings after Commit: %v, %v", open, err)
+	}
+}
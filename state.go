@@ -0,0 +1,237 @@
+package mega
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileState records what was last synced for a single file
+type FileState struct {
+	// Path of the file relative to the root of the sync using
+	// forward slashes
+	Path string `json:"path"`
+	// Size of the file in bytes
+	Size int64 `json:"size"`
+	// Modification time of the local file
+	ModTime time.Time `json:"mtime"`
+	// Fingerprint of the contents as returned by FileFingerprint
+	Fingerprint string `json:"fp,omitempty"`
+	// Hash of the MEGA node the file was synced with
+	Hash string `json:"hash,omitempty"`
+	// Time the file was last synced
+	SyncTime time.Time `json:"synced"`
+	// Failures is how many times in a row syncing FailedVersion of the
+	// file has failed, with Error the last error.  States which only
+	// record failures have no Hash.
+	Failures      int    `json:"failures,omitempty"`
+	Error         string `json:"error,omitempty"`
+	FailedVersion string `json:"failed,omitempty"`
+}
+
+// Unchanged returns true if the local file described by fi looks the
+// same as when it was synced so it needn't be fingerprinted again
+func (s *FileState) Unchanged(fi os.FileInfo) bool {
+	return s.Size == fi.Size() && s.ModTime.Equal(fi.ModTime())
+}
+
+// StateStore persists FileState records between runs of the sync and
+// backup code so unchanged files can be skipped and moved files
+// recognised by their fingerprint.
+//
+// Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Get returns the state for path, ok is false if there is none
+	Get(path string) (state FileState, ok bool, err error)
+	// Put stores the state replacing any with the same Path
+	Put(state FileState) error
+	// Delete removes the state for path if any
+	Delete(path string) error
+	// Walk calls fn for each state in Path order, stopping at the
+	// first error which is returned
+	Walk(fn func(state FileState) error) error
+	// Close writes any pending changes and releases the store
+	Close() error
+}
+
+// FileFingerprint returns a fingerprint of the contents of the file at
+// path for comparing against FileState.Fingerprint
+func FileFingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// JSONStateStore is a StateStore kept in memory and saved as a JSON
+// file.  It suits small to medium sized trees - use a database backed
+// store such as the one in the boltstate package for big ones.
+//
+// Changes are written out by Flush and Close.
+type JSONStateStore struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]FileState
+	dirty  bool
+}
+
+// jsonStateFile is the on disk format of a JSONStateStore
+type jsonStateFile struct {
+	Version int         `json:"version"`
+	Files   []FileState `json:"files"`
+}
+
+// NewJSONStateStore opens the JSON state file at path, starting empty
+// if it doesn't exist yet
+func NewJSONStateStore(path string) (*JSONStateStore, error) {
+	s := &JSONStateStore{
+		path:   path,
+		states: make(map[string]FileState),
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file jsonStateFile
+	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range file.Files {
+		s.states[state.Path] = state
+	}
+	return s, nil
+}
+
+// Get returns the state for path
+func (s *JSONStateStore) Get(path string) (FileState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[path]
+	return state, ok, nil
+}
+
+// Put stores the state
+func (s *JSONStateStore) Put(state FileState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[state.Path] = state
+	s.dirty = true
+	return nil
+}
+
+// Delete removes the state for path
+func (s *JSONStateStore) Delete(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.states[path]; ok {
+		delete(s.states, path)
+		s.dirty = true
+	}
+	return nil
+}
+
+// sorted returns the states in Path order
+//
+// Call with the mutex held
+func (s *JSONStateStore) sorted() []FileState {
+	states := make([]FileState, 0, len(s.states))
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Path < states[j].Path
+	})
+	return states
+}
+
+// Walk calls fn for each state in Path order.  fn may modify the
+// store.
+func (s *JSONStateStore) Walk(fn func(state FileState) error) error {
+	s.mu.Lock()
+	states := s.sorted()
+	s.mu.Unlock()
+
+	for _, state := range states {
+		err := fn(state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the state file if anything has changed.  The file is
+// replaced atomically.
+func (s *JSONStateStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// path is empty for stores only kept in memory
+	if !s.dirty || s.path == "" {
+		return nil
+	}
+
+	buf, err := json.Marshal(jsonStateFile{Version: 1, Files: s.sorted()})
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(s.path, buf)
+	if err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with buf so that a crash
+// leaves either the old or the new contents
+func writeFileAtomic(path string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Close flushes the store
+func (s *JSONStateStore) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,84 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mega-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewJSONStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0).UTC()
+	for _, p := range []string{"b/file", "a", "c"} {
+		err = s.Put(FileState{Path: p, Size: 3, ModTime: mtime, Hash: "h" + p})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Delete("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewJSONStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, ok, err := s.Get("b/file")
+	if err != nil || !ok {
+		t.Fatalf("Get: %v %v", ok, err)
+	}
+	if state.Hash != "hb/file" || !state.ModTime.Equal(mtime) {
+		t.Errorf("bad state %+v", state)
+	}
+	if _, ok, _ := s.Get("c"); ok {
+		t.Errorf("deleted state still present")
+	}
+
+	var paths []string
+	err = s.Walk(func(state FileState) error {
+		paths = append(paths, state.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != "a" || paths[1] != "b/file" {
+		t.Errorf("bad walk %v", paths)
+	}
+}
+
+func TestFileFingerprint(t *testing.T) {
+	f, err := ioutil.TempFile("", "mega-fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("hello")
+	_ = f.Close()
+
+	fp, err := FileFingerprint(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if fp != want {
+		t.Errorf("want %s got %s", want, fp)
+	}
+}
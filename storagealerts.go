@@ -0,0 +1,150 @@
+package mega
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default interval between the polls of WatchStorage
+const STORAGE_POLL_INTERVAL = 15 * time.Minute
+
+// StorageAlert says the storage used by the account has crossed one of
+// the thresholds given to SetStorageAlerts
+type StorageAlert struct {
+	// The threshold crossed as a fraction of the capacity, say 0.9
+	Threshold float64
+	// Whether the usage went over the threshold rather than back
+	// under it
+	Rising bool
+	// Storage used and the capacity in bytes as last fetched, 0 if
+	// they haven't been yet
+	Used uint64
+	Max  uint64
+	// EOVERQUOTA if a request failing for lack of space raised the
+	// alert rather than the usage fetched
+	Err error
+}
+
+// storageState is the storage usage last seen, for storage alerts
+type storageState struct {
+	mu   sync.Mutex
+	used uint64
+	max  uint64
+	// used as a fraction of max
+	frac float64
+}
+
+// SetStorageAlerts calls fn each time the storage used by the account
+// goes over or back under one of thresholds, fractions of its capacity
+// such as 0.9 for 90%, so long running uploaders can warn an operator
+// before uploads start failing.  No thresholds means 0.9 and 1.  A nil
+// fn turns the alerts off.
+//
+// The usage is checked each time GetAccountDetails is called, which
+// WatchStorage does periodically, and a request failing with
+// EOVERQUOTA counts as being full.  fn is called from the goroutine
+// which noticed, maybe while it holds locks of the client, so it
+// shouldn't call the client but hand the alert on, say over a channel.
+func (m *Mega) SetStorageAlerts(thresholds []float64, fn func(StorageAlert)) error {
+	thresholds, err := storageThresholds(thresholds)
+	if err != nil {
+		return err
+	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.storageThresholds = thresholds
+	m.config.storageAlert = fn
+	return nil
+}
+
+// WithStorageAlerts calls fn when the storage used crosses thresholds,
+// see SetStorageAlerts
+func WithStorageAlerts(thresholds []float64, fn func(StorageAlert)) Option {
+	return func(m *Mega) error {
+		thresholds, err := storageThresholds(thresholds)
+		if err != nil {
+			return err
+		}
+		m.config.storageThresholds = thresholds
+		m.config.storageAlert = fn
+		return nil
+	}
+}
+
+// storageThresholds returns thresholds checked and sorted, or the
+// defaults if there are none
+func storageThresholds(thresholds []float64) ([]float64, error) {
+	if len(thresholds) == 0 {
+		return []float64{0.9, 1}, nil
+	}
+	for _, t := range thresholds {
+		if t <= 0 {
+			return nil, EARGS
+		}
+	}
+	thresholds = append([]float64(nil), thresholds...)
+	sort.Float64s(thresholds)
+	return thresholds, nil
+}
+
+// WatchStorage fetches the storage usage every interval, or
+// STORAGE_POLL_INTERVAL if 0, to raise the alerts set with
+// SetStorageAlerts.  Errors fetching it are logged and it is fetched
+// again next time.
+//
+// WatchStorage blocks until ctx is done, then returns nil, so run it
+// in its own goroutine.
+func (m *Mega) WatchStorage(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = STORAGE_POLL_INTERVAL
+	}
+	for {
+		_, err := m.GetAccountDetails()
+		if err != nil && ctx.Err() == nil {
+			m.logf("storage alerts: fetching usage: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-m.after(interval):
+		}
+	}
+}
+
+// noteStorage raises the storage alerts for the thresholds crossed
+// since the usage was last seen.  err is EOVERQUOTA if a request
+// failed for lack of space, when the account is taken to be full.
+func (m *Mega) noteStorage(used, max uint64, err error) {
+	cfg := m.getConfig()
+	if cfg.storageAlert == nil {
+		return
+	}
+	m.quota.mu.Lock()
+	last := m.quota.frac
+	if err != nil {
+		used, max = m.quota.used, m.quota.max
+		if m.quota.frac < 1 {
+			m.quota.frac = 1
+		}
+	} else {
+		if max == 0 {
+			m.quota.mu.Unlock()
+			return
+		}
+		m.quota.used, m.quota.max = used, max
+		m.quota.frac = float64(used) / float64(max)
+	}
+	frac := m.quota.frac
+	m.quota.mu.Unlock()
+
+	for _, t := range cfg.storageThresholds {
+		switch {
+		case last < t && frac >= t:
+			cfg.storageAlert(StorageAlert{Threshold: t, Rising: true, Used: used, Max: max, Err: err})
+		case last >= t && frac < t:
+			cfg.storageAlert(StorageAlert{Threshold: t, Used: used, Max: max})
+		}
+	}
+}
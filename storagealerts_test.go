@@ -0,0 +1,72 @@
+package mega
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestStorageAlerts(t *testing.T) {
+	var mu sync.Mutex
+	var used uint64
+	srv := newMockServer(t, func(cmd map[string]interface{}, r *http.Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd["a"] == "uq" {
+			return map[string]interface{}{"mstrg": 1000, "cstrg": used}
+		}
+		return ErrorMsg(-17)
+	})
+	defer srv.Close()
+	m := newMockSession(t, srv)
+
+	var alerts []StorageAlert
+	if err := m.SetStorageAlerts([]float64{1, 0.9}, func(a StorageAlert) {
+		alerts = append(alerts, a)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetStorageAlerts([]float64{0.9, 0}, nil); err != EARGS {
+		t.Errorf("bad threshold: got %v", err)
+	}
+
+	for _, step := range []struct {
+		used uint64
+		want []StorageAlert
+	}{
+		{500, nil},
+		{950, []StorageAlert{{Threshold: 0.9, Rising: true, Used: 950, Max: 1000}}},
+		{960, nil},
+		{1000, []StorageAlert{{Threshold: 1, Rising: true, Used: 1000, Max: 1000}}},
+		{800, []StorageAlert{{Threshold: 0.9, Used: 800, Max: 1000}, {Threshold: 1, Used: 800, Max: 1000}}},
+	} {
+		mu.Lock()
+		used = step.used
+		mu.Unlock()
+		alerts = nil
+		// polled once before the context is seen to be done
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := m.WatchStorage(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(alerts, step.want) {
+			t.Errorf("used %d: got %+v", step.used, alerts)
+		}
+	}
+
+	// Running out of space counts as full
+	alerts = nil
+	if _, err := m.api_request([]byte(`[{"a":"p"}]`)); err != EOVERQUOTA {
+		t.Fatalf("got %v", err)
+	}
+	want := []StorageAlert{
+		{Threshold: 0.9, Rising: true, Used: 800, Max: 1000, Err: EOVERQUOTA},
+		{Threshold: 1, Rising: true, Used: 800, Max: 1000, Err: EOVERQUOTA},
+	}
+	if !reflect.DeepEqual(alerts, want) {
+		t.Errorf("over quota: got %+v", alerts)
+	}
+}
@@ -0,0 +1,651 @@
+package mega
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default Syncer settings
+const (
+	SYNC_DEBOUNCE  = time.Second
+	SYNC_MAX_BATCH = 1000
+)
+
+// Syncer mirrors a local directory tree into a MEGA folder.
+//
+// Sync does a single pass, Watch keeps the remote side up to date as
+// local changes happen.  What was synced is recorded in a StateStore
+// so unchanged files are skipped on the next run.
+//
+// If a file has changed both locally and remotely since it was last
+// synced the local version is renamed to a conflict copy such as
+// "report (conflict 2006-01-02 user).txt" and uploaded under that
+// name leaving the remote version alone.
+//
+// A new local file with the fingerprint of a synced one which has
+// gone is taken to have been moved or renamed, and its remote copy is
+// moved to match rather than uploaded again.
+type Syncer struct {
+	m      *Mega
+	local  string
+	remote *Node
+	state  StateStore
+	conflictReport
+	skipReport
+
+	// Debounce is how long Watch waits for local changes to settle
+	// before syncing them, 0 for SYNC_DEBOUNCE
+	Debounce time.Duration
+	// MaxBatch is the most changed paths Watch collects before it
+	// syncs them without waiting, 0 for SYNC_MAX_BATCH
+	MaxBatch int
+	// FailureThreshold stops a pass once this many files have failed,
+	// 0 to carry on regardless.  It defaults to the
+	// WithFailureThreshold setting.
+	FailureThreshold int
+	// Selection picks the folders synced, all of them if nil
+	Selection *Selection
+	// Dedupe copies files whose contents are already in the account
+	// on the server instead of uploading them, see
+	// UploadOptions.Dedupe.  Files recorded in the sync state are
+	// found by their fingerprint.
+	Dedupe bool
+
+	// results of the current pass, nil outside Sync
+	report *Report
+	// synced files whose local copy has gone by size, and the paths
+	// of those found moved, during a pass
+	movedFrom map[int64][]FileState
+	moved     map[string]bool
+
+	// set while Plan is running to record the actions instead
+	plan    *Plan
+	planned map[string]bool
+}
+
+// NewSyncer returns a Syncer which mirrors the local directory into
+// the remote folder.  If state is nil the sync state is only kept in
+// memory.
+func (m *Mega) NewSyncer(local string, remote *Node, state StateStore) (*Syncer, error) {
+	if remote == nil || (remote.GetType() != FOLDER && remote.GetType() != ROOT) {
+		return nil, EARGS
+	}
+	local = longPath(local)
+	fi, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, EARGS
+	}
+	if state == nil {
+		state = &JSONStateStore{states: make(map[string]FileState)}
+	}
+	return &Syncer{
+		m:      m,
+		local:  local,
+		remote: remote,
+		state:  state,
+
+		FailureThreshold: m.getConfig().failureThreshold,
+	}, nil
+}
+
+// localPath returns the local path of rel
+func (s *Syncer) localPath(rel string) string {
+	return filepath.Join(s.local, localRel(rel))
+}
+
+// relPath returns the slash separated path of p relative to the
+// local root, in remote names
+func (s *Syncer) relPath(p string) (string, error) {
+	rel, err := filepath.Rel(s.local, p)
+	if err != nil {
+		return "", err
+	}
+	return remoteRel(rel), nil
+}
+
+// child returns the child of parent called name, nil if there is none
+func (s *Syncer) child(parent *Node, name string) *Node {
+	children, err := s.m.FS.GetChildren(parent)
+	if err != nil {
+		return nil
+	}
+	for _, c := range children {
+		if c.GetName() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// lookup returns the remote node for rel, nil if there is none
+func (s *Syncer) lookup(rel string) *Node {
+	if rel == "." || rel == "" {
+		return s.remote
+	}
+	nodes, err := s.m.FS.PathLookup(s.remote, strings.Split(rel, "/"))
+	if err != nil {
+		return nil
+	}
+	return nodes[len(nodes)-1]
+}
+
+// ensureDir returns the remote folder for rel creating it and any
+// missing parents
+//
+// When planning the folder returned is nil if it doesn't exist yet
+func (s *Syncer) ensureDir(rel string) (*Node, error) {
+	n := s.remote
+	if rel == "." || rel == "" {
+		return n, nil
+	}
+	p := ""
+	for _, name := range strings.Split(rel, "/") {
+		p = path.Join(p, name)
+		c := s.child(n, name)
+		if c != nil && !c.IsFolder() {
+			// a file is in the way
+			if s.plan != nil {
+				s.plan.add(Action{Type: ACTION_TRASH, Path: p, Size: c.GetSize()})
+			} else {
+				err := s.m.Delete(c, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+			c = nil
+		}
+		if c == nil && s.plan != nil {
+			if !s.planned[p] {
+				s.planned[p] = true
+				s.plan.add(Action{Type: ACTION_MKDIR, Path: p})
+			}
+		} else if c == nil {
+			var err error
+			c, err = s.m.CreateDir(name, n)
+			if err != nil {
+				return nil, err
+			}
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// syncFile uploads the local file rel if it has changed since it was
+// last synced, replacing the remote copy.  Files which keep failing
+// are skipped.
+func (s *Syncer) syncFile(rel string, fi os.FileInfo) (err error) {
+	if !s.Selection.Selected(rel) {
+		return nil
+	}
+	st, ok, err := s.state.Get(rel)
+	if err != nil {
+		return err
+	}
+	version := localVersion(fi)
+	if s.skip(st, ok, version) {
+		s.m.logf("sync: skipping %q: failed %d times: %s", rel, st.Failures, st.Error)
+		s.report.add(rel, ITEM_SKIPPED, fmt.Errorf("failed %d times: %s", st.Failures, st.Error))
+		return nil
+	}
+	if s.plan == nil {
+		defer func() {
+			if err != nil {
+				if ferr := recordFailure(s.state, rel, version, err); ferr != nil {
+					s.m.logf("sync: %q: recording failure: %v", rel, ferr)
+				}
+			}
+		}()
+	}
+	ok = ok && st.synced()
+	if ok && st.Unchanged(fi) && s.m.FS.HashLookup(st.Hash) != nil {
+		return nil
+	}
+	if !ok {
+		moved, err := s.localMove(rel, fi)
+		if err != nil || moved {
+			return err
+		}
+	}
+
+	parent, err := s.ensureDir(path.Dir(rel))
+	if err != nil {
+		return err
+	}
+	name := path.Base(rel)
+	old := s.child(parent, name)
+	if ok && !st.Unchanged(fi) && old != nil && old.GetHash() != st.Hash {
+		return s.conflict(rel, fi, parent)
+	}
+
+	if s.plan != nil {
+		s.plan.add(Action{Type: ACTION_UPLOAD, Path: rel, Size: fi.Size()})
+		if old != nil {
+			s.plan.add(Action{Type: ACTION_TRASH, Path: rel, Size: old.GetSize()})
+		}
+		return nil
+	}
+
+	fp, err := FileFingerprint(s.localPath(rel))
+	if err != nil {
+		return err
+	}
+	s.m.debugf("sync: uploading %q", rel)
+	res, err := s.m.UploadFileWith(s.localPath(rel), parent, name, UploadOptions{Dedupe: s.Dedupe})
+	if err != nil {
+		return err
+	}
+	node := res.Node
+	if old != nil && old.GetHash() != node.GetHash() {
+		err = s.m.Delete(old, false)
+		if err != nil {
+			return err
+		}
+	}
+	s.report.add(rel, ITEM_DONE, nil)
+
+	return s.state.Put(FileState{
+		Path:        rel,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime(),
+		Fingerprint: fp,
+		Hash:        node.GetHash(),
+		SyncTime:    s.m.now(),
+	})
+}
+
+// conflict keeps both versions of rel which has changed locally and
+// in parent remotely by renaming the local file to a conflict copy and
+// uploading that
+func (s *Syncer) conflict(rel string, fi os.FileInfo, parent *Node) error {
+	now := s.m.now()
+	cname := conflictName(rel, now, s.user(), func(p string) bool {
+		_, err := os.Lstat(s.localPath(p))
+		return err == nil || s.child(parent, path.Base(p)) != nil
+	})
+	if s.plan != nil {
+		s.plan.add(Action{Type: ACTION_CONFLICT, Path: rel, To: cname, Size: fi.Size()})
+		s.plan.add(Action{Type: ACTION_UPLOAD, Path: cname, Size: fi.Size()})
+		return nil
+	}
+	s.m.logf("sync: %q changed on both sides, saving local version as %q", rel, cname)
+
+	// Stop tracking rel first so the remote version isn't removed
+	err := s.forget(rel)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(s.localPath(rel), s.localPath(cname))
+	if err != nil {
+		return err
+	}
+	err = s.syncFile(cname, fi)
+	if err != nil {
+		return err
+	}
+
+	s.add(Conflict{Path: rel, ConflictPath: cname, Time: now})
+	return nil
+}
+
+// forget removes the state of rel and everything below it
+func (s *Syncer) forget(rel string) error {
+	var paths []string
+	err := s.state.Walk(func(st FileState) error {
+		if st.Path == rel || strings.HasPrefix(st.Path, rel+"/") {
+			paths = append(paths, st.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		err = s.state.Delete(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove moves the remote copy of the local path rel, which no longer
+// exists, to the trash.  Files are only removed if they are the
+// version which was synced and folders only if they don't contain
+// anything which wasn't synced.
+func (s *Syncer) remove(rel string) error {
+	tracked := make(map[string]bool)
+	err := s.state.Walk(func(st FileState) error {
+		if st.Path == rel || strings.HasPrefix(st.Path, rel+"/") {
+			tracked[st.Hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	n := s.lookup(rel)
+	if s.plan != nil {
+		if n != nil && n != s.remote && s.onlyTracked(n, tracked) {
+			var size int64
+			size, err = s.m.FS.treeSize(n)
+			if err != nil {
+				return err
+			}
+			s.plan.add(Action{Type: ACTION_TRASH, Path: rel, Size: size})
+		}
+		return nil
+	}
+	if n != nil && n != s.remote && s.onlyTracked(n, tracked) {
+		s.m.debugf("sync: removing %q", rel)
+		err = s.m.Delete(n, false)
+		if err != nil {
+			return err
+		}
+		s.report.add(rel, ITEM_DONE, nil)
+	}
+	return s.forget(rel)
+}
+
+// move moves the remote copy of the file with state st to the local
+// path to
+func (s *Syncer) move(st FileState, to string) error {
+	n := s.m.FS.HashLookup(st.Hash)
+	if n == nil {
+		return ENOENT
+	}
+	parent, err := s.ensureDir(path.Dir(to))
+	if err != nil {
+		return err
+	}
+
+	s.m.debugf("sync: moving %q to %q", st.Path, to)
+	if old := s.child(parent, path.Base(to)); old != nil && old != n {
+		err = s.m.Delete(old, false)
+		if err != nil {
+			return err
+		}
+	}
+	s.m.FS.mutex.Lock()
+	moved := n.parent != parent
+	s.m.FS.mutex.Unlock()
+	if moved {
+		err = s.m.moveAnyName(n, parent)
+		if err != nil {
+			return err
+		}
+	}
+	if n.GetName() != path.Base(to) {
+		err = s.m.Rename(n, path.Base(to))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.state.Delete(st.Path)
+	if err != nil {
+		return err
+	}
+	st.Path = to
+	st.SyncTime = s.m.now()
+	return s.state.Put(st)
+}
+
+// indexGone indexes the synced files whose local copy has gone for
+// localMove, only those at or below the paths in under unless it is
+// nil
+func (s *Syncer) indexGone(under []string) error {
+	s.movedFrom = make(map[int64][]FileState)
+	s.moved = make(map[string]bool)
+	return s.state.Walk(func(st FileState) error {
+		if !st.synced() || st.Fingerprint == "" {
+			return nil
+		}
+		if under != nil {
+			found := false
+			for _, rel := range under {
+				found = found || st.Path == rel || strings.HasPrefix(st.Path, rel+"/")
+			}
+			if !found {
+				return nil
+			}
+		}
+		if _, err := os.Lstat(s.localPath(st.Path)); os.IsNotExist(err) {
+			s.movedFrom[st.Size] = append(s.movedFrom[st.Size], st)
+		}
+		return nil
+	})
+}
+
+// localMove moves the remote copy of a synced file which has gone if
+// the new local file rel has its fingerprint, returning whether it
+// did
+func (s *Syncer) localMove(rel string, fi os.FileInfo) (bool, error) {
+	candidates := s.movedFrom[fi.Size()]
+	if len(candidates) == 0 {
+		return false, nil
+	}
+	fp, err := FileFingerprint(s.localPath(rel))
+	if err != nil {
+		return false, err
+	}
+	for i, st := range candidates {
+		if st.Fingerprint != fp || s.m.FS.HashLookup(st.Hash) == nil {
+			continue
+		}
+		s.movedFrom[fi.Size()] = append(candidates[:i:i], candidates[i+1:]...)
+		if s.plan != nil {
+			s.plan.add(Action{Type: ACTION_MOVE, Path: st.Path, To: rel})
+			s.moved[st.Path] = true
+			return true, nil
+		}
+		from := st.Path
+		st.ModTime = fi.ModTime()
+		err = s.move(st, rel)
+		if err != nil {
+			return false, err
+		}
+		s.moved[from] = true
+		s.report.add(rel, ITEM_DONE, nil)
+		return true, nil
+	}
+	return false, nil
+}
+
+// onlyTracked returns true if n and all the files below it have
+// hashes in tracked
+func (s *Syncer) onlyTracked(n *Node, tracked map[string]bool) bool {
+	if s.m.LoadTree(n) != nil {
+		return false
+	}
+
+	s.m.FS.mutex.Lock()
+	defer s.m.FS.mutex.Unlock()
+
+	var check func(n *Node) bool
+	check = func(n *Node) bool {
+		if n.ntype == FILE {
+			return tracked[n.hash]
+		}
+		for _, c := range n.children {
+			if !check(c) {
+				return false
+			}
+		}
+		return true
+	}
+	return check(n)
+}
+
+// syncTree syncs the local directory rel and everything below it
+func (s *Syncer) syncTree(rel string) error {
+	var firstErr error
+	err := filepath.Walk(s.localPath(rel), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			s.m.logf("sync: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return nil
+		}
+		r, err := s.relPath(p)
+		if err != nil {
+			return err
+		}
+		if !s.Selection.Selected(r) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case fi.IsDir():
+			_, err = s.ensureDir(r)
+		case fi.Mode().IsRegular():
+			err = s.syncFile(r, fi)
+		default:
+			// skip symlinks, devices and the like
+			return nil
+		}
+		if err != nil {
+			s.m.logf("sync: %q: %v", r, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if s.report.add(r, ITEM_FAILED, err) {
+				return ETOOMANYFAILURES
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// Sync makes a single pass uploading new and changed files, creating
+// folders and moving the remote copies of deleted files to the trash.
+// Remote files which were never synced are left alone.
+//
+// Errors on individual files are logged and the pass carries on, the
+// first one is returned.  After FailureThreshold failures the pass
+// stops with ETOOMANYFAILURES.
+func (s *Syncer) Sync() error {
+	_, err := s.SyncReport()
+	return err
+}
+
+// SyncReport is Sync returning a report of what happened to each file
+// it acted on
+func (s *Syncer) SyncReport() (*Report, error) {
+	report := newReport(s.FailureThreshold)
+	s.report = report
+	defer func() {
+		s.report = nil
+	}()
+	err := s.sync()
+	if report.Aborted {
+		err = ETOOMANYFAILURES
+	}
+	return report, err
+}
+
+// sync makes a single pass for Sync, stopping at the failure
+// threshold
+func (s *Syncer) sync() error {
+	if s.Dedupe && s.plan == nil {
+		err := s.state.Walk(func(st FileState) error {
+			if st.Fingerprint != "" && st.synced() {
+				s.m.noteUploaded(st.Fingerprint, st.Size, st.Hash)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := s.indexGone(nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		s.movedFrom, s.moved = nil, nil
+	}()
+	firstErr := s.syncTree(".")
+	if firstErr == ETOOMANYFAILURES {
+		if err := flushState(s.state); err != nil {
+			s.m.logf("sync: saving state: %v", err)
+		}
+		return firstErr
+	}
+
+	// Remove the remote copies of files which have gone
+	var gone []string
+	err = s.state.Walk(func(st FileState) error {
+		_, err := os.Lstat(s.localPath(st.Path))
+		if os.IsNotExist(err) && !s.moved[st.Path] {
+			gone = append(gone, st.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, rel := range gone {
+		switch {
+		case !s.Selection.Selected(rel) && s.plan != nil:
+			continue
+		case !s.Selection.Selected(rel):
+			err = s.forget(rel)
+		default:
+			err = s.remove(rel)
+		}
+		if err != nil {
+			s.m.logf("sync: %q: %v", rel, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if s.report.add(rel, ITEM_FAILED, err) {
+				break
+			}
+		}
+	}
+
+	err = flushState(s.state)
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+// flushState writes out pending changes for stores which buffer them
+func flushState(state StateStore) error {
+	if f, ok := state.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Plan does a dry run of Sync returning what it would do without
+// changing anything locally, remotely or in the sync state.  Don't
+// call it while Sync or Watch are running.
+func (s *Syncer) Plan() (*Plan, error) {
+	s.plan = &Plan{}
+	s.planned = make(map[string]bool)
+	defer func() {
+		s.plan = nil
+		s.planned = nil
+	}()
+	err := s.Sync()
+	return s.plan, err
+}
@@ -0,0 +1,194 @@
+package mega
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFile writes a local test file creating its directory
+func writeFile(t *testing.T, dir, rel, data string) {
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(p, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it is true or fails the test
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSyncerSync(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.txt", "hello")
+	writeFile(t, dir, "sub/b.txt", "world!")
+
+	s, err := m.NewSyncer(dir, m.FS.GetRoot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := b.lookupPath(m, "a.txt")
+	if a == "" || b.lookupPath(m, "sub/b.txt") == "" {
+		t.Fatalf("files not uploaded")
+	}
+	if data, _ := b.content(a); len(data) != 5 {
+		t.Errorf("a.txt: wrong size %d", len(data))
+	}
+
+	// Unchanged files aren't uploaded again
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.lookupPath(m, "a.txt") != a {
+		t.Errorf("unchanged file was uploaded again")
+	}
+
+	writeFile(t, dir, "a.txt", "hello again")
+	err = os.Remove(filepath.Join(dir, "sub", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newA := b.lookupPath(m, "a.txt")
+	if newA == "" || newA == a {
+		t.Errorf("changed file not uploaded")
+	}
+	if b.lookupPath(m, "sub/b.txt") != "" {
+		t.Errorf("deleted file still present")
+	}
+	if m.FS.HashLookup(a).parent != m.FS.GetTrash() {
+		t.Errorf("old version not moved to trash")
+	}
+}
+
+func TestSyncerLocalMove(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.txt", "hello")
+	writeFile(t, dir, "sub/b.txt", "world!")
+	s, err := m.NewSyncer(dir, m.FS.GetRoot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	a := b.lookupPath(m, "a.txt")
+
+	err = os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Action{{Type: ACTION_MOVE, Path: "a.txt", To: "sub/c.txt"}}
+	if !reflect.DeepEqual(plan.Actions, want) {
+		t.Errorf("planned %v", plan.Actions)
+	}
+
+	if err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.lookupPath(m, "sub/c.txt"); got != a {
+		t.Errorf("moved file was uploaded again")
+	}
+	if b.lookupPath(m, "a.txt") != "" {
+		t.Errorf("old name still present")
+	}
+	if st, ok, _ := s.state.Get("sub/c.txt"); !ok || st.Hash != a {
+		t.Errorf("state %+v", st)
+	}
+}
+
+func TestSyncerWatch(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := m.NewSyncer(dir, m.FS.GetRoot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debounce = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Watch(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch: %v", err)
+		}
+	}()
+
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	writeFile(t, dir, "new/file.txt", "data")
+	waitFor(t, "upload", func() bool { return b.lookupPath(m, "new/file.txt") != "" })
+	h := b.lookupPath(m, "new/file.txt")
+
+	err = os.Rename(filepath.Join(dir, "new", "file.txt"), filepath.Join(dir, "renamed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "rename", func() bool { return b.lookupPath(m, "renamed.txt") != "" })
+	if got := b.lookupPath(m, "renamed.txt"); got != h {
+		t.Errorf("renamed file was uploaded again")
+	}
+	if b.lookupPath(m, "new/file.txt") != "" {
+		t.Errorf("old name still present")
+	}
+
+	err = os.RemoveAll(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delete", func() bool { return b.lookupPath(m, "new") == "" })
+}
@@ -0,0 +1,126 @@
+package mega
+
+import (
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SetTempDir keeps partial downloads and data spooled to disk, such as
+// zip archives being unpacked by UploadArchive, in dir rather than at
+// the destination and in the system temporary directory.  Use it when
+// the destination mustn't see half written files or hasn't room for
+// them.  Downloads are moved into place once complete and checked.
+//
+// maxSpill, if not 0, is the most bytes put in one temporary file.
+// Downloads larger than that are written straight to the destination
+// as without a temporary directory, and spooling more fails with
+// ESPILL.
+//
+// Partial downloads are named after the node and the destination so
+// DownloadOptions.Resume and the TransferManager find them again.  The
+// state files of the TransferManager and sync stores stay where they
+// are put.
+func (m *Mega) SetTempDir(dir string, maxSpill int64) error {
+	if maxSpill < 0 {
+		return EARGS
+	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.tempDir = dir
+	m.config.maxSpill = maxSpill
+	return nil
+}
+
+// WithTempDir keeps partial downloads and spooled data in dir, see
+// SetTempDir
+func WithTempDir(dir string, maxSpill int64) Option {
+	return func(m *Mega) error {
+		if maxSpill < 0 {
+			return EARGS
+		}
+		m.config.tempDir = dir
+		m.config.maxSpill = maxSpill
+		return nil
+	}
+}
+
+// partialPath returns where to download the file with handle hash,
+// size bytes long, on its way to dst, which is dst itself unless
+// there is a temporary directory for it
+func (cfg config) partialPath(dst string, hash string, size int64) string {
+	if cfg.tempDir == "" || (cfg.maxSpill > 0 && size > cfg.maxSpill) {
+		return dst
+	}
+	if abs, err := filepath.Abs(dst); err == nil {
+		dst = abs
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(dst))
+	return filepath.Join(cfg.tempDir, "mega-"+hash+"-"+strconv.FormatUint(h.Sum64(), 36)+".part")
+}
+
+// moveFile moves the file src to dst, copying it if they are on
+// different filesystems
+func moveFile(src, dst string) error {
+	if src == dst {
+		return nil
+	}
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	err := copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// spillPath copies the file at path, which can only be read once in
+// order, to a temporary file as cfg allows, returning its path and a
+// function to remove it
+func (cfg config) spillPath(path string) (tmp string, cleanup func(), err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	f, _, cleanup, err := cfg.spill(in, "mega-upload")
+	closeErr := in.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	if closeErr != nil {
+		cleanup()
+		return "", nil, closeErr
+	}
+	return f.Name(), cleanup, nil
+}
+
+// spill copies r to a temporary file, returning it and a function to
+// close and remove it.  It fails with ESPILL if r holds more than the
+// limit.
+func (cfg config) spill(r io.Reader, prefix string) (f *os.File, size int64, cleanup func(), err error) {
+	f, err = ioutil.TempFile(cfg.tempDir, prefix)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup = func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	if cfg.maxSpill > 0 {
+		r = io.LimitReader(r, cfg.maxSpill+1)
+	}
+	size, err = io.Copy(f, r)
+	if err == nil && cfg.maxSpill > 0 && size > cfg.maxSpill {
+		err = ESPILL
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, size, cleanup, nil
+}
@@ -0,0 +1,120 @@
+package mega
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dirNames returns the names of the files in dir
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestTempDir(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-tempdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "tmp")
+	out := filepath.Join(dir, "out")
+	for _, d := range []string{tmp, out} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.SetTempDir(tmp, -1); err != EARGS {
+		t.Errorf("negative limit: got %v, want EARGS", err)
+	}
+	if err = m.SetTempDir(tmp, 2*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomFile(t, dir, "big.bin", 1500000)
+	n, err := m.UploadFile(filepath.Join(dir, "big.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial downloads are kept in the temporary directory
+	dst := filepath.Join(out, "big.bin")
+	b.mu.Lock()
+	b.failDownload = func(h string, start int) bool {
+		return start > 0
+	}
+	b.mu.Unlock()
+	err = m.DownloadFileWith(n, dst, DownloadOptions{Resume: true})
+	if err == nil {
+		t.Fatal("download didn't fail")
+	}
+	if names := dirNames(t, out); len(names) != 0 {
+		t.Errorf("destination has %q", names)
+	}
+	if names := dirNames(t, tmp); len(names) != 1 {
+		t.Errorf("temporary directory has %q, want the partial download", names)
+	}
+
+	b.mu.Lock()
+	b.failDownload = nil
+	b.mu.Unlock()
+	checkDownload(t, m, n, dst, data)
+	if names := dirNames(t, tmp); len(names) != 0 {
+		t.Errorf("temporary directory left with %q", names)
+	}
+
+	// Files over the limit go straight to the destination
+	if err = m.SetTempDir(tmp, 1000); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.beforeDownload = func(h string, start int) {
+		if _, err := os.Stat(filepath.Join(out, "direct.bin")); err != nil {
+			t.Errorf("not downloading to the destination: %v", err)
+		}
+	}
+	b.mu.Unlock()
+	checkDownload(t, m, n, filepath.Join(out, "direct.bin"), data)
+	b.mu.Lock()
+	b.beforeDownload = nil
+	b.mu.Unlock()
+
+	// Spooling archives is limited too
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	fw, _ := zw.Create("file.txt")
+	_, _ = fw.Write(data[:5000])
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stream := struct{ io.Reader }{bytes.NewReader(zipBuf.Bytes())}
+	if _, err = m.UploadArchive(stream, ARCHIVE_ZIP, m.FS.GetRoot()); err != ESPILL {
+		t.Errorf("UploadArchive: got %v, want ESPILL", err)
+	}
+	if err = m.SetTempDir(tmp, 0); err != nil {
+		t.Fatal(err)
+	}
+	stream = struct{ io.Reader }{bytes.NewReader(zipBuf.Bytes())}
+	if _, err = m.UploadArchive(stream, ARCHIVE_ZIP, m.FS.GetRoot()); err != nil {
+		t.Errorf("UploadArchive: %v", err)
+	}
+	if names := dirNames(t, tmp); len(names) != 0 {
+		t.Errorf("temporary directory left with %q", names)
+	}
+}
@@ -0,0 +1,269 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GetThumbnail returns the thumbnail the web client shows for the file
+// n, or ENOENT if it has none.  The image is padded with zero bytes to
+// a multiple of 16, which JPEG decoders ignore.
+func (m *Mega) GetThumbnail(n *Node) ([]byte, error) {
+	return m.getFileAttr(n, FA_THUMBNAIL)
+}
+
+// GetPreview returns the preview image the web client shows for the
+// file n, or ENOENT if it has none, padded as GetThumbnail's
+func (m *Mega) GetPreview(n *Node) ([]byte, error) {
+	return m.getFileAttr(n, FA_PREVIEW)
+}
+
+// SetThumbnailCache keeps the thumbnails and previews fetched by
+// GetThumbnail and GetPreview in dir so they needn't be fetched again,
+// say each time a gallery is shown.  They are kept encrypted as they
+// are stored on the server, named after the node and the handle of the
+// image so one replaced by SetThumbnails is fetched afresh.  When the
+// files take more than maxBytes the least recently used are removed.
+// An empty dir turns the cache off.
+func (m *Mega) SetThumbnailCache(dir string, maxBytes int64) error {
+	c, err := newThumbCache(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.thumbs = c
+	return nil
+}
+
+// WithThumbnailCache keeps fetched thumbnails and previews in dir, see
+// SetThumbnailCache
+func WithThumbnailCache(dir string, maxBytes int64) Option {
+	return func(m *Mega) error {
+		c, err := newThumbCache(dir, maxBytes)
+		if err != nil {
+			return err
+		}
+		m.config.thumbs = c
+		return nil
+	}
+}
+
+// thumbCache is a directory of file attributes as fetched
+type thumbCache struct {
+	mu  sync.Mutex
+	dir string
+	max int64
+}
+
+// newThumbCache returns the cache in dir, nil if dir is empty
+func newThumbCache(dir string, maxBytes int64) (*thumbCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if maxBytes <= 0 {
+		return nil, EARGS
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &thumbCache{dir: dir, max: maxBytes}, nil
+}
+
+// path returns where the attribute with handle fah of node h is kept
+func (c *thumbCache) path(h, fah string) string {
+	return filepath.Join(c.dir, h+"-"+fah+".fa")
+}
+
+// get returns the attribute kept, marking it used, or nil
+func (c *thumbCache) get(m *Mega, h, fah string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.path(h, fah)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	now := m.now()
+	_ = os.Chtimes(p, now, now)
+	return data
+}
+
+// put keeps the attribute data, removing the least recently used ones
+// to keep within the size.  Failing to is only logged as the data has
+// been fetched anyway.
+func (c *thumbCache) put(m *Mega, h, fah string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.path(h, fah)
+	err := ioutil.WriteFile(p, data, 0600)
+	if err != nil {
+		m.logf("thumbnail cache: %v", err)
+		return
+	}
+	now := m.now()
+	_ = os.Chtimes(p, now, now)
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		m.logf("thumbnail cache: %v", err)
+		return
+	}
+	var total int64
+	var files []os.FileInfo
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".fa") {
+			files = append(files, fi)
+			total += fi.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if total <= c.max {
+			break
+		}
+		err = os.Remove(filepath.Join(c.dir, fi.Name()))
+		if err != nil {
+			m.logf("thumbnail cache: %v", err)
+			continue
+		}
+		total -= fi.Size()
+	}
+}
+
+// fileAttrHandle returns the handle of the file attribute of type typ
+// in fa, as the server lists them, "" if there isn't one
+func fileAttrHandle(fa string, typ int) string {
+	prefix := strconv.Itoa(typ) + "*"
+	for _, a := range strings.Split(fa, "/") {
+		if i := strings.IndexByte(a, ':'); i >= 0 {
+			a = a[i+1:]
+		}
+		if strings.HasPrefix(a, prefix) {
+			return a[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// getFileAttr returns the file attribute of type typ of n decrypted,
+// from the cache if it is there
+func (m *Mega) getFileAttr(n *Node, typ int) ([]byte, error) {
+	if n == nil {
+		return nil, EARGS
+	}
+	m.FS.mutex.Lock()
+	h, ntype, fa, key := n.hash, n.ntype, n.fa, n.meta.key
+	m.FS.mutex.Unlock()
+	if ntype != FILE || len(key) != 16 {
+		return nil, EARGS
+	}
+	fah := fileAttrHandle(fa, typ)
+	if fah == "" {
+		return nil, ENOENT
+	}
+
+	cfg := m.getConfig()
+	var enc []byte
+	if cfg.thumbs != nil {
+		enc = cfg.thumbs.get(m, h, fah)
+	}
+	if enc == nil {
+		var err error
+		enc, err = m.fetchFileAttr(cfg, fah)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.thumbs != nil {
+			cfg.thumbs.put(m, h, fah, enc)
+		}
+	}
+
+	if len(enc)%16 != 0 {
+		return nil, EBADRESP
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(enc))
+	cipher.NewCBCDecrypter(blk, make([]byte, 16)).CryptBlocks(data, enc)
+	return data, nil
+}
+
+// fetchFileAttr fetches the encrypted file attribute with handle fah
+func (m *Mega) fetchFileAttr(cfg config, fah string) ([]byte, error) {
+	handle, err := base64urldecode(fah)
+	if err != nil || len(handle) != 8 {
+		return nil, EARGS
+	}
+
+	var msg [1]FileAttrGetMsg
+	var res [1]UploadResp
+	msg[0].Cmd = "ufa"
+	msg[0].Fah = fah
+	msg[0].R = 1
+	if cfg.https {
+		msg[0].SSL = 2
+	}
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	m.conns.acquire()
+	defer m.conns.release()
+	rsp, err := m.storage.Post(res[0].P, "application/octet-stream", bytes.NewReader(handle))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.New("Http Status: " + rsp.Status)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if errno, ok := chunkErrno(body); ok {
+		return nil, parseError(errno)
+	}
+
+	// the reply is the handle, the length as 4 bytes little endian
+	// and the data of each attribute asked for
+	for len(body) >= 12 {
+		l := int(binary.LittleEndian.Uint32(body[8:12]))
+		if l > len(body)-12 {
+			break
+		}
+		if bytes.Equal(body[:8], handle) {
+			return body[12 : 12+l], nil
+		}
+		body = body[12+l:]
+	}
+	return nil, EBADRESP
+}
@@ -0,0 +1,93 @@
+package mega
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbnailCache(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	clock := &stepClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m.SetClock(clock)
+	tick := func() {
+		clock.mu.Lock()
+		clock.now = clock.now.Add(time.Minute)
+		clock.mu.Unlock()
+	}
+
+	dir, err := ioutil.TempDir("", "mega-thumbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = m.SetThumbnailCache(dir, 0); err != EARGS {
+		t.Errorf("no size: got %v", err)
+	}
+	if err = m.SetThumbnailCache(dir, 90); err != nil {
+		t.Fatal(err)
+	}
+
+	root := m.FS.GetRoot()
+	f1 := uploadString(t, m, root, "f1.jpg", "one")
+	f2 := uploadString(t, m, root, "f2.jpg", "two")
+	thumb := bytes.Repeat([]byte("t"), 32)
+	preview := []byte("a preview")
+	if err = m.SetThumbnails(f1, thumb, preview); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetThumbnails(f2, bytes.Repeat([]byte("u"), 48), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.GetPreview(f2); err != ENOENT {
+		t.Errorf("missing preview: got %v", err)
+	}
+
+	fetches := func() int {
+		return chunkRequests(b, "fa/")
+	}
+	got, err := m.GetThumbnail(f1)
+	if err != nil || !bytes.Equal(got, thumb) {
+		t.Fatalf("thumbnail %q, %v", got, err)
+	}
+	tick()
+	got, err = m.GetPreview(f1)
+	if err != nil || len(got) != 16 || !bytes.HasPrefix(got, preview) {
+		t.Fatalf("preview %q, %v", got, err)
+	}
+	tick()
+	if _, err = m.GetThumbnail(f1); err != nil || fetches() != 2 {
+		t.Errorf("thumbnail fetched again: %d fetches, %v", fetches(), err)
+	}
+
+	// Adding the other thumbnail goes over the limit so the least
+	// recently used, the preview, is removed
+	tick()
+	if _, err = m.GetThumbnail(f2); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.fa"))
+	if len(files) != 2 {
+		t.Errorf("cache holds %v", files)
+	}
+	tick()
+	if _, err = m.GetThumbnail(f1); err != nil || fetches() != 3 {
+		t.Errorf("%d fetches, %v", fetches(), err)
+	}
+	if _, err = m.GetPreview(f1); err != nil || fetches() != 4 {
+		t.Errorf("evicted preview: %d fetches, %v", fetches(), err)
+	}
+
+	// A new thumbnail is fetched afresh
+	thumb = bytes.Repeat([]byte("v"), 16)
+	if err = m.SetThumbnails(f1, thumb, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = m.GetThumbnail(f1); err != nil || !bytes.Equal(got, thumb) {
+		t.Errorf("new thumbnail %q, %v", got, err)
+	}
+}
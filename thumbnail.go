@@ -0,0 +1,220 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// File attribute types of the images the web client shows for a file
+const (
+	FA_THUMBNAIL = 0
+	FA_PREVIEW   = 1
+)
+
+// Sizes of the images made by ImageThumbnails
+const (
+	THUMBNAIL_SIZE = 120  // width and height of a thumbnail
+	PREVIEW_SIZE   = 1000 // most width or height of a preview
+)
+
+// ThumbnailFunc makes the thumbnail and preview, as JPEG images, of
+// the file called name, size bytes long, read from r.  It returns nil
+// images for files it has none for.
+type ThumbnailFunc func(name string, r io.ReaderAt, size int64) (thumbnail, preview []byte, err error)
+
+// ImageThumbnails is a ThumbnailFunc for GIF, JPEG and PNG images.  The
+// thumbnail is the middle square of the image scaled to
+// THUMBNAIL_SIZE, the preview the whole image scaled down to fit in
+// PREVIEW_SIZE.  Transparent areas are made white.  Other files have
+// no images.
+func ImageThumbnails(name string, r io.ReaderAt, size int64) (thumbnail, preview []byte, err error) {
+	img, _, err := image.Decode(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		// not an image we can read
+		return nil, nil, nil
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, nil, nil
+	}
+
+	// middle square
+	sq := b
+	if d := b.Dx() - b.Dy(); d > 0 {
+		sq.Min.X += d / 2
+		sq.Max.X = sq.Min.X + b.Dy()
+	} else if d < 0 {
+		sq.Min.Y -= d / 2
+		sq.Max.Y = sq.Min.Y + b.Dx()
+	}
+	thumbnail, err = encodeJPEG(scaleImage(img, sq, THUMBNAIL_SIZE, THUMBNAIL_SIZE))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w, h := b.Dx(), b.Dy()
+	if w > PREVIEW_SIZE || h > PREVIEW_SIZE {
+		if w > h {
+			w, h = PREVIEW_SIZE, max(1, h*PREVIEW_SIZE/w)
+		} else {
+			w, h = max(1, w*PREVIEW_SIZE/h), PREVIEW_SIZE
+		}
+	}
+	preview, err = encodeJPEG(scaleImage(img, b, w, h))
+	if err != nil {
+		return nil, nil, err
+	}
+	return thumbnail, preview, nil
+}
+
+// scaleImage returns the part r of src scaled to w by h, each pixel
+// the average of the pixels it covers laid over white
+func scaleImage(src image.Image, r image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := r.Dx(), r.Dy()
+	for y := 0; y < h; y++ {
+		y0 := r.Min.Y + y*sh/h
+		y1 := max(y0+1, r.Min.Y+(y+1)*sh/h)
+		for x := 0; x < w; x++ {
+			x0 := r.Min.X + x*sw/w
+			x1 := max(x0+1, r.Min.X+(x+1)*sw/w)
+			var rs, gs, bs, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					// colours are premultiplied so adding what
+					// shows through gives white behind
+					rs += uint64(cr + 0xffff - ca)
+					gs += uint64(cg + 0xffff - ca)
+					bs += uint64(cb + 0xffff - ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(rs / n >> 8)
+			dst.Pix[i+1] = uint8(gs / n >> 8)
+			dst.Pix[i+2] = uint8(bs / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// encodeJPEG returns img as a JPEG
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// max returns the larger of a and b
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// SetThumbnails uploads thumbnail and preview, JPEG images such as
+// those made by ImageThumbnails, as the images the web client shows
+// for the file n.  Either may be nil to leave it as it is.
+func (m *Mega) SetThumbnails(n *Node, thumbnail, preview []byte) error {
+	if n == nil {
+		return EARGS
+	}
+	m.FS.mutex.Lock()
+	ntype, key := n.ntype, n.meta.key
+	m.FS.mutex.Unlock()
+	if ntype != FILE || len(key) != 16 {
+		return EARGS
+	}
+	for _, a := range []struct {
+		typ  int
+		data []byte
+	}{{FA_THUMBNAIL, thumbnail}, {FA_PREVIEW, preview}} {
+		if a.data == nil {
+			continue
+		}
+		h, err := m.uploadFileAttr(a.data, key)
+		if err != nil {
+			return err
+		}
+		err = m.putFileAttr(n, strconv.Itoa(a.typ)+"*"+h)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFileAttr encrypts data with the file key and uploads it as a
+// file attribute, returning its handle
+func (m *Mega) uploadFileAttr(data []byte, key []byte) (string, error) {
+	cfg := m.getConfig()
+	if cfg.readonly {
+		return "", EREADONLY
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	enc := paddnull(append([]byte(nil), data...), 16)
+	cipher.NewCBCEncrypter(blk, make([]byte, 16)).CryptBlocks(enc, enc)
+
+	var msg [1]UploadMsg
+	var res [1]UploadResp
+	msg[0].Cmd = "ufa"
+	msg[0].S = int64(len(enc))
+	if cfg.https {
+		msg[0].SSL = 2
+	}
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return "", err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return "", err
+	}
+
+	m.conns.acquire()
+	defer m.conns.release()
+	rsp, err := m.storage.Post(res[0].P, "application/octet-stream", bytes.NewReader(enc))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	if rsp.StatusCode != http.StatusOK {
+		return "", errors.New("Http Status: " + rsp.Status)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", err
+	}
+	if errno, ok := chunkErrno(body); ok {
+		return "", parseError(errno)
+	}
+	// the handle is 8 bytes
+	if len(body) != 8 {
+		return "", EBADRESP
+	}
+	return base64urlencode(body), nil
+}
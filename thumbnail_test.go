@@ -0,0 +1,145 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPNG returns a w by h PNG, red on the left half and blue on the
+// right
+func testPNG(t *testing.T, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// near returns true if the colour c is close to r, g, b
+func near(c color.Color, r, g, b uint32) bool {
+	cr, cg, cb, _ := c.RGBA()
+	d := func(x, y uint32) bool {
+		return x>>8+24 >= y && y+24 >= x>>8
+	}
+	return d(cr, r) && d(cg, g) && d(cb, b)
+}
+
+func TestImageThumbnails(t *testing.T) {
+	data := testPNG(t, 2400, 600)
+	thumb, preview, err := ImageThumbnails("wide.png", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != THUMBNAIL_SIZE || b.Dy() != THUMBNAIL_SIZE {
+		t.Errorf("thumbnail %v", b)
+	}
+	// the middle square is half red, half blue
+	if !near(img.At(10, 60), 255, 0, 0) || !near(img.At(110, 60), 0, 0, 255) {
+		t.Errorf("thumbnail not the middle of the image")
+	}
+	img, err = jpeg.Decode(bytes.NewReader(preview))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 1000 || b.Dy() != 250 {
+		t.Errorf("preview %v, want 1000x250", b)
+	}
+
+	// Transparent images are on white
+	clear := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, clear); err != nil {
+		t.Fatal(err)
+	}
+	thumb, _, err = ImageThumbnails("clear.png", bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil || !near(img.At(60, 60), 255, 255, 255) {
+		t.Errorf("transparent thumbnail not white: %v", err)
+	}
+
+	thumb, preview, err = ImageThumbnails("notes.txt", bytes.NewReader([]byte("hello")), 5)
+	if thumb != nil || preview != nil || err != nil {
+		t.Errorf("text file: got %d, %d, %v", len(thumb), len(preview), err)
+	}
+}
+
+func TestUploadThumbnails(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-thumbnail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "photo.png")
+	if err = ioutil.WriteFile(p, testPNG(t, 300, 200), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := m.UploadFileWith(p, m.FS.GetRoot(), "", UploadOptions{Thumbnails: ImageThumbnails})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := res.Node
+	blk, err := aes.NewCipher(n.meta.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		typ  int
+		w, h int
+	}{{FA_THUMBNAIL, 120, 120}, {FA_PREVIEW, 300, 200}} {
+		h := fileAttr(n.fa, want.typ)
+		b.mu.Lock()
+		enc := b.fileAttrs[h]
+		b.mu.Unlock()
+		if enc == nil || len(enc)%16 != 0 {
+			t.Errorf("attribute %d: %q not uploaded", want.typ, h)
+			continue
+		}
+		cipher.NewCBCDecrypter(blk, make([]byte, 16)).CryptBlocks(enc, enc)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(enc))
+		if err != nil || cfg.Width != want.w || cfg.Height != want.h {
+			t.Errorf("attribute %d: %+v, %v", want.typ, cfg, err)
+		}
+	}
+
+	// Without Thumbnails nothing is stored
+	res, err = m.UploadFileWith(p, m.FS.GetRoot(), "plain.png", UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Node.fa != "" {
+		t.Errorf("attributes %q stored without Thumbnails", res.Node.fa)
+	}
+	if err = m.SetThumbnails(m.FS.GetRoot(), []byte{1}, nil); err != EARGS {
+		t.Errorf("folder: got %v, want EARGS", err)
+	}
+}
@@ -0,0 +1,111 @@
+package mega
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// Tracer starts spans for the API calls and chunk transfers so they
+// can be fed to a distributed tracing system such as OpenTelemetry.
+// An adapter starts a span with the tracer of that system, sets the
+// attributes on it and wraps it as a Span.
+//
+// Start is called from whichever goroutine makes the call so must be
+// safe for concurrent use.  API calls don't take a context so their
+// spans start from context.Background(); chunk spans start from the
+// context of the transfer, see DownloadOptions.Context.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span)
+}
+
+// Span is an operation started by a Tracer
+type Span interface {
+	// SetAttributes adds attributes known once the operation is done
+	SetAttributes(attrs ...TraceAttr)
+	// End finishes the span with the error the operation returned,
+	// nil if it worked
+	End(err error)
+}
+
+// TraceAttr is an attribute of a span.  Value is a string or an int64.
+type TraceAttr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span names and attribute keys
+const (
+	SPAN_API_REQUEST    = "mega.api"
+	SPAN_DOWNLOAD_CHUNK = "mega.download.chunk"
+	SPAN_UPLOAD_CHUNK   = "mega.upload.chunk"
+
+	// Comma separated API commands in the request
+	ATTR_COMMANDS = "mega.commands"
+	// Times the request was retried
+	ATTR_RETRIES = "mega.retries"
+	// Hash of the handle of the node downloaded or the folder uploaded
+	// into - the handles themselves aren't exposed
+	ATTR_NODE = "mega.node"
+	// Index of the chunk in the file
+	ATTR_CHUNK = "mega.chunk"
+	// Bytes in the chunk
+	ATTR_BYTES = "mega.bytes"
+)
+
+// SetTracer sets the tracer for API calls and chunk transfers, nil for
+// none
+func (m *Mega) SetTracer(t Tracer) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.config.tracer = t
+}
+
+// WithTracer sets the tracer for API calls and chunk transfers, see
+// SetTracer
+func WithTracer(t Tracer) Option {
+	return func(m *Mega) error {
+		m.config.tracer = t
+		return nil
+	}
+}
+
+// noopSpan is the Span used when there is no Tracer
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...TraceAttr) {}
+func (noopSpan) End(err error)                    {}
+
+// startSpan starts a span with the tracer of cfg, or a span which does
+// nothing if there isn't one
+func (cfg *config) startSpan(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span) {
+	if cfg.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return cfg.tracer.Start(ctx, name, attrs...)
+}
+
+// traceHandle returns the hash of handle h for ATTR_NODE so traces
+// can be correlated without revealing the handles
+func traceHandle(h string) string {
+	sum := sha256.Sum256([]byte(h))
+	return hex.EncodeToString(sum[:8])
+}
+
+// traceCommands returns the API commands in the request r for
+// ATTR_COMMANDS
+func traceCommands(r []byte) string {
+	var cmds []struct {
+		Cmd string `json:"a"`
+	}
+	if json.Unmarshal(r, &cmds) != nil {
+		return ""
+	}
+	names := make([]string, len(cmds))
+	for i, c := range cmds {
+		names[i] = c.Cmd
+	}
+	return strings.Join(names, ",")
+}
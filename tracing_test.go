@@ -0,0 +1,111 @@
+package mega
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span kept by recordingTracer
+type recordedSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+	err   error
+}
+
+// recordingTracer is a Tracer which keeps the spans
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	s *recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span) {
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	sp := recordingSpan{t: t, s: s}
+	sp.SetAttributes(attrs...)
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return ctx, sp
+}
+
+func (sp recordingSpan) SetAttributes(attrs ...TraceAttr) {
+	sp.t.mu.Lock()
+	defer sp.t.mu.Unlock()
+	for _, a := range attrs {
+		sp.s.attrs[a.Key] = a.Value
+	}
+}
+
+func (sp recordingSpan) End(err error) {
+	sp.t.mu.Lock()
+	defer sp.t.mu.Unlock()
+	sp.s.ended = true
+	sp.s.err = err
+}
+
+// find returns the spans called name
+func (t *recordingTracer) find(name string) (spans []*recordedSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	tr := &recordingTracer{}
+	m, b := newFakeMegaWith(t, func(m *Mega) {
+		m.SetTracer(tr)
+	})
+	defer b.Close()
+
+	n := uploadString(t, m, m.FS.GetRoot(), "f.txt", "traced")
+	var w memWriterAt
+	if err := m.DownloadTo(n, &w, nil); err != nil {
+		t.Fatal(err)
+	}
+	api := tr.find(SPAN_API_REQUEST)
+	m.SetTracer(nil)
+	if _, err := m.CreateDir("untraced", m.FS.GetRoot()); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.find(SPAN_API_REQUEST)) != len(api) {
+		t.Errorf("traced without a tracer")
+	}
+
+	var commands []string
+	for _, s := range api {
+		if !s.ended {
+			t.Errorf("API span not ended: %+v", s)
+		}
+		commands = append(commands, s.attrs[ATTR_COMMANDS].(string))
+	}
+	if got := strings.Join(commands, " "); !strings.Contains(got, "u p") || !strings.Contains(got, "g") {
+		t.Errorf("API spans for %q", got)
+	}
+
+	for _, name := range []string{SPAN_UPLOAD_CHUNK, SPAN_DOWNLOAD_CHUNK} {
+		spans := tr.find(name)
+		if len(spans) != 1 {
+			t.Fatalf("%d %s spans", len(spans), name)
+		}
+		s := spans[0]
+		if !s.ended || s.err != nil || s.attrs[ATTR_CHUNK] != int64(0) || s.attrs[ATTR_BYTES] != int64(6) {
+			t.Errorf("%s span %+v", name, s)
+		}
+		if node, _ := s.attrs[ATTR_NODE].(string); node == "" || strings.Contains(node, n.GetHash()) {
+			t.Errorf("%s span node %q", name, node)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package mega
+
+import "sync"
+
+// txStep is a step of a Transaction
+type txStep struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// Transaction runs an operation made of several steps, say uploading a
+// new version of a file then deleting the old one, or creating a
+// folder then moving files into it, keeping track of which steps have
+// completed.  MEGA has no transactions of its own so if a step fails
+// part way the completed steps can be rolled back, as far as they can
+// be, with Rollback, or the operation carried on later from where it
+// stopped with the TransactionToken of the error.
+//
+// Steps which make things later steps need, such as the handle of a
+// new node, should record them with Set so they are kept in the token
+// and available with Get when the transaction is resumed.
+type Transaction struct {
+	mu      sync.Mutex
+	steps   []txStep
+	done    int
+	resumed []string
+	values  map[string]string
+}
+
+// TransactionToken records the progress of a Transaction so it can be
+// carried on with ResumeTransaction.  It marshals to JSON for keeping
+// between runs.
+type TransactionToken struct {
+	// Names of the steps completed, in order
+	Done []string `json:"done"`
+	// Values recorded with Set
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// NewTransaction returns an empty transaction
+func NewTransaction() *Transaction {
+	return &Transaction{values: make(map[string]string)}
+}
+
+// ResumeTransaction returns a transaction which carries on from token.
+// Add the same steps again and Run runs the ones which weren't done,
+// failing with EARGS if the names of the completed steps don't match.
+func ResumeTransaction(token TransactionToken) *Transaction {
+	tx := NewTransaction()
+	tx.resumed = append([]string(nil), token.Done...)
+	for k, v := range token.Values {
+		tx.values[k] = v
+	}
+	return tx
+}
+
+// Step adds a step called name which runs do.  undo should reverse it
+// for Rollback, nil if it can't be reversed.
+func (tx *Transaction) Step(name string, do func() error, undo func() error) *Transaction {
+	tx.mu.Lock()
+	tx.steps = append(tx.steps, txStep{name: name, do: do, undo: undo})
+	tx.mu.Unlock()
+	return tx
+}
+
+// Set records value under key for later steps and the token
+func (tx *Transaction) Set(key, value string) {
+	tx.mu.Lock()
+	tx.values[key] = value
+	tx.mu.Unlock()
+}
+
+// Get returns the value recorded under key, "" if there is none
+func (tx *Transaction) Get(key string) string {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.values[key]
+}
+
+// Token returns the progress of the transaction
+func (tx *Transaction) Token() TransactionToken {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.token()
+}
+
+// token returns the progress of the transaction
+//
+// Call with the mutex held
+func (tx *Transaction) token() TransactionToken {
+	t := TransactionToken{Values: make(map[string]string, len(tx.values))}
+	for _, s := range tx.steps[:tx.done] {
+		t.Done = append(t.Done, s.name)
+	}
+	for k, v := range tx.values {
+		t.Values[k] = v
+	}
+	return t
+}
+
+// resume marks the steps done which the token passed to
+// ResumeTransaction says were, checking they are the same steps
+//
+// Call with the mutex held
+func (tx *Transaction) resume() error {
+	if tx.resumed == nil {
+		return nil
+	}
+	if len(tx.resumed) > len(tx.steps) {
+		return EARGS
+	}
+	for i, name := range tx.resumed {
+		if tx.steps[i].name != name {
+			return EARGS
+		}
+	}
+	tx.done = len(tx.resumed)
+	tx.resumed = nil
+	return nil
+}
+
+// Run runs the steps which haven't been done yet in order, stopping at
+// the first which fails with a *TransactionError.  It may be called
+// again, after fixing the cause, to carry on.
+func (tx *Transaction) Run() error {
+	tx.mu.Lock()
+	err := tx.resume()
+	tx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		tx.mu.Lock()
+		if tx.done >= len(tx.steps) {
+			tx.mu.Unlock()
+			return nil
+		}
+		s := tx.steps[tx.done]
+		tx.mu.Unlock()
+
+		err = s.do()
+
+		tx.mu.Lock()
+		if err != nil {
+			txErr := &TransactionError{Step: s.name, Token: tx.token(), Err: err}
+			tx.mu.Unlock()
+			return txErr
+		}
+		tx.done++
+		tx.mu.Unlock()
+	}
+}
+
+// Rollback undoes the completed steps, last first.  It stops with a
+// *TransactionError at the first step which can't be undone, wrapping
+// EIRREVERSIBLE, or whose undo fails, as undoing the steps before it
+// might lose data - say removing a folder files were moved into.  The
+// steps which are left are still done and shown by Token.
+func (tx *Transaction) Rollback() error {
+	tx.mu.Lock()
+	err := tx.resume()
+	tx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		tx.mu.Lock()
+		if tx.done == 0 {
+			tx.mu.Unlock()
+			return nil
+		}
+		s := tx.steps[tx.done-1]
+		tx.mu.Unlock()
+
+		if s.undo == nil {
+			return &TransactionError{Step: s.name, Token: tx.Token(), Err: EIRREVERSIBLE}
+		}
+		err = s.undo()
+		if err != nil {
+			return &TransactionError{Step: s.name, Token: tx.Token(), Err: err}
+		}
+
+		tx.mu.Lock()
+		tx.done--
+		tx.mu.Unlock()
+	}
+}
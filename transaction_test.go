@@ -0,0 +1,111 @@
+package mega
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// moveInto adds steps to tx creating the folder name in parent then
+// moving nodes into it
+func moveInto(m *Mega, tx *Transaction, name string, parent *Node, nodes []*Node) {
+	tx.Step("mkdir", func() error {
+		dir, err := m.CreateDir(name, parent)
+		if err != nil {
+			return err
+		}
+		tx.Set("dir", dir.GetHash())
+		return nil
+	}, func() error {
+		return m.Delete(m.FS.HashLookup(tx.Get("dir")), true)
+	})
+	for _, n := range nodes {
+		n := n
+		tx.Step("move "+n.GetName(), func() error {
+			dir := m.FS.HashLookup(tx.Get("dir"))
+			if dir == nil {
+				return ENOENT
+			}
+			return m.Move(n, dir)
+		}, func() error {
+			return m.Move(n, parent)
+		})
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	root := m.FS.GetRoot()
+	a := uploadString(t, m, root, "a.txt", "a")
+	c := uploadString(t, m, root, "c.txt", "c")
+	gone := uploadString(t, m, root, "gone.txt", "gone")
+	if err := m.Delete(gone, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The move of the deleted file fails
+	tx := NewTransaction()
+	moveInto(m, tx, "dir", root, []*Node{a, gone, c})
+	err := tx.Run()
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || txErr.Step != "move gone.txt" || len(txErr.Token.Done) != 2 {
+		t.Fatalf("Run: got %v", err)
+	}
+	if a.parent == root {
+		t.Errorf("first move not done")
+	}
+
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if a.parent != root || m.FS.HashLookup(tx.Get("dir")) != nil {
+		t.Errorf("not rolled back")
+	}
+	if len(tx.Token().Done) != 0 {
+		t.Errorf("steps still done after rollback: %q", tx.Token().Done)
+	}
+
+	// Carry on from a token after fixing the problem
+	tx = NewTransaction()
+	moveInto(m, tx, "dir", root, []*Node{a, gone, c})
+	err = tx.Run()
+	if !errors.As(err, &txErr) {
+		t.Fatalf("Run: got %v", err)
+	}
+	buf, err := json.Marshal(txErr.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token TransactionToken
+	if err = json.Unmarshal(buf, &token); err != nil {
+		t.Fatal(err)
+	}
+	tx = ResumeTransaction(token)
+	moveInto(m, tx, "dir", root, []*Node{c, a})
+	if err = tx.Run(); err != EARGS {
+		t.Errorf("resumed with different steps: got %v, want EARGS", err)
+	}
+	again := uploadString(t, m, root, "gone.txt", "back again")
+	tx = ResumeTransaction(token)
+	moveInto(m, tx, "dir", root, []*Node{a, again, c})
+	if err = tx.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dir := m.FS.HashLookup(tx.Get("dir"))
+	if dir == nil || a.parent != dir || again.parent != dir || c.parent != dir {
+		t.Errorf("resumed transaction didn't finish")
+	}
+
+	// Steps without undo stop the rollback
+	tx.Step("final", func() error { return nil }, nil)
+	if err = tx.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); !errors.Is(err, EIRREVERSIBLE) {
+		t.Errorf("Rollback: got %v, want EIRREVERSIBLE", err)
+	}
+	if len(tx.Token().Done) != 5 {
+		t.Errorf("%d steps done, want 5", len(tx.Token().Done))
+	}
+}
@@ -0,0 +1,358 @@
+package mega
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// DownloadOptions overrides the client settings for a single download
+// so, say, a daemon can give interactive downloads more workers than
+// background ones.  The zero value uses the client settings.
+type DownloadOptions struct {
+	// Workers fetching chunks at once, 0 for the client setting
+	Workers int
+	// Limiter for the bandwidth of this download instead of the
+	// client's, nil for the client's
+	Limiter *RateLimiter
+	// SkipVerify skips checking the MAC of the whole file at the end
+	SkipVerify bool
+	// Resume keeps the chunks already in the destination file from an
+	// earlier attempt and only downloads the rest.  Only chunks wholly
+	// inside the file are kept, and as they may have holes if the
+	// earlier attempt was interrupted the MAC check is the only
+	// protection - on EMACMISMATCH download again without Resume, or
+	// set Repair.
+	Resume bool
+	// Repair, if the MAC of the whole file doesn't match, finds the
+	// chunks which are corrupt and downloads just those again before
+	// giving up with EMACMISMATCH, see repairChunks
+	Repair bool
+	// Progress receives the bytes of each chunk as it is done and is
+	// closed at the end, as the progress argument of DownloadFile
+	Progress *chan int
+	// Context cancels the download, nil for none
+	Context context.Context
+}
+
+// UploadOptions overrides the client settings for a single upload.
+// The zero value uses the client settings.
+type UploadOptions struct {
+	// Workers sending chunks at once, 0 for the client setting
+	Workers int
+	// Limiter for the bandwidth of this upload instead of the
+	// client's, nil for the client's
+	Limiter *RateLimiter
+	// Resume, if not nil, carries on from the state of an earlier
+	// attempt if it has one and is set to the state of this one if
+	// it fails so it can be passed again.  It is cleared when the
+	// upload succeeds.
+	Resume *UploadState
+	// Progress receives the bytes of each chunk as it is done and is
+	// closed at the end, as the progress argument of UploadFile
+	Progress *chan int
+	// Context cancels the upload, nil for none
+	Context context.Context
+	// Media reads the dimensions and duration of images and videos
+	// into the result and stores those of videos as MEGA's media
+	// attribute, see SetMediaInfo
+	Media bool
+	// Thumbnails, if set, makes the thumbnail and preview images of
+	// the file, which are stored with it for the web client to show,
+	// see ImageThumbnails and SetThumbnails
+	Thumbnails ThumbnailFunc
+	// Dedupe, if set, copies a file of ours with the same contents on
+	// the server instead of uploading, setting Copied and BytesSaved
+	// in the result.  Files uploaded in this session are found by
+	// their FileFingerprint, others of the same size by checking
+	// their MAC against the file, which means reading it once more
+	// for each.  The copy keeps the thumbnails and media attribute of
+	// the file copied so Media and Thumbnails aren't used.
+	Dedupe bool
+}
+
+// transferConfig returns cfg with the workers and limiter overridden
+func transferConfig(cfg config, workers, max int, limiter *RateLimiter) (config, int, error) {
+	switch {
+	case workers < 0:
+		return cfg, 0, EARGS
+	case workers > max:
+		return cfg, 0, EWORKER_LIMIT_EXCEEDED
+	}
+	if limiter != nil {
+		cfg.limiter = limiter
+	}
+	return cfg, workers, nil
+}
+
+// config returns cfg with the options applied
+func (o *DownloadOptions) config(cfg config) (config, error) {
+	cfg, workers, err := transferConfig(cfg, o.Workers, MAX_DOWNLOAD_WORKERS, o.Limiter)
+	if workers > 0 {
+		cfg.dl_workers = workers
+	}
+	return cfg, err
+}
+
+// config returns cfg with the options applied
+func (o *UploadOptions) config(cfg config) (config, error) {
+	cfg, workers, err := transferConfig(cfg, o.Workers, MAX_UPLOAD_WORKERS, o.Limiter)
+	if workers > 0 {
+		cfg.ul_workers = workers
+	}
+	return cfg, err
+}
+
+// resumeChunks records the chunks of d which are wholly inside f,
+// returning how many bytes they hold
+func resumeChunks(d *Download, f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var resumed int64
+	for id := 0; id < d.Chunks(); id++ {
+		pos, size, err := d.ChunkLocation(id)
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 || pos+int64(size) > info.Size() {
+			continue
+		}
+		chunk := make([]byte, size)
+		if _, err = f.ReadAt(chunk, pos); err != nil {
+			return 0, err
+		}
+		if err = d.ResumeChunk(id, chunk); err != nil {
+			return 0, err
+		}
+		resumed += int64(size)
+	}
+	return resumed, nil
+}
+
+// DownloadFileWith downloads src to dstpath like DownloadFile with
+// the settings in opts
+func (m *Mega) DownloadFileWith(src *Node, dstpath string, opts DownloadOptions) error {
+	progress := opts.Progress
+	defer func() {
+		if progress != nil {
+			close(*progress)
+		}
+	}()
+
+	cfg, err := opts.config(m.getConfig())
+	if err != nil {
+		return err
+	}
+	d, err := m.newDownload(cfg, src)
+	if err != nil {
+		return err
+	}
+	if opts.Context != nil {
+		d.ctx = opts.Context
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if opts.Resume {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	part := cfg.partialPath(dstpath, src.GetHash(), d.Size())
+	outfile, err := os.OpenFile(part, flags, 0600)
+	if err != nil {
+		return err
+	}
+
+	if opts.Resume {
+		var resumed int64
+		resumed, err = resumeChunks(d, outfile)
+		if err == nil && resumed > 0 {
+			m.debugf("%s: resuming with %d bytes done", d.src.name, resumed)
+			if progress != nil {
+				*progress <- int(resumed)
+			}
+		}
+		if err == nil {
+			err = outfile.Truncate(d.Size())
+		}
+	}
+	if err == nil {
+		err = m.downloadChunks(d, outfile, progress)
+	}
+
+	// Check nothing was lost before trusting the file
+	if err == nil {
+		var info os.FileInfo
+		info, err = outfile.Stat()
+		if err == nil && info.Size() != d.Size() {
+			m.debugf("%s: downloaded %d bytes, expecting %d", d.src.name, info.Size(), d.Size())
+			err = ESIZE
+		}
+	}
+
+	closeErr := outfile.Close()
+	if err != nil {
+		// keep what was done for resuming
+		if !opts.Resume {
+			_ = os.Remove(part)
+		}
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if !opts.SkipVerify {
+		err = d.Finish()
+		if errors.Is(err, EMACMISMATCH) && opts.Repair {
+			err = m.repairFile(d, part)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = m.checkDownloadFile(src, part)
+	if err != nil {
+		return err
+	}
+	return moveFile(part, dstpath)
+}
+
+// UploadFileWith uploads srcpath into parent like UploadFileResult
+// with the settings in opts
+func (m *Mega) UploadFileWith(srcpath string, parent *Node, name string, opts UploadOptions) (res *UploadResult, err error) {
+	start := m.now()
+	progress := opts.Progress
+	defer func() {
+		if progress != nil {
+			close(*progress)
+		}
+	}()
+
+	cfg, err := opts.config(m.getConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	var infile *os.File
+	var fileSize int64
+
+	if name == "" {
+		name = filepath.Base(srcpath)
+	}
+
+	// FIFOs and devices have no size and can't be read again so they
+	// are copied to a temporary file first
+	info, err := os.Stat(srcpath)
+	if err != nil || !info.Mode().IsRegular() {
+		if opts.Resume != nil && opts.Resume.URL != "" {
+			return nil, EARGS
+		}
+		var tmp string
+		var cleanup func()
+		tmp, cleanup, err = cfg.spillPath(srcpath)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		m.debugf("%s: not a regular file, spooled to %s", srcpath, tmp)
+		srcpath = tmp
+		info, err = os.Stat(srcpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fileSize = info.Size()
+
+	infile, err = os.OpenFile(srcpath, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		e := infile.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	if opts.Dedupe && (opts.Resume == nil || opts.Resume.URL == "") {
+		res, err = m.dedupeUpload(srcpath, infile, fileSize, parent, name)
+		if err != nil || res != nil {
+			return res, err
+		}
+	}
+
+	var u *Upload
+	if opts.Resume != nil && opts.Resume.URL != "" {
+		u, err = m.resumeUpload(cfg, parent, name, fileSize, *opts.Resume)
+	} else {
+		u, err = m.startUpload(cfg, parent, name, fileSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Context != nil {
+		u.ctx = opts.Context
+	}
+	if opts.Resume != nil {
+		defer func() {
+			if err != nil {
+				*opts.Resume = u.State()
+			} else {
+				*opts.Resume = UploadState{}
+			}
+		}()
+	}
+
+	u.fp = sha256.New()
+	err = m.uploadChunks(u, infile, progress)
+	if err != nil {
+		return nil, err
+	}
+	err = m.checkUpload(name, infile, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := u.finishRetry()
+	if err != nil {
+		return nil, err
+	}
+	res = u.result(node)
+	res.Elapsed = m.now().Sub(start)
+	// Only a resumed upload needs the file read again
+	res.Fingerprint = u.fingerprint()
+	if res.Fingerprint == "" {
+		res.Fingerprint, err = FileFingerprint(srcpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.noteUploaded(res.Fingerprint, fileSize, node.GetHash())
+	var media *MediaInfo
+	res.ContentType, media, err = probeUpload(name, infile, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Media && media != nil {
+		res.Media = media
+		if media.Duration > 0 {
+			err = m.SetMediaInfo(node, media)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.Thumbnails != nil {
+		thumbnail, preview, err := opts.Thumbnails(name, infile, fileSize)
+		if err == nil {
+			err = m.SetThumbnails(node, thumbnail, preview)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
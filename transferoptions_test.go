@@ -0,0 +1,155 @@
+package mega
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chunkRequests returns the number of chunk requests seen by the fake
+// whose key starts with prefix
+func chunkRequests(b *fakeBackend, prefix string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	for k, n := range b.requests {
+		if strings.HasPrefix(k, prefix) {
+			total += n
+		}
+	}
+	return total
+}
+
+func TestDownloadOptions(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "src", 1000000)
+	n, err := m.UploadFile(filepath.Join(dir, "src"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := n.GetHash()
+	dst := filepath.Join(dir, "dst")
+
+	if err = m.DownloadFileWith(n, dst, DownloadOptions{Workers: -1}); err != EARGS {
+		t.Errorf("negative workers: got %v, want EARGS", err)
+	}
+	if err = m.DownloadFileWith(n, dst, DownloadOptions{Workers: MAX_DOWNLOAD_WORKERS + 1}); err != EWORKER_LIMIT_EXCEEDED {
+		t.Errorf("too many workers: got %v, want EWORKER_LIMIT_EXCEEDED", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = m.DownloadFileWith(n, dst, DownloadOptions{Context: ctx})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled download: got %v", err)
+	}
+
+	ch := make(chan int)
+	var done int
+	finished := make(chan struct{})
+	go func() {
+		for n := range ch {
+			done += n
+		}
+		close(finished)
+	}()
+	err = m.DownloadFileWith(n, dst, DownloadOptions{Workers: 1, Limiter: NewRateLimiter(0), Progress: &ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-finished
+	if done != len(data) {
+		t.Errorf("progress reported %d bytes, want %d", done, len(data))
+	}
+
+	// Resume from part of the file
+	if err = os.Truncate(dst, 500000); err != nil {
+		t.Fatal(err)
+	}
+	before := chunkRequests(b, h+"/")
+	if err = m.DownloadFileWith(n, dst, DownloadOptions{Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := m.NewDownload(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := chunkRequests(b, h+"/") - before; got == 0 || got >= d.Chunks() {
+		t.Errorf("resumed download fetched %d of %d chunks", got, d.Chunks())
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil || string(got) != string(data) {
+		t.Errorf("resumed download differs: %v", err)
+	}
+}
+
+func TestUploadOptions(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "src", 1000000)
+	src := filepath.Join(dir, "src")
+	root := m.FS.GetRoot()
+
+	if _, err = m.UploadFileWith(src, root, "", UploadOptions{Workers: MAX_UPLOAD_WORKERS + 1}); err != EWORKER_LIMIT_EXCEEDED {
+		t.Errorf("too many workers: got %v, want EWORKER_LIMIT_EXCEEDED", err)
+	}
+
+	// A chunk fails leaving the state to resume from
+	b.mu.Lock()
+	b.failUpload = func(id string, offset int) bool {
+		return offset != 0 && offset == lastChunkOffset(len(data))
+	}
+	b.mu.Unlock()
+	var state UploadState
+	_, err = m.UploadFileWith(src, root, "", UploadOptions{Workers: 2, Resume: &state})
+	if err == nil {
+		t.Fatal("upload succeeded with a failing chunk")
+	}
+	if state.URL == "" || state.ChunkMACs[0] == nil {
+		t.Fatalf("no state to resume from: %+v", state)
+	}
+	id := strings.TrimPrefix(state.URL, b.URL+"/ul/")
+	sent := chunkRequests(b, id+"/0")
+
+	b.mu.Lock()
+	b.failUpload = nil
+	b.mu.Unlock()
+	res, err := m.UploadFileWith(src, root, "", UploadOptions{Resume: &state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunkRequests(b, id+"/0") != sent {
+		t.Errorf("first chunk sent again")
+	}
+	if state.URL != "" {
+		t.Errorf("state not cleared")
+	}
+	if want, _ := FileFingerprint(src); res.Fingerprint != want {
+		t.Errorf("resumed upload fingerprint %q, want %q", res.Fingerprint, want)
+	}
+	checkDownload(t, m, res.Node, filepath.Join(dir, "dst"), data)
+}
+
+// lastChunkOffset returns the position of the last chunk of a file of
+// size bytes
+func lastChunkOffset(size int) int {
+	chunks := getChunkSizes(int64(size))
+	return int(chunks[len(chunks)-1].position)
+}
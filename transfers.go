@@ -0,0 +1,945 @@
+package mega
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TransferType says which way a Transfer goes
+type TransferType int
+
+// Transfer types
+const (
+	TRANSFER_DOWNLOAD TransferType = iota
+	TRANSFER_UPLOAD
+)
+
+func (t TransferType) String() string {
+	switch t {
+	case TRANSFER_DOWNLOAD:
+		return "download"
+	case TRANSFER_UPLOAD:
+		return "upload"
+	}
+	return "unknown"
+}
+
+// TransferStatus is the state of a Transfer in the TransferManager
+type TransferStatus int
+
+// Transfer states
+const (
+	TRANSFER_QUEUED TransferStatus = iota
+	TRANSFER_RUNNING
+	TRANSFER_DONE
+	TRANSFER_FAILED
+)
+
+func (s TransferStatus) String() string {
+	switch s {
+	case TRANSFER_QUEUED:
+		return "queued"
+	case TRANSFER_RUNNING:
+		return "running"
+	case TRANSFER_DONE:
+		return "done"
+	case TRANSFER_FAILED:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// TRANSFER_CONCURRENCY is the default number of transfers a
+// TransferManager runs at once
+const TRANSFER_CONCURRENCY = 2
+
+// TRANSFER_POLICY_POLL is how often a TransferManager held back by
+// MayTransfer asks again by default
+const TRANSFER_POLICY_POLL = 10 * time.Second
+
+// Transfer is a download or upload queued in a TransferManager.  It
+// is saved to disk along with what is needed to resume it.
+type Transfer struct {
+	// Unique ID of the transfer
+	ID string `json:"id"`
+	// Download or upload
+	Type TransferType `json:"type"`
+	// Where the transfer has got to
+	Status TransferStatus `json:"status"`
+	// Local file downloaded to or uploaded from
+	LocalPath string `json:"local"`
+	// Hash of the node to download, or of the uploaded node when done
+	Hash string `json:"hash,omitempty"`
+	// Hash of the folder to upload into
+	Parent string `json:"parent,omitempty"`
+	// Name of the file
+	Name string `json:"name"`
+	// Size of the file in bytes
+	Size int64 `json:"size"`
+	// Priority of the transfer, see SetPriority
+	Priority TransferPriority `json:"priority,omitempty"`
+	// Chunks of a download which have been written
+	Done []int `json:"done,omitempty"`
+	// State of an upload in progress
+	Upload *UploadState `json:"upload,omitempty"`
+	// Why the transfer failed
+	Error string `json:"error,omitempty"`
+}
+
+// copy returns a deep copy of the transfer
+func (t *Transfer) copy() Transfer {
+	c := *t
+	c.Done = append([]int(nil), t.Done...)
+	if t.Upload != nil {
+		u := *t.Upload
+		c.Upload = &u
+	}
+	return c
+}
+
+// errPaused is returned by transfers interrupted by Stop
+var errPaused = errors.New("transfer paused")
+
+// TransferManager runs a queue of downloads and uploads in the
+// background.
+//
+// Transfers are started highest priority first.  The running transfers
+// share a pool of chunk slots weighted by priority, so when a high
+// priority transfer is queued while everything running is of lower
+// priority it is started straight away and takes most of the slots,
+// with the others carrying on slowly rather than being cancelled.
+//
+// If it has a state file the queue is saved there as it changes,
+// including which chunks of each transfer have been done, so after a
+// restart NewTransferManager picks up where it left off and partial
+// transfers carry on rather than starting again.
+type TransferManager struct {
+	m    *Mega
+	path string
+
+	// Concurrent is the number of transfers run at once, 0 for
+	// TRANSFER_CONCURRENCY.  Set it before calling Start.
+	Concurrent int
+	// MayTransfer, if set, is asked before each chunk is started and
+	// while it returns false the transfers wait where they are, say
+	// while on a metered connection.  It is asked again every
+	// PolicyPoll, 0 for TRANSFER_POLICY_POLL, or when Recheck is
+	// called.  Set it before calling Start.
+	MayTransfer func() bool
+	PolicyPoll  time.Duration
+
+	mu        sync.Mutex
+	changed   *sync.Cond // broadcast when a transfer changes state
+	transfers []*Transfer
+	stop      chan struct{}
+	stopping  bool
+	workers   sync.WaitGroup
+	lastSave  time.Time
+	sched     *chunkScheduler
+	n         int           // workers started by Start
+	idle      int           // workers waiting for a transfer
+	extra     int           // workers started to run a higher priority transfer
+	recheck   chan struct{} // closed by Recheck
+	held      int           // chunks waiting for MayTransfer
+}
+
+// transfersFile is the on disk format of the TransferManager state
+type transfersFile struct {
+	Version   int         `json:"version"`
+	Transfers []*Transfer `json:"transfers"`
+}
+
+// NewTransferManager returns a TransferManager saving its queue in the
+// file statePath, or only keeping it in memory if statePath is "".
+//
+// If the file exists the queue is loaded from it.  Transfers which were
+// running are queued again to resume from where they got to.  Call
+// Start to run them.
+//
+// The state file contains the keys of uploads in progress so keep it
+// private.
+func (m *Mega) NewTransferManager(statePath string) (*TransferManager, error) {
+	tm := &TransferManager{
+		m:    m,
+		path: statePath,
+	}
+	tm.changed = sync.NewCond(&tm.mu)
+	if statePath == "" {
+		return tm, nil
+	}
+
+	buf, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return tm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file transfersFile
+	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range file.Transfers {
+		if t.Status == TRANSFER_RUNNING {
+			t.Status = TRANSFER_QUEUED
+		}
+	}
+	tm.transfers = file.Transfers
+	return tm, nil
+}
+
+// save writes the state file.  Progress updates are only written once
+// a second unless force is set.
+//
+// Call with the mutex held
+func (tm *TransferManager) save(force bool) {
+	if tm.path == "" || (!force && tm.m.now().Sub(tm.lastSave) < time.Second) {
+		return
+	}
+	buf, err := json.Marshal(transfersFile{Version: 1, Transfers: tm.transfers})
+	if err == nil {
+		err = writeFileAtomic(tm.path, buf)
+	}
+	if err != nil {
+		tm.m.logf("transfers: saving state: %v", err)
+		return
+	}
+	tm.lastSave = tm.m.now()
+}
+
+// add queues a new transfer
+func (tm *TransferManager) add(t *Transfer) (string, error) {
+	var err error
+	cfg := tm.m.getConfig()
+	t.ID, err = randString(cfg.idSource(), 8)
+	if err != nil {
+		return "", err
+	}
+	t.Status = TRANSFER_QUEUED
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.transfers = append(tm.transfers, t)
+	tm.save(true)
+	tm.changed.Broadcast()
+	tm.preempt()
+	return t.ID, nil
+}
+
+// QueueDownload queues a download of the file src to dstpath returning
+// the ID of the transfer
+func (tm *TransferManager) QueueDownload(src *Node, dstpath string) (string, error) {
+	if src == nil || !src.IsFile() {
+		return "", EARGS
+	}
+	return tm.add(&Transfer{
+		Type:      TRANSFER_DOWNLOAD,
+		LocalPath: dstpath,
+		Hash:      src.GetHash(),
+		Name:      src.GetName(),
+		Size:      src.GetSize(),
+	})
+}
+
+// QueueUpload queues an upload of the file srcpath into parent as
+// name, or the base name of srcpath if name is "", returning the ID of
+// the transfer
+func (tm *TransferManager) QueueUpload(srcpath string, parent *Node, name string) (string, error) {
+	if parent == nil {
+		return "", EARGS
+	}
+	fi, err := os.Stat(srcpath)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", EARGS
+	}
+	if name == "" {
+		name = filepath.Base(srcpath)
+	}
+	return tm.add(&Transfer{
+		Type:      TRANSFER_UPLOAD,
+		LocalPath: srcpath,
+		Parent:    parent.GetHash(),
+		Name:      name,
+		Size:      fi.Size(),
+	})
+}
+
+// Transfers returns a copy of all the transfers in queue order
+func (tm *TransferManager) Transfers() []Transfer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	ts := make([]Transfer, 0, len(tm.transfers))
+	for _, t := range tm.transfers {
+		ts = append(ts, t.copy())
+	}
+	return ts
+}
+
+// find returns the transfer with the id given
+//
+// Call with the mutex held
+func (tm *TransferManager) find(id string) (int, *Transfer) {
+	for i, t := range tm.transfers {
+		if t.ID == id {
+			return i, t
+		}
+	}
+	return -1, nil
+}
+
+// Get returns a copy of the transfer with the id given
+func (tm *TransferManager) Get(id string) (Transfer, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	_, t := tm.find(id)
+	if t == nil {
+		return Transfer{}, false
+	}
+	return t.copy(), true
+}
+
+// Retry queues a failed transfer again.  It resumes from where it got
+// to if possible.
+func (tm *TransferManager) Retry(id string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	_, t := tm.find(id)
+	if t == nil {
+		return ENOENT
+	}
+	if t.Status != TRANSFER_FAILED {
+		return EARGS
+	}
+	t.Status = TRANSFER_QUEUED
+	t.Error = ""
+	tm.save(true)
+	tm.changed.Broadcast()
+	return nil
+}
+
+// SetPriority changes the priority of a transfer.  It takes effect
+// straight away for a running transfer.
+func (tm *TransferManager) SetPriority(id string, p TransferPriority) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	_, t := tm.find(id)
+	if t == nil {
+		return ENOENT
+	}
+	t.Priority = p
+	tm.save(true)
+	tm.changed.Broadcast()
+	tm.preempt()
+	return nil
+}
+
+// Remove removes a transfer which isn't running from the queue
+func (tm *TransferManager) Remove(id string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	i, t := tm.find(id)
+	if t == nil {
+		return ENOENT
+	}
+	if t.Status == TRANSFER_RUNNING {
+		return EARGS
+	}
+	tm.transfers = append(tm.transfers[:i], tm.transfers[i+1:]...)
+	tm.save(true)
+	tm.changed.Broadcast()
+	return nil
+}
+
+// Start starts running the queued transfers in the background
+func (tm *TransferManager) Start() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.stop != nil {
+		return
+	}
+	tm.stop = make(chan struct{})
+	tm.stopping = false
+
+	n := tm.Concurrent
+	if n <= 0 {
+		n = TRANSFER_CONCURRENCY
+	}
+	cfg := tm.m.getConfig()
+	workers := cfg.dl_workers
+	if cfg.ul_workers > workers {
+		workers = cfg.ul_workers
+	}
+	tm.sched = newChunkScheduler(n * workers)
+	tm.n = n
+	for i := 0; i < n; i++ {
+		tm.workers.Add(1)
+		go tm.worker(tm.stop, false)
+	}
+	tm.preempt()
+}
+
+// preempt starts an extra worker if a queued transfer has a higher
+// priority than one running and there is no idle worker to take it.
+// The extra workers are limited to the number Start runs.
+//
+// Call with the mutex held
+func (tm *TransferManager) preempt() {
+	if tm.stop == nil || tm.stopping || tm.idle > 0 || tm.extra >= tm.n {
+		return
+	}
+	var queued, running *Transfer
+	for _, t := range tm.transfers {
+		switch t.Status {
+		case TRANSFER_QUEUED:
+			if queued == nil || t.Priority > queued.Priority {
+				queued = t
+			}
+		case TRANSFER_RUNNING:
+			if running == nil || t.Priority < running.Priority {
+				running = t
+			}
+		}
+	}
+	if queued == nil || running == nil || queued.Priority <= running.Priority {
+		return
+	}
+	tm.m.debugf("transfers: %q preempting %q", queued.Name, running.Name)
+	tm.extra++
+	tm.workers.Add(1)
+	go tm.worker(tm.stop, true)
+}
+
+// Stop pauses the running transfers at the next chunk, saves the state
+// and returns once they have stopped.  They carry on from there when
+// Start is called again.
+func (tm *TransferManager) Stop() {
+	tm.mu.Lock()
+	if tm.stop == nil {
+		tm.mu.Unlock()
+		return
+	}
+	close(tm.stop)
+	tm.stopping = true
+	tm.changed.Broadcast()
+	tm.sched.wake()
+	tm.mu.Unlock()
+
+	tm.workers.Wait()
+
+	tm.mu.Lock()
+	tm.stop = nil
+	tm.save(true)
+	tm.mu.Unlock()
+}
+
+// Wait blocks until there are no queued or running transfers, or the
+// manager is stopped
+func (tm *TransferManager) Wait() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for !tm.stopping && tm.stop != nil {
+		busy := false
+		for _, t := range tm.transfers {
+			if t.Status == TRANSFER_QUEUED || t.Status == TRANSFER_RUNNING {
+				busy = true
+				break
+			}
+		}
+		if !busy {
+			return
+		}
+		tm.changed.Wait()
+	}
+}
+
+// next waits for a queued transfer and marks it running, returning
+// nil when the manager is stopped.  The highest priority transfer is
+// taken, the first queued of those with the same priority.  If wait is
+// false it returns nil rather than waiting.
+func (tm *TransferManager) next(wait bool) *Transfer {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for !tm.stopping {
+		var best *Transfer
+		for _, t := range tm.transfers {
+			if t.Status == TRANSFER_QUEUED && (best == nil || t.Priority > best.Priority) {
+				best = t
+			}
+		}
+		if best != nil {
+			best.Status = TRANSFER_RUNNING
+			tm.save(true)
+			tm.changed.Broadcast()
+			return best
+		}
+		if !wait {
+			return nil
+		}
+		tm.idle++
+		tm.changed.Wait()
+		tm.idle--
+	}
+	return nil
+}
+
+// worker runs transfers until the manager is stopped, or just one if
+// extra is set
+func (tm *TransferManager) worker(stop <-chan struct{}, extra bool) {
+	defer tm.workers.Done()
+	if extra {
+		defer func() {
+			tm.mu.Lock()
+			tm.extra--
+			tm.mu.Unlock()
+		}()
+	}
+	for {
+		t := tm.next(!extra)
+		if t == nil {
+			return
+		}
+
+		var err error
+		switch t.Type {
+		case TRANSFER_DOWNLOAD:
+			err = tm.runDownload(t, stop)
+		case TRANSFER_UPLOAD:
+			err = tm.runUpload(t, stop)
+		default:
+			err = EARGS
+		}
+
+		tm.mu.Lock()
+		switch {
+		case err == errPaused:
+			t.Status = TRANSFER_QUEUED
+		case err != nil:
+			tm.m.logf("transfers: %s %q failed: %v", t.Type, t.Name, err)
+			t.Status = TRANSFER_FAILED
+			t.Error = err.Error()
+		default:
+			t.Status = TRANSFER_DONE
+		}
+		tm.save(true)
+		tm.changed.Broadcast()
+		tm.mu.Unlock()
+		if extra {
+			return
+		}
+	}
+}
+
+// allowed waits until MayTransfer allows chunks to start, returning
+// false if stop is closed first
+func (tm *TransferManager) allowed(stop <-chan struct{}) bool {
+	if tm.MayTransfer == nil || tm.MayTransfer() {
+		return true
+	}
+	poll := tm.PolicyPoll
+	if poll <= 0 {
+		poll = TRANSFER_POLICY_POLL
+	}
+
+	tm.mu.Lock()
+	if tm.held == 0 {
+		tm.m.debugf("transfers: held back by policy")
+	}
+	tm.held++
+	tm.mu.Unlock()
+	defer func() {
+		tm.mu.Lock()
+		tm.held--
+		tm.mu.Unlock()
+	}()
+
+	for {
+		tm.mu.Lock()
+		if tm.recheck == nil {
+			tm.recheck = make(chan struct{})
+		}
+		recheck := tm.recheck
+		tm.mu.Unlock()
+
+		select {
+		case <-stop:
+			return false
+		case <-recheck:
+		case <-tm.m.after(poll):
+		}
+		if tm.MayTransfer() {
+			return true
+		}
+	}
+}
+
+// Recheck makes transfers held back by MayTransfer ask it again now,
+// say when the network changes
+func (tm *TransferManager) Recheck() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.recheck != nil {
+		close(tm.recheck)
+		tm.recheck = nil
+	}
+}
+
+// Held returns true if transfers are waiting for MayTransfer
+func (tm *TransferManager) Held() bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.held > 0
+}
+
+// slots returns the functions runChunks uses to get chunk slots for t
+// from the scheduler, once MayTransfer allows
+func (tm *TransferManager) slots(t *Transfer, stop <-chan struct{}) (acquire func() bool, release func()) {
+	acquire = func() bool {
+		if !tm.allowed(stop) {
+			return false
+		}
+		tm.mu.Lock()
+		p := t.Priority
+		tm.mu.Unlock()
+		return tm.sched.acquire(p, stop)
+	}
+	return acquire, tm.sched.release
+}
+
+// doneChunks returns the set of chunks of a download already written
+func (tm *TransferManager) doneChunks(t *Transfer) map[int]bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	done := make(map[int]bool, len(t.Done))
+	for _, id := range t.Done {
+		done[id] = true
+	}
+	return done
+}
+
+// chunkDone records that chunk id of a download has been written
+func (tm *TransferManager) chunkDone(t *Transfer, id int) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t.Done = append(t.Done, id)
+	tm.save(false)
+}
+
+// resetChunks forgets the progress of a download
+func (tm *TransferManager) resetChunks(t *Transfer) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t.Done = nil
+	tm.save(true)
+}
+
+// stopContext returns a context which is done once stop is closed or
+// cancel is called
+func stopContext(stop <-chan struct{}) (ctx context.Context, cancel func()) {
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// runChunks runs transfer for each of the chunks ids using workers
+// goroutines until they are done, one fails or stop is closed.  Each
+// chunk waits for acquire before starting and calls release when done.
+func runChunks(m *Mega, name string, ids []int, workers int, stop <-chan struct{}, acquire func() bool, release func(), transfer func(id int) error) error {
+	workch := make(chan int)
+	errch := make(chan error, workers)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range workch {
+				err := transfer(id)
+				release()
+				if err != nil {
+					errch <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+	for i := 0; i < len(ids) && err == nil; {
+		if !acquire() {
+			err = errPaused
+			break
+		}
+		select {
+		case workch <- ids[i]:
+			i++
+		case err = <-errch:
+			release()
+		case <-stop:
+			err = errPaused
+			release()
+		}
+	}
+	close(workch)
+	wg.Wait()
+
+	return drainErrors(m, name, err, errch)
+}
+
+// runDownload downloads t skipping the chunks done already
+func (tm *TransferManager) runDownload(t *Transfer, stop <-chan struct{}) error {
+	src := tm.m.FS.HashLookup(t.Hash)
+	if src == nil {
+		return ENOENT
+	}
+	d, err := tm.m.NewDownload(src)
+	if err != nil {
+		return err
+	}
+
+	done := tm.doneChunks(t)
+	flags := os.O_RDWR | os.O_CREATE
+	if len(done) == 0 {
+		flags |= os.O_TRUNC
+	}
+	part := d.cfg.partialPath(t.LocalPath, t.Hash, d.Size())
+	outfile, err := os.OpenFile(part, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = outfile.Close()
+	}()
+
+	// Read back the chunks written by an earlier run for the MAC
+	for id := range done {
+		chk_start, chk_size, err := d.ChunkLocation(id)
+		if err == nil {
+			chunk := make([]byte, chk_size)
+			_, err = outfile.ReadAt(chunk, chk_start)
+			if err == nil {
+				err = d.ResumeChunk(id, chunk)
+			}
+		}
+		if err != nil {
+			tm.m.logf("transfers: %q: can't resume, starting again: %v", t.Name, err)
+			tm.resetChunks(t)
+			done = map[int]bool{}
+			err = outfile.Truncate(0)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if len(done) > 0 {
+		tm.m.debugf("transfers: %q: resuming with %d/%d chunks done", t.Name, len(done), d.Chunks())
+	}
+
+	var todo []int
+	for id := 0; id < d.Chunks(); id++ {
+		if !done[id] {
+			todo = append(todo, id)
+		}
+	}
+	acquire, release := tm.slots(t, stop)
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+	err = runChunks(tm.m, t.Name, todo, d.cfg.dl_workers, stop, acquire, release, func(id int) error {
+		chk_start, chk_size, err := d.ChunkLocation(id)
+		if err != nil {
+			return err
+		}
+		if tm.m.mem.acquire(ctx, int64(chk_size)) != nil {
+			return errPaused
+		}
+		defer tm.m.mem.release(int64(chk_size))
+		chunk, err := d.DownloadChunk(id)
+		if err != nil {
+			return &ChunkError{Op: "download", Chunk: id, Offset: chk_start, Err: err}
+		}
+		n, err := outfile.WriteAt(chunk, chk_start)
+		if err == nil && n != len(chunk) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return &ChunkError{Op: "write", Chunk: id, Offset: chk_start, Err: err}
+		}
+		tm.chunkDone(t, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	info, err := outfile.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != d.Size() {
+		tm.resetChunks(t)
+		return ESIZE
+	}
+	err = d.Finish()
+	if err != nil {
+		// Don't trust any of it next time
+		tm.resetChunks(t)
+		return err
+	}
+	err = outfile.Close()
+	if err != nil {
+		return err
+	}
+	return moveFile(part, t.LocalPath)
+}
+
+// uploadState returns the saved state of an upload
+func (tm *TransferManager) uploadState(t *Transfer) *UploadState {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if t.Upload == nil {
+		return nil
+	}
+	st := *t.Upload
+	return &st
+}
+
+// setUploadState records the state of an upload, nil to start again
+func (tm *TransferManager) setUploadState(t *Transfer, st *UploadState, force bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t.Upload = st
+	tm.save(force)
+}
+
+// runUpload uploads t skipping the chunks done already
+func (tm *TransferManager) runUpload(t *Transfer, stop <-chan struct{}) error {
+	parent := tm.m.FS.HashLookup(t.Parent)
+	if parent == nil {
+		return ENOENT
+	}
+	fi, err := os.Stat(t.LocalPath)
+	if err != nil {
+		return err
+	}
+	infile, err := os.Open(t.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = infile.Close()
+	}()
+
+	var u *Upload
+	if st := tm.uploadState(t); st != nil && fi.Size() == t.Size {
+		u, err = tm.m.ResumeUpload(parent, t.Name, fi.Size(), *st)
+		if err != nil {
+			tm.m.logf("transfers: %q: can't resume, starting again: %v", t.Name, err)
+			u = nil
+		}
+	}
+	if u == nil {
+		u, err = tm.m.NewUpload(parent, t.Name, fi.Size())
+		if err != nil {
+			return err
+		}
+		tm.mu.Lock()
+		t.Size = fi.Size()
+		tm.mu.Unlock()
+		st := u.State()
+		tm.setUploadState(t, &st, true)
+	}
+
+	todo := func() []int {
+		var todo []int
+		for id := 0; id < u.Chunks(); id++ {
+			if !u.ChunkDone(id) {
+				todo = append(todo, id)
+			}
+		}
+		return todo
+	}
+	if n := len(todo()); n < u.Chunks() {
+		tm.m.debugf("transfers: %q: resuming with %d/%d chunks done", t.Name, u.Chunks()-n, u.Chunks())
+	}
+	acquire, release := tm.slots(t, stop)
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+	send := func(id int) error {
+		chk_start, chk_size, err := u.ChunkLocation(id)
+		if err != nil {
+			return err
+		}
+		if tm.m.mem.acquire(ctx, int64(chk_size)) != nil {
+			return errPaused
+		}
+		defer tm.m.mem.release(int64(chk_size))
+		chunk := make([]byte, chk_size)
+		n, err := infile.ReadAt(chunk, chk_start)
+		if err != nil && err != io.EOF {
+			return &ChunkError{Op: "read", Chunk: id, Offset: chk_start, Err: err}
+		}
+		if n != len(chunk) {
+			return &ChunkError{Op: "read", Chunk: id, Offset: chk_start, Err: errors.New("chunk too short")}
+		}
+		err = u.UploadChunk(id, chunk)
+		if err != nil {
+			return &ChunkError{Op: "upload", Chunk: id, Offset: chk_start, Err: err}
+		}
+		st := u.State()
+		tm.setUploadState(t, &st, false)
+		return nil
+	}
+	err = runChunks(tm.m, t.Name, todo(), u.cfg.ul_workers, stop, acquire, release, send)
+	for renewals := 0; errors.Is(err, EEXPIRED) && renewals < UPLOAD_URL_RENEWALS; renewals++ {
+		tm.m.debugf("transfers: %q: upload URL expired, starting again with a new one", t.Name)
+		err = u.renewURL()
+		if err != nil {
+			break
+		}
+		st := u.State()
+		tm.setUploadState(t, &st, true)
+		err = runChunks(tm.m, t.Name, todo(), u.cfg.ul_workers, stop, acquire, release, send)
+	}
+	if errors.Is(err, EEXPIRED) || errors.Is(err, EFAILED) {
+		// The upload URL is no good so start again next time
+		tm.setUploadState(t, nil, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	node, err := u.finishRetry()
+	if err != nil {
+		if permanentError(err) {
+			tm.setUploadState(t, nil, true)
+		} else {
+			// Keep the chunks so Retry only needs to complete it
+			st := u.State()
+			tm.setUploadState(t, &st, true)
+		}
+		return err
+	}
+
+	tm.mu.Lock()
+	t.Hash = node.GetHash()
+	t.Upload = nil
+	tm.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,314 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// randomFile writes size random bytes to a new file in dir
+func randomFile(t *testing.T, dir string, name string, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTransferManager(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "up.bin", 300000)
+
+	tm, err := m.NewTransferManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Start()
+	defer tm.Stop()
+
+	id, err := tm.QueueUpload(filepath.Join(dir, "up.bin"), m.FS.GetRoot(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Wait()
+	up, _ := tm.Get(id)
+	if up.Status != TRANSFER_DONE || up.Hash == "" {
+		t.Fatalf("upload not done: %+v", up)
+	}
+
+	id, err = tm.QueueDownload(m.FS.HashLookup(up.Hash), filepath.Join(dir, "down.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Wait()
+	down, _ := tm.Get(id)
+	if down.Status != TRANSFER_DONE {
+		t.Fatalf("download not done: %+v", down)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "down.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs: %v", err)
+	}
+}
+
+func TestTransferManagerResume(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	m.SetRetries(0)
+
+	dir, err := ioutil.TempDir("", "mega-transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "transfers.json")
+	// chunks of 128k, 256k and the rest
+	data := randomFile(t, dir, "up.bin", 500000)
+
+	// Only the first chunk gets through
+	b.mu.Lock()
+	b.failUpload = func(id string, offset int) bool { return offset != 0 }
+	b.mu.Unlock()
+
+	tm, err := m.NewTransferManager(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Concurrent = 1
+	tm.Start()
+	id, err := tm.QueueUpload(filepath.Join(dir, "up.bin"), m.FS.GetRoot(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Wait()
+	tm.Stop()
+	up, _ := tm.Get(id)
+	if up.Status != TRANSFER_FAILED || up.Upload == nil {
+		t.Fatalf("upload should have failed with state: %+v", up)
+	}
+
+	// A new manager picks up the state and finishes the upload
+	b.mu.Lock()
+	b.failUpload = nil
+	b.mu.Unlock()
+	tm, err = m.NewTransferManager(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tm.Retry(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Start()
+	tm.Wait()
+	up, _ = tm.Get(id)
+	if up.Status != TRANSFER_DONE {
+		t.Fatalf("upload not resumed: %+v", up)
+	}
+	uploadID := up.Hash
+	if n := b.requestCount(uploadKey(t, b, uploadID) + "/0"); n != 1 {
+		t.Errorf("first chunk uploaded %d times", n)
+	}
+
+	// Same again for a download
+	b.mu.Lock()
+	b.failDownload = func(h string, start int) bool { return start != 0 }
+	b.mu.Unlock()
+	id, err = tm.QueueDownload(m.FS.HashLookup(up.Hash), filepath.Join(dir, "down.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Wait()
+	tm.Stop()
+	down, _ := tm.Get(id)
+	if down.Status != TRANSFER_FAILED || len(down.Done) != 1 {
+		t.Fatalf("download should have failed with progress: %+v", down)
+	}
+
+	b.mu.Lock()
+	b.failDownload = nil
+	b.mu.Unlock()
+	tm, err = m.NewTransferManager(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tm.Retry(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Start()
+	tm.Wait()
+	tm.Stop()
+	down, _ = tm.Get(id)
+	if down.Status != TRANSFER_DONE {
+		t.Fatalf("download not resumed: %+v", down)
+	}
+	if n := b.requestCount(up.Hash + "/0"); n != 1 {
+		t.Errorf("first chunk downloaded %d times", n)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "down.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs: %v", err)
+	}
+}
+
+// uploadKey returns the fake's upload id for the node with hash h
+func uploadKey(t *testing.T, b *fakeBackend, h string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, data := range b.uploads {
+		if bytes.Equal(data, b.data[h]) {
+			return id
+		}
+	}
+	t.Fatalf("no upload for %s", h)
+	return ""
+}
+
+func TestTransferManagerPriority(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	_ = m.SetDownloadWorkers(1)
+	_ = m.SetUploadWorkers(1)
+
+	dir, err := ioutil.TempDir("", "mega-transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 7 chunks slowed down so the backup is still going when the
+	// interactive download is queued
+	backupData := randomFile(t, dir, "backup.bin", 3000000)
+	backup, err := m.UploadFile(filepath.Join(dir, "backup.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := uploadString(t, m, m.FS.GetRoot(), "small.txt", "wanted now")
+	b.mu.Lock()
+	b.beforeDownload = func(h string, start int) {
+		if h == backup.GetHash() {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	b.mu.Unlock()
+
+	tm, err := m.NewTransferManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Concurrent = 1
+	tm.Start()
+	defer tm.Stop()
+
+	backupID, err := tm.QueueDownload(backup, filepath.Join(dir, "backup.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tm.SetPriority(backupID, PRIORITY_LOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "backup to start", func() bool {
+		tr, _ := tm.Get(backupID)
+		return len(tr.Done) > 0
+	})
+
+	smallID, err := tm.QueueDownload(small, filepath.Join(dir, "small.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tm.SetPriority(smallID, PRIORITY_HIGH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "interactive download", func() bool {
+		tr, _ := tm.Get(smallID)
+		return tr.Status == TRANSFER_DONE
+	})
+	tr, _ := tm.Get(backupID)
+	if tr.Status != TRANSFER_RUNNING {
+		t.Errorf("backup is %s, want still running", tr.Status)
+	}
+
+	tm.Wait()
+	tr, _ = tm.Get(backupID)
+	if tr.Status != TRANSFER_DONE {
+		t.Fatalf("backup not done: %+v", tr)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "backup.out"))
+	if err != nil || !bytes.Equal(got, backupData) {
+		t.Errorf("backup data differs: %v", err)
+	}
+	if n := b.requestCount(backup.GetHash() + "/0"); n != 1 {
+		t.Errorf("first backup chunk fetched %d times, want 1", n)
+	}
+	if err := tm.SetPriority("nope", PRIORITY_HIGH); err != ENOENT {
+		t.Errorf("SetPriority of unknown transfer: %v", err)
+	}
+}
+
+func TestTransferManagerPolicy(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	randomFile(t, dir, "up.bin", 300000)
+
+	tm, err := m.NewTransferManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	wifi := false
+	tm.MayTransfer = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return wifi
+	}
+	tm.PolicyPoll = time.Hour
+	tm.Start()
+	defer tm.Stop()
+
+	id, err := tm.QueueUpload(filepath.Join(dir, "up.bin"), m.FS.GetRoot(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "transfer held", tm.Held)
+	b.mu.Lock()
+	sent := len(b.requests)
+	b.mu.Unlock()
+	if sent != 0 {
+		t.Errorf("%d chunks sent while held", sent)
+	}
+
+	mu.Lock()
+	wifi = true
+	mu.Unlock()
+	tm.Recheck()
+	tm.Wait()
+	if up, _ := tm.Get(id); up.Status != TRANSFER_DONE {
+		t.Fatalf("upload not done: %+v", up)
+	}
+	if tm.Held() {
+		t.Errorf("still held")
+	}
+}
@@ -0,0 +1,128 @@
+package mega
+
+import "encoding/json"
+
+// TrashOrigin is where a node in the trash was before it was trashed
+type TrashOrigin struct {
+	// The folder it was in, nil if that has gone since
+	Parent *Node
+	// Path of the folder it was in
+	Path string
+}
+
+// trashOrigin records the folder a node was moved to the trash from
+type trashOrigin struct {
+	parent string
+	path   string
+}
+
+// OriginalLocation returns where the node n in the trash, or the
+// trashed folder it is in, was before it was trashed, so it can be
+// restored there.  The "rr" attribute the official clients set when
+// they trash a node says which folder, otherwise it is known for nodes
+// seen being moved to the trash while the client was running.  It
+// returns false if n isn't in the trash or where it was isn't known.
+func (fs *MegaFS) OriginalLocation(n *Node) (TrashOrigin, bool) {
+	if n == nil {
+		return TrashOrigin{}, false
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	top := fs.trashTop(n)
+	if top == nil {
+		return TrashOrigin{}, false
+	}
+
+	if raw, ok := top.attrs["rr"]; ok {
+		var h string
+		if json.Unmarshal(raw, &h) == nil {
+			if parent := fs.lookup[h]; parent != nil && !fs.inTrash(parent) {
+				return TrashOrigin{Parent: parent, Path: fs.pathOf(parent)}, true
+			}
+		}
+	}
+	o, ok := fs.origins[top.hash]
+	if !ok {
+		return TrashOrigin{}, false
+	}
+	parent := fs.lookup[o.parent]
+	if parent != nil && fs.inTrash(parent) {
+		parent = nil
+	}
+	return TrashOrigin{Parent: parent, Path: o.path}, true
+}
+
+// trashTop returns the node directly in the trash which n is or is
+// below, nil if n isn't in the trash
+//
+// Call with the FS mutex held
+func (fs *MegaFS) trashTop(n *Node) *Node {
+	for ; n != nil && fs.trash != nil; n = n.parent {
+		if n.parent == fs.trash {
+			return n
+		}
+	}
+	return nil
+}
+
+// inTrash returns true if n is the trash or below it
+//
+// Call with the FS mutex held
+func (fs *MegaFS) inTrash(n *Node) bool {
+	for ; n != nil; n = n.parent {
+		if n == fs.trash {
+			return true
+		}
+	}
+	return false
+}
+
+// noteMove records where n came from if it has just been moved from
+// oldParent to the trash, and forgets it if it has been moved out.  A
+// node moved up from a trashed folder takes on where that came from.
+//
+// Call with the FS mutex held
+func (fs *MegaFS) noteMove(n, oldParent *Node) {
+	switch {
+	case fs.trash == nil || n.parent != fs.trash:
+		delete(fs.origins, n.hash)
+	case oldParent == nil || oldParent == fs.trash:
+	case !fs.inTrash(oldParent):
+		fs.origins[n.hash] = trashOrigin{parent: oldParent.hash, path: fs.pathOf(oldParent)}
+	default:
+		if o, ok := fs.origins[fs.trashTop(oldParent).hash]; ok {
+			fs.origins[n.hash] = o
+		}
+	}
+}
+
+// noteGone remembers where the node n removed by an event was, as the
+// server sends a move as a removal then an addition
+//
+// Call with the FS mutex held
+func (fs *MegaFS) noteGone(n *Node) {
+	o, ok := fs.origins[n.hash]
+	if n.parent != nil && !fs.inTrash(n.parent) {
+		o, ok = trashOrigin{parent: n.parent.hash, path: fs.pathOf(n.parent)}, true
+	}
+	delete(fs.origins, n.hash)
+	if ok {
+		fs.moving[n.hash] = o
+	}
+}
+
+// noteArrived records where the node n added by an event came from if
+// it was removed just before, being moved to the trash
+//
+// Call with the FS mutex held
+func (fs *MegaFS) noteArrived(n *Node) {
+	o, ok := fs.moving[n.hash]
+	if !ok {
+		return
+	}
+	delete(fs.moving, n.hash)
+	if fs.trash != nil && n.parent == fs.trash {
+		fs.origins[n.hash] = o
+	}
+}
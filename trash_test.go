@@ -0,0 +1,91 @@
+package mega
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOriginalLocation(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	root := m.FS.GetRoot()
+	trash := m.FS.GetTrash()
+	dir, err := m.CreateDir("dir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := m.CreateDir("sub", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1 := uploadString(t, m, sub, "f1", "one")
+	f2 := uploadString(t, m, dir, "f2", "two")
+
+	if _, ok := m.FS.OriginalLocation(f1); ok {
+		t.Errorf("node not in the trash has an original location")
+	}
+
+	// Trashed here, the folder and anything in it know where it was
+	if err = m.Delete(sub, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*Node{sub, f1} {
+		o, ok := m.FS.OriginalLocation(n)
+		if !ok || o.Parent != dir || o.Path != "Cloud Drive/dir" {
+			t.Errorf("%s: got %+v, %v", n.GetName(), o, ok)
+		}
+	}
+
+	// Moved within the trash it keeps its origin, restored it loses it
+	if err = m.Move(f1, trash); err != nil {
+		t.Fatal(err)
+	}
+	if o, ok := m.FS.OriginalLocation(f1); !ok || o.Parent != dir {
+		t.Errorf("moved within the trash: got %+v, %v", o, ok)
+	}
+	if err = m.Move(sub, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.FS.OriginalLocation(sub); ok {
+		t.Errorf("restored node still has an original location")
+	}
+
+	// Trashed elsewhere, seen as a removal then an addition
+	b.mu.Lock()
+	item := *b.nodes[f2.GetHash()]
+	b.mu.Unlock()
+	item.Parent = trash.GetHash()
+	dev, _ := json.Marshal(FSEvent{Cmd: "d", N: f2.GetHash()})
+	if err = m.processDeleteNode(dev); err != nil {
+		t.Fatal(err)
+	}
+	ev := FSEvent{Cmd: "t"}
+	ev.T.Files = []FSNode{item}
+	tev, _ := json.Marshal(ev)
+	if err = m.processAddNode(tev); err != nil {
+		t.Fatal(err)
+	}
+	f2 = m.FS.HashLookup(item.Hash)
+	if o, ok := m.FS.OriginalLocation(f2); !ok || o.Parent != dir || o.Path != "Cloud Drive/dir" {
+		t.Errorf("trashed by event: got %+v, %v", o, ok)
+	}
+
+	// The rr attribute wins, and the folder having gone is reported
+	rr := json.RawMessage(`"` + sub.GetHash() + `"`)
+	m.FS.mutex.Lock()
+	f2.attrs = map[string]json.RawMessage{"rr": rr}
+	m.FS.mutex.Unlock()
+	if o, ok := m.FS.OriginalLocation(f2); !ok || o.Parent != sub || o.Path != "Cloud Drive/dir/sub" {
+		t.Errorf("from rr: got %+v, %v", o, ok)
+	}
+	m.FS.mutex.Lock()
+	f2.attrs = nil
+	m.FS.mutex.Unlock()
+	if err = m.Delete(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if o, ok := m.FS.OriginalLocation(f2); !ok || o.Parent != nil || o.Path != "Cloud Drive/dir" {
+		t.Errorf("folder gone: got %+v, %v", o, ok)
+	}
+}
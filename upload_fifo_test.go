@@ -0,0 +1,64 @@
+//go:build !windows && !js
+// +build !windows,!js
+
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUploadFIFO(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "pipe")
+	if err = syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("can't make a FIFO: %v", err)
+	}
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		_, _ = f.Write(data)
+		_ = f.Close()
+	}()
+
+	tmp := filepath.Join(dir, "tmp")
+	if err = os.Mkdir(tmp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetTempDir(tmp, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := m.UploadFile(fifo, m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.GetName() != "pipe" || n.GetSize() != int64(len(data)) {
+		t.Errorf("uploaded %q of %d bytes", n.GetName(), n.GetSize())
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "check"), data)
+	if left, _ := ioutil.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("%d temporary files left", len(left))
+	}
+
+	// Resuming isn't possible as the data can't be read again
+	state := UploadState{URL: "http://example.com/ul"}
+	if _, err = m.UploadFileWith(fifo, m.FS.GetRoot(), "", UploadOptions{Resume: &state}); err != EARGS {
+		t.Errorf("resume from a FIFO: got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUploadFileResult(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "up.bin")
+	randomFile(t, dir, "up.bin", 300000)
+
+	// The first attempt at the second chunk fails
+	failed := false
+	b.mu.Lock()
+	b.failUpload = func(id string, offset int) bool {
+		if offset != 0 && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+	b.mu.Unlock()
+
+	res, err := m.UploadFileResult(src, m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Node == nil || res.Node.GetName() != "up.bin" {
+		t.Fatalf("wrong node %+v", res.Node)
+	}
+	want, err := FileFingerprint(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Fingerprint != want {
+		t.Errorf("fingerprint %q, want %q", res.Fingerprint, want)
+	}
+	if !bytes.Equal(res.MetaMAC, res.Node.meta.mac) {
+		t.Errorf("meta-MAC %x, node has %x", res.MetaMAC, res.Node.meta.mac)
+	}
+	if res.Bytes != 300000 {
+		t.Errorf("sent %d bytes, want 300000", res.Bytes)
+	}
+	if res.Retries != 1 {
+		t.Errorf("%d retries, want 1", res.Retries)
+	}
+	if res.Elapsed <= 0 {
+		t.Errorf("elapsed %v", res.Elapsed)
+	}
+}
+
+// checkDownload downloads n to dst checking it contains data
+func checkDownload(t *testing.T, m *Mega, n *Node, dst string, data []byte) {
+	err := m.DownloadFile(n, dst, nil)
+	if err != nil {
+		t.Fatalf("download %q: %v", n.GetName(), err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%q: downloaded data differs: %v", n.GetName(), err)
+	}
+}
+
+func TestUploadCompletionRetry(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "up.bin")
+	data := randomFile(t, dir, "up.bin", 300000)
+
+	// Completion is temporarily unavailable
+	fails := 0
+	b.mu.Lock()
+	b.extra = func(cmd map[string]interface{}, r *http.Request) interface{} {
+		if cmd["a"] == "p" && fails > 0 {
+			fails--
+			return ErrorMsg(-18)
+		}
+		return nil
+	}
+	fails = COMPLETION_RETRIES - 1
+	b.mu.Unlock()
+
+	n, err := m.UploadFile(src, m.FS.GetRoot(), "retried.bin", nil)
+	if err != nil {
+		t.Fatalf("upload with completion retries: %v", err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "retried.out"), data)
+
+	b.mu.Lock()
+	fails = COMPLETION_RETRIES
+	b.mu.Unlock()
+	_, err = m.UploadFile(src, m.FS.GetRoot(), "later.bin", nil)
+	var cerr *CompletionError
+	if !errors.As(err, &cerr) || !errors.Is(err, ETEMPUNAVAIL) {
+		t.Fatalf("want CompletionError, got %v", err)
+	}
+	if cerr.Handle == "" || cerr.Handle != cerr.State.CompletionHandle {
+		t.Fatalf("completion handle not surfaced: %+v", cerr)
+	}
+
+	// Finish it later without sending the data again
+	b.mu.Lock()
+	sent := len(b.requests)
+	b.mu.Unlock()
+	u, err := m.ResumeUpload(m.FS.GetRoot(), "later.bin", int64(len(data)), cerr.State)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 0; id < u.Chunks(); id++ {
+		if !u.ChunkDone(id) {
+			t.Fatalf("chunk %d not done", id)
+		}
+	}
+	n, err = u.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	if len(b.requests) != sent {
+		t.Errorf("chunks were sent again")
+	}
+	b.mu.Unlock()
+	checkDownload(t, m, n, filepath.Join(dir, "later.out"), data)
+}
+
+func TestUploadCompletionHandle(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+	if err := m.SetUploadWorkers(4); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "mega-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "up.bin", 1500000)
+
+	// The first chunk is retried so it is likely to complete the
+	// upload rather than the last
+	b.mu.Lock()
+	failed := false
+	b.failUpload = func(id string, offset int) bool {
+		if offset == 0 && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+	b.mu.Unlock()
+	n, err := m.UploadFile(filepath.Join(dir, "up.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "up.out"), data)
+
+	// Chunks sent in reverse order
+	u, err := m.NewUpload(m.FS.GetRoot(), "reversed.bin", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Chunks() < 3 {
+		t.Fatalf("only %d chunks", u.Chunks())
+	}
+	for id := u.Chunks() - 1; id >= 0; id-- {
+		if id == 0 {
+			if _, err = u.Finish(); err != EINCOMPLETE {
+				t.Errorf("Finish with a chunk missing: got %v, want EINCOMPLETE", err)
+			}
+		}
+		pos, size, err := u.ChunkLocation(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := append([]byte(nil), data[pos:pos+int64(size)]...)
+		if err = u.UploadChunk(id, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err = u.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "reversed.out"), data)
+}
+
+func TestUploadURLExpiry(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "up.bin", 1000000)
+	src := filepath.Join(dir, "up.bin")
+
+	// The next upload URL expires after its first chunk
+	var expire string
+	expireNext := func() {
+		b.mu.Lock()
+		expire = strconv.Itoa(b.next + 1)
+		b.mu.Unlock()
+	}
+	b.mu.Lock()
+	b.failUpload = func(id string, offset int) bool {
+		if id == expire && offset != 0 {
+			b.expired[id] = true
+		}
+		return false
+	}
+	b.mu.Unlock()
+
+	expireNext()
+	ch := make(chan int)
+	var done int
+	finished := make(chan struct{})
+	go func() {
+		for n := range ch {
+			done += n
+		}
+		close(finished)
+	}()
+	n, err := m.UploadFile(src, m.FS.GetRoot(), "", &ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-finished
+	if done != len(data) {
+		t.Errorf("progress reported %d bytes, want %d", done, len(data))
+	}
+	if b.requestCount(expire+"/0") != 1 {
+		t.Errorf("first URL not used")
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "up.out"), data)
+
+	// and with the transfer manager
+	tm, err := m.NewTransferManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Start()
+	defer tm.Stop()
+	expireNext()
+	id, err := tm.QueueUpload(src, m.FS.GetRoot(), "queued.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.Wait()
+	up, _ := tm.Get(id)
+	if up.Status != TRANSFER_DONE {
+		t.Fatalf("upload not done: %+v", up)
+	}
+	checkDownload(t, m, m.FS.HashLookup(up.Hash), filepath.Join(dir, "queued.out"), data)
+}
+
+func TestChunkErrno(t *testing.T) {
+	for _, tc := range []struct {
+		resp  string
+		errno ErrorMsg
+		ok    bool
+	}{
+		{"", 0, false},
+		{"-3", -3, true},
+		{"-17", -17, true},
+		{"0", 0, false},
+		{"-x", 0, false},
+		{"-AbCdEfGhIjKlMnOpQrStUvWxYz", 0, false},
+	} {
+		errno, ok := chunkErrno([]byte(tc.resp))
+		if errno != tc.errno || ok != tc.ok {
+			t.Errorf("chunkErrno(%q) = %d, %v", tc.resp, errno, ok)
+		}
+	}
+}
+
+// memWriterAt is an io.WriterAt into memory
+type memWriterAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := int(off) + len(p); end > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, end-len(w.buf))...)
+	}
+	return copy(w.buf[off:], p), nil
+}
+
+func TestUploadFromDownloadTo(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	data := make([]byte, 3*1024*1024+17)
+	_, _ = rand.Read(data)
+	if _, err := m.UploadFrom(bytes.NewReader(data), int64(len(data)), m.FS.GetRoot(), "", nil); err != EARGS {
+		t.Errorf("UploadFrom with no name: want EARGS, got %v", err)
+	}
+	n, err := m.UploadFrom(bytes.NewReader(data), int64(len(data)), m.FS.GetRoot(), "mem.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.GetName() != "mem.bin" || n.GetSize() != int64(len(data)) {
+		t.Errorf("uploaded %q of %d bytes", n.GetName(), n.GetSize())
+	}
+
+	w := &memWriterAt{}
+	progress := make(chan int)
+	done := make(chan int)
+	go func() {
+		total := 0
+		for p := range progress {
+			total += p
+		}
+		done <- total
+	}()
+	if err = m.DownloadTo(n, w, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if total := <-done; total != len(data) {
+		t.Errorf("progress reported %d bytes, want %d", total, len(data))
+	}
+	if !bytes.Equal(w.buf, data) {
+		t.Errorf("downloaded data differs")
+	}
+}
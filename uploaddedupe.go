@@ -0,0 +1,192 @@
+package mega
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// contentKey returns the key under which a file uploaded with the
+// FileFingerprint fp and size is indexed
+func contentKey(fp string, size int64) string {
+	return fmt.Sprintf("%s/%d", fp, size)
+}
+
+// noteUploaded records that the local file with the FileFingerprint
+// fp and size is now the node h, for UploadOptions.Dedupe
+func (m *Mega) noteUploaded(fp string, size int64, h string) {
+	m.uploadedMu.Lock()
+	defer m.uploadedMu.Unlock()
+	if m.uploaded == nil {
+		m.uploaded = make(map[string]string)
+	}
+	m.uploaded[contentKey(fp, size)] = h
+}
+
+// findCopy returns a file of ours with the same contents as the local
+// file p, which has the FileFingerprint fp, or nil if there is none.
+//
+// A file uploaded in this session is found by its fingerprint.
+// Otherwise the files of the same size outside the trash are checked
+// by working out the MAC p would have under the key of each, so only
+// files which aren't in the index cost a read of p.  Files in incoming
+// shares aren't used as their owner chose their key.
+func (m *Mega) findCopy(p, fp string, size int64) *Node {
+	m.uploadedMu.Lock()
+	h := m.uploaded[contentKey(fp, size)]
+	m.uploadedMu.Unlock()
+
+	type candidate struct {
+		node    *Node
+		compkey []byte
+		mac     []byte
+	}
+	var candidates []candidate
+	m.FS.mutex.Lock()
+	if n := m.FS.hashLookup(h); n != nil && !m.FS.inTrash(n) {
+		m.FS.mutex.Unlock()
+		return n
+	}
+	for _, n := range m.FS.lookup {
+		if n.ntype != FILE || n.size != size || len(n.meta.compkey) != 32 || m.FS.inTrash(n) {
+			continue
+		}
+		top := n
+		for top.parent != nil {
+			top = top.parent
+		}
+		if m.FS.isShareRoot(top) {
+			continue
+		}
+		candidates = append(candidates, candidate{node: n, compkey: n.meta.compkey, mac: n.meta.mac})
+	}
+	m.FS.mutex.Unlock()
+
+	for _, c := range candidates {
+		mac, err := fileMetaMAC(p, c.compkey)
+		if err != nil {
+			m.logf("%s: checking for a copy: %v", p, err)
+			return nil
+		}
+		if bytes.Equal(mac, c.mac) {
+			m.noteUploaded(fp, size, c.node.GetHash())
+			return c.node
+		}
+	}
+	return nil
+}
+
+// copyFile makes a copy of the file src named name in parent on the
+// server, without sending its contents
+func (m *Mega) copyFile(src, parent *Node, name string) (*Node, error) {
+	var entry *JournalEntry
+	defer func() {
+		m.journal(entry)
+	}()
+	m.FS.mutex.Lock()
+	defer m.FS.mutex.Unlock()
+
+	if err := m.FS.checkAccess(parent, ACCESS_READWRITE); err != nil {
+		return nil, err
+	}
+	if len(src.meta.compkey) != 32 {
+		return nil, EKEY
+	}
+	var msg [1]UploadCompleteMsg
+	var res [1]UploadCompleteResp
+
+	attr_data, err := encryptAttr(src.meta.key, FileAttr{Name: name, Fingerprint: src.fingerprint})
+	if err != nil {
+		return nil, err
+	}
+	master_aes, err := aes.NewCipher(m.k)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, len(src.meta.compkey))
+	err = blockEncrypt(master_aes, key, src.meta.compkey)
+	if err != nil {
+		return nil, err
+	}
+
+	msg[0].Cmd = "p"
+	msg[0].T = parent.hash
+	msg[0].N[0].H = src.hash
+	msg[0].N[0].T = int(FILE)
+	msg[0].N[0].A = attr_data
+	msg[0].N[0].K = base64urlencode(key)
+	msg[0].Cr, err = m.newNodeCr(parent, src.hash, src.meta.compkey)
+	if err != nil {
+		return nil, err
+	}
+	msg[0].I, err = m.newRequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.api_request(req)
+	if err != nil {
+		return nil, err
+	}
+	err = m.decodeResponse(result, &res)
+	if err != nil {
+		return nil, err
+	}
+	node, err := m.addFSNode(res[0].F[0])
+	if err == nil {
+		node.creator = m.handle
+		entry = m.journalEntry(JOURNAL_CREATE, JOURNAL_LOCAL, m.handle, node, "")
+	}
+	return node, err
+}
+
+// dedupeUpload copies a file with the same contents as infile, read
+// from srcpath, to parent as name if there is one, see
+// UploadOptions.Dedupe.  It returns a nil result if there isn't.
+func (m *Mega) dedupeUpload(srcpath string, infile *os.File, fileSize int64, parent *Node, name string) (*UploadResult, error) {
+	// nothing to save for an empty file
+	if parent == nil || fileSize == 0 {
+		return nil, nil
+	}
+	start := m.now()
+	fp, err := FileFingerprint(srcpath)
+	if err != nil {
+		return nil, err
+	}
+	src := m.findCopy(srcpath, fp, fileSize)
+	if src == nil {
+		return nil, nil
+	}
+	err = m.checkUpload(name, infile, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	node, err := m.copyFile(src, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	m.debugf("%s: copied %s instead of uploading %d bytes", srcpath, src.GetHash(), fileSize)
+	m.metrics.add(uploadBytesSaved, fileSize)
+
+	res := &UploadResult{
+		Node:        node,
+		Fingerprint: fp,
+		Copied:      true,
+		BytesSaved:  fileSize,
+	}
+	m.FS.mutex.Lock()
+	res.MetaMAC = append([]byte(nil), node.meta.mac...)
+	m.FS.mutex.Unlock()
+	res.ContentType, _, err = probeUpload(name, infile, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	res.Elapsed = m.now().Sub(start)
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadDedupe(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := randomFile(t, dir, "a.bin", 300000)
+	if err = ioutil.WriteFile(filepath.Join(dir, "b.bin"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := randomFile(t, dir, "c.bin", len(data))
+
+	root := m.FS.GetRoot()
+	first, err := m.UploadFileWith(filepath.Join(dir, "a.bin"), root, "", UploadOptions{Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Copied || first.Bytes != int64(len(data)) {
+		t.Fatalf("first upload: copied %v sending %d bytes", first.Copied, first.Bytes)
+	}
+	dst, err := m.CreateDir("dst", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Found by the fingerprint of the first upload, then by the MAC
+	// as if uploaded in another session
+	for i, name := range []string{"copy1.bin", "copy2.bin"} {
+		if i == 1 {
+			m.uploadedMu.Lock()
+			m.uploaded = nil
+			m.uploadedMu.Unlock()
+		}
+		chunks := m.Stats().UploadChunks
+		res, err := m.UploadFileWith(filepath.Join(dir, "b.bin"), dst, name, UploadOptions{Dedupe: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Copied || res.BytesSaved != int64(len(data)) || res.Bytes != 0 {
+			t.Errorf("%s: copied %v saving %d bytes, sent %d", name, res.Copied, res.BytesSaved, res.Bytes)
+		}
+		if sent := m.Stats().UploadChunks - chunks; sent != 0 {
+			t.Errorf("%s: %d chunks uploaded", name, sent)
+		}
+		if res.Node.GetName() != name || res.Node.GetSize() != int64(len(data)) || res.Fingerprint != first.Fingerprint {
+			t.Errorf("%s: got %q of %d bytes", name, res.Node.GetName(), res.Node.GetSize())
+		}
+		checkDownload(t, m, res.Node, filepath.Join(dir, "out.bin"), data)
+	}
+	if saved := m.Stats().UploadBytesSaved; saved != 2*int64(len(data)) {
+		t.Errorf("saved %d bytes", saved)
+	}
+
+	// Different contents of the same size are uploaded, as is a
+	// file whose only copy is in the trash
+	res, err := m.UploadFileWith(filepath.Join(dir, "c.bin"), dst, "", UploadOptions{Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied {
+		t.Error("different contents copied")
+	}
+	checkDownload(t, m, res.Node, filepath.Join(dir, "out.bin"), other)
+	if err = m.Delete(res.Node, false); err != nil {
+		t.Fatal(err)
+	}
+	res, err = m.UploadFileWith(filepath.Join(dir, "c.bin"), root, "", UploadOptions{Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied {
+		t.Error("file in the trash copied")
+	}
+}
@@ -0,0 +1,265 @@
+// Package urlparse parses and builds the public links used by MEGA
+// for files and folders.
+//
+// All the historical link formats are understood, for example
+//
+//	https://mega.nz/file/<handle>#<key>
+//	https://mega.nz/folder/<handle>#<key>/file/<child>
+//	https://mega.co.nz/#!<handle>!<key>
+//	https://mega.nz/#F!<handle>!<key>!<child>
+//	https://mega.nz/embed/<handle>#<key>
+//	mega://#!<handle>!<key>
+//	https://mega.nz/#P!<password protected data>
+package urlparse
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LinkType is the kind of node a link points to
+type LinkType int
+
+// Link types
+const (
+	LINK_FILE LinkType = iota
+	LINK_FOLDER
+)
+
+func (t LinkType) String() string {
+	switch t {
+	case LINK_FILE:
+		return "file"
+	case LINK_FOLDER:
+		return "folder"
+	}
+	return fmt.Sprintf("LinkType(%d)", int(t))
+}
+
+// Base URL used by BuildLink
+const BASE_URL = "https://mega.nz"
+
+var (
+	// ENOTLINK is returned for strings which aren't MEGA links
+	ENOTLINK = errors.New("Not a MEGA link")
+	// EBADHANDLE is returned when the handle of a link is malformed
+	EBADHANDLE = errors.New("Bad handle in MEGA link")
+	// EBADKEY is returned when the key of a link is malformed
+	EBADKEY = errors.New("Bad key in MEGA link")
+)
+
+// Link describes a parsed MEGA public link
+type Link struct {
+	// Whether the link is to a file or a folder
+	Type LinkType
+	// Public handle of the file or folder
+	Handle string
+	// Base64 decryption key - empty if the link doesn't include it
+	Key string
+	// Password is set for password protected links.  The key is
+	// encrypted inside PasswordData and Key is empty.
+	Password bool
+	// The raw data of a password protected link
+	PasswordData string
+	// Handle of a file or folder selected inside a folder link
+	Child string
+	// Whether Child is a file or a folder
+	ChildType LinkType
+}
+
+// String returns the link in the current canonical format
+func (l *Link) String() string {
+	if l.Password {
+		return BASE_URL + "/#P!" + l.PasswordData
+	}
+	s := BuildLink(l.Type, l.Handle, l.Key)
+	if l.Type == LINK_FOLDER && l.Child != "" {
+		s += "/" + l.ChildType.String() + "/" + l.Child
+	}
+	return s
+}
+
+// BuildLink returns a canonical link to the node of type t with the
+// public handle given.  If key is empty the link is built without a
+// decryption key.
+func BuildLink(t LinkType, handle, key string) string {
+	s := BASE_URL + "/" + t.String() + "/" + handle
+	if key != "" {
+		s += "#" + key
+	}
+	return s
+}
+
+// decode decodes s with unpadded base64 url encoding also accepting
+// the standard base64 characters as MEGA does.
+func decode(s string) ([]byte, error) {
+	s = strings.Replace(s, "+", "-", -1)
+	s = strings.Replace(s, "/", "_", -1)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// checkHandle checks a public handle is 6 bytes of base64
+func checkHandle(h string) error {
+	b, err := decode(h)
+	if err != nil || len(h) != 8 || len(b) != 6 {
+		return EBADHANDLE
+	}
+	return nil
+}
+
+// checkKey checks the key has the right length for the link type
+func checkKey(t LinkType, k string) error {
+	if k == "" {
+		return nil
+	}
+	b, err := decode(k)
+	if err != nil {
+		return EBADKEY
+	}
+	switch {
+	case t == LINK_FILE && len(b) == 32:
+	case t == LINK_FOLDER && len(b) == 16:
+	default:
+		return EBADKEY
+	}
+	return nil
+}
+
+// parsePassword decodes the type and handle from the data of a
+// password protected link
+func parsePassword(data string) (*Link, error) {
+	b, err := decode(data)
+	// algorithm, type, 6 byte handle, 32 byte salt, key, 32 byte mac
+	if err != nil || len(b) < 2+6+32+16+32 {
+		return nil, EBADKEY
+	}
+	l := &Link{
+		Password:     true,
+		PasswordData: data,
+		Handle:       base64.RawURLEncoding.EncodeToString(b[2:8]),
+	}
+	switch b[1] {
+	case 0:
+		l.Type = LINK_FOLDER
+	case 1:
+		l.Type = LINK_FILE
+	default:
+		return nil, EBADKEY
+	}
+	return l, nil
+}
+
+// ParseLink parses a MEGA link in any of the known formats.
+//
+// The scheme and host may be omitted and mega.nz and mega.co.nz hosts
+// are both accepted.
+func ParseLink(s string) (*Link, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Replace(s, "%21", "!", -1)
+	s = strings.Replace(s, "%23", "#", -1)
+
+	// Strip the scheme and host leaving the path and fragment
+	switch {
+	case strings.HasPrefix(s, "mega://"):
+		s = strings.TrimPrefix(s, "mega://")
+	case strings.HasPrefix(s, "mega:"):
+		s = strings.TrimPrefix(s, "mega:")
+	default:
+		s = strings.TrimPrefix(s, "https://")
+		s = strings.TrimPrefix(s, "http://")
+		s = strings.TrimPrefix(s, "www.")
+		switch {
+		case strings.HasPrefix(s, "mega.nz"):
+			s = strings.TrimPrefix(s, "mega.nz")
+		case strings.HasPrefix(s, "mega.co.nz"):
+			s = strings.TrimPrefix(s, "mega.co.nz")
+		case strings.HasPrefix(s, "#"):
+		default:
+			return nil, ENOTLINK
+		}
+	}
+	s = strings.TrimPrefix(s, "/")
+
+	var l *Link
+	var rest string
+	switch {
+	case strings.HasPrefix(s, "#P!"):
+		return parsePassword(s[3:])
+	case strings.HasPrefix(s, "#F!"):
+		parts := strings.SplitN(s[3:], "!", 3)
+		l = &Link{Type: LINK_FOLDER, Handle: parts[0]}
+		if len(parts) > 1 {
+			l.Key = parts[1]
+		}
+		if len(parts) > 2 {
+			// The old format doesn't say if the child is a file
+			l.Child = parts[2]
+			l.ChildType = LINK_FILE
+		}
+		// Some clients append ?child instead of !child
+		if i := strings.Index(l.Key, "?"); i >= 0 {
+			l.Child, l.ChildType = l.Key[i+1:], LINK_FOLDER
+			l.Key = l.Key[:i]
+		}
+	case strings.HasPrefix(s, "#!"), strings.HasPrefix(s, "#E!"):
+		s = s[strings.Index(s, "!")+1:]
+		parts := strings.SplitN(s, "!", 2)
+		l = &Link{Type: LINK_FILE, Handle: parts[0]}
+		if len(parts) > 1 {
+			l.Key = parts[1]
+		}
+	case strings.HasPrefix(s, "file/"), strings.HasPrefix(s, "embed/"):
+		s = s[strings.Index(s, "/")+1:]
+		parts := strings.SplitN(s, "#", 2)
+		l = &Link{Type: LINK_FILE, Handle: parts[0]}
+		if len(parts) > 1 {
+			l.Key = parts[1]
+		}
+	case strings.HasPrefix(s, "folder/"):
+		parts := strings.SplitN(strings.TrimPrefix(s, "folder/"), "#", 2)
+		l = &Link{Type: LINK_FOLDER, Handle: parts[0]}
+		if len(parts) > 1 {
+			l.Key = parts[1]
+			if i := strings.Index(l.Key, "/"); i >= 0 {
+				l.Key, rest = l.Key[:i], l.Key[i+1:]
+			}
+		}
+	default:
+		return nil, ENOTLINK
+	}
+
+	// Child selector of a new style folder link
+	if rest != "" {
+		parts := strings.SplitN(rest, "/", 3)
+		if len(parts) < 2 {
+			return nil, ENOTLINK
+		}
+		switch parts[0] {
+		case "file":
+			l.ChildType = LINK_FILE
+		case "folder":
+			l.ChildType = LINK_FOLDER
+		default:
+			return nil, ENOTLINK
+		}
+		l.Child = parts[1]
+	}
+
+	err := checkHandle(l.Handle)
+	if err != nil {
+		return nil, err
+	}
+	if l.Child != "" {
+		err = checkHandle(l.Child)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkKey(l.Type, l.Key)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
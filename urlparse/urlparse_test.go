@@ -0,0 +1,99 @@
+package urlparse
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseLink(t *testing.T) {
+	fk := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+	dk := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+	for _, test := range []struct {
+		in   string
+		want Link
+	}{
+		{"https://mega.nz/file/AbCdEfGh#" + fk, Link{Type: LINK_FILE, Handle: "AbCdEfGh", Key: fk}},
+		{"https://mega.nz/file/AbCdEfGh", Link{Type: LINK_FILE, Handle: "AbCdEfGh"}},
+		{"mega.nz/embed/AbCdEfGh#" + fk, Link{Type: LINK_FILE, Handle: "AbCdEfGh", Key: fk}},
+		{"https://mega.co.nz/#!AbCdEfGh!" + fk, Link{Type: LINK_FILE, Handle: "AbCdEfGh", Key: fk}},
+		{"https://mega.nz/%23!AbCdEfGh%21" + fk, Link{Type: LINK_FILE, Handle: "AbCdEfGh", Key: fk}},
+		{"mega://#!AbCdEfGh!" + fk, Link{Type: LINK_FILE, Handle: "AbCdEfGh", Key: fk}},
+		{"#!AbCdEfGh!" + fk, Link{Type: LINK_FILE, Handle: "AbCdEfGh", Key: fk}},
+		{"https://mega.nz/folder/AbCdEfGh#" + dk, Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk}},
+		{"https://mega.nz/folder/AbCdEfGh#" + dk + "/file/ChIlDxYz", Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk, Child: "ChIlDxYz", ChildType: LINK_FILE}},
+		{"https://mega.nz/folder/AbCdEfGh#" + dk + "/folder/ChIlDxYz", Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk, Child: "ChIlDxYz", ChildType: LINK_FOLDER}},
+		{"https://mega.co.nz/#F!AbCdEfGh!" + dk, Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk}},
+		{"https://mega.nz/#F!AbCdEfGh!" + dk + "!ChIlDxYz", Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk, Child: "ChIlDxYz", ChildType: LINK_FILE}},
+		{"https://mega.nz/#F!AbCdEfGh!" + dk + "?ChIlDxYz", Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk, Child: "ChIlDxYz", ChildType: LINK_FOLDER}},
+	} {
+		got, err := ParseLink(test.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.in, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("%q: want %+v, got %+v", test.in, test.want, *got)
+		}
+	}
+}
+
+func TestParseLinkErrors(t *testing.T) {
+	fk := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+	dk := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+	for _, test := range []struct {
+		in   string
+		want error
+	}{
+		{"", ENOTLINK},
+		{"https://example.com/file/AbCdEfGh#" + fk, ENOTLINK},
+		{"https://mega.nz/fm/AbCdEfGh", ENOTLINK},
+		{"https://mega.nz/file/AbC#" + fk, EBADHANDLE},
+		{"https://mega.nz/file/AbCdEfGh#" + dk, EBADKEY},
+		{"https://mega.nz/folder/AbCdEfGh#" + fk, EBADKEY},
+		{"https://mega.nz/folder/AbCdEfGh#" + dk + "/file/x", EBADHANDLE},
+		{"https://mega.nz/#P!AAAA", EBADKEY},
+	} {
+		_, err := ParseLink(test.in)
+		if err != test.want {
+			t.Errorf("%q: want error %v, got %v", test.in, test.want, err)
+		}
+	}
+}
+
+func TestParsePasswordLink(t *testing.T) {
+	b := make([]byte, 2+6+32+32+32)
+	b[0] = 2
+	b[1] = 1
+	copy(b[2:], "\x01\x02\x03\x04\x05\x06")
+	data := base64.RawURLEncoding.EncodeToString(b)
+	l, err := ParseLink("https://mega.nz/#P!" + data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !l.Password || l.Type != LINK_FILE || l.Handle != "AQIDBAUG" || l.Key != "" {
+		t.Errorf("bad password link: %+v", l)
+	}
+	if l.String() != "https://mega.nz/#P!"+data {
+		t.Errorf("bad round trip: %q", l.String())
+	}
+}
+
+func TestBuildLink(t *testing.T) {
+	dk := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+	s := BuildLink(LINK_FOLDER, "AbCdEfGh", dk)
+	if s != "https://mega.nz/folder/AbCdEfGh#"+dk {
+		t.Errorf("bad link %q", s)
+	}
+	if s = BuildLink(LINK_FILE, "AbCdEfGh", ""); s != "https://mega.nz/file/AbCdEfGh" {
+		t.Errorf("bad link %q", s)
+	}
+	l := &Link{Type: LINK_FOLDER, Handle: "AbCdEfGh", Key: dk, Child: "ChIlDxYz", ChildType: LINK_FOLDER}
+	if !strings.HasSuffix(l.String(), "/folder/ChIlDxYz") {
+		t.Errorf("bad child link %q", l.String())
+	}
+	got, err := ParseLink(l.String())
+	if err != nil || *got != *l {
+		t.Errorf("round trip failed: %+v, %v", got, err)
+	}
+}
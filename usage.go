@@ -0,0 +1,187 @@
+package mega
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keeping of the daily usage
+const (
+	USAGE_DAYS           = 31               // days kept
+	USAGE_FLUSH_INTERVAL = 30 * time.Second // least time between saves
+	usageDateFormat      = "2006-01-02"
+)
+
+// DayUsage is the file data transferred on one day
+type DayUsage struct {
+	// Day in local time as YYYY-MM-DD
+	Date string `json:"date"`
+	// Bytes of chunks downloaded and uploaded
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+// usageLog counts the bytes transferred each day, saving them to a
+// file if it has one
+type usageLog struct {
+	mu   sync.Mutex
+	days []DayUsage // oldest first
+	path string
+	// changed since saved, when last saved and the error saving
+	dirty bool
+	saved time.Time
+	err   error
+	now   func() time.Time
+}
+
+// newUsageLog returns an empty usageLog kept in memory
+func newUsageLog() *usageLog {
+	return &usageLog{now: time.Now}
+}
+
+// setClock makes the log tell the date by c
+func (l *usageLog) setClock(c Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = c.Now
+}
+
+// add counts bytes downloaded and uploaded today, saving to the file
+// now and again.  A nil usageLog doesn't count.
+func (l *usageLog) add(download, upload int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	date := now.Format(usageDateFormat)
+	if len(l.days) == 0 || l.days[len(l.days)-1].Date != date {
+		l.days = append(l.days, DayUsage{Date: date})
+		if len(l.days) > USAGE_DAYS {
+			l.days = append(l.days[:0], l.days[len(l.days)-USAGE_DAYS:]...)
+		}
+	}
+	day := &l.days[len(l.days)-1]
+	day.Download += download
+	day.Upload += upload
+	l.dirty = true
+	if l.path != "" && now.Sub(l.saved) >= USAGE_FLUSH_INTERVAL {
+		l.err = l.save()
+	}
+}
+
+// save writes the usage to the file
+//
+// Call with the mutex held
+func (l *usageLog) save() error {
+	buf, err := json.Marshal(l.days)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(l.path, buf)
+	if err != nil {
+		return err
+	}
+	l.dirty = false
+	l.saved = l.now()
+	return nil
+}
+
+// DailyUsage returns the file data transferred on each of the last
+// USAGE_DAYS days on which anything was, oldest first, to help keep
+// an eye on the transfer quota of free accounts.  Without a usage file
+// it only counts this Mega.
+func (m *Mega) DailyUsage() []DayUsage {
+	l := m.usage
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]DayUsage(nil), l.days...)
+}
+
+// UsageToday returns the file data transferred today
+func (m *Mega) UsageToday() DayUsage {
+	l := m.usage
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	date := l.now().Format(usageDateFormat)
+	if len(l.days) > 0 && l.days[len(l.days)-1].Date == date {
+		return l.days[len(l.days)-1]
+	}
+	return DayUsage{Date: date}
+}
+
+// SetUsageFile keeps the daily usage in the JSON file at path so it
+// adds up across runs and Mega instances, loading it if it exists.
+// What was counted before is added to it.  The file is saved at most
+// every USAGE_FLUSH_INTERVAL while transferring - call FlushUsage
+// before exiting.  Instances running at once mustn't share a file.
+func (m *Mega) SetUsageFile(path string) error {
+	var days []DayUsage
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		err = json.Unmarshal(buf, &days)
+		if err != nil {
+			return err
+		}
+	}
+
+	l := m.usage
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range l.days {
+		i := sort.Search(len(days), func(i int) bool {
+			return days[i].Date >= d.Date
+		})
+		if i < len(days) && days[i].Date == d.Date {
+			days[i].Download += d.Download
+			days[i].Upload += d.Upload
+			continue
+		}
+		days = append(days, DayUsage{})
+		copy(days[i+1:], days[i:])
+		days[i] = d
+	}
+	if len(days) > USAGE_DAYS {
+		days = days[len(days)-USAGE_DAYS:]
+	}
+	l.days = days
+	l.path = path
+	l.dirty = true
+	return l.save()
+}
+
+// WithUsageFile keeps the daily usage in the file at path, see
+// SetUsageFile
+func WithUsageFile(path string) Option {
+	return func(m *Mega) error {
+		return m.SetUsageFile(path)
+	}
+}
+
+// FlushUsage saves the daily usage to the usage file if it has changed,
+// returning any error saving it since the last flush
+func (m *Mega) FlushUsage() error {
+	l := m.usage
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return nil
+	}
+	err := l.err
+	l.err = nil
+	if l.dirty {
+		if e := l.save(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
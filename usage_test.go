@@ -0,0 +1,65 @@
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsage(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.json")
+
+	data := randomFile(t, dir, "file.bin", 300000)
+	n, err := m.UploadFile(filepath.Join(dir, "file.bin"), m.FS.GetRoot(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "copy.bin"), data)
+	today := m.UsageToday()
+	if today.Download != 300000 || today.Upload != 300000 || today.Date != time.Now().Format("2006-01-02") {
+		t.Errorf("today %+v", today)
+	}
+
+	// Kept in the file, adding up across instances
+	if err = m.SetUsageFile(path); err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, m, n, filepath.Join(dir, "copy.bin"), data)
+	if err = m.FlushUsage(); err != nil {
+		t.Fatal(err)
+	}
+	m2 := New(WithUsageFile(path))
+	if got := m2.UsageToday(); got.Download != 600000 || got.Upload != 300000 {
+		t.Errorf("loaded %+v", got)
+	}
+
+	// Only the last USAGE_DAYS days are kept
+	day := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	l := newUsageLog()
+	l.now = func() time.Time {
+		return day
+	}
+	for i := 0; i < USAGE_DAYS+5; i++ {
+		l.add(int64(i), 1)
+		l.add(1, 0)
+		day = day.AddDate(0, 0, 1)
+	}
+	m2.usage = l
+	days := m2.DailyUsage()
+	if len(days) != USAGE_DAYS || days[0].Date != "2020-01-06" || days[0].Download != 6 || days[0].Upload != 1 {
+		t.Errorf("got %d days starting %+v", len(days), days[0])
+	}
+	if got := m2.UsageToday(); got.Download != 0 || got.Date != day.Format("2006-01-02") {
+		t.Errorf("nothing transferred today: %+v", got)
+	}
+}
@@ -1,69 +1,53 @@
 package mega
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"io"
 	"math/big"
-	"net"
-	"net/http"
 	"regexp"
 	"strings"
-	"time"
 )
 
-func newHttpClient(timeout time.Duration) *http.Client {
-	// TODO: Need to test this out
-	// Doesn't seem to work as expected
-	c := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(netw, addr string) (net.Conn, error) {
-				c, err := net.DialTimeout(netw, addr, timeout)
-				if err != nil {
-					return nil, err
-				}
-				return c, nil
-			},
-			Proxy: http.ProxyFromEnvironment,
-		},
-	}
-	return c
-}
-
 // bytes_to_a32 converts the byte slice b to uint32 slice considering
 // the bytes to be in big endian order.
 func bytes_to_a32(b []byte) ([]uint32, error) {
-	length := len(b) + 3
-	a := make([]uint32, length/4)
-	buf := bytes.NewBuffer(b)
-	for i, _ := range a {
-		err := binary.Read(buf, binary.BigEndian, &a[i])
-		if err != nil {
-			return nil, err
-		}
+	a, err := appendA32(make([]uint32, 0, (len(b)+3)/4), b)
+	if err != nil {
+		return nil, err
 	}
-
 	return a, nil
 }
 
+// appendA32 appends the uint32s in b, in big endian order, to dst.  It
+// returns io.ErrUnexpectedEOF if the length of b isn't a multiple of 4.
+func appendA32(dst []uint32, b []byte) ([]uint32, error) {
+	for len(b) >= 4 {
+		dst = append(dst, binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) > 0 {
+		return dst, io.ErrUnexpectedEOF
+	}
+	return dst, nil
+}
+
 // a32_to_bytes converts the uint32 slice a to byte slice where each
 // uint32 is decoded in big endian order.
 func a32_to_bytes(a []uint32) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	buf.Grow(len(a) * 4) // To prevent reallocations in Write
+	return appendA32Bytes(make([]byte, 0, len(a)*4), a), nil
+}
+
+// appendA32Bytes appends the uint32s in a to dst in big endian order
+func appendA32Bytes(dst []byte, a []uint32) []byte {
 	for _, v := range a {
-		err := binary.Write(buf, binary.BigEndian, v)
-		if err != nil {
-			return nil, err
-		}
+		dst = append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 	}
-
-	return buf.Bytes(), nil
+	return dst
 }
 
 // base64urlencode encodes byte slice b using base64 url encoding
@@ -72,21 +56,93 @@ func base64urlencode(b []byte) string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
+// appendBase64urlencode appends b encoded as base64urlencode does to
+// dst
+func appendBase64urlencode(dst []byte, b []byte) []byte {
+	n := base64.RawURLEncoding.EncodedLen(len(b))
+	dst = growBytes(dst, n)
+	base64.RawURLEncoding.Encode(dst[len(dst):len(dst)+n], b)
+	return dst[:len(dst)+n]
+}
+
 // base64urldecode decodes the byte slice b using unpadded base64 url
 // decoding. It also allows the characters from standard base64 to be
 // compatible with the mega decoder.
 func base64urldecode(s string) ([]byte, error) {
-	enc := base64.RawURLEncoding
+	b, err := appendBase64urldecode(nil, s)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// base64urlDecodeMap maps the characters of both the url and standard
+// base64 alphabets to their values and everything else to 0xff
+var base64urlDecodeMap = func() (m [256]byte) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	for i := range m {
+		m[i] = 0xff
+	}
+	for i := 0; i < len(alphabet); i++ {
+		m[alphabet[i]] = byte(i)
+	}
+	m['+'], m['/'] = 62, 63
+	return m
+}()
+
+// appendBase64urldecode appends s decoded as base64urldecode does to
+// dst, allocating only if dst hasn't the room
+func appendBase64urldecode(dst []byte, s string) ([]byte, error) {
+	if len(s)%4 == 1 {
+		return base64urldecodeSlow(dst, s)
+	}
+	start := len(dst)
+	dst = growBytes(dst, len(s)*6/8)
+	var acc uint32
+	bits := uint(0)
+	for i := 0; i < len(s); i++ {
+		v := base64urlDecodeMap[s[i]]
+		if v == 0xff {
+			return base64urldecodeSlow(dst[:start], s)
+		}
+		acc = acc<<6 | uint32(v)
+		bits += 6
+		if bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	return dst, nil
+}
+
+// base64urldecodeSlow is appendBase64urldecode for strings which
+// aren't plain base64, giving the error the standard decoder does
+func base64urldecodeSlow(dst []byte, s string) ([]byte, error) {
 	// mega base64 decoder accepts the characters from both URLEncoding and StdEncoding
 	// though nearly all strings are URL encoded
 	s = strings.Replace(s, "+", "-", -1)
 	s = strings.Replace(s, "/", "_", -1)
-	return enc.DecodeString(s)
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
+
+// growBytes returns b with room for n more bytes
+func growBytes(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	grown := make([]byte, len(b), len(b)+n)
+	copy(grown, b)
+	return grown
 }
 
 // base64_to_a32 converts base64 encoded byte slice b to uint32 slice.
 func base64_to_a32(s string) ([]uint32, error) {
-	d, err := base64urldecode(s)
+	var buf [64]byte
+	d, err := appendBase64urldecode(buf[:0], s)
 	if err != nil {
 		return nil, err
 	}
@@ -95,11 +151,8 @@ func base64_to_a32(s string) ([]uint32, error) {
 
 // a32_to_base64 converts uint32 slice to base64 encoded byte slice.
 func a32_to_base64(a []uint32) (string, error) {
-	d, err := a32_to_bytes(a)
-	if err != nil {
-		return "", err
-	}
-	return base64urlencode(d), nil
+	var buf [64]byte
+	return base64urlencode(appendA32Bytes(buf[:0], a)), nil
 }
 
 // paddnull pads byte slice b such that the size of resulting byte
@@ -249,19 +302,36 @@ func blockEncrypt(blk cipher.Block, dst, src []byte) error {
 	return nil
 }
 
-// decryptSeessionId decrypts the session id using the given private
-// key.
-func decryptSessionId(privk string, csid string, mk []byte) (string, error) {
+// rsaPrivateKey is the RSA private key (p,q,d) of the account
+type rsaPrivateKey struct {
+	p, q, d *big.Int
+}
 
+// decryptPrivateKey decrypts the RSA private key of the account
+// using the master key.
+func decryptPrivateKey(privk string, mk []byte) (*rsaPrivateKey, error) {
 	block, err := aes.NewCipher(mk)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	pk, err := base64urldecode(privk)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = blockDecrypt(block, pk, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	p, q, d := getRSAKey(pk)
+	return &rsaPrivateKey{p: p, q: q, d: d}, nil
+}
+
+// decryptSeessionId decrypts the session id using the given private
+// key.
+func decryptSessionId(privk string, csid string, mk []byte) (string, error) {
+
+	key, err := decryptPrivateKey(privk, mk)
 	if err != nil {
 		return "", err
 	}
@@ -273,38 +343,208 @@ func decryptSessionId(privk string, csid string, mk []byte) (string, error) {
 
 	m, _ := getMPI(c)
 
-	p, q, d := getRSAKey(pk)
-	r := decryptRSA(m, p, q, d)
+	r := decryptRSA(m, key.p, key.q, key.d)
 
 	return base64urlencode(r[:43]), nil
 
 }
 
+// decryptShareKey decrypts an RSA encrypted share key returning the
+// 16 byte AES key.
+func decryptShareKey(k string, key *rsaPrivateKey) ([]byte, error) {
+	return decryptRSAKey(k, key, 16)
+}
+
+// decryptRSAKey decrypts the RSA encrypted key k returning its first
+// size bytes
+func decryptRSAKey(k string, key *rsaPrivateKey, size int) ([]byte, error) {
+	if key == nil {
+		return nil, EKEY
+	}
+	c, err := base64urldecode(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) < 2 || int((uint64(c[0])*256+uint64(c[1])+7)>>3)+2 > len(c) {
+		return nil, EKEY
+	}
+
+	m, _ := getMPI(c)
+	r := decryptRSA(m, key.p, key.q, key.d)
+
+	// The plaintext is padded to 2 bytes less than the modulus so
+	// put back any leading zeros big.Int dropped
+	n := new(big.Int).Mul(key.p, key.q)
+	l := (n.BitLen()+7)/8 - 2
+	if len(r) < l {
+		r = append(make([]byte, l-len(r)), r...)
+	}
+	if len(r) < size {
+		return nil, EKEY
+	}
+
+	return r[:size], nil
+}
+
+// encodeMPI encodes x in the length prefixed format used by MEGA
+func encodeMPI(x *big.Int) []byte {
+	b := x.Bytes()
+	bits := x.BitLen()
+	return append([]byte{byte(bits >> 8), byte(bits)}, b...)
+}
+
+// encryptShareKey RSA encrypts the share key sk to the public key
+// pubk so decryptShareKey can decrypt it, padding it with bytes from
+// random.
+func encryptShareKey(sk []byte, pubk string, random io.Reader) (string, error) {
+	b, err := base64urldecode(pubk)
+	if err != nil {
+		return "", err
+	}
+	mpi := func() (*big.Int, error) {
+		if len(b) < 2 || int((uint64(b[0])*256+uint64(b[1])+7)>>3)+2 > len(b) {
+			return nil, EKEY
+		}
+		var x *big.Int
+		x, b = getMPI(b)
+		return x, nil
+	}
+	n, err := mpi()
+	if err != nil {
+		return "", err
+	}
+	e, err := mpi()
+	if err != nil {
+		return "", err
+	}
+	l := (n.BitLen()+7)/8 - 2
+	if l < len(sk) || e.Sign() <= 0 {
+		return "", EKEY
+	}
+
+	plain := make([]byte, l)
+	copy(plain, sk)
+	_, err = io.ReadFull(random, plain[len(sk):])
+	if err != nil {
+		return "", err
+	}
+	c := new(big.Int).Exp(new(big.Int).SetBytes(plain), e, n)
+	return base64urlencode(encodeMPI(c)), nil
+}
+
 // chunkSize describes a size and position of chunk
 type chunkSize struct {
 	position int64
 	size     int
 }
 
+// Chunks grow by CHUNK_STEP over the first CHUNK_RAMP chunks then stay
+// CHUNK_MAX bytes
+const (
+	CHUNK_STEP = 131072
+	CHUNK_RAMP = 8
+	CHUNK_MAX  = CHUNK_STEP * CHUNK_RAMP
+)
+
+// chunkCount returns the number of chunks in a file of size bytes
+func chunkCount(size int64) int64 {
+	const ramp = CHUNK_STEP * CHUNK_RAMP * (CHUNK_RAMP + 1) / 2
+	if size <= 0 {
+		return 0
+	}
+	if size > ramp {
+		return CHUNK_RAMP + (size-ramp+CHUNK_MAX-1)/CHUNK_MAX
+	}
+	var n, end int64
+	for end < size {
+		n++
+		end += n * CHUNK_STEP
+	}
+	return n
+}
+
+// chunkLocation returns the position and size of chunk id of a file of
+// size bytes, working it out directly so it is cheap for any size.
+// ok is false if there is no such chunk.
+func chunkLocation(size int64, id int64) (position int64, chk_size int, ok bool) {
+	if id < 0 || id >= chunkCount(size) {
+		return 0, 0, false
+	}
+	var next int64
+	if id < CHUNK_RAMP {
+		position = CHUNK_STEP * id * (id + 1) / 2
+		next = position + CHUNK_STEP*(id+1)
+	} else {
+		position = CHUNK_STEP*CHUNK_RAMP*(CHUNK_RAMP+1)/2 + (id-CHUNK_RAMP)*CHUNK_MAX
+		next = position + CHUNK_MAX
+	}
+	if next > size {
+		next = size
+	}
+	return position, int(next - position), true
+}
+
 func getChunkSizes(size int64) (chunks []chunkSize) {
-	p := int64(0)
-	for i := 1; size > 0; i++ {
-		var chunk int
-		if i <= 8 {
-			chunk = i * 131072
-		} else {
-			chunk = 1048576
-		}
-		if size < int64(chunk) {
-			chunk = int(size)
-		}
+	n := chunkCount(size)
+	for id := int64(0); id < n; id++ {
+		p, chunk, _ := chunkLocation(size, id)
 		chunks = append(chunks, chunkSize{position: p, size: chunk})
-		p += int64(chunk)
-		size -= int64(chunk)
 	}
 	return chunks
 }
 
+// Chunk is a piece of a file transferred and MACed as a unit
+type Chunk struct {
+	// Position of the chunk in the file
+	Offset int64
+	// Size of the chunk in bytes
+	Length int
+}
+
+// ChunkPlan returns the chunks MEGA splits a file of size bytes into,
+// in order.  Transfers must use these boundaries as each chunk has its
+// own MAC, and the file MAC is worked out from the chunk MACs in this
+// order, so tools downloading or uploading parts of a file elsewhere
+// can agree on where the parts start and end.
+//
+// An empty file has no chunks, although uploading one sends a single
+// empty chunk.
+func ChunkPlan(size int64) []Chunk {
+	n := chunkCount(size)
+	chunks := make([]Chunk, 0, n)
+	for id := int64(0); id < n; id++ {
+		p, chunk, _ := chunkLocation(size, id)
+		chunks = append(chunks, Chunk{Offset: p, Length: chunk})
+	}
+	return chunks
+}
+
+// ChunkAt returns chunk id of the ChunkPlan for a file of size bytes
+// without working out the whole plan, false if there is no such chunk
+func ChunkAt(size int64, id int64) (Chunk, bool) {
+	p, chunk, ok := chunkLocation(size, id)
+	return Chunk{Offset: p, Length: chunk}, ok
+}
+
+// ChunkCount returns the number of chunks in the ChunkPlan for a file
+// of size bytes
+func ChunkCount(size int64) int64 {
+	return chunkCount(size)
+}
+
+// ctrIV returns the AES-CTR counter block for the data at offset in a
+// file.  The first 8 bytes are the nonce from the file key, the last 8
+// the number of the 16 byte block at offset, big endian.
+func ctrIV(nonce []byte, offset int64) ([]byte, error) {
+	if len(nonce) < 8 || offset < 0 || offset%16 != 0 {
+		return nil, EARGS
+	}
+	iv := make([]byte, 16)
+	copy(iv, nonce[:8])
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset)/16)
+	return iv, nil
+}
+
 var attrMatch = regexp.MustCompile(`{".*"}`)
 
 func decryptAttr(key []byte, data string) (attr FileAttr, err error) {
@@ -323,15 +563,22 @@ func decryptAttr(key []byte, data string) (attr FileAttr, err error) {
 	if err != nil {
 		return attr, err
 	}
+	if len(ddata) < aes.BlockSize || len(ddata)%aes.BlockSize != 0 {
+		return attr, EBADATTR
+	}
 	mode.CryptBlocks(buf, ddata)
 
-	if string(buf[:4]) == "MEGA" {
-		str := strings.TrimRight(string(buf[4:]), "\x00")
-		trimmed := attrMatch.FindString(str)
-		if trimmed != "" {
-			str = trimmed
+	// Decrypting with the wrong key gives garbage
+	if string(buf[:4]) != "MEGA" {
+		return attr, EBADATTR
+	}
+	str := strings.TrimRight(string(buf[4:]), "\x00")
+	err = json.Unmarshal([]byte(str), &attr)
+	if err != nil {
+		// allow for rubbish after the attributes
+		if trimmed := attrMatch.FindString(str); trimmed != "" {
+			err = json.Unmarshal([]byte(trimmed), &attr)
 		}
-		err = json.Unmarshal([]byte(str), &attr)
 	}
 	return attr, err
 }
@@ -361,10 +608,20 @@ func encryptAttr(key []byte, attr FileAttr) (b string, err error) {
 	return b, nil
 }
 
-func randString(l int) (string, error) {
+// newRequestID returns an ID for the "i" field of a mutating command.
+// The server uses it to recognise a command it has already done, so a
+// request which is retried must be sent again with the same ID.
+func (m *Mega) newRequestID() (string, error) {
+	cfg := m.getConfig()
+	return randString(cfg.idSource(), 10)
+}
+
+// randString returns l random letters and digits made from the bytes
+// read from r
+func randString(r io.Reader, l int) (string, error) {
 	encoding := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789/+"
 	b := make([]byte, l)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(r, b)
 	if err != nil {
 		return "", err
 	}
@@ -1,7 +1,11 @@
 package mega
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -103,3 +107,148 @@ func TestGetChunkSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkLocationHuge(t *testing.T) {
+	const tb = int64(1) << 40
+	for _, size := range []int64{1, 4<<30 + 1, 5 * tb, 64*tb + 12345} {
+		n := chunkCount(size)
+		pos, chk, ok := chunkLocation(size, n-1)
+		if !ok || pos+int64(chk) != size || chk <= 0 || chk > CHUNK_MAX {
+			t.Errorf("size %d: last chunk %d at %d size %d ok %v", size, n-1, pos, chk, ok)
+		}
+		if _, _, ok := chunkLocation(size, n); ok {
+			t.Errorf("size %d: chunk %d beyond the end", size, n)
+		}
+		// Chunks must follow on from each other
+		for _, id := range []int64{0, 7, 8, n / 2, n - 2} {
+			if id < 0 || id+1 >= n {
+				continue
+			}
+			p1, c1, _ := chunkLocation(size, id)
+			p2, _, _ := chunkLocation(size, id+1)
+			if p1+int64(c1) != p2 {
+				t.Errorf("size %d: chunk %d ends at %d, next starts at %d", size, id, p1+int64(c1), p2)
+			}
+		}
+	}
+
+	// The direct calculation agrees with adding up the chunks
+	for _, size := range []int64{0, 100, 131072, 4718592, 4718593, 50000000} {
+		var pos int64
+		for id, c := range getChunkSizes(size) {
+			if c.position != pos {
+				t.Fatalf("size %d: chunk %d at %d, want %d", size, id, c.position, pos)
+			}
+			pos += int64(c.size)
+		}
+		if pos != size {
+			t.Errorf("size %d: chunks add up to %d", size, pos)
+		}
+	}
+}
+
+func TestCtrIV(t *testing.T) {
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, test := range []struct {
+		offset int64
+		want   []byte
+	}{
+		{0, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{16, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 1}},
+		// past 4GB the block number needs more than 28 bits
+		{1 << 36, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 1, 0, 0, 0, 0}},
+		// 5TB
+		{5 << 40, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0x50, 0, 0, 0, 0}},
+	} {
+		got, err := ctrIV(nonce, test.offset)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("offset %d: got %x %v, want %x", test.offset, got, err, test.want)
+		}
+	}
+	if _, err := ctrIV(nonce, 8); err != EARGS {
+		t.Errorf("unaligned offset: %v", err)
+	}
+	if _, err := ctrIV(nonce[:4], 0); err != EARGS {
+		t.Errorf("short nonce: %v", err)
+	}
+}
+
+func TestChunkPlan(t *testing.T) {
+	const size = 10*1024*1024 + 7
+	plan := ChunkPlan(size)
+	internal := getChunkSizes(size)
+	if int64(len(plan)) != ChunkCount(size) || len(plan) != len(internal) {
+		t.Fatalf("plan has %d chunks, count %d, want %d", len(plan), ChunkCount(size), len(internal))
+	}
+	for id, c := range plan {
+		if c.Offset != internal[id].position || c.Length != internal[id].size {
+			t.Errorf("chunk %d is %+v, want %+v", id, c, internal[id])
+		}
+		at, ok := ChunkAt(size, int64(id))
+		if !ok || at != c {
+			t.Errorf("ChunkAt(%d) = %+v %v, want %+v", id, at, ok, c)
+		}
+	}
+	if len(ChunkPlan(0)) != 0 {
+		t.Error("empty file has chunks")
+	}
+}
+
+func TestBase64urldecode(t *testing.T) {
+	for _, s := range []string{
+		"", "AA", "AAA", "AAAA", "_-8", "/+8", "3q2-7w", "3q2+7w", "3q2-7w8",
+		"A", "AAAAA", "AA==", "A A", "AA\nAA", "*",
+	} {
+		std, stdErr := base64.RawURLEncoding.DecodeString(strings.NewReplacer("+", "-", "/", "_").Replace(s))
+		got, err := base64urldecode(s)
+		if (err == nil) != (stdErr == nil) || (err == nil && !bytes.Equal(got, std)) {
+			t.Errorf("%q: got %x %v, want %x %v", s, got, err, std, stdErr)
+		}
+	}
+
+	// Appends after what is there
+	got, err := appendBase64urldecode([]byte{1}, "3q2-7w")
+	if err != nil || !bytes.Equal(got, []byte{1, 0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("append: got %x %v", got, err)
+	}
+	if enc := appendBase64urlencode([]byte("x"), got[1:]); string(enc) != "x3q2-7w" {
+		t.Errorf("append encode: got %q", enc)
+	}
+}
+
+func TestA32(t *testing.T) {
+	b := []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 1}
+	a, err := bytes_to_a32(b)
+	if err != nil || !reflect.DeepEqual(a, []uint32{0xdeadbeef, 1}) {
+		t.Errorf("bytes_to_a32: got %x %v", a, err)
+	}
+	if got, _ := a32_to_bytes(a); !bytes.Equal(got, b) {
+		t.Errorf("a32_to_bytes: got %x", got)
+	}
+	if _, err = bytes_to_a32(b[:6]); err != io.ErrUnexpectedEOF {
+		t.Errorf("short input: got %v", err)
+	}
+	s, err := a32_to_base64(a)
+	if err != nil || s != "3q2-7wAAAAE" {
+		t.Errorf("a32_to_base64: got %q %v", s, err)
+	}
+	if a, err = base64_to_a32(s); err != nil || !reflect.DeepEqual(a, []uint32{0xdeadbeef, 1}) {
+		t.Errorf("base64_to_a32: got %x %v", a, err)
+	}
+}
+
+func TestConversionAllocs(t *testing.T) {
+	key := "3q2-7wAAAAHerb7vAAAAAQ"
+	buf := make([]byte, 0, 64)
+	out := make([]byte, 0, 64)
+	a := make([]uint32, 0, 16)
+	allocs := testing.AllocsPerRun(100, func() {
+		b, _ := appendBase64urldecode(buf[:0], key)
+		a, _ = appendA32(a[:0], b)
+		buf = appendA32Bytes(b[:0], a)
+		out = appendBase64urlencode(out[:0], buf)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations, want none", allocs)
+	}
+}
@@ -0,0 +1,181 @@
+//go:build !js
+// +build !js
+
+package mega
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch syncs once then keeps the remote folder up to date with local
+// changes until ctx is cancelled.
+//
+// Changes are collected until none have been seen for Debounce, or
+// MaxBatch paths have changed, then synced together so a file being
+// written is only uploaded once.  A file which disappears from one
+// place and appears in another within a batch with the same
+// fingerprint is moved and renamed remotely rather than uploaded
+// again.
+//
+// Errors syncing individual files are logged and watching carries
+// on.  Watch returns an error if the watcher can't be set up.
+func (s *Syncer) Watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+
+	err = s.watchTree(w, ".")
+	if err != nil {
+		return err
+	}
+	err = s.Sync()
+	if err != nil {
+		s.m.logf("sync: initial sync: %v", err)
+	}
+
+	debounce := s.Debounce
+	if debounce <= 0 {
+		debounce = SYNC_DEBOUNCE
+	}
+	maxBatch := s.MaxBatch
+	if maxBatch <= 0 {
+		maxBatch = SYNC_MAX_BATCH
+	}
+
+	pending := make(map[string]struct{})
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			s.syncBatch(w, pending)
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			rel, err := s.relPath(ev.Name)
+			if err != nil || rel == "." {
+				continue
+			}
+			pending[rel] = struct{}{}
+			if len(pending) >= maxBatch {
+				s.syncBatch(w, pending)
+				pending = make(map[string]struct{})
+				settled = nil
+				continue
+			}
+			settled = s.m.after(debounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			s.m.logf("sync: watcher: %v", err)
+		case <-settled:
+			s.syncBatch(w, pending)
+			pending = make(map[string]struct{})
+			settled = nil
+		}
+	}
+}
+
+// watchTree adds the local directory rel and all the directories
+// below it to the watcher
+func (s *Syncer) watchTree(w *fsnotify.Watcher, rel string) error {
+	return filepath.Walk(s.localPath(rel), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			s.m.logf("sync: %v", err)
+			return nil
+		}
+		if fi.IsDir() {
+			return w.Add(p)
+		}
+		return nil
+	})
+}
+
+// syncBatch syncs a batch of changed local paths
+func (s *Syncer) syncBatch(w *fsnotify.Watcher, pending map[string]struct{}) {
+	if len(pending) == 0 {
+		return
+	}
+
+	paths := make([]string, 0, len(pending))
+	for rel := range pending {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	var gone []string
+	files := make(map[string]os.FileInfo)
+	var dirs []string
+	for _, rel := range paths {
+		fi, err := os.Lstat(s.localPath(rel))
+		switch {
+		case os.IsNotExist(err):
+			gone = append(gone, rel)
+		case err != nil:
+			s.m.logf("sync: %q: %v", rel, err)
+		case fi.IsDir():
+			dirs = append(dirs, rel)
+		case fi.Mode().IsRegular():
+			files[rel] = fi
+		}
+	}
+
+	s.m.debugf("sync: batch of %d changes", len(paths))
+	// files which have gone are looked for among the new ones by
+	// syncFile so they are moved rather than uploaded again
+	if len(gone) > 0 {
+		err := s.indexGone(gone)
+		if err != nil {
+			s.m.logf("sync: looking for moved files: %v", err)
+		}
+		defer func() {
+			s.movedFrom, s.moved = nil, nil
+		}()
+	}
+
+	for _, rel := range dirs {
+		err := s.watchTree(w, rel)
+		if err == nil {
+			err = s.syncTree(rel)
+		}
+		if err != nil {
+			s.m.logf("sync: %q: %v", rel, err)
+		}
+	}
+	for _, rel := range paths {
+		fi, ok := files[rel]
+		if !ok {
+			continue
+		}
+		err := s.syncFile(rel, fi)
+		if err != nil {
+			s.m.logf("sync: %q: %v", rel, err)
+		}
+	}
+	for _, rel := range gone {
+		if s.moved[rel] {
+			continue
+		}
+		err := s.remove(rel)
+		if err != nil {
+			s.m.logf("sync: %q: %v", rel, err)
+		}
+	}
+
+	err := flushState(s.state)
+	if err != nil {
+		s.m.logf("sync: saving state: %v", err)
+	}
+}
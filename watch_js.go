@@ -0,0 +1,9 @@
+package mega
+
+import "context"
+
+// Watch isn't supported in the browser as there is no local
+// filesystem to watch.  It returns EUNSUPPORTED.
+func (s *Syncer) Watch(ctx context.Context) error {
+	return EUNSUPPORTED
+}
@@ -0,0 +1,78 @@
+//go:build !js
+// +build !js
+
+package mega
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSyncerWatchRenameFingerprint(t *testing.T) {
+	m, b := newFakeMega(t)
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "mega-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "a.txt", "aaaa")
+	s, err := m.NewSyncer(dir, m.FS.GetRoot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	a := b.lookupPath(m, "a.txt")
+
+	// a file of the same size and time isn't taken for the moved one
+	err = os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "y.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "x.txt", "bbbb")
+	fi, err := os.Stat(filepath.Join(dir, "y.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filepath.Join(dir, "x.txt"), fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.syncBatch(nil, map[string]struct{}{"a.txt": {}, "x.txt": {}, "y.txt": {}})
+
+	if got := b.lookupPath(m, "y.txt"); got != a {
+		t.Errorf("moved file was uploaded again")
+	}
+	if got := b.lookupPath(m, "x.txt"); got == "" || got == a {
+		t.Errorf("new file took the moved file's place")
+	}
+
+	// files in a renamed folder are moved with it
+	if err = os.Mkdir(filepath.Join(dir, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "d"), "f.txt", "ffff")
+	if err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f := b.lookupPath(m, "d/f.txt")
+	if err = os.Rename(filepath.Join(dir, "d"), filepath.Join(dir, "e")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s.syncBatch(w, map[string]struct{}{"d": {}, "e": {}})
+	if got := b.lookupPath(m, "e/f.txt"); got != f {
+		t.Errorf("file in renamed folder was uploaded again")
+	}
+}